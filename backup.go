@@ -0,0 +1,63 @@
+package kvstore
+
+import (
+	"io"
+	"os"
+
+	"github.com/yazgazan/kvstore/block"
+)
+
+// Backup writes the objects of the store to w as a tar archive, while holding
+// the store lock in shared mode: readers carry on, writers wait until the
+// backup is written, which holds every transaction committed before it. The
+// backups of encrypted stores are sealed with the store key.
+func (st *store) Backup(w io.Writer) error {
+	st.m.RLock()
+	defer st.m.RUnlock()
+
+	return st.db.ExportTar(w)
+}
+
+// BackupFile writes a backup of the store at fpath to w, like Backup. The
+// store is opened read-only, nothing being written to the file, and a shared
+// advisory lock is held on it during the backup: the stores opened with
+// NewFromFile by other processes wait for the backup to be written before
+// writing to the file, so that the backup is never torn.
+func BackupFile(fpath string, w io.Writer, opts ...block.Option) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	unlock, err := flock(f, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	st, err := NewReadOnly(f, opts...)
+	if err != nil {
+		return err
+	}
+	err = st.Backup(w)
+	cerr := st.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Restore creates a store in the empty file f from a backup written by
+// Backup, with the block size and the compression of the backed up store.
+// The options are given to block.RestoreTar: the backups of encrypted stores
+// need block.WithCipher with the key of the store, which the restored store
+// is encrypted with.
+func Restore(f io.ReadWriteSeeker, backup io.Reader, opts ...block.Option) error {
+	db, err := block.RestoreTar(f, backup, opts...)
+	if err != nil {
+		return err
+	}
+
+	return db.Close()
+}
@@ -7,20 +7,69 @@ import (
 )
 
 type BlockMeta struct {
-	pos int64
-	idx uint32
+	pos    int64
+	idx    uint32
+	legacy bool // v1 header, without flags
 
 	End  uint32 // relative to blockStart + sizeof(blockMeta)
 	Next uint32
+
+	// v2
+	Flags      uint32
+	Stored     uint32 // bytes used by the encoded payload when compressed
+	Generation uint64 // DB generation of the last payload write that changed the header
 }
 
+const (
+	BlockFlagCompressed uint32 = 1 << iota
+)
+
 var (
-	sizeEnd  = binarySizePanic(BlockMeta{}.End)
-	sizeNext = binarySizePanic(BlockMeta{}.Next)
+	sizeEnd             = binarySizePanic(BlockMeta{}.End)
+	sizeNext            = binarySizePanic(BlockMeta{}.Next)
+	sizeBlockFlags      = binarySizePanic(BlockMeta{}.Flags)
+	sizeStored          = binarySizePanic(BlockMeta{}.Stored)
+	sizeBlockGeneration = binarySizePanic(BlockMeta{}.Generation)
 )
 
+func (db *BlockDB) newBlockMeta(idx uint32) *BlockMeta {
+	return &BlockMeta{
+		pos:    db.sizeMeta + int64(idx)*int64(db.meta.BlockSize),
+		idx:    idx,
+		legacy: db.meta.Version == 1,
+	}
+}
+
+func (db *BlockDB) blockMetaSize() int {
+	return db.newBlockMeta(0).Size()
+}
+
+// stamp records a new generation on the block, the header still has to be
+// written by the caller. The generation of the DB is only persisted along with
+// its flags, or on Close.
+func (db *BlockDB) stamp(b *BlockMeta) {
+	if b.legacy {
+		return
+	}
+
+	db.meta.Generation++
+	b.Generation = db.meta.Generation
+}
+
+// resume raises the generation of the DB to that of b, which can be ahead of
+// it when the DB wasn't closed after b was stamped.
+func (db *BlockDB) resume(b *BlockMeta) {
+	if b.Generation > db.meta.Generation {
+		db.meta.Generation = b.Generation
+	}
+}
+
 func (m BlockMeta) Size() int {
-	return sizeEnd + sizeNext
+	if m.legacy {
+		return sizeEnd + sizeNext
+	}
+
+	return sizeEnd + sizeNext + sizeBlockFlags + sizeStored + sizeBlockGeneration
 }
 
 func (m BlockMeta) WriteTo(w io.Writer) (n int64, err error) {
@@ -36,6 +85,28 @@ func (m BlockMeta) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	n += int64(sizeNext)
 
+	if m.legacy {
+		return n, nil
+	}
+
+	err = binary.Write(w, binary.LittleEndian, m.Flags)
+	if err != nil {
+		return n, fmt.Errorf("writing flags: %w", err)
+	}
+	n += int64(sizeBlockFlags)
+
+	err = binary.Write(w, binary.LittleEndian, m.Stored)
+	if err != nil {
+		return n, fmt.Errorf("writing stored size: %w", err)
+	}
+	n += int64(sizeStored)
+
+	err = binary.Write(w, binary.LittleEndian, m.Generation)
+	if err != nil {
+		return n, fmt.Errorf("writing generation: %w", err)
+	}
+	n += int64(sizeBlockGeneration)
+
 	return n, nil
 }
 
@@ -70,5 +141,27 @@ func (m *BlockMeta) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 	n += int64(sizeNext)
 
+	if m.legacy {
+		return n, nil
+	}
+
+	err = binary.Read(r, binary.LittleEndian, &m.Flags)
+	if err != nil {
+		return n, fmt.Errorf("reading flags: %w", err)
+	}
+	n += int64(sizeBlockFlags)
+
+	err = binary.Read(r, binary.LittleEndian, &m.Stored)
+	if err != nil {
+		return n, fmt.Errorf("reading stored size: %w", err)
+	}
+	n += int64(sizeStored)
+
+	err = binary.Read(r, binary.LittleEndian, &m.Generation)
+	if err != nil {
+		return n, fmt.Errorf("reading generation: %w", err)
+	}
+	n += int64(sizeBlockGeneration)
+
 	return n, nil
 }
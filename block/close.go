@@ -0,0 +1,61 @@
+package block
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrClosed = errors.New("block DB is closed")
+
+type flusher interface {
+	Flush() error
+}
+
+// Close flushes the writes buffered by the index pool, persists the generation,
+// then flushes the writes buffered by the file when it implements Flush()
+// error, syncs the file when it supports
+// it and invalidates the DB along with every Object opened from it. The file
+// itself is left open.
+func (db *BlockDB) Close() error {
+	if db.ra == nil && !db.isClosed() {
+		db.indexM.Lock()
+		err := db.index.Flush()
+		db.indexM.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	if db.isClosed() {
+		return ErrClosed
+	}
+	if db.ra == nil {
+		err := db.writeGeneration()
+		if err != nil {
+			return err
+		}
+	}
+
+	f := db.f
+	if t, ok := f.(*tracedFile); ok {
+		f = t.f
+	}
+	if fl, ok := f.(flusher); ok && db.ra == nil {
+		err := fl.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if s, ok := db.f.(syncer); ok {
+		err := s.Sync()
+		if err != nil && !errors.Is(err, ErrSyncUnsupported) {
+			return err
+		}
+	}
+	atomic.StoreInt32(&db.closed, 1)
+
+	return nil
+}
@@ -1,37 +1,78 @@
 package block
 
 import (
-	"bytes"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/yazgazan/kvstore/container"
 )
 
 const (
 	Magic            = 1978942581
-	LatestVersion    = 1
+	LatestVersion    = 2
 	DefaultBlockSize = 4096
 )
 
 var MinimumBlockSize = uint32(BlockMeta{}.Size() + 1)
 
 type BlockDB struct {
-	m *sync.Mutex
-
-	f io.ReadWriteSeeker
-
-	meta     DBMeta
-	sizeMeta int64
-	objects  map[string]*ObjectMeta
-	indexObj *Object
-	index    *container.Pool
+	m        *sync.Mutex // file and allocator
+	indexM   *sync.Mutex // index pool
+	objectsM *sync.RWMutex
+	locksM   *sync.Mutex // advisory object locks
+
+	f         io.ReadWriteSeeker
+	ra        io.ReaderAt // set for shared, read-only DBs
+	aead      cipher.AEAD
+	tracer    Tracer
+	sync      bool
+	maxBlocks uint32
+
+	meta       DBMeta
+	sizeMeta   int64
+	freeBlocks map[uint32]BlockMeta // headers of the free list blocks
+	freeTail   uint32
+	objects    map[string]*ObjectMeta
+	names      []string // sorted object names
+	locks      map[string]*objectLock
+	indexObj   *Object
+	index      *container.Pool
+
+	closed   int32
+	written  bool   // OpenedAt has been persisted
+	saved    uint64 // generation last persisted in the meta
+	updates  int    // allocator updates in progress
+	damaged  bool   // an update failed, the DB stays dirty until recovered
+	recovery RecoveryStats
 }
 
 func Create(f io.ReadWriteSeeker, opts ...Option) (*BlockDB, error) {
+	c := config{
+		blockSize: DefaultBlockSize,
+		version:   LatestVersion,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if _, ok := f.(syncer); c.sync && !ok {
+		return nil, ErrSyncUnsupported
+	}
+	if c.version == 0 || c.version > LatestVersion {
+		return nil, fmt.Errorf("unsupported version %d, latest supported version is %d", c.version, LatestVersion)
+	}
+	if c.version == 1 && (c.key != nil || c.compress) {
+		return nil, errors.New("version 1 DBs can't be encrypted nor compressed")
+	}
+	if c.tracer != nil {
+		f = &tracedFile{f: f, tracer: c.tracer}
+	}
+
 	off, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
@@ -42,15 +83,36 @@ func Create(f io.ReadWriteSeeker, opts ...Option) (*BlockDB, error) {
 
 	meta := DBMeta{
 		Magic:   Magic,
-		Version: LatestVersion,
+		Version: c.version,
 
-		BlockSize: DefaultBlockSize,
+		BlockSize: c.blockSize,
+		CreatedAt: time.Now().UnixNano(),
 	}
-	for _, opt := range opts {
-		opt(&meta)
+	meta.OpenedAt = meta.CreatedAt
+	meta.UUID, err = newUUID()
+	if err != nil {
+		return nil, fmt.Errorf("generating UUID: %w", err)
 	}
-	if meta.BlockSize < MinimumBlockSize {
-		return nil, fmt.Errorf("invalid block size %d (should be greater or equal to %d)", meta.BlockSize, MinimumBlockSize)
+	if c.compress {
+		meta.Flags |= FlagCompressed
+	}
+	minBlockSize := MinimumBlockSize
+
+	aead, err := newAEAD(c.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cipher key: %w", err)
+	}
+	if aead != nil {
+		meta.Flags |= FlagEncrypted
+		meta.KeyCheck, err = sealKeyCheck(aead)
+		if err != nil {
+			return nil, err
+		}
+		minBlockSize += uint32(aead.NonceSize() + aead.Overhead())
+	}
+
+	if meta.BlockSize < minBlockSize {
+		return nil, fmt.Errorf("invalid block size %d (should be greater or equal to %d)", meta.BlockSize, minBlockSize)
 	}
 
 	sizeMeta, err := meta.WriteTo(f)
@@ -59,13 +121,24 @@ func Create(f io.ReadWriteSeeker, opts ...Option) (*BlockDB, error) {
 	}
 
 	db := &BlockDB{
-		m: &sync.Mutex{},
-
-		f: f,
-
-		meta:     meta,
-		sizeMeta: sizeMeta,
-		objects:  map[string]*ObjectMeta{},
+		m:        &sync.Mutex{},
+		indexM:   &sync.Mutex{},
+		objectsM: &sync.RWMutex{},
+		locksM:   &sync.Mutex{},
+
+		f:         f,
+		aead:      aead,
+		tracer:    c.tracer,
+		sync:      c.sync,
+		maxBlocks: c.maxBlocks,
+
+		meta:       meta,
+		sizeMeta:   sizeMeta,
+		freeBlocks: map[uint32]BlockMeta{},
+		objects:    map[string]*ObjectMeta{},
+		locks:      map[string]*objectLock{},
+		written:    true,
+		saved:      meta.Generation,
 	}
 
 	db.indexObj = &Object{
@@ -73,10 +146,7 @@ func Create(f io.ReadWriteSeeker, opts ...Option) (*BlockDB, error) {
 
 		m: &sync.Mutex{},
 		blocks: []*BlockMeta{
-			{
-				pos: db.sizeMeta,
-				idx: 0,
-			},
+			db.newBlockMeta(0),
 		},
 	}
 
@@ -90,7 +160,22 @@ func Create(f io.ReadWriteSeeker, opts ...Option) (*BlockDB, error) {
 	return db, err
 }
 
-func Open(f io.ReadWriteSeeker) (*BlockDB, error) {
+func Open(f io.ReadWriteSeeker, opts ...Option) (*BlockDB, error) {
+	return open(f, nil, opts...)
+}
+
+func open(f io.ReadWriteSeeker, ra io.ReaderAt, opts ...Option) (*BlockDB, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if _, ok := f.(syncer); c.sync && !ok {
+		return nil, ErrSyncUnsupported
+	}
+	if c.tracer != nil {
+		f = &tracedFile{f: f, tracer: c.tracer}
+	}
+
 	_, err := f.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, err
@@ -103,19 +188,63 @@ func Open(f io.ReadWriteSeeker) (*BlockDB, error) {
 		return nil, fmt.Errorf("failed to read meta: %w", err)
 	}
 
-	db := &BlockDB{
-		m: &sync.Mutex{},
-
-		f: f,
-
-		meta:     meta,
-		sizeMeta: sizeMeta,
-		objects:  map[string]*ObjectMeta{},
+	aead, err := newAEAD(c.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cipher key: %w", err)
+	}
+	switch {
+	case meta.Flags&FlagEncrypted == 0 && aead != nil:
+		return nil, ErrNotEncrypted
+	case meta.Flags&FlagEncrypted != 0 && aead == nil:
+		return nil, ErrKeyRequired
+	case aead != nil:
+		err = openKeyCheck(aead, meta.KeyCheck)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	indexBlocks, err := db.blocks(0)
-	if err != nil {
-		return nil, err
+	db := &BlockDB{
+		m:        &sync.Mutex{},
+		indexM:   &sync.Mutex{},
+		objectsM: &sync.RWMutex{},
+		locksM:   &sync.Mutex{},
+
+		f:         f,
+		ra:        ra,
+		aead:      aead,
+		tracer:    c.tracer,
+		sync:      c.sync,
+		maxBlocks: c.maxBlocks,
+
+		meta:       meta,
+		sizeMeta:   sizeMeta,
+		freeBlocks: map[uint32]BlockMeta{},
+		objects:    map[string]*ObjectMeta{},
+		locks:      map[string]*objectLock{},
+		saved:      meta.Generation,
+	}
+
+	dirty := meta.Flags&FlagDirty != 0
+	if dirty && ra != nil {
+		return nil, fmt.Errorf("DB needs recovery: %w", ErrReadOnly)
+	}
+	owned := map[uint32]struct{}{}
+	var indexBlocks []*BlockMeta
+	if dirty {
+		indexBlocks, err = db.recoverChain(0, owned)
+		if err != nil {
+			return nil, fmt.Errorf("recovering index: %w", err)
+		}
+	} else {
+		err = db.loadFreeBlocks()
+		if err != nil {
+			return nil, err
+		}
+		indexBlocks, err = db.blocks(0)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	db.indexObj = &Object{
@@ -130,7 +259,11 @@ func Open(f io.ReadWriteSeeker) (*BlockDB, error) {
 		return nil, err
 	}
 
-	chunks := db.index.Allocated()
+	var stale []*ObjectMeta
+	chunks, err := db.index.Allocated()
+	if err != nil {
+		return nil, err
+	}
 	for _, chunk := range chunks {
 		objMeta := &ObjectMeta{
 			chunk: chunk,
@@ -145,84 +278,142 @@ func Open(f io.ReadWriteSeeker) (*BlockDB, error) {
 			return nil, err
 		}
 
+		if prev, ok := db.objects[objMeta.Name]; ok {
+			// left behind when moving the metadata to a bigger chunk
+			if prev.Size >= objMeta.Size {
+				stale = append(stale, objMeta)
+				continue
+			}
+			stale = append(stale, prev)
+		}
 		db.objects[objMeta.Name] = objMeta
 	}
 
-	return db, err
-}
-
-func (db *BlockDB) free(idx uint32) error {
-	meta := BlockMeta{
-		pos: db.sizeMeta + int64(idx)*int64(db.meta.BlockSize),
-		idx: idx,
-	}
-	_, err := db.f.Seek(meta.pos, io.SeekStart)
-	if err != nil {
-		return err
+	if dirty {
+		err = db.recover(owned, stale)
+		if err != nil {
+			return nil, fmt.Errorf("recovering allocator: %w", err)
+		}
 	}
-	_, err = meta.ReadFrom(db.f)
-	if err != nil {
-		return err
+	for name, objMeta := range db.objects {
+		db.names = append(db.names, name)
+		if objMeta.LastBlock != 0 {
+			continue
+		}
+		blocks, err := db.blocks(objMeta.StartBlock)
+		if err != nil {
+			return nil, err
+		}
+		objMeta.Size, objMeta.LastBlock = chainSize(blocks)
 	}
+	sort.Strings(db.names)
 
-	next := meta.Next
+	db.meta.OpenedAt = time.Now().UnixNano()
 
-	meta.Next = db.meta.FirstFreeBlock
-	meta.End = 0
-	_, err = db.f.Seek(meta.pos, io.SeekStart)
-	if err != nil {
-		return err
-	}
-	_, err = meta.WriteTo(db.f)
-	if err != nil {
-		return err
-	}
+	return db, err
+}
 
-	db.meta.FirstFreeBlock = meta.idx
-	err = db.meta.WriteFirstFreeBlock(db.f)
-	if err != nil {
-		return err
+// touch persists the last open time on the first write after Open, so that
+// files opened without writing to them are left untouched.
+func (db *BlockDB) touch() error {
+	if db.written || db.meta.Version == 1 {
+		return nil
 	}
+	db.written = true
 
-	if next != 0 {
-		return db.free(next)
-	}
+	return db.meta.WriteOpenedAt(db.f)
+}
 
-	return nil
+func (db *BlockDB) free(idx uint32) error {
+	start := time.Now()
+	n, err := db.freeChain(idx)
+	db.trace(TraceFree, idx, int64(n), start, err)
+
+	return err
 }
 
-func (db *BlockDB) allocSingle() (*BlockMeta, error) {
-	if db.meta.FirstFreeBlock != 0 {
-		meta := &BlockMeta{
-			pos: db.sizeMeta + int64(db.meta.FirstFreeBlock)*int64(db.meta.BlockSize),
-			idx: db.meta.FirstFreeBlock,
+// freeChain clears the blocks of the chain starting at idx and splices the
+// whole chain at the head of the free list.
+func (db *BlockDB) freeChain(idx uint32) (uint32, error) {
+	var n, tail uint32
+
+	next := idx
+	for next != 0 {
+		if _, ok := db.freeBlocks[next]; ok {
+			return n, fmt.Errorf("freeing block %d twice", next)
 		}
+
+		meta := db.newBlockMeta(next)
 		_, err := db.f.Seek(meta.pos, io.SeekStart)
 		if err != nil {
-			return nil, err
+			return n, err
 		}
 		_, err = meta.ReadFrom(db.f)
 		if err != nil {
-			return nil, err
+			return n, err
 		}
 
-		db.meta.FirstFreeBlock = meta.Next
-		err = db.meta.WriteFirstFreeBlock(db.f)
+		next = meta.Next
+		if next == 0 {
+			meta.Next = db.meta.FirstFreeBlock
+			tail = meta.idx
+		}
+		meta.End = 0
+		meta.Flags = 0
+		meta.Stored = 0
+		_, err = db.f.Seek(meta.pos, io.SeekStart)
 		if err != nil {
-			return nil, err
+			return n, err
+		}
+		_, err = meta.WriteTo(db.f)
+		if err != nil {
+			return n, err
 		}
 
-		meta.Next = 0
-		_, err = db.f.Seek(meta.pos, io.SeekStart)
+		db.freeBlocks[meta.idx] = *meta
+		n++
+	}
+
+	if db.meta.FirstFreeBlock == 0 {
+		db.freeTail = tail
+	}
+	db.meta.FirstFreeBlock = idx
+
+	return n, db.writeFirstFreeBlock()
+}
+
+func (db *BlockDB) allocSingle() (*BlockMeta, error) {
+	start := time.Now()
+	meta, err := db.allocBlock()
+	if err != nil {
+		db.trace(TraceAlloc, 0, 1, start, err)
+		return nil, err
+	}
+	db.trace(TraceAlloc, meta.idx, 1, start, nil)
+
+	return meta, nil
+}
+
+func (db *BlockDB) allocBlock() (*BlockMeta, error) {
+	if db.meta.FirstFreeBlock != 0 {
+		meta := db.freeBlocks[db.meta.FirstFreeBlock]
+		delete(db.freeBlocks, meta.idx)
+		db.meta.FirstFreeBlock = meta.Next
+		if meta.Next == 0 {
+			db.freeTail = 0
+		}
+		err := db.writeFirstFreeBlock()
 		if err != nil {
 			return nil, err
 		}
+
+		meta.Next = 0
 		err = meta.WriteNext(db.f)
 		if err != nil {
 			return nil, err
 		}
 
-		return meta, nil
+		return &meta, nil
 	}
 
 	mm, err := db.grow(1, false)
@@ -234,23 +425,41 @@ func (db *BlockDB) allocSingle() (*BlockMeta, error) {
 }
 
 func (db *BlockDB) Grow(n uint32) error {
+	if db.ra != nil {
+		return ErrReadOnly
+	}
 	db.m.Lock()
 	defer db.m.Unlock()
+	if db.isClosed() {
+		return ErrClosed
+	}
 
-	_, err := db.grow(n, true)
+	err := db.beginUpdate()
+	if err != nil {
+		return err
+	}
+	_, err = db.grow(n, true)
 
-	return err
+	return db.endUpdate(err)
 }
 
 func (db *BlockDB) grow(n uint32, free bool) ([]*BlockMeta, error) {
-	startNewBlocks := db.sizeMeta + int64(db.meta.BlockCount)*int64(db.meta.BlockSize)
-	_, err := db.f.Seek(startNewBlocks, io.SeekStart)
+	start := time.Now()
+	first := db.meta.BlockCount
+	mm, err := db.growBlocks(n, free)
+	db.trace(TraceGrow, first, int64(n), start, err)
+
+	return mm, err
+}
+
+func (db *BlockDB) growBlocks(n uint32, free bool) ([]*BlockMeta, error) {
+	err := db.checkQuota(n)
 	if err != nil {
 		return nil, err
 	}
 
-	b := bytes.Repeat([]byte{0}, int(n*db.meta.BlockSize))
-	_, err = db.f.Write(b)
+	startNewBlocks := db.sizeMeta + int64(db.meta.BlockCount)*int64(db.meta.BlockSize)
+	err = db.extend(startNewBlocks, n)
 	if err != nil {
 		return nil, err
 	}
@@ -263,11 +472,8 @@ func (db *BlockDB) grow(n uint32, free bool) ([]*BlockMeta, error) {
 			return nil, err
 		}
 
-		meta := &BlockMeta{
-			pos:  blockPos,
-			idx:  db.meta.BlockCount + i,
-			Next: db.meta.BlockCount + i + 1,
-		}
+		meta := db.newBlockMeta(db.meta.BlockCount + i)
+		meta.Next = db.meta.BlockCount + i + 1
 		if i == n-1 {
 			meta.Next = 0
 		}
@@ -281,81 +487,86 @@ func (db *BlockDB) grow(n uint32, free bool) ([]*BlockMeta, error) {
 
 	db.meta.BlockCount += n
 
-	err = db.meta.WriteBlockCount(db.f)
+	err = db.writeBlockCount()
 	if err != nil {
 		return nil, err
 	}
 
-	if !free {
+	if !free || n == 0 {
 		return mm, nil
 	}
+	for _, meta := range mm {
+		db.freeBlocks[meta.idx] = *meta
+	}
 
 	if db.meta.FirstFreeBlock == 0 {
-		db.meta.FirstFreeBlock = db.meta.BlockCount - n
-		err = db.meta.WriteFirstFreeBlock(db.f)
+		db.meta.FirstFreeBlock = mm[0].idx
+		err = db.writeFirstFreeBlock()
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		firstFreeBlock, err := db.findLastFreeBlock()
+		tail := db.freeBlocks[db.freeTail]
+		tail.Next = mm[0].idx
+		db.freeBlocks[tail.idx] = tail
+		err = db.barrier()
 		if err != nil {
 			return nil, err
 		}
-		meta := BlockMeta{
-			pos: db.sizeMeta + int64(firstFreeBlock)*int64(db.meta.BlockSize),
-			idx: firstFreeBlock,
-
-			Next: mm[0].idx,
-		}
-		_, err = db.f.Seek(meta.pos, io.SeekStart)
+		err = tail.WriteNext(db.f)
 		if err != nil {
 			return nil, err
 		}
-		_, err = meta.WriteTo(db.f)
+		err = db.barrier()
 		if err != nil {
 			return nil, err
 		}
 	}
+	db.freeTail = mm[n-1].idx
 
 	return nil, nil
 }
 
-func (db *BlockDB) findLastFreeBlock() (uint32, error) {
-	start := db.meta.FirstFreeBlock
+type truncater interface {
+	Truncate(size int64) error
+}
 
-	// start of first free block
-	curPos, err := db.f.Seek(int64(db.sizeMeta)+int64(start)*int64(db.meta.BlockSize), io.SeekStart)
-	if err != nil {
-		return 0, err
+// extend makes room for n blocks starting at off. Files that can be truncated
+// are extended without writing the zeroed payloads.
+func (db *BlockDB) extend(off int64, n uint32) error {
+	f := db.f
+	if t, ok := f.(*tracedFile); ok {
+		f = t.f
+	}
+	if t, ok := f.(truncater); ok {
+		return t.Truncate(off + int64(n)*int64(db.meta.BlockSize))
 	}
-	blockMeta := BlockMeta{}
-	_, err = blockMeta.ReadFrom(db.f)
+
+	_, err := db.f.Seek(off, io.SeekStart)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	for blockMeta.Next != 0 {
-		curPos, err = db.f.Seek(int64(db.sizeMeta)+int64(blockMeta.Next)*int64(db.meta.BlockSize), io.SeekStart)
-		if err != nil {
-			return 0, err
-		}
-		_, err = blockMeta.ReadFrom(db.f)
+	b := make([]byte, db.meta.BlockSize)
+	for i := uint32(0); i < n; i++ {
+		_, err = db.f.Write(b)
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
 
-	lastFreeBlock := (curPos - int64(db.sizeMeta)) / int64(db.meta.BlockSize)
-	if lastFreeBlock == 0 {
-		return 0, errors.New("last free block cannot be at position 0")
-	}
-
-	return uint32(lastFreeBlock), nil
+	return nil
 }
 
 func (db *BlockDB) FileSize() (int64, error) {
 	db.m.Lock()
 	defer db.m.Unlock()
+	if db.isClosed() {
+		return 0, ErrClosed
+	}
+	if db.ra != nil {
+		return db.sizeMeta + int64(db.meta.BlockCount)*int64(db.meta.BlockSize), nil
+	}
 
 	return db.f.Seek(0, io.SeekEnd)
 }
@@ -370,25 +581,25 @@ func (db *BlockDB) Meta() DBMeta {
 func (db *BlockDB) Blocks() ([]BlockMeta, error) {
 	db.m.Lock()
 	defer db.m.Unlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
 
-	curPos, err := db.f.Seek(int64(db.sizeMeta), io.SeekStart)
+	_, err := db.f.Seek(int64(db.sizeMeta), io.SeekStart)
 	if err != nil {
 		return nil, err
 	}
 
 	mm := make([]BlockMeta, db.meta.BlockCount)
 	for i := uint32(0); i < db.meta.BlockCount; i++ {
-		meta := BlockMeta{
-			pos: curPos,
-			idx: i,
-		}
+		meta := db.newBlockMeta(i)
 		n, err := meta.ReadFrom(db.f)
 		if err != nil {
 			return nil, err
 		}
-		mm[i] = meta
+		mm[i] = *meta
 
-		curPos, err = db.f.Seek(int64(db.meta.BlockSize)-n, io.SeekCurrent)
+		_, err = db.f.Seek(int64(db.meta.BlockSize)-n, io.SeekCurrent)
 		if err != nil {
 			return nil, err
 		}
@@ -397,16 +608,60 @@ func (db *BlockDB) Blocks() ([]BlockMeta, error) {
 	return mm, nil
 }
 
-func (db *BlockDB) blocks(start uint32) ([]*BlockMeta, error) {
-	block := &BlockMeta{
-		pos: db.sizeMeta + int64(start)*int64(db.meta.BlockSize),
-		idx: start,
+// EachBlock calls fn with the header of every block, in order, until fn
+// returns false. Headers are read one at a time and the DB isn't locked while
+// fn runs, so blocks allocated in the meantime are visited too.
+func (db *BlockDB) EachBlock(fn func(BlockMeta) bool) error {
+	for i := uint32(0); ; i++ {
+		meta, err := db.blockHeader(i)
+		if err != nil || meta == nil {
+			return err
+		}
+		if !fn(*meta) {
+			return nil
+		}
 	}
-	_, err := db.f.Seek(block.pos, io.SeekStart)
+}
+
+// blockHeader reads the header of block idx, or returns nil past the last
+// block.
+func (db *BlockDB) blockHeader(idx uint32) (*BlockMeta, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	if idx >= db.meta.BlockCount {
+		return nil, nil
+	}
+
+	return db.readHeader(idx)
+}
+
+func (db *BlockDB) readHeader(idx uint32) (*BlockMeta, error) {
+	meta := db.newBlockMeta(idx)
+	r, err := db.readerAt(meta.pos)
 	if err != nil {
 		return nil, err
 	}
-	_, err = block.ReadFrom(db.f)
+	_, err = meta.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func chainSize(blocks []*BlockMeta) (size int64, last uint32) {
+	for _, b := range blocks {
+		size += int64(b.End)
+	}
+
+	return size, blocks[len(blocks)-1].idx
+}
+
+func (db *BlockDB) blocks(start uint32) ([]*BlockMeta, error) {
+	block, err := db.readHeader(start)
 	if err != nil {
 		return nil, err
 	}
@@ -415,15 +670,7 @@ func (db *BlockDB) blocks(start uint32) ([]*BlockMeta, error) {
 	}
 
 	for block.Next != 0 {
-		block = &BlockMeta{
-			pos: db.sizeMeta + int64(block.Next)*int64(db.meta.BlockSize),
-			idx: block.Next,
-		}
-		_, err = db.f.Seek(block.pos, io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-		_, err = block.ReadFrom(db.f)
+		block, err = db.readHeader(block.Next)
 		if err != nil {
 			return nil, err
 		}
@@ -2,12 +2,18 @@ package block_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/yazgazan/kvstore/block"
 )
@@ -161,6 +167,32 @@ func TestBlockDB(t *testing.T) {
 			t.Logf("block %d: %#v\n", i, b)
 		}
 
+		var streamed []block.BlockMeta
+		err = db.EachBlock(func(b block.BlockMeta) bool {
+			streamed = append(streamed, b)
+			return true
+		})
+		if err != nil {
+			t.Errorf("unexpected error streaming block headers: %v", err)
+			return
+		}
+		if len(streamed) != len(bb) {
+			t.Errorf("db.EachBlock() streamed %d blocks, expected %d", len(streamed), len(bb))
+		}
+		for i := 0; i < len(streamed) && i < len(bb); i++ {
+			if streamed[i] != bb[i] {
+				t.Errorf("db.EachBlock() block %d = %#v, expected %#v", i, streamed[i], bb[i])
+			}
+		}
+		var seen int
+		err = db.EachBlock(func(b block.BlockMeta) bool {
+			seen++
+			return false
+		})
+		if err != nil || seen != 1 {
+			t.Errorf("db.EachBlock(stop) = %v after %d blocks, expected to stop after 1", err, seen)
+		}
+
 		for _, o := range db.Objects() {
 			t.Logf("object %q: %#v\n", o.Name, o)
 		}
@@ -372,9 +404,14 @@ func TestBlockDB(t *testing.T) {
 			return
 		}
 
-		_, err = obj.Seek(3, io.SeekCurrent)
-		if err != io.EOF {
-			t.Errorf("obj.Seek(3, current): expected EOF, got %v", err)
+		// seeking past the end is allowed, the gap is filled on write
+		got, err = obj.Seek(3, io.SeekCurrent)
+		if err != nil {
+			t.Errorf("obj.Seek(3, current): unexpected error: %v", err)
+			return
+		}
+		if size := obj.Size(); got != size+2 {
+			t.Errorf("obj.Seek(3, current) = %d, expected %d", got, size+2)
 			return
 		}
 
@@ -419,6 +456,50 @@ func TestBlockDB(t *testing.T) {
 		}
 	})
 
+	subTest("Generation", func(t *testing.T, db *block.BlockDB) {
+		foo, err := db.Open("foo")
+		if err != nil {
+			t.Errorf("unexpected error opening object: %v", err)
+			return
+		}
+		baz, err := db.Open("baz")
+		if err != nil {
+			t.Errorf("unexpected error opening object: %v", err)
+			return
+		}
+		fooGen := foo.Stats().Generation
+		bazGen := baz.Stats().Generation
+
+		// overwrites that don't extend the block leave its header as is
+		_, err = baz.Write([]byte("ABC"))
+		if err != nil {
+			t.Errorf("unexpected error writing to object: %v", err)
+			return
+		}
+		if got := baz.Stats().Generation; got != bazGen {
+			t.Errorf("baz.Stats().Generation = %d after an overwrite, expected %d", got, bazGen)
+		}
+		_, err = baz.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = baz.Write([]byte("DEF"))
+		}
+		if err != nil {
+			t.Errorf("unexpected error appending to object: %v", err)
+			return
+		}
+
+		if got := foo.Stats().Generation; got != fooGen {
+			t.Errorf("foo.Stats().Generation = %d, expected %d", got, fooGen)
+		}
+		got := baz.Stats().Generation
+		if got <= bazGen {
+			t.Errorf("baz.Stats().Generation = %d, expected more than %d", got, bazGen)
+		}
+		if metaGen := db.Meta().Generation; metaGen != got {
+			t.Errorf("db.Meta().Generation = %d, expected %d", metaGen, got)
+		}
+	})
+
 	var (
 		freeBlocks uint32
 		objects    uint32
@@ -431,6 +512,13 @@ func TestBlockDB(t *testing.T) {
 		}
 
 		t.Logf("db stats: %#v\n", stats)
+		var runBlocks uint32
+		for _, run := range stats.FreeSpace.Runs {
+			runBlocks += run.Length
+		}
+		if runBlocks != stats.FreeBlocks {
+			t.Errorf("db.Stats().FreeSpace.Runs cover %d blocks, expected %d", runBlocks, stats.FreeBlocks)
+		}
 		freeBlocks = stats.FreeBlocks
 		objects = stats.Objects
 	})
@@ -583,6 +671,14 @@ func TestBlockDB(t *testing.T) {
 			t.Errorf("db.Stats().DBMeta.BlockCount = %d, expected %d", dbStats.DBMeta.BlockCount, blocks)
 			return
 		}
+		if dbStats.Fragmentation.Blocks != int(blocks) {
+			t.Errorf("db.Stats().Fragmentation.Blocks = %d, expected %d", dbStats.Fragmentation.Blocks, blocks)
+			return
+		}
+		if len(objStats.BlockIndexes) != objStats.Blocks || objStats.Runs < 1 || objStats.Runs > objStats.Blocks {
+			t.Errorf("obj.Stats() = %+v, inconsistent block indexes and runs", objStats)
+			return
+		}
 	})
 }
 
@@ -593,3 +689,1838 @@ func readStringN(r io.Reader, n int) (string, error) {
 
 	return string(p), err
 }
+
+func TestBlockDBCipher(t *testing.T) {
+	fpath := filepath.Join(tmpDirPath, "test-block-db-cipher")
+	key := bytes.Repeat([]byte{0x42}, 32)
+	secret := bytes.Repeat([]byte("very secret payload "), 500)
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("secret")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(secret)
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+
+	raw, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Errorf("unexpected error reading file: %v", err)
+		return
+	}
+	if bytes.Contains(raw, []byte("very secret payload")) {
+		t.Error("found plaintext payload in the database file")
+	}
+
+	_, err = block.Open(f)
+	if !errors.Is(err, block.ErrKeyRequired) {
+		t.Errorf("block.Open(f) = %v, expected %v", err, block.ErrKeyRequired)
+	}
+	_, err = block.Open(f, block.WithCipher(bytes.Repeat([]byte{0x43}, 32)))
+	if !errors.Is(err, block.ErrInvalidKey) {
+		t.Errorf("block.Open(f, wrong key) = %v, expected %v", err, block.ErrInvalidKey)
+	}
+
+	db, err = block.Open(f, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("unexpected error opening block DB: %v", err)
+		return
+	}
+	obj, err = db.Open("secret")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if !bytes.Equal(b, secret) {
+		t.Errorf("io.ReadAll(obj) returned %d bytes, expected %d matching bytes", len(b), len(secret))
+	}
+}
+
+func TestBlockDBCompression(t *testing.T) {
+	for i, tc := range []struct {
+		name string
+		opts []block.Option
+	}{
+		{"compressed", []block.Option{block.WithCompression()}},
+		{"compressed and encrypted", []block.Option{block.WithCompression(), block.WithCipher(bytes.Repeat([]byte{0x42}, 16))}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(tmpDirPath, fmt.Sprintf("test-block-db-compression-%d", i)))
+			if err != nil {
+				t.Errorf("unexpected error creating file: %v", err)
+				return
+			}
+			defer f.Close()
+
+			db, err := block.Create(f, tc.opts...)
+			if err != nil {
+				t.Errorf("unexpected error creating block DB: %v", err)
+				return
+			}
+			obj, err := db.Create("text")
+			if err != nil {
+				t.Errorf("unexpected error creating object: %v", err)
+				return
+			}
+
+			expected := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 2000)
+			_, err = obj.Write(expected)
+			if err != nil {
+				t.Errorf("unexpected error writing to object: %v", err)
+				return
+			}
+			uncompressedBlocks := len(expected) / int(db.Meta().BlockSize)
+			if blocks := obj.Stats().Blocks; blocks >= uncompressedBlocks {
+				t.Errorf("obj.Stats().Blocks = %d, expected less than %d", blocks, uncompressedBlocks)
+			}
+
+			noise := make([]byte, 10000)
+			rand.Read(noise)
+			copy(expected[30000:], noise)
+			_, err = obj.Seek(30000, io.SeekStart)
+			if err != nil {
+				t.Errorf("obj.Seek(30000, start): unexpected error: %v", err)
+				return
+			}
+			_, err = obj.Write(noise)
+			if err != nil {
+				t.Errorf("unexpected error overwriting object: %v", err)
+				return
+			}
+			expected = append(expected, noise...)
+			_, err = obj.Seek(0, io.SeekEnd)
+			if err != nil {
+				t.Errorf("obj.Seek(0, end): unexpected error: %v", err)
+				return
+			}
+			_, err = obj.Write(noise)
+			if err != nil {
+				t.Errorf("unexpected error appending to object: %v", err)
+				return
+			}
+
+			obj, err = db.Open("text")
+			if err != nil {
+				t.Errorf("unexpected error opening object: %v", err)
+				return
+			}
+			if size := obj.Size(); size != int64(len(expected)) {
+				t.Errorf("obj.Size() = %d, expected %d", size, len(expected))
+			}
+			b, err := io.ReadAll(obj)
+			if err != nil {
+				t.Errorf("unexpected error reading object: %v", err)
+				return
+			}
+			if !bytes.Equal(b, expected) {
+				t.Errorf("io.ReadAll(obj) returned %d bytes, expected %d matching bytes", len(b), len(expected))
+			}
+		})
+	}
+}
+
+func TestBlockDBTracer(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-tracer"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	counts := map[block.TraceOp]int{}
+	tracer := block.TracerFunc(func(e block.TraceEvent) {
+		if e.Err != nil {
+			t.Errorf("unexpected error traced for %s: %v", e.Op, e.Err)
+		}
+		counts[e.Op]++
+	})
+
+	db, err := block.Create(f, block.WithTracer(tracer))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("traced")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 10000))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	err = db.Delete("traced")
+	if err != nil {
+		t.Errorf("unexpected error deleting object: %v", err)
+		return
+	}
+
+	for _, op := range []block.TraceOp{block.TraceRead, block.TraceWrite, block.TraceSeek, block.TraceGrow, block.TraceAlloc, block.TraceFree} {
+		if counts[op] == 0 {
+			t.Errorf("no %s event traced", op)
+		}
+	}
+}
+
+func TestBlockDBSync(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-sync"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = block.Create(struct{ io.ReadWriteSeeker }{f}, block.WithSync())
+	if !errors.Is(err, block.ErrSyncUnsupported) {
+		t.Errorf("block.Create(no Sync, WithSync()) = %v, expected %v", err, block.ErrSyncUnsupported)
+	}
+
+	db, err := block.Create(f, block.WithSync())
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("synced")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 10000))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	err = db.Delete("synced")
+	if err != nil {
+		t.Errorf("unexpected error deleting object: %v", err)
+	}
+}
+
+func TestBlockDBGeneration(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-generation"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("stamped")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 10000))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	expected := db.Meta().Generation
+	if expected == 0 {
+		t.Errorf("db.Meta().Generation = 0 after writes, expected more")
+	}
+
+	// the generation is persisted when the update completes
+	shared, err := block.OpenShared(f)
+	if err != nil {
+		t.Errorf("unexpected error opening the block DB: %v", err)
+		return
+	}
+	if got := shared.Meta().Generation; got != expected {
+		t.Errorf("persisted generation = %d, expected %d", got, expected)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Errorf("unexpected error closing the block DB: %v", err)
+		return
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error opening the block DB: %v", err)
+		return
+	}
+	if got := db.Meta().Generation; got != expected {
+		t.Errorf("db.Meta().Generation = %d after re-opening, expected %d", got, expected)
+	}
+}
+
+func TestBlockDBGrowWithoutTruncate(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-grow"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(struct{ io.ReadWriteSeeker }{f})
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	err = db.Grow(3)
+	if err != nil {
+		t.Errorf("db.Grow(3): unexpected error: %v", err)
+		return
+	}
+
+	size, err := db.FileSize()
+	if err != nil {
+		t.Errorf("unexpected error getting file size: %v", err)
+		return
+	}
+	meta := db.Meta()
+	expected := int64(meta.Size()) + 4*int64(meta.BlockSize)
+	if size != expected {
+		t.Errorf("db.FileSize() = %d, expected %d", size, expected)
+	}
+}
+
+func TestBlockDBRecovery(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-recovery"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	var lastBlock uint32
+	for _, name := range []string{"a", "b", "c"} {
+		obj, err := db.Create(name)
+		if err != nil {
+			t.Errorf("unexpected error creating object %q: %v", name, err)
+			return
+		}
+		_, err = obj.Write(bytes.Repeat([]byte(name), 10000))
+		if err != nil {
+			t.Errorf("unexpected error writing to object %q: %v", name, err)
+			return
+		}
+		if name == "a" {
+			indexes := obj.Stats().BlockIndexes
+			lastBlock = indexes[len(indexes)-1]
+		}
+	}
+	err = db.Delete("c")
+	if err != nil {
+		t.Errorf("unexpected error deleting object: %v", err)
+		return
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if stats.DBMeta.Flags&block.FlagDirty != 0 {
+		t.Errorf("DB is dirty after all updates completed")
+	}
+	freeBlocks := stats.FreeBlocks
+
+	// Simulate a crash leaking the free list, with a dangling pointer at the
+	// end of "a".
+	meta := stats.DBMeta
+	meta.Flags |= block.FlagDirty
+	meta.FirstFreeBlock = 0
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	_, err = meta.WriteTo(f)
+	if err != nil {
+		t.Errorf("unexpected error writing meta: %v", err)
+		return
+	}
+	_, err = f.Seek(int64(meta.Size())+int64(lastBlock)*int64(meta.BlockSize)+4, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	err = binary.Write(f, binary.LittleEndian, meta.BlockCount+10)
+	if err != nil {
+		t.Errorf("unexpected error writing next pointer: %v", err)
+		return
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error opening dirty block DB: %v", err)
+		return
+	}
+	stats, err = db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if !stats.Recovery.Recovered {
+		t.Errorf("Stats().Recovery.Recovered = false, expected true")
+	}
+	if stats.Recovery.CutChains != 1 {
+		t.Errorf("Stats().Recovery.CutChains = %d, expected 1", stats.Recovery.CutChains)
+	}
+	if stats.FreeBlocks != freeBlocks || stats.Recovery.FreeBlocks != freeBlocks {
+		t.Errorf("free blocks after recovery = %d (%d), expected %d", stats.FreeBlocks, stats.Recovery.FreeBlocks, freeBlocks)
+	}
+	if stats.DBMeta.Flags&block.FlagDirty != 0 {
+		t.Errorf("DB is still dirty after recovery")
+	}
+	obj, err := db.Open("a")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	s, err := readStringN(obj, 10000)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if s != strings.Repeat("a", 10000) {
+		t.Errorf("object content changed after recovery")
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	stats, err = db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if stats.Recovery.Recovered {
+		t.Errorf("Stats().Recovery.Recovered = true after a clean open")
+	}
+	if stats.FreeBlocks != freeBlocks {
+		t.Errorf("Stats().FreeBlocks = %d, expected %d", stats.FreeBlocks, freeBlocks)
+	}
+}
+
+func TestBlockDBIdentity(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-identity"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	before := time.Now().UnixNano()
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	meta := db.Meta()
+	if meta.UUID == ([16]byte{}) {
+		t.Errorf("db.Meta().UUID is empty")
+	}
+	if meta.CreatedAt < before || meta.CreatedAt > time.Now().UnixNano() {
+		t.Errorf("db.Meta().CreatedAt = %d, expected a time after %d", meta.CreatedAt, before)
+	}
+	if meta.OpenedAt != meta.CreatedAt {
+		t.Errorf("db.Meta().OpenedAt = %d, expected %d", meta.OpenedAt, meta.CreatedAt)
+	}
+
+	otherFile, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-identity-other"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer otherFile.Close()
+	other, err := block.Create(otherFile)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	if other.Meta().UUID == meta.UUID {
+		t.Errorf("two DBs share UUID %s", meta.UUIDString())
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error opening block DB: %v", err)
+		return
+	}
+	reopened := db.Meta()
+	if reopened.UUID != meta.UUID {
+		t.Errorf("db.Meta().UUID = %s after Open, expected %s", reopened.UUIDString(), meta.UUIDString())
+	}
+	if reopened.CreatedAt != meta.CreatedAt {
+		t.Errorf("db.Meta().CreatedAt = %d after Open, expected %d", reopened.CreatedAt, meta.CreatedAt)
+	}
+	if reopened.OpenedAt < meta.OpenedAt {
+		t.Errorf("db.Meta().OpenedAt = %d after Open, expected at least %d", reopened.OpenedAt, meta.OpenedAt)
+	}
+}
+
+func TestBlockDBClose(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-close"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("test")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write([]byte("hello"))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Errorf("unexpected error closing block DB: %v", err)
+		return
+	}
+	err = db.Close()
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("db.Close() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+	_, err = obj.Write([]byte("world"))
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("obj.Write() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+	_, err = obj.Seek(0, io.SeekStart)
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("obj.Seek() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+	_, err = obj.Read(make([]byte, 5))
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("obj.Read() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+	_, err = db.Open("test")
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("db.Open() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+	_, err = db.Create("other")
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("db.Create() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+	err = db.Delete("test")
+	if !errors.Is(err, block.ErrClosed) {
+		t.Errorf("db.Delete() = %v on a closed DB, expected %v", err, block.ErrClosed)
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	obj, err = db.Open("test")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	s, err := readStringN(obj, 5)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if s != "hello" {
+		t.Errorf("obj.Read() = %q, expected %q", s, "hello")
+	}
+
+	ff := &flushFile{File: f}
+	db, err = block.Open(ff, block.WithTracer(block.TracerFunc(func(block.TraceEvent) {})))
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	err = db.Close()
+	if err != nil || ff.flushes != 1 {
+		t.Errorf("db.Close() = %v, flushed the file %d times, expected once", err, ff.flushes)
+	}
+}
+
+type flushFile struct {
+	*os.File
+	flushes int
+}
+
+func (f *flushFile) Flush() error {
+	f.flushes++
+
+	return nil
+}
+
+func TestBlockDBConcurrentCreate(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-concurrent-create"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+
+	const n = 20
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			obj, err := db.Create(fmt.Sprintf("obj-%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = obj.Write(bytes.Repeat([]byte{byte('a' + i)}, 5000))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		err = <-errs
+		if err != nil {
+			t.Errorf("unexpected error creating object: %v", err)
+		}
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	for i := 0; i < n; i++ {
+		obj, err := db.Open(fmt.Sprintf("obj-%d", i))
+		if err != nil {
+			t.Errorf("unexpected error opening obj-%d: %v", i, err)
+			continue
+		}
+		s, err := readStringN(obj, 5000)
+		if err != nil {
+			t.Errorf("unexpected error reading obj-%d: %v", i, err)
+			continue
+		}
+		if s != strings.Repeat(string(rune('a'+i)), 5000) {
+			t.Errorf("obj-%d content doesn't match", i)
+		}
+	}
+}
+
+func TestBlockDBLockObject(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-lock-object"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+
+	unlockA := db.LockObject("a", true)
+	unlockB := db.LockObject("a", true)
+	unlockOther := db.LockObject("b", false)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock := db.LockObject("a", false)
+		close(locked)
+		unlock()
+	}()
+
+	unlockA()
+	unlockOther()
+	select {
+	case <-locked:
+		t.Errorf("exclusive lock acquired while a shared lock is held")
+		return
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlockB()
+	unlockB() // unlocking twice is a no-op
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("exclusive lock not acquired after shared locks were released")
+	}
+}
+
+func TestBlockDBScrub(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-scrub"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithCipher(bytes.Repeat([]byte{0x42}, 32)))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		obj, err := db.Create(name)
+		if err != nil {
+			t.Errorf("unexpected error creating object %q: %v", name, err)
+			return
+		}
+		_, err = obj.Write(bytes.Repeat([]byte(name), 10000))
+		if err != nil {
+			t.Errorf("unexpected error writing to object %q: %v", name, err)
+			return
+		}
+	}
+	err = db.Delete("c")
+	if err != nil {
+		t.Errorf("unexpected error deleting object: %v", err)
+		return
+	}
+
+	var problems []block.ScrubProblem
+	report := func(p block.ScrubProblem) {
+		problems = append(problems, p)
+	}
+	err = db.Scrub(context.Background(), 0, report)
+	if err != nil {
+		t.Errorf("unexpected error scrubbing block DB: %v", err)
+		return
+	}
+	if len(problems) != 0 {
+		t.Errorf("db.Scrub() reported %v on a healthy DB", problems)
+		problems = nil
+	}
+
+	obj, err := db.Open("b")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	corrupted := obj.Stats().BlockIndexes[1]
+	off := int64(stats.DBMeta.Size()) + int64(corrupted)*int64(stats.DBMeta.BlockSize) + int64(stats.BlockMetaSize) + 100
+	_, err = f.WriteAt([]byte("corrupted"), off)
+	if err != nil {
+		t.Errorf("unexpected error corrupting block: %v", err)
+		return
+	}
+
+	err = db.Scrub(context.Background(), 1000, report)
+	if err != nil {
+		t.Errorf("unexpected error scrubbing block DB: %v", err)
+		return
+	}
+	if len(problems) != 1 {
+		t.Errorf("db.Scrub() reported %d problems, expected 1: %v", len(problems), problems)
+		return
+	}
+	if problems[0].Block != corrupted || problems[0].Object != "b" || !errors.Is(problems[0], block.ErrAuthFailed) {
+		t.Errorf("db.Scrub() reported %v, expected an auth failure for block %d of \"b\"", problems[0], corrupted)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.Scrub(ctx, 0, report)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("db.Scrub(canceled) = %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestBlockDBFreeLongChain(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-free-long-chain"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	var (
+		tracing    bool
+		metaSize   int64
+		metaWrites int
+		freed      int64
+	)
+	tracer := block.TracerFunc(func(e block.TraceEvent) {
+		if !tracing {
+			return
+		}
+		switch e.Op {
+		case block.TraceWrite:
+			if e.Offset < metaSize {
+				metaWrites++
+			}
+		case block.TraceFree:
+			freed += e.Size
+		}
+	})
+
+	db, err := block.Create(f, block.WithBlockSize(64), block.WithTracer(tracer))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("long")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 100000))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	blocks := obj.Stats().Blocks
+	metaSize = int64(db.Meta().Size())
+
+	tracing = true
+	err = db.Delete("long")
+	tracing = false
+	if err != nil {
+		t.Errorf("unexpected error deleting object: %v", err)
+		return
+	}
+	if freed != int64(blocks) {
+		t.Errorf("freed %d blocks, expected %d", freed, blocks)
+	}
+	if metaWrites > 10 {
+		t.Errorf("deleting a %d blocks object took %d DB meta writes", blocks, metaWrites)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if int(stats.FreeBlocks) < blocks {
+		t.Errorf("db.Stats().FreeBlocks = %d, expected at least %d", stats.FreeBlocks, blocks)
+	}
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	reopened, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if reopened.FreeBlocks != stats.FreeBlocks {
+		t.Errorf("db.Stats().FreeBlocks = %d after re-opening, expected %d", reopened.FreeBlocks, stats.FreeBlocks)
+	}
+}
+
+func TestBlockDBAllocatorCache(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-allocator-cache"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	var (
+		tracing bool
+		reads   int
+	)
+	tracer := block.TracerFunc(func(e block.TraceEvent) {
+		if tracing && e.Op == block.TraceRead {
+			reads++
+		}
+	})
+
+	db, err := block.Create(f, block.WithTracer(tracer))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("test")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	// Growing twice links the second run after the tail of the first one.
+	for i := 0; i < 2; i++ {
+		err = db.Grow(10)
+		if err != nil {
+			t.Errorf("unexpected error growing block DB: %v", err)
+			return
+		}
+	}
+
+	tracing = true
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 15*(block.DefaultBlockSize-100)))
+	tracing = false
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	if reads != 0 {
+		t.Errorf("allocating free blocks read from the file %d times", reads)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	reopened, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if reopened.FreeBlocks != stats.FreeBlocks {
+		t.Errorf("db.Stats().FreeBlocks = %d after re-opening, expected %d", reopened.FreeBlocks, stats.FreeBlocks)
+	}
+	if fmt.Sprint(reopened.FreeSpace.Runs) != fmt.Sprint(stats.FreeSpace.Runs) {
+		t.Errorf("db.Stats().FreeSpace.Runs = %v after re-opening, expected %v", reopened.FreeSpace.Runs, stats.FreeSpace.Runs)
+	}
+}
+
+func TestBlockDBObjectSize(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-object-size"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("sized")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		_, err = obj.Write(bytes.Repeat([]byte{'A'}, 5000))
+		if err != nil {
+			t.Errorf("unexpected error writing to object: %v", err)
+			return
+		}
+	}
+	_, err = obj.Seek(100, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	_, err = obj.Write([]byte("overwritten"))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	if size := obj.Size(); size != 15000 {
+		t.Errorf("obj.Size() = %d, expected 15000", size)
+	}
+	lastBlock := obj.Stats().BlockIndexes[obj.Stats().Blocks-1]
+
+	var (
+		tracing bool
+		reads   int
+	)
+	tracer := block.TracerFunc(func(e block.TraceEvent) {
+		if tracing && e.Op == block.TraceRead {
+			reads++
+		}
+	})
+	db, err = block.Open(f, block.WithTracer(tracer))
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	for _, meta := range db.Objects() {
+		if meta.Name != "sized" {
+			continue
+		}
+		if meta.Size != 15000 || meta.LastBlock != lastBlock {
+			t.Errorf("ObjectMeta{Size: %d, LastBlock: %d}, expected {15000, %d}", meta.Size, meta.LastBlock, lastBlock)
+		}
+	}
+	tracing = true
+	obj, err = db.Open("sized")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	size := obj.Size()
+	tracing = false
+	if size != 15000 {
+		t.Errorf("obj.Size() = %d after re-opening, expected 15000", size)
+	}
+	if reads != 0 {
+		t.Errorf("opening an object and getting its size read from the file %d times", reads)
+	}
+
+	obj, err = db.Create("sized")
+	if err != nil {
+		t.Errorf("unexpected error truncating object: %v", err)
+		return
+	}
+	if size := obj.Size(); size != 0 {
+		t.Errorf("obj.Size() = %d after truncating, expected 0", size)
+	}
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	obj, err = db.Open("sized")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	if size := obj.Size(); size != 0 {
+		t.Errorf("obj.Size() = %d after truncating and re-opening, expected 0", size)
+	}
+}
+
+func TestBlockDBCompressedOverwrite(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-compressed-overwrite"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithCompression(), block.WithBlockSize(256))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("obj")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'a'}, 900))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	if blocks := obj.Stats().Blocks; blocks != 1 {
+		t.Errorf("obj.Stats().Blocks = %d, expected 1", blocks)
+		return
+	}
+
+	noise := make([]byte, 900)
+	rand.Read(noise)
+	_, err = obj.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	_, err = obj.Write(noise)
+	if err != nil {
+		t.Errorf("unexpected error overwriting object: %v", err)
+		return
+	}
+	stats := obj.Stats()
+	if stats.Blocks == 1 {
+		t.Errorf("obj.Stats().Blocks = 1 after overwriting with incompressible data, expected more")
+		return
+	}
+	last := stats.BlockIndexes[len(stats.BlockIndexes)-1]
+	if oo := db.Objects(); len(oo) != 1 || oo[0].LastBlock != last || oo[0].Size != 900 {
+		t.Errorf("db.Objects() = %+v, expected a last block of %d and a size of 900", oo, last)
+	}
+
+	db, err = block.Open(f, block.WithCompression())
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	if oo := db.Objects(); len(oo) != 1 || oo[0].LastBlock != last {
+		t.Errorf("db.Objects() = %+v after re-opening, expected a last block of %d", oo, last)
+	}
+}
+
+func TestBlockDBSparseObject(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-sparse-object"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("sparse")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write([]byte("abc"))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+
+	got, err := obj.Seek(10000, io.SeekStart)
+	if err != nil || got != 10000 {
+		t.Errorf("obj.Seek(10000, start) = %d, %v, expected 10000", got, err)
+		return
+	}
+	_, err = obj.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("obj.Read() past the end = %v, expected EOF", err)
+	}
+	got, err = obj.Seek(-10, io.SeekCurrent)
+	if err != nil || got != 9990 {
+		t.Errorf("obj.Seek(-10, current) = %d, %v, expected 9990", got, err)
+		return
+	}
+	_, err = obj.Write([]byte("xyz"))
+	if err != nil {
+		t.Errorf("unexpected error writing past the end: %v", err)
+		return
+	}
+	if size := obj.Size(); size != 9993 {
+		t.Errorf("obj.Size() = %d, expected 9993", size)
+	}
+
+	expected := append(append([]byte("abc"), make([]byte, 9987)...), "xyz"...)
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	obj, err = db.Open("sparse")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("obj content = %d bytes, expected \"abc\", 9987 zeros and \"xyz\"", len(b))
+	}
+}
+
+func TestBlockDBSeekBlockBoundary(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-seek-block-boundary"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithBlockSize(64))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("obj")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	expected := make([]byte, 200)
+	for i := range expected {
+		expected[i] = byte(i)
+	}
+	_, err = obj.Write(expected)
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+
+	// seeking back stops at the end of the first block
+	seek := func() bool {
+		for _, s := range []struct {
+			offset   int64
+			whence   int
+			expected int64
+		}{
+			{45, io.SeekStart, 45},
+			{-5, io.SeekCurrent, 40},
+			{5, io.SeekCurrent, 45},
+		} {
+			got, err := obj.Seek(s.offset, s.whence)
+			if err != nil || got != s.expected {
+				t.Errorf("obj.Seek(%d, %d) = %d, %v, expected %d", s.offset, s.whence, got, err, s.expected)
+				return false
+			}
+		}
+		return true
+	}
+	if !seek() {
+		return
+	}
+	b := make([]byte, 10)
+	n, err := obj.Read(b)
+	if err != nil || n != len(b) {
+		t.Errorf("obj.Read() = %d, %v, expected %d", n, err, len(b))
+		return
+	}
+	if !bytes.Equal(b, expected[45:55]) {
+		t.Errorf("obj.Read() = %v, expected %v", b, expected[45:55])
+	}
+
+	if !seek() {
+		return
+	}
+	_, err = obj.Write([]byte("xyz"))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	copy(expected[45:], "xyz")
+	if size := obj.Size(); size != 200 {
+		t.Errorf("obj.Size() = %d, expected 200", size)
+	}
+	_, err = obj.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	b, err = io.ReadAll(obj)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("obj content = %v, expected %v", b, expected)
+	}
+}
+
+func TestBlockDBOpenAppend(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-open-append"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	var (
+		tracing bool
+		reads   int
+	)
+	tracer := block.TracerFunc(func(e block.TraceEvent) {
+		if tracing && e.Op == block.TraceRead {
+			reads++
+		}
+	})
+	db, err := block.Create(f, block.WithTracer(tracer))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("log")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 50000))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+
+	_, err = db.OpenAppend("missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("db.OpenAppend(missing) = %v, expected %v", err, os.ErrNotExist)
+	}
+
+	tracing = true
+	app, err := db.OpenAppend("log")
+	if err != nil {
+		t.Errorf("unexpected error opening object for append: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		_, err = app.Write(bytes.Repeat([]byte{'B'}, 3000))
+		if err != nil {
+			t.Errorf("unexpected error appending to object: %v", err)
+			return
+		}
+	}
+	tracing = false
+	// the tail block header, the rest is index metadata
+	if reads > 10 {
+		t.Errorf("appending to a %d blocks object read from the file %d times", obj.Stats().Blocks, reads)
+	}
+	if size := app.Size(); size != 59000 {
+		t.Errorf("app.Size() = %d, expected 59000", size)
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	obj, err = db.Open("log")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	expected := append(bytes.Repeat([]byte{'A'}, 50000), bytes.Repeat([]byte{'B'}, 9000)...)
+	if !bytes.Equal(b, expected) {
+		t.Errorf("obj content doesn't match after appending (%d bytes, expected %d)", len(b), len(expected))
+	}
+}
+
+func TestBlockDBOpenAppendCompressed(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-open-append-compressed"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithCompression(), block.WithBlockSize(256))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("log")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'a'}, 900))
+	if err != nil {
+		t.Errorf("unexpected error writing to object: %v", err)
+		return
+	}
+	// overwriting with incompressible data spills to new tail blocks
+	expected := make([]byte, 900)
+	rand.Read(expected)
+	_, err = obj.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	_, err = obj.Write(expected)
+	if err != nil {
+		t.Errorf("unexpected error overwriting object: %v", err)
+		return
+	}
+
+	app, err := db.OpenAppend("log")
+	if err != nil {
+		t.Errorf("unexpected error opening object for append: %v", err)
+		return
+	}
+	_, err = app.Write(bytes.Repeat([]byte{'b'}, 500))
+	if err != nil {
+		t.Errorf("unexpected error appending to object: %v", err)
+		return
+	}
+	expected = append(expected, bytes.Repeat([]byte{'b'}, 500)...)
+	if size := app.Size(); size != int64(len(expected)) {
+		t.Errorf("app.Size() = %d, expected %d", size, len(expected))
+	}
+
+	obj, err = db.Open("log")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("obj content doesn't match after appending (%d bytes, expected %d)", len(b), len(expected))
+	}
+}
+
+func TestBlockDBMaxBlocks(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-max-blocks"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithMaxBlocks(8))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	obj, err := db.Create("big")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(bytes.Repeat([]byte{'A'}, 10*block.DefaultBlockSize))
+	var quotaErr *block.QuotaError
+	if !errors.As(err, &quotaErr) || !errors.Is(err, block.ErrQuotaExceeded) {
+		t.Errorf("obj.Write(past quota) = %v, expected a *block.QuotaError", err)
+		return
+	}
+	if quotaErr.MaxBlocks != 8 {
+		t.Errorf("QuotaError.MaxBlocks = %d, expected 8", quotaErr.MaxBlocks)
+	}
+	meta := db.Meta()
+	if meta.BlockCount > 8 {
+		t.Errorf("db.Meta().BlockCount = %d, expected at most 8", meta.BlockCount)
+	}
+	if meta.Flags&block.FlagDirty != 0 {
+		t.Errorf("DB left dirty after hitting the quota")
+	}
+	err = db.Grow(100)
+	if !errors.Is(err, block.ErrQuotaExceeded) {
+		t.Errorf("db.Grow(100) = %v, expected %v", err, block.ErrQuotaExceeded)
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	err = db.Grow(100)
+	if err != nil {
+		t.Errorf("db.Grow(100) without quota: unexpected error: %v", err)
+	}
+}
+
+func TestBlockDBOpenShared(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-open-shared"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	key := bytes.Repeat([]byte{0x42}, 32)
+	db, err := block.Create(f, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	expected := map[string][]byte{}
+	for _, name := range []string{"a", "b"} {
+		obj, err := db.Create(name)
+		if err != nil {
+			t.Errorf("unexpected error creating object %q: %v", name, err)
+			return
+		}
+		expected[name] = bytes.Repeat([]byte(name+"0123456789"), 2000)
+		_, err = obj.Write(expected[name])
+		if err != nil {
+			t.Errorf("unexpected error writing to object %q: %v", name, err)
+			return
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Errorf("unexpected error closing block DB: %v", err)
+		return
+	}
+
+	db, err = block.OpenShared(f, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("unexpected error opening shared block DB: %v", err)
+		return
+	}
+	_, err = db.Create("c")
+	if !errors.Is(err, block.ErrReadOnly) {
+		t.Errorf("db.Create() = %v on a shared DB, expected %v", err, block.ErrReadOnly)
+	}
+
+	const readers = 8
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		name := []string{"a", "b"}[i%2]
+		go func() {
+			obj, err := db.Open(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			b, err := io.ReadAll(obj)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(b, expected[name]) {
+				errs <- fmt.Errorf("content of %q doesn't match", name)
+				return
+			}
+			_, err = obj.Write([]byte("x"))
+			if !errors.Is(err, block.ErrReadOnly) {
+				errs <- fmt.Errorf("obj.Write() = %v on a shared DB, expected %v", err, block.ErrReadOnly)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < readers; i++ {
+		err = <-errs
+		if err != nil {
+			t.Errorf("reading from shared DB: %v", err)
+		}
+	}
+}
+
+func TestBlockDBList(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-list"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	for _, name := range []string{"a/2", "b/1", "a/b/3", "ab", "a/1"} {
+		_, err = db.Create(name)
+		if err != nil {
+			t.Errorf("unexpected error creating object %q: %v", name, err)
+			return
+		}
+	}
+
+	if got := fmt.Sprint(db.List("a/")); got != "[a/1 a/2 a/b/3]" {
+		t.Errorf("db.List(\"a/\") = %s, expected [a/1 a/2 a/b/3]", got)
+	}
+	if got := fmt.Sprint(db.List("")); got != "[a/1 a/2 a/b/3 ab b/1]" {
+		t.Errorf("db.List(\"\") = %s, expected [a/1 a/2 a/b/3 ab b/1]", got)
+	}
+	if got := db.List("c/"); len(got) != 0 {
+		t.Errorf("db.List(\"c/\") = %v, expected none", got)
+	}
+
+	n, err := db.DeletePrefix("a/")
+	if err != nil {
+		t.Errorf("unexpected error deleting prefix: %v", err)
+		return
+	}
+	if n != 3 {
+		t.Errorf("db.DeletePrefix(\"a/\") = %d, expected 3", n)
+	}
+	_, err = db.Open("a/b/3")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("db.Open(\"a/b/3\") = %v after deleting its prefix, expected %v", err, os.ErrNotExist)
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error re-opening block DB: %v", err)
+		return
+	}
+	if got := fmt.Sprint(db.List("")); got != "[ab b/1]" {
+		t.Errorf("db.List(\"\") = %s after re-opening, expected [ab b/1]", got)
+	}
+}
+
+func TestBlockDBTar(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-tar"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f, block.WithBlockSize(512))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	expected := map[string][]byte{
+		"empty":    {},
+		"small":    []byte("hello, world!"),
+		"dir/big":  bytes.Repeat([]byte("0123456789"), 5000),
+		"dir/big2": bytes.Repeat([]byte("abcdefghij"), 300),
+	}
+	for name, content := range expected {
+		obj, err := db.Create(name)
+		if err != nil {
+			t.Errorf("unexpected error creating object %q: %v", name, err)
+			return
+		}
+		_, err = obj.Write(content)
+		if err != nil {
+			t.Errorf("unexpected error writing to object %q: %v", name, err)
+			return
+		}
+	}
+
+	var archive bytes.Buffer
+	err = db.ExportTar(&archive)
+	if err != nil {
+		t.Errorf("unexpected error exporting block DB: %v", err)
+		return
+	}
+
+	imported, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-tar-imported"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer imported.Close()
+	db, err = block.Create(imported, block.WithCompression())
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	err = block.ImportTar(db, &archive)
+	if err != nil {
+		t.Errorf("unexpected error importing block DB: %v", err)
+		return
+	}
+
+	if got := fmt.Sprint(db.List("")); got != "[dir/big dir/big2 empty small]" {
+		t.Errorf("db.List(\"\") = %s after import, expected [dir/big dir/big2 empty small]", got)
+	}
+	for name, content := range expected {
+		obj, err := db.Open(name)
+		if err != nil {
+			t.Errorf("unexpected error opening object %q: %v", name, err)
+			continue
+		}
+		b, err := io.ReadAll(obj)
+		if err != nil {
+			t.Errorf("unexpected error reading object %q: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("content of %q doesn't match after import (%d bytes, expected %d)", name, len(b), len(content))
+		}
+	}
+}
+
+func TestBlockDBVersion1(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-version-1"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = block.Create(f, block.WithVersion(1), block.WithCompression())
+	if err == nil {
+		t.Errorf("block.Create(..., WithVersion(1), WithCompression()): expected an error")
+		return
+	}
+	_, err = block.Create(f, block.WithVersion(block.LatestVersion+1))
+	if err == nil {
+		t.Errorf("block.Create(..., WithVersion(%d)): expected an error", block.LatestVersion+1)
+		return
+	}
+
+	db, err := block.Create(f, block.WithVersion(1), block.WithBlockSize(512))
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	data := bytes.Repeat([]byte("version 1 "), 500)
+	obj, err := db.Create("object")
+	if err != nil {
+		t.Errorf("unexpected error creating object: %v", err)
+		return
+	}
+	_, err = obj.Write(data)
+	if err != nil {
+		t.Errorf("unexpected error writing object: %v", err)
+		return
+	}
+	err = db.Close()
+	if err != nil {
+		t.Errorf("unexpected error closing block DB: %v", err)
+		return
+	}
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error opening block DB: %v", err)
+		return
+	}
+	if v := db.Meta().Version; v != 1 {
+		t.Errorf("db.Meta().Version = %d, expected 1", v)
+	}
+	obj, err = db.Open("object")
+	if err != nil {
+		t.Errorf("unexpected error opening object: %v", err)
+		return
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Errorf("unexpected error reading object: %v", err)
+		return
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("read %d bytes from the object, expected the %d written", len(b), len(data))
+	}
+}
+
+func TestBlockDBReclaim(t *testing.T) {
+	f, err := os.Create(filepath.Join(tmpDirPath, "test-block-db-reclaim"))
+	if err != nil {
+		t.Errorf("unexpected error creating file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	db, err := block.Create(f)
+	if err != nil {
+		t.Errorf("unexpected error creating block DB: %v", err)
+		return
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		obj, err := db.Create(name)
+		if err != nil {
+			t.Errorf("unexpected error creating object %q: %v", name, err)
+			return
+		}
+		_, err = obj.Write(bytes.Repeat([]byte(name), 10000))
+		if err != nil {
+			t.Errorf("unexpected error writing to object %q: %v", name, err)
+			return
+		}
+	}
+	err = db.Delete("b")
+	if err != nil {
+		t.Errorf("unexpected error deleting object: %v", err)
+		return
+	}
+	n, err := db.Reclaim()
+	if n != 0 || err != nil {
+		t.Errorf("db.Reclaim() = %d, %v on a DB without leaks, expected 0", n, err)
+		return
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	freeBlocks := stats.FreeBlocks
+	err = db.Close()
+	if err != nil {
+		t.Errorf("unexpected error closing block DB: %v", err)
+		return
+	}
+
+	// Leak the free list
+	meta := stats.DBMeta
+	meta.FirstFreeBlock = 0
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("unexpected error seeking: %v", err)
+		return
+	}
+	_, err = meta.WriteTo(f)
+	if err != nil {
+		t.Errorf("unexpected error writing meta: %v", err)
+		return
+	}
+
+	ro, err := block.OpenShared(f)
+	if err != nil {
+		t.Errorf("unexpected error opening block DB read-only: %v", err)
+		return
+	}
+	_, err = ro.Reclaim()
+	if !errors.Is(err, block.ErrReadOnly) {
+		t.Errorf("ro.Reclaim() = %v, expected %v", err, block.ErrReadOnly)
+	}
+	ro.Close()
+
+	db, err = block.Open(f)
+	if err != nil {
+		t.Errorf("unexpected error opening block DB: %v", err)
+		return
+	}
+	defer db.Close()
+	n, err = db.Reclaim()
+	if err != nil {
+		t.Errorf("unexpected error reclaiming blocks: %v", err)
+		return
+	}
+	if uint32(n) != freeBlocks {
+		t.Errorf("db.Reclaim() = %d, expected %d", n, freeBlocks)
+	}
+	stats, err = db.Stats()
+	if err != nil {
+		t.Errorf("unexpected error getting stats: %v", err)
+		return
+	}
+	if stats.FreeBlocks != freeBlocks {
+		t.Errorf("%d free blocks after reclaiming, expected %d", stats.FreeBlocks, freeBlocks)
+	}
+
+	for _, name := range []string{"a", "c"} {
+		obj, err := db.Open(name)
+		if err != nil {
+			t.Errorf("unexpected error opening object %q: %v", name, err)
+			return
+		}
+		b, err := io.ReadAll(obj)
+		if err != nil {
+			t.Errorf("unexpected error reading object %q: %v", name, err)
+			return
+		}
+		if !bytes.Equal(b, bytes.Repeat([]byte(name), 10000)) {
+			t.Errorf("object %q changed after reclaiming blocks", name)
+		}
+	}
+	var problems []block.ScrubProblem
+	err = db.Scrub(context.Background(), 0, func(p block.ScrubProblem) {
+		problems = append(problems, p)
+	})
+	if err != nil || len(problems) != 0 {
+		t.Errorf("db.Scrub() = %v, %v after reclaiming blocks, expected no problems", problems, err)
+	}
+}
@@ -0,0 +1,67 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// List returns the names of the objects starting with prefix, in order.
+// Names are free-form, but using "/" as a separator gives a hierarchy of
+// objects that can be listed and deleted by directory.
+func (db *BlockDB) List(prefix string) []string {
+	db.objectsM.RLock()
+	defer db.objectsM.RUnlock()
+
+	var names []string
+	for i := sort.SearchStrings(db.names, prefix); i < len(db.names); i++ {
+		if !strings.HasPrefix(db.names[i], prefix) {
+			break
+		}
+		names = append(names, db.names[i])
+	}
+
+	return names
+}
+
+// DeletePrefix deletes every object starting with prefix, and returns how many
+// were deleted.
+func (db *BlockDB) DeletePrefix(prefix string) (int, error) {
+	var n int
+
+	for _, name := range db.List(prefix) {
+		err := db.Delete(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// addName and removeName keep the sorted names in sync with db.objects, they
+// have to be called with objectsM held.
+func (db *BlockDB) addName(name string) {
+	i := sort.SearchStrings(db.names, name)
+	if i < len(db.names) && db.names[i] == name {
+		return
+	}
+
+	db.names = append(db.names, "")
+	copy(db.names[i+1:], db.names[i:])
+	db.names[i] = name
+}
+
+func (db *BlockDB) removeName(name string) {
+	i := sort.SearchStrings(db.names, name)
+	if i == len(db.names) || db.names[i] != name {
+		return
+	}
+
+	db.names = append(db.names[:i], db.names[i+1:]...)
+}
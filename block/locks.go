@@ -0,0 +1,47 @@
+package block
+
+import "sync"
+
+type objectLock struct {
+	m    sync.RWMutex
+	refs int
+}
+
+// LockObject takes an advisory lock on the named object, shared or exclusive,
+// and returns the function releasing it. The DB itself ignores these locks,
+// they only coordinate callers accessing the same objects. The object doesn't
+// have to exist.
+func (db *BlockDB) LockObject(name string, shared bool) (unlock func()) {
+	db.locksM.Lock()
+	l, ok := db.locks[name]
+	if !ok {
+		l = &objectLock{}
+		db.locks[name] = l
+	}
+	l.refs++
+	db.locksM.Unlock()
+
+	if shared {
+		l.m.RLock()
+	} else {
+		l.m.Lock()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if shared {
+				l.m.RUnlock()
+			} else {
+				l.m.Unlock()
+			}
+
+			db.locksM.Lock()
+			defer db.locksM.Unlock()
+			l.refs--
+			if l.refs == 0 {
+				delete(db.locks, name)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package block
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -14,26 +15,57 @@ type DBMeta struct {
 	BlockCount uint32
 
 	FirstFreeBlock uint32
+
+	// v2
+	Flags      uint32
+	KeyCheck   [keyCheckSize]byte
+	Generation uint64 // last generation stamped on a block
+	UUID       [16]byte
+	CreatedAt  int64 // unix nanoseconds
+	OpenedAt   int64 // unix nanoseconds
 }
 
+const (
+	FlagEncrypted uint32 = 1 << iota
+	FlagCompressed
+	FlagDirty // allocator updates in progress, cleared once they complete
+)
+
 var (
 	sizeMagic          = binarySizePanic(DBMeta{}.Magic)
 	sizeVersion        = binarySizePanic(DBMeta{}.Version)
 	sizeBlockSize      = binarySizePanic(DBMeta{}.BlockSize)
 	sizeBlockCount     = binarySizePanic(DBMeta{}.BlockCount)
 	sizeFirstFreeBlock = binarySizePanic(DBMeta{}.FirstFreeBlock)
+	sizeFlags          = binarySizePanic(DBMeta{}.Flags)
+	sizeKeyCheck       = binarySizePanic(DBMeta{}.KeyCheck)
+	sizeGeneration     = binarySizePanic(DBMeta{}.Generation)
+	sizeUUID           = binarySizePanic(DBMeta{}.UUID)
+	sizeCreatedAt      = binarySizePanic(DBMeta{}.CreatedAt)
+	sizeOpenedAt       = binarySizePanic(DBMeta{}.OpenedAt)
 )
 
-type Option func(m *DBMeta)
+// newUUID returns a random (version 4) UUID.
+func newUUID() ([16]byte, error) {
+	var uuid [16]byte
 
-func WithBlockSize(blockSize uint32) Option {
-	return func(m *DBMeta) {
-		m.BlockSize = blockSize
+	_, err := rand.Read(uuid[:])
+	if err != nil {
+		return uuid, err
 	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	return uuid, nil
 }
 
 func (m DBMeta) Size() int {
-	return sizeMagic + sizeVersion + sizeBlockSize + sizeBlockCount + sizeFirstFreeBlock
+	size := sizeMagic + sizeVersion + sizeBlockSize + sizeBlockCount + sizeFirstFreeBlock
+	if m.Version == 1 {
+		return size
+	}
+
+	return size + sizeFlags + sizeKeyCheck + sizeGeneration + sizeUUID + sizeCreatedAt + sizeOpenedAt
 }
 
 func (m DBMeta) WriteTo(w io.Writer) (n int64, err error) {
@@ -67,6 +99,46 @@ func (m DBMeta) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	n += int64(sizeFirstFreeBlock)
 
+	if m.Version == 1 {
+		return n, nil
+	}
+
+	err = binary.Write(w, binary.LittleEndian, m.Flags)
+	if err != nil {
+		return n, fmt.Errorf("writing flags: %w", err)
+	}
+	n += int64(sizeFlags)
+
+	err = binary.Write(w, binary.LittleEndian, m.KeyCheck)
+	if err != nil {
+		return n, fmt.Errorf("writing key check: %w", err)
+	}
+	n += int64(sizeKeyCheck)
+
+	err = binary.Write(w, binary.LittleEndian, m.Generation)
+	if err != nil {
+		return n, fmt.Errorf("writing generation: %w", err)
+	}
+	n += int64(sizeGeneration)
+
+	err = binary.Write(w, binary.LittleEndian, m.UUID)
+	if err != nil {
+		return n, fmt.Errorf("writing UUID: %w", err)
+	}
+	n += int64(sizeUUID)
+
+	err = binary.Write(w, binary.LittleEndian, m.CreatedAt)
+	if err != nil {
+		return n, fmt.Errorf("writing creation time: %w", err)
+	}
+	n += int64(sizeCreatedAt)
+
+	err = binary.Write(w, binary.LittleEndian, m.OpenedAt)
+	if err != nil {
+		return n, fmt.Errorf("writing last open time: %w", err)
+	}
+	n += int64(sizeOpenedAt)
+
 	return n, nil
 }
 
@@ -92,6 +164,63 @@ func (m DBMeta) WriteFirstFreeBlock(w io.WriteSeeker) error {
 	return binary.Write(w, binary.LittleEndian, m.FirstFreeBlock)
 }
 
+func (m DBMeta) WriteFlags(w io.WriteSeeker) error {
+	off := sizeMagic + sizeVersion + sizeBlockSize + sizeBlockCount + sizeFirstFreeBlock
+
+	_, err := w.Seek(int64(off), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, m.Flags)
+}
+
+// WriteFlagsAndGeneration writes the flags, key check and generation in a
+// single write, the fields being contiguous.
+func (m DBMeta) WriteFlagsAndGeneration(w io.WriteSeeker) error {
+	off := sizeMagic + sizeVersion + sizeBlockSize + sizeBlockCount + sizeFirstFreeBlock
+
+	_, err := w.Seek(int64(off), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, sizeFlags+sizeKeyCheck+sizeGeneration)
+	binary.LittleEndian.PutUint32(b, m.Flags)
+	copy(b[sizeFlags:], m.KeyCheck[:])
+	binary.LittleEndian.PutUint64(b[sizeFlags+sizeKeyCheck:], m.Generation)
+	_, err = w.Write(b)
+
+	return err
+}
+
+func (m DBMeta) WriteGeneration(w io.WriteSeeker) error {
+	off := sizeMagic + sizeVersion + sizeBlockSize + sizeBlockCount + sizeFirstFreeBlock + sizeFlags + sizeKeyCheck
+
+	_, err := w.Seek(int64(off), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, m.Generation)
+}
+
+func (m DBMeta) WriteOpenedAt(w io.WriteSeeker) error {
+	off := sizeMagic + sizeVersion + sizeBlockSize + sizeBlockCount + sizeFirstFreeBlock + sizeFlags + sizeKeyCheck + sizeGeneration + sizeUUID + sizeCreatedAt
+
+	_, err := w.Seek(int64(off), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, m.OpenedAt)
+}
+
+// UUIDString formats the UUID in its canonical hyphenated form.
+func (m DBMeta) UUIDString() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", m.UUID[0:4], m.UUID[4:6], m.UUID[6:8], m.UUID[8:10], m.UUID[10:16])
+}
+
 func (m *DBMeta) ReadFrom(r io.Reader) (n int64, err error) {
 	err = binary.Read(r, binary.LittleEndian, &m.Magic)
 	if err != nil {
@@ -132,5 +261,45 @@ func (m *DBMeta) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 	n += int64(sizeFirstFreeBlock)
 
+	if m.Version == 1 {
+		return n, nil
+	}
+
+	err = binary.Read(r, binary.LittleEndian, &m.Flags)
+	if err != nil {
+		return n, fmt.Errorf("reading flags: %w", err)
+	}
+	n += int64(sizeFlags)
+
+	err = binary.Read(r, binary.LittleEndian, &m.KeyCheck)
+	if err != nil {
+		return n, fmt.Errorf("reading key check: %w", err)
+	}
+	n += int64(sizeKeyCheck)
+
+	err = binary.Read(r, binary.LittleEndian, &m.Generation)
+	if err != nil {
+		return n, fmt.Errorf("reading generation: %w", err)
+	}
+	n += int64(sizeGeneration)
+
+	err = binary.Read(r, binary.LittleEndian, &m.UUID)
+	if err != nil {
+		return n, fmt.Errorf("reading UUID: %w", err)
+	}
+	n += int64(sizeUUID)
+
+	err = binary.Read(r, binary.LittleEndian, &m.CreatedAt)
+	if err != nil {
+		return n, fmt.Errorf("reading creation time: %w", err)
+	}
+	n += int64(sizeCreatedAt)
+
+	err = binary.Read(r, binary.LittleEndian, &m.OpenedAt)
+	if err != nil {
+		return n, fmt.Errorf("reading last open time: %w", err)
+	}
+	n += int64(sizeOpenedAt)
+
 	return n, nil
 }
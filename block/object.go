@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/yazgazan/kvstore/container"
 )
@@ -13,40 +14,81 @@ type ObjectMeta struct {
 
 	Name       string
 	StartBlock uint32
+	LastBlock  uint32 // 0 until known, for objects created before it was recorded
+	Size       int64
 	Deleted    bool
 }
 
 type Object struct {
-	db *BlockDB
+	db   *BlockDB
+	meta *ObjectMeta // nil for the index object
 
 	m           *sync.Mutex
 	blocks      []*BlockMeta
 	offset      int64
 	posBlockIdx int
 	posBlockOff uint32
+	hole        int64 // bytes the offset is past the end of the object
 }
 
 type ObjectStats struct {
-	Size   int64
-	Blocks int
-	Free   int // bytes available at the end of last block
+	Size       int64
+	Blocks     int
+	Free       int    // bytes available at the end of last block
+	Generation uint64 // highest generation across the object's blocks
+
+	BlockIndexes []uint32
+	Runs         int   // runs of contiguous blocks
+	Wasted       []int // unused payload bytes, per block
 }
 
 func (o *Object) Stats() ObjectStats {
 	o.m.Lock()
 	defer o.m.Unlock()
+	if o.blocks == nil {
+		o.lockDB()
+		err := o.load()
+		o.unlockDB()
+		if err != nil {
+			return ObjectStats{}
+		}
+	}
 
 	return o.stats()
 }
 
 func (o *Object) stats() ObjectStats {
+	return o.db.objectStats(o.blocks)
+}
+
+func (db *BlockDB) objectStats(blocks []*BlockMeta) ObjectStats {
 	stats := ObjectStats{
-		Blocks: len(o.blocks),
-		Size:   o.size(),
+		Blocks: len(blocks),
+
+		BlockIndexes: make([]uint32, len(blocks)),
+		Wasted:       make([]int, len(blocks)),
 	}
 
-	lastBlock := o.blocks[len(o.blocks)-1]
-	stats.Free = (int(o.db.meta.BlockSize) - int(o.db.sizeMeta)) - int(lastBlock.End)
+	for i, b := range blocks {
+		stats.Size += int64(b.End)
+		if b.Generation > stats.Generation {
+			stats.Generation = b.Generation
+		}
+
+		stats.BlockIndexes[i] = b.idx
+		if i == 0 || blocks[i-1].idx+1 != b.idx {
+			stats.Runs++
+		}
+
+		stored := b.End
+		if b.Flags&BlockFlagCompressed != 0 {
+			stored = b.Stored
+		}
+		stats.Wasted[i] = int(db.payloadCap()) - int(stored)
+	}
+
+	lastBlock := blocks[len(blocks)-1]
+	stats.Free = int(db.blockCap()) - int(lastBlock.End)
 
 	return stats
 }
@@ -54,6 +96,11 @@ func (o *Object) stats() ObjectStats {
 func (o *Object) Size() int64 {
 	o.m.Lock()
 	defer o.m.Unlock()
+	if o.meta != nil {
+		o.lockDB()
+		defer o.unlockDB()
+		return o.meta.Size
+	}
 
 	return o.size()
 }
@@ -70,28 +117,39 @@ func (o *Object) size() int64 {
 func (o *Object) Read(p []byte) (int, error) {
 	o.m.Lock()
 	defer o.m.Unlock()
-	o.db.m.Lock()
-	defer o.db.m.Unlock()
+	o.lockDB()
+	defer o.unlockDB()
+	if o.db.isClosed() {
+		return 0, ErrClosed
+	}
+	err := o.load()
+	if err != nil {
+		return 0, err
+	}
 
 	return o.read(p)
 }
 
 func (o *Object) read(p []byte) (int, error) {
+	if o.hole > 0 {
+		return 0, io.EOF
+	}
 	blockMeta := o.blocks[o.posBlockIdx]
 
 	if o.posBlockOff == blockMeta.End {
-		return 0, io.EOF
+		if blockMeta.Next == 0 {
+			return 0, io.EOF
+		}
+		o.posBlockIdx++
+		o.posBlockOff = 0
+		return o.read(p)
 	}
 
 	canRead := blockMeta.End - o.posBlockOff
 	if int(canRead) > len(p) {
 		canRead = uint32(len(p))
 	}
-	_, err := o.db.f.Seek(blockMeta.pos+int64(blockMeta.Size())+int64(o.posBlockOff), io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-	n, err := o.db.f.Read(p[:canRead])
+	n, err := o.db.readBlockAt(blockMeta, p[:canRead], o.posBlockOff)
 	if err != nil {
 		return n, err
 	}
@@ -112,47 +170,144 @@ func (o *Object) read(p []byte) (int, error) {
 }
 
 func (o *Object) Write(p []byte) (int, error) {
+	if o.db.ra != nil {
+		return 0, ErrReadOnly
+	}
 	o.m.Lock()
 	defer o.m.Unlock()
+	o.db.m.Lock()
+	if o.db.isClosed() {
+		o.db.m.Unlock()
+		return 0, ErrClosed
+	}
+	err := o.load()
+	if err != nil {
+		o.db.m.Unlock()
+		return 0, err
+	}
+	// Overwrites of compressed data can spill to new blocks, moving the
+	// tail of the chain like growing the object does.
+	if o.meta == nil || o.offset+int64(len(p)) <= o.meta.Size && o.db.meta.Flags&FlagCompressed == 0 {
+		defer o.db.m.Unlock()
+		err = o.fillHole()
+		if err != nil {
+			return 0, err
+		}
+		return o.write(p)
+	}
+
+	// The metadata is saved once the data is written.
+	err = o.db.beginUpdate()
+	if err != nil {
+		o.db.m.Unlock()
+		return 0, err
+	}
+	n := 0
+	err = o.fillHole()
+	if err == nil {
+		n, err = o.write(p)
+	}
+	changed := false
+	if o.offset > o.meta.Size {
+		o.meta.Size = o.offset
+		changed = true
+	}
+	if last := o.blocks[len(o.blocks)-1].idx; last != o.meta.LastBlock {
+		o.meta.LastBlock = last
+		changed = true
+	}
+	o.db.m.Unlock()
+	if changed {
+		serr := o.db.saveMeta(o.meta)
+		if err == nil {
+			err = serr
+		}
+	}
+
 	o.db.m.Lock()
 	defer o.db.m.Unlock()
 
-	return o.write(p)
+	return n, o.db.endUpdate(err)
+}
+
+// fillHole writes zeros over the gap left by seeking past the end of the
+// object, before writing at the new offset.
+func (o *Object) fillHole() error {
+	if o.hole == 0 {
+		return nil
+	}
+	hole := o.hole
+	o.hole = 0
+	o.offset -= hole
+
+	zeros := make([]byte, o.db.blockCap())
+	for hole > 0 {
+		n := len(zeros)
+		if int64(n) > hole {
+			n = int(hole)
+		}
+		_, err := o.write(zeros[:n])
+		if err != nil {
+			return err
+		}
+		hole -= int64(n)
+	}
+
+	return nil
+}
+
+// load reads the chain of blocks of objects opened lazily. db.m has to be
+// held.
+func (o *Object) load() error {
+	if o.blocks != nil {
+		return nil
+	}
+
+	blocks, err := o.db.blocks(o.meta.StartBlock)
+	if err != nil {
+		return err
+	}
+	o.blocks = blocks
+
+	return nil
 }
 
 func (o *Object) write(p []byte) (int, error) {
 	blockMeta := o.blocks[o.posBlockIdx]
 
-	canWrite := (o.db.meta.BlockSize - uint32(blockMeta.Size())) - o.posBlockOff
+	canWrite := o.blockLimit(blockMeta) - o.posBlockOff
 	if int(canWrite) > len(p) {
 		canWrite = uint32(len(p))
 	}
-	_, err := o.db.f.Seek(blockMeta.pos+int64(blockMeta.Size())+int64(o.posBlockOff), io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-	n, err := o.db.f.Write(p[:canWrite])
+	n, spill, err := o.db.writeBlockAt(blockMeta, p[:canWrite], o.posBlockOff)
+	o.offset += int64(n)
+	o.posBlockOff += uint32(n)
 	if err != nil {
 		return n, err
 	}
-
-	o.offset += int64(n)
-	o.posBlockOff += uint32(n)
-	if o.posBlockOff > blockMeta.End {
-		blockMeta.End = o.posBlockOff
-		err = blockMeta.WriteEnd(o.db.f)
+	if len(spill) > 0 {
+		err = o.db.beginUpdate()
+		if err != nil {
+			return n, err
+		}
+		err = o.db.endUpdate(o.insertAfter(o.posBlockIdx, spill))
 		if err != nil {
 			return n, err
 		}
+		_, err = o.seekFromStart(o.offset)
+		if err != nil {
+			return n, err
+		}
+		blockMeta = o.blocks[o.posBlockIdx]
 	}
 	p = p[n:]
 	if len(p) == 0 {
 		return n, nil
 	}
-	if o.posBlockOff == o.db.meta.BlockSize-uint32(blockMeta.Size()) {
+	if o.posBlockOff == o.blockLimit(blockMeta) {
 		if blockMeta.Next == 0 {
 			newBlocks := uint32(len(p) / int(o.db.meta.BlockSize))
-			if newBlocks == 0 {
+			if newBlocks == 0 || o.db.meta.Flags&FlagCompressed != 0 {
 				newBlocks = 1
 			}
 			err = o.alloc(newBlocks)
@@ -168,30 +323,83 @@ func (o *Object) write(p []byte) (int, error) {
 	return n + nnext, err
 }
 
+// blockLimit is the offset up to which a block can be written to. Blocks
+// holding data in the middle of the chain can be overwritten but not extended.
+func (o *Object) blockLimit(b *BlockMeta) uint32 {
+	if b.Next != 0 && b.End != 0 {
+		return b.End
+	}
+
+	return o.db.blockCap()
+}
+
+// insertAfter links a new block holding data after the block at idx.
+func (o *Object) insertAfter(idx int, data []byte) error {
+	prev := o.blocks[idx]
+
+	block, err := o.db.allocSingle()
+	if err != nil {
+		return err
+	}
+	block.Next = prev.Next
+	err = block.WriteNext(o.db.f)
+	if err != nil {
+		return err
+	}
+	prev.Next = block.idx
+	err = prev.WriteNext(o.db.f)
+	if err != nil {
+		return err
+	}
+
+	o.blocks = append(o.blocks[:idx+1], append([]*BlockMeta{block}, o.blocks[idx+1:]...)...)
+
+	_, spill, err := o.db.writeBlockAt(block, data, 0)
+	if err != nil {
+		return err
+	}
+	if len(spill) > 0 {
+		return o.insertAfter(idx+1, spill)
+	}
+
+	return nil
+}
+
 func (o *Object) alloc(n uint32) error {
+	err := o.db.beginUpdate()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	first := len(o.blocks)
+	err = o.allocBlocks(n)
+	if err != nil {
+		o.db.trace(TraceAlloc, 0, int64(n), start, err)
+		return o.db.endUpdate(err)
+	}
+	o.db.trace(TraceAlloc, o.blocks[first].idx, int64(n), start, nil)
+
+	return o.db.endUpdate(nil)
+}
+
+func (o *Object) allocBlocks(n uint32) error {
 	newFreeBlocks := make([]*BlockMeta, 0, n)
 	next := o.db.meta.FirstFreeBlock
 	for n > 0 && next != 0 {
 		// Use free blocks
-		newBlockMeta := &BlockMeta{
-			pos: o.db.sizeMeta + int64(next)*int64(o.db.meta.BlockSize),
-			idx: next,
-		}
-		_, err := o.db.f.Seek(newBlockMeta.pos, io.SeekStart)
-		if err != nil {
-			return err
-		}
-		_, err = newBlockMeta.ReadFrom(o.db.f)
-		if err != nil {
-			return err
-		}
+		newBlockMeta := o.db.freeBlocks[next]
+		delete(o.db.freeBlocks, next)
 		next = newBlockMeta.Next
-		newFreeBlocks = append(newFreeBlocks, newBlockMeta)
+		newFreeBlocks = append(newFreeBlocks, &newBlockMeta)
 		n--
 	}
 	if len(newFreeBlocks) > 0 {
 		o.db.meta.FirstFreeBlock = next
-		err := o.db.meta.WriteFirstFreeBlock(o.db.f)
+		if next == 0 {
+			o.db.freeTail = 0
+		}
+		err := o.db.writeFirstFreeBlock()
 		if err != nil {
 			return err
 		}
@@ -238,6 +446,15 @@ func (o *Object) alloc(n uint32) error {
 func (o *Object) Seek(offset int64, whence int) (int64, error) {
 	o.m.Lock()
 	defer o.m.Unlock()
+	o.lockDB()
+	err := ErrClosed
+	if !o.db.isClosed() {
+		err = o.load()
+	}
+	o.unlockDB()
+	if err != nil {
+		return 0, err
+	}
 
 	return o.seek(offset, whence)
 }
@@ -259,6 +476,7 @@ func (o *Object) seekFromStart(offset int64) (int64, error) {
 	o.offset = 0
 	o.posBlockIdx = 0
 	o.posBlockOff = 0
+	o.hole = 0
 
 	return o.seekFromRelative(offset)
 }
@@ -271,6 +489,7 @@ func (o *Object) seekFromEnd(offset int64) (int64, error) {
 	o.offset = size
 	o.posBlockIdx = len(o.blocks) - 1
 	o.posBlockOff = o.blocks[o.posBlockIdx].End
+	o.hole = 0
 
 	return o.seekFromRelativeBack(offset)
 }
@@ -286,7 +505,15 @@ func (o *Object) seekFromRelative(offset int64) (int64, error) {
 		return o.offset, nil
 	}
 	if o.posBlockOff == blockMeta.End {
-		return 0, io.EOF
+		if blockMeta.Next != 0 {
+			// seeking back can stop at the end of a block in the middle
+			o.posBlockIdx++
+			o.posBlockOff = 0
+			return o.seekFromRelative(offset)
+		}
+		o.hole += offset
+		o.offset += offset
+		return o.offset, nil
 	}
 
 	canRead := blockMeta.End - o.posBlockOff
@@ -312,6 +539,15 @@ func (o *Object) seekFromRelativeBack(offset int64) (int64, error) {
 	if offset == 0 {
 		return o.offset, nil
 	}
+	if o.hole > 0 {
+		back := o.hole
+		if back > offset {
+			back = offset
+		}
+		o.hole -= back
+		o.offset -= back
+		return o.seekFromRelativeBack(offset - back)
+	}
 	if o.posBlockOff == 0 && o.posBlockIdx == 0 {
 		return 0, io.EOF
 	}
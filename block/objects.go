@@ -2,16 +2,19 @@ package block
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"sync"
+
+	"github.com/yazgazan/kvstore/container"
 )
 
 func (db *BlockDB) Objects() []ObjectMeta {
-	db.m.Lock()
-	defer db.m.Unlock()
+	db.objectsM.RLock()
+	defer db.objectsM.RUnlock()
 
-	oo := make([]ObjectMeta, len(db.objects))
+	oo := make([]ObjectMeta, 0, len(db.objects))
 	for _, o := range db.objects {
 		oo = append(oo, *o)
 	}
@@ -19,144 +22,323 @@ func (db *BlockDB) Objects() []ObjectMeta {
 	return oo
 }
 
-func (db *BlockDB) Create(name string) (*Object, error) {
+func (db *BlockDB) lookup(name string) (*ObjectMeta, bool) {
+	db.objectsM.RLock()
+	defer db.objectsM.RUnlock()
+
 	meta, ok := db.objects[name]
-	if ok {
-		db.m.Lock()
-		defer db.m.Unlock()
-		blockMeta := &BlockMeta{
-			pos: db.sizeMeta + int64(meta.StartBlock)*int64(db.meta.BlockSize),
-			idx: meta.StartBlock,
-		}
-		_, err := db.f.Seek(blockMeta.pos, io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-		_, err = blockMeta.ReadFrom(db.f)
-		if err != nil {
-			return nil, err
-		}
-		next := blockMeta.Next
-		blockMeta.Next = 0
-		blockMeta.End = 0
-		_, err = db.f.Seek(blockMeta.pos, io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
-		_, err = blockMeta.WriteTo(db.f)
-		if err != nil {
-			return nil, err
-		}
-		if next != 0 {
-			err = db.free(next)
-			if err != nil {
-				return nil, err
-			}
-		}
 
-		return &Object{
-			db:     db,
-			m:      &sync.Mutex{},
-			blocks: []*BlockMeta{blockMeta},
-		}, nil
+	return meta, ok
+}
+
+// Create holds the index lock for the whole creation, but the allocator lock
+// only while allocating the first block, so that objects can be opened, read
+// and written to concurrently.
+func (db *BlockDB) Create(name string) (*Object, error) {
+	if db.ra != nil {
+		return nil, ErrReadOnly
+	}
+	db.indexM.Lock()
+	meta, ok := db.lookup(name)
+	if ok {
+		db.indexM.Unlock()
+		return db.reset(meta)
 	}
+	defer db.indexM.Unlock()
 
 	db.m.Lock()
+	if db.isClosed() {
+		db.m.Unlock()
+		return nil, ErrClosed
+	}
+	err := db.beginUpdate()
+	if err != nil {
+		db.m.Unlock()
+		return nil, err
+	}
 	block, err := db.allocSingle()
 	if err != nil {
+		err = db.endUpdate(err)
 		db.m.Unlock()
 		return nil, err
 	}
+	db.m.Unlock()
 
 	meta = &ObjectMeta{
 		Name:       name,
 		StartBlock: block.idx,
+		LastBlock:  block.idx,
 	}
 
 	b, err := json.Marshal(meta)
+	if err == nil {
+		meta.chunk, err = db.allocMeta(b)
+	}
+
+	db.m.Lock()
+	defer db.m.Unlock()
+	if err != nil {
+		return nil, db.endUpdate(err)
+	}
+
+	db.objectsM.Lock()
+	db.objects[name] = meta
+	db.addName(name)
+	db.objectsM.Unlock()
+
+	err = db.endUpdate(nil)
 	if err != nil {
-		db.m.Unlock()
 		return nil, err
 	}
 
-	db.m.Unlock()
-	chunk, err := db.index.AllocAndWrite(b)
+	return &Object{
+		db:   db,
+		meta: meta,
+
+		m:      &sync.Mutex{},
+		blocks: []*BlockMeta{block},
+	}, nil
+}
+
+func (db *BlockDB) reset(meta *ObjectMeta) (*Object, error) {
+	db.m.Lock()
+	if db.isClosed() {
+		db.m.Unlock()
+		return nil, ErrClosed
+	}
+	err := db.beginUpdate()
 	if err != nil {
+		db.m.Unlock()
 		return nil, err
 	}
+	blockMeta, err := db.truncate(meta)
+	if err == nil {
+		meta.Size = 0
+		meta.LastBlock = meta.StartBlock
+	}
+	db.m.Unlock()
+	if err == nil {
+		err = db.saveMeta(meta)
+	}
 
 	db.m.Lock()
 	defer db.m.Unlock()
-
-	meta.chunk = chunk
-
-	db.objects[name] = meta
+	err = db.endUpdate(err)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Object{
-		db: db,
-
+		db:     db,
+		meta:   meta,
 		m:      &sync.Mutex{},
-		blocks: []*BlockMeta{block},
+		blocks: []*BlockMeta{blockMeta},
 	}, nil
 }
 
-func (db *BlockDB) Delete(name string) error {
+// metaSlack is left free in index chunks, so that the metadata of an object
+// can grow a little without moving to a new chunk.
+const metaSlack = 32
+
+func (db *BlockDB) allocMeta(b []byte) (*container.Chunk, error) {
+	chunk, err := db.index.Alloc(uint32(len(b)) + metaSlack)
+	if err != nil {
+		return nil, err
+	}
+	_, err = chunk.Write(b)
+	if err != nil {
+		_ = chunk.Free()
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// saveMeta writes the metadata of an object back to the index, moving it to a
+// bigger chunk when needed. db.m must not be held.
+func (db *BlockDB) saveMeta(meta *ObjectMeta) error {
+	db.indexM.Lock()
+	defer db.indexM.Unlock()
+
+	current, ok := db.lookup(meta.Name)
+	if !ok || current != meta {
+		// deleted in the meantime
+		return nil
+	}
+
 	db.m.Lock()
+	b, err := json.Marshal(meta)
+	db.m.Unlock()
+	if err != nil {
+		return err
+	}
 
-	meta, ok := db.objects[name]
-	if !ok {
-		db.m.Unlock()
-		return os.ErrNotExist
+	if len(b) <= int(meta.chunk.Cap()) {
+		_, err = meta.chunk.Write(b)
+		return err
 	}
 
-	blockMeta := BlockMeta{
-		pos: db.sizeMeta + int64(meta.StartBlock)*int64(db.meta.BlockSize),
-		idx: meta.StartBlock,
+	chunk, err := db.allocMeta(b)
+	if err != nil {
+		return err
 	}
-	_, err := db.f.Seek(blockMeta.pos, io.SeekStart)
+	err = meta.chunk.Free()
 	if err != nil {
-		db.m.Unlock()
 		return err
 	}
+	meta.chunk = chunk
+
+	return nil
+}
+
+// truncate empties the first block of an object and frees the rest of its
+// chain.
+func (db *BlockDB) truncate(meta *ObjectMeta) (*BlockMeta, error) {
+	blockMeta := db.newBlockMeta(meta.StartBlock)
+	_, err := db.f.Seek(blockMeta.pos, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
 	_, err = blockMeta.ReadFrom(db.f)
 	if err != nil {
-		db.m.Unlock()
-		return err
+		return nil, err
+	}
+	next := blockMeta.Next
+	blockMeta.Next = 0
+	blockMeta.End = 0
+	blockMeta.Flags = 0
+	blockMeta.Stored = 0
+	db.stamp(blockMeta)
+	_, err = db.f.Seek(blockMeta.pos, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	_, err = blockMeta.WriteTo(db.f)
+	if err != nil {
+		return nil, err
+	}
+	if next != 0 {
+		err = db.free(next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return blockMeta, nil
+}
+
+func (db *BlockDB) Delete(name string) error {
+	if db.ra != nil {
+		return ErrReadOnly
+	}
+	db.indexM.Lock()
+	defer db.indexM.Unlock()
+
+	meta, ok := db.lookup(name)
+	if !ok {
+		return os.ErrNotExist
 	}
 
+	db.m.Lock()
+	if db.isClosed() {
+		db.m.Unlock()
+		return ErrClosed
+	}
+	err := db.beginUpdate()
 	db.m.Unlock()
-	err = meta.chunk.Free()
 	if err != nil {
 		return err
 	}
+
+	err = meta.chunk.Free()
+
 	db.m.Lock()
+	defer db.m.Unlock()
+	if err != nil {
+		return db.endUpdate(err)
+	}
 
+	db.objectsM.Lock()
 	delete(db.objects, name)
+	db.removeName(name)
+	db.objectsM.Unlock()
 
-	err = db.free(blockMeta.idx)
-	db.m.Unlock()
-
-	return err
+	return db.endUpdate(db.free(meta.StartBlock))
 }
 
 func (db *BlockDB) Open(name string) (*Object, error) {
+	meta, ok := db.lookup(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
 	db.m.Lock()
 	defer db.m.Unlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
 
-	meta, ok := db.objects[name]
+	return &Object{
+		db:   db,
+		meta: meta,
+
+		m: &sync.Mutex{},
+	}, nil
+}
+
+// Appender writes at the end of an object. Only the tail block of the object
+// is loaded, so opening one is O(1) whatever the object size.
+type Appender struct {
+	o *Object
+}
+
+func (db *BlockDB) OpenAppend(name string) (*Appender, error) {
+	if db.ra != nil {
+		return nil, ErrReadOnly
+	}
+	meta, ok := db.lookup(name)
 	if !ok {
 		return nil, os.ErrNotExist
 	}
 
-	blocks, err := db.blocks(meta.StartBlock)
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+
+	tail, err := db.readHeader(meta.LastBlock)
 	if err != nil {
 		return nil, err
 	}
+	// LastBlock lags behind the chain when saving it was interrupted
+	for n := uint32(0); tail.Next != 0; n++ {
+		if n == db.meta.BlockCount {
+			return nil, fmt.Errorf("chain of %q loops after block %d", name, meta.LastBlock)
+		}
+		tail, err = db.readHeader(tail.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &Object{
-		db: db,
+	return &Appender{
+		o: &Object{
+			db:   db,
+			meta: meta,
 
-		m:      &sync.Mutex{},
-		blocks: blocks,
+			m:           &sync.Mutex{},
+			blocks:      []*BlockMeta{tail},
+			offset:      meta.Size,
+			posBlockOff: tail.End,
+		},
 	}, nil
 }
+
+func (a *Appender) Write(p []byte) (int, error) {
+	return a.o.Write(p)
+}
+
+func (a *Appender) Size() int64 {
+	return a.o.Size()
+}
@@ -0,0 +1,70 @@
+package block
+
+type config struct {
+	blockSize uint32
+	key       []byte
+	compress  bool
+	tracer    Tracer
+	sync      bool
+	maxBlocks uint32
+	version   uint32
+}
+
+type Option func(c *config)
+
+func WithBlockSize(blockSize uint32) Option {
+	return func(c *config) {
+		c.blockSize = blockSize
+	}
+}
+
+// WithVersion makes Create write the DB in an older format version, for the
+// files to be read by older versions of the package. Version 1 DBs can't be
+// encrypted nor compressed.
+func WithVersion(version uint32) Option {
+	return func(c *config) {
+		c.version = version
+	}
+}
+
+// WithCipher encrypts block payloads with AES-GCM. The key must be 16, 24 or
+// 32 bytes long, and the same key has to be provided to Open.
+func WithCipher(key []byte) Option {
+	return func(c *config) {
+		c.key = key
+	}
+}
+
+// WithCompression stores block payloads deflated whenever it saves space.
+// Compressed blocks can hold more than BlockSize bytes of object data.
+func WithCompression() Option {
+	return func(c *config) {
+		c.compress = true
+	}
+}
+
+// WithTracer reports file I/O and allocator events to t.
+func WithTracer(t Tracer) Option {
+	return func(c *config) {
+		c.tracer = t
+	}
+}
+
+// WithSync syncs the file around allocator metadata updates, so they are
+// never reordered with the payload writes they depend on. The file has to
+// implement Sync() error, like *os.File does. Opening the file with O_DSYNC
+// gives the same guarantees for every write.
+func WithSync() Option {
+	return func(c *config) {
+		c.sync = true
+	}
+}
+
+// WithMaxBlocks caps the number of blocks in the DB, growing past it fails
+// with a *QuotaError. The limit isn't stored in the file and has to be given
+// to Open too.
+func WithMaxBlocks(n uint32) Option {
+	return func(c *config) {
+		c.maxBlocks = n
+	}
+}
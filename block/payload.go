@@ -0,0 +1,317 @@
+package block
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	keyCheckSize = 12 + 16 // GCM nonce + tag
+
+	maxCompressionRatio = 4
+	minCompressionGain  = 8 // compress only when saving at least 1/8th
+)
+
+var (
+	ErrKeyRequired  = errors.New("database is encrypted, a key is required")
+	ErrNotEncrypted = errors.New("database is not encrypted")
+	ErrInvalidKey   = errors.New("invalid key")
+	ErrAuthFailed   = errors.New("block payload failed authentication")
+)
+
+var keyCheckData = []byte("kvstore key check")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, nil
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+func sealKeyCheck(aead cipher.AEAD) (check [keyCheckSize]byte, err error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return check, err
+	}
+
+	copy(check[:], aead.Seal(nonce, nonce, nil, keyCheckData))
+
+	return check, nil
+}
+
+func openKeyCheck(aead cipher.AEAD, check [keyCheckSize]byte) error {
+	nonceSize := aead.NonceSize()
+
+	_, err := aead.Open(nil, check[:nonceSize], check[nonceSize:], keyCheckData)
+	if err != nil {
+		return ErrInvalidKey
+	}
+
+	return nil
+}
+
+func blockAD(idx uint32) []byte {
+	ad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ad, idx)
+
+	return ad
+}
+
+// payloadCap is the number of bytes that fit in a block once encoded.
+func (db *BlockDB) payloadCap() uint32 {
+	c := db.meta.BlockSize - uint32(db.blockMetaSize())
+	if db.aead != nil {
+		c -= uint32(db.aead.NonceSize() + db.aead.Overhead())
+	}
+
+	return c
+}
+
+// blockCap is the number of object bytes a block can hold. Compression lets a
+// block hold more than its payload capacity, as long as the data shrinks
+// enough to fit.
+func (db *BlockDB) blockCap() uint32 {
+	if db.meta.Flags&FlagCompressed != 0 {
+		return db.payloadCap() * maxCompressionRatio
+	}
+
+	return db.payloadCap()
+}
+
+// encoded reports whether block payloads have to be read and written whole.
+func (db *BlockDB) encoded() bool {
+	return db.aead != nil || db.meta.Flags&FlagCompressed != 0
+}
+
+func (db *BlockDB) payloadPos(b *BlockMeta) int64 {
+	return b.pos + int64(b.Size())
+}
+
+func (db *BlockDB) readPayload(b *BlockMeta) ([]byte, error) {
+	if b.End == 0 {
+		return []byte{}, nil
+	}
+
+	size := int(b.End)
+	if b.Flags&BlockFlagCompressed != 0 {
+		size = int(b.Stored)
+	}
+	if db.aead != nil {
+		size += db.aead.NonceSize() + db.aead.Overhead()
+	}
+
+	r, err := db.readerAt(db.payloadPos(b))
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, size)
+	_, err = io.ReadFull(r, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.aead != nil {
+		nonce, sealed := p[:db.aead.NonceSize()], p[db.aead.NonceSize():]
+		p, err = db.aead.Open(sealed[:0], nonce, sealed, blockAD(b.idx))
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", b.idx, ErrAuthFailed)
+		}
+	}
+	if b.Flags&BlockFlagCompressed != 0 {
+		p, err = inflate(p, b.End)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: decompressing payload: %w", b.idx, err)
+		}
+	}
+
+	return p, nil
+}
+
+// writePayload stores p as the whole payload of b and updates its header.
+// Only the first n bytes are stored when p cannot be encoded to fit the block.
+func (db *BlockDB) writePayload(b *BlockMeta, p []byte) (n int, err error) {
+	stored, compressed, n := db.encodePayload(p)
+
+	if db.aead != nil {
+		nonce := make([]byte, db.aead.NonceSize(), db.aead.NonceSize()+len(stored)+db.aead.Overhead())
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return 0, err
+		}
+		stored = db.aead.Seal(nonce, nonce, stored, blockAD(b.idx))
+	}
+
+	_, err = db.f.Seek(db.payloadPos(b), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.f.Write(stored)
+	if err != nil {
+		return 0, err
+	}
+
+	b.End = uint32(n)
+	b.Flags &^= BlockFlagCompressed
+	b.Stored = 0
+	if compressed {
+		b.Flags |= BlockFlagCompressed
+		b.Stored = uint32(len(stored))
+		if db.aead != nil {
+			b.Stored -= uint32(db.aead.NonceSize() + db.aead.Overhead())
+		}
+	}
+	db.stamp(b)
+	_, err = db.f.Seek(b.pos, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	_, err = b.WriteTo(db.f)
+
+	return n, err
+}
+
+func (db *BlockDB) encodePayload(p []byte) (stored []byte, compressed bool, n int) {
+	payloadCap := int(db.payloadCap())
+	if db.meta.Flags&FlagCompressed == 0 {
+		return p, false, len(p)
+	}
+
+	c := deflate(p)
+	if len(c) <= payloadCap && len(c) < len(p)-len(p)/minCompressionGain {
+		return c, true, len(p)
+	}
+	if len(p) <= payloadCap {
+		return p, false, len(p)
+	}
+
+	// p doesn't fit, estimate how much of it would from the compression ratio
+	n = len(p) * payloadCap / len(c)
+	n -= n / 8
+	if n > payloadCap {
+		c = deflate(p[:n])
+		if len(c) <= payloadCap {
+			return c, true, n
+		}
+	}
+
+	return p[:payloadCap], false, payloadCap
+}
+
+func (db *BlockDB) readBlockAt(b *BlockMeta, p []byte, off uint32) (int, error) {
+	if db.aead == nil && b.Flags&BlockFlagCompressed == 0 {
+		r, err := db.readerAt(db.payloadPos(b) + int64(off))
+		if err != nil {
+			return 0, err
+		}
+
+		return r.Read(p)
+	}
+
+	payload, err := db.readPayload(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(p, payload[off:]), nil
+}
+
+// writeBlockAt writes p at off in the block. When the block can't hold the
+// resulting payload, the bytes that didn't fit are returned in spill and have
+// to be stored in a new block following b.
+func (db *BlockDB) writeBlockAt(b *BlockMeta, p []byte, off uint32) (n int, spill []byte, err error) {
+	if db.encoded() {
+		return db.writeEncodedAt(b, p, off)
+	}
+
+	_, err = db.f.Seek(db.payloadPos(b)+int64(off), io.SeekStart)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err = db.f.Write(p)
+	if err != nil {
+		return n, nil, err
+	}
+
+	end := off + uint32(n)
+	if end <= b.End {
+		return n, nil, nil
+	}
+	b.End = end
+	if b.legacy {
+		return n, nil, b.WriteEnd(db.f)
+	}
+	// the header is rewritten whole, in the same single write, to stamp it
+	db.stamp(b)
+	_, err = db.f.Seek(b.pos, io.SeekStart)
+	if err != nil {
+		return n, nil, err
+	}
+	_, err = b.WriteTo(db.f)
+
+	return n, nil, err
+}
+
+func (db *BlockDB) writeEncodedAt(b *BlockMeta, p []byte, off uint32) (n int, spill []byte, err error) {
+	payload, err := db.readPayload(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if end := int(off) + len(p); end > len(payload) {
+		payload = append(payload, make([]byte, end-len(payload))...)
+	}
+	copy(payload[off:], p)
+
+	end := b.End
+	stored, err := db.writePayload(b, payload)
+	if err != nil {
+		b.End = end
+		return 0, nil, err
+	}
+
+	return len(p), payload[stored:], nil
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+func deflate(p []byte) []byte {
+	var buf bytes.Buffer
+
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+
+	_, _ = w.Write(p)
+	_ = w.Close()
+
+	return buf.Bytes()
+}
+
+func inflate(p []byte, size uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+
+	return b, err
+}
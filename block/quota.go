@@ -0,0 +1,36 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrQuotaExceeded = errors.New("block quota exceeded")
+
+// QuotaError is returned when growing the DB would take it past the limit set
+// with WithMaxBlocks. It matches ErrQuotaExceeded with errors.Is.
+type QuotaError struct {
+	MaxBlocks  uint32
+	BlockCount uint32
+	Requested  uint32
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("growing by %d blocks would exceed the limit of %d blocks (currently %d)", e.Requested, e.MaxBlocks, e.BlockCount)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+func (db *BlockDB) checkQuota(n uint32) error {
+	if db.maxBlocks == 0 || uint64(db.meta.BlockCount)+uint64(n) <= uint64(db.maxBlocks) {
+		return nil
+	}
+
+	return &QuotaError{
+		MaxBlocks:  db.maxBlocks,
+		BlockCount: db.meta.BlockCount,
+		Requested:  n,
+	}
+}
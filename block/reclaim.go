@@ -0,0 +1,116 @@
+package block
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Reclaim returns to the free list the blocks that are neither free nor in
+// the chain of the index or of an object, like the ones an interrupted update
+// leaves in version 1 DBs, which Open doesn't recover. It returns the number
+// of blocks freed, and an error without freeing any when a chain is broken or
+// shares blocks with another, as reported by Scrub.
+func (db *BlockDB) Reclaim() (int, error) {
+	if db.ra != nil {
+		return 0, ErrReadOnly
+	}
+	db.indexM.Lock()
+	defer db.indexM.Unlock()
+
+	db.objectsM.RLock()
+	names := make([]string, 0, len(db.objects))
+	starts := make(map[string]uint32, len(db.objects))
+	for name, meta := range db.objects {
+		names = append(names, name)
+		starts[name] = meta.StartBlock
+	}
+	db.objectsM.RUnlock()
+	sort.Strings(names)
+
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.isClosed() {
+		return 0, ErrClosed
+	}
+
+	owned := map[uint32]struct{}{}
+	err := db.ownChain(0, owned)
+	if err != nil {
+		return 0, fmt.Errorf("index: %w", err)
+	}
+	for _, name := range names {
+		err = db.ownChain(starts[name], owned)
+		if err != nil {
+			return 0, fmt.Errorf("object %q: %w", name, err)
+		}
+	}
+
+	var leaked []uint32
+	for idx := db.meta.BlockCount - 1; idx > 0; idx-- {
+		_, ok := owned[idx]
+		_, free := db.freeBlocks[idx]
+		if !ok && !free {
+			leaked = append(leaked, idx)
+		}
+	}
+	if len(leaked) == 0 {
+		return 0, nil
+	}
+
+	err = db.beginUpdate()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, idx := range leaked {
+		err = db.reclaimBlock(idx)
+		if err != nil {
+			break
+		}
+		n++
+	}
+
+	return n, db.endUpdate(err)
+}
+
+// ownChain adds the blocks of the chain starting at start to owned. db.m has
+// to be held.
+func (db *BlockDB) ownChain(start uint32, owned map[uint32]struct{}) error {
+	next := start
+	for {
+		if next >= db.meta.BlockCount {
+			return fmt.Errorf("block %d is past the last block %d", next, db.meta.BlockCount-1)
+		}
+		if _, ok := owned[next]; ok {
+			return fmt.Errorf("block %d is used twice", next)
+		}
+		if _, ok := db.freeBlocks[next]; ok {
+			return fmt.Errorf("block %d is also free", next)
+		}
+		owned[next] = struct{}{}
+
+		b, err := db.readHeader(next)
+		if err != nil {
+			return err
+		}
+		if b.Next == 0 {
+			return nil
+		}
+		next = b.Next
+	}
+}
+
+// reclaimBlock cuts block idx from whatever it points to and frees it.
+func (db *BlockDB) reclaimBlock(idx uint32) error {
+	meta, err := db.readHeader(idx)
+	if err != nil {
+		return err
+	}
+	meta.Next = 0
+	err = meta.WriteNext(db.f)
+	if err != nil {
+		return err
+	}
+
+	return db.free(idx)
+}
@@ -0,0 +1,196 @@
+package block
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+type RecoveryStats struct {
+	Recovered      bool     // Open found the DB dirty and rebuilt the allocator
+	CutChains      int      // chains cut at a block out of range or owned twice
+	DroppedObjects []string // objects whose first block was unusable
+	FreeBlocks     uint32   // blocks in the rebuilt free list
+}
+
+// beginUpdate marks the DB dirty on disk before the allocator state is
+// modified, so that an interrupted update is detected by the next Open.
+// Updates can nest, and db.m has to be held.
+func (db *BlockDB) beginUpdate() error {
+	err := db.touch()
+	if err != nil {
+		return err
+	}
+	if db.updates == 0 && db.meta.Version != 1 && db.meta.Flags&FlagDirty == 0 {
+		db.meta.Flags |= FlagDirty
+		err = db.writeFlags()
+		if err != nil {
+			db.damaged = true
+			return err
+		}
+	}
+	db.updates++
+
+	return nil
+}
+
+// endUpdate clears the dirty flag once the outermost update completes. A
+// failed update leaves the flag set until the DB is recovered, unless it was
+// refused by the quota before touching the allocator state.
+func (db *BlockDB) endUpdate(err error) error {
+	db.updates--
+	if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+		db.damaged = true
+		return err
+	}
+	if db.updates > 0 || db.damaged || db.meta.Flags&FlagDirty == 0 {
+		return err
+	}
+
+	db.meta.Flags &^= FlagDirty
+	werr := db.writeFlags()
+	if err == nil {
+		err = werr
+	}
+
+	return err
+}
+
+// recoverChain loads the chain starting at start, cutting it before the first
+// block that is out of range or already owned by another chain.
+func (db *BlockDB) recoverChain(start uint32, owned map[uint32]struct{}) ([]*BlockMeta, error) {
+	var bb []*BlockMeta
+
+	next := start
+	for {
+		block := db.newBlockMeta(next)
+		_, err := db.f.Seek(block.pos, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		_, err = block.ReadFrom(db.f)
+		if err != nil {
+			return nil, err
+		}
+		owned[next] = struct{}{}
+		bb = append(bb, block)
+
+		next = block.Next
+		if next == 0 {
+			return bb, nil
+		}
+		if _, ok := owned[next]; ok || next >= db.meta.BlockCount {
+			block.Next = 0
+			err = block.WriteNext(db.f)
+			if err != nil {
+				return nil, err
+			}
+			db.recovery.CutChains++
+			return bb, nil
+		}
+	}
+}
+
+// recover rebuilds the allocator state of a dirty DB from the blocks reachable
+// from the index; everything else goes back to the free list. owned holds the
+// blocks of the index object, stale the outdated copies of object metadata.
+func (db *BlockDB) recover(owned map[uint32]struct{}, stale []*ObjectMeta) error {
+	// keeps index writes from clearing the dirty flag until we are done
+	db.updates++
+	defer func() {
+		db.updates--
+	}()
+
+	for _, meta := range stale {
+		err := meta.chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(db.objects))
+	for name := range db.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		meta := db.objects[name]
+		_, ok := owned[meta.StartBlock]
+		if ok || meta.StartBlock == 0 || meta.StartBlock >= db.meta.BlockCount {
+			err := meta.chunk.Free()
+			if err != nil {
+				return err
+			}
+			delete(db.objects, name)
+			db.recovery.DroppedObjects = append(db.recovery.DroppedObjects, name)
+			continue
+		}
+
+		blocks, err := db.recoverChain(meta.StartBlock, owned)
+		if err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			db.resume(b)
+		}
+		size, last := chainSize(blocks)
+		if size != meta.Size || last != meta.LastBlock {
+			meta.Size, meta.LastBlock = size, last
+			err = db.saveMeta(meta)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	db.freeBlocks = map[uint32]BlockMeta{}
+	db.freeTail = 0
+	next := uint32(0)
+	for idx := db.meta.BlockCount - 1; idx > 0; idx-- {
+		if _, ok := owned[idx]; ok {
+			continue
+		}
+
+		meta := db.newBlockMeta(idx)
+		_, err := db.f.Seek(meta.pos, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = meta.ReadFrom(db.f)
+		if err != nil {
+			return err
+		}
+		db.resume(meta)
+		meta.Next = next
+		meta.End = 0
+		meta.Flags = 0
+		meta.Stored = 0
+		_, err = db.f.Seek(meta.pos, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = meta.WriteTo(db.f)
+		if err != nil {
+			return err
+		}
+
+		db.freeBlocks[idx] = *meta
+		if db.freeTail == 0 {
+			db.freeTail = idx
+		}
+		next = idx
+	}
+
+	db.meta.FirstFreeBlock = next
+	err := db.writeFirstFreeBlock()
+	if err != nil {
+		return err
+	}
+
+	db.recovery.Recovered = true
+	db.recovery.FreeBlocks = uint32(len(db.freeBlocks))
+	db.meta.Flags &^= FlagDirty
+
+	return db.writeFlags()
+}
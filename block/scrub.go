@@ -0,0 +1,212 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type ScrubProblem struct {
+	Block  uint32
+	Object string // empty for the index object and free blocks
+	Free   bool
+	Err    error
+}
+
+func (p ScrubProblem) Error() string {
+	switch {
+	case p.Free:
+		return fmt.Sprintf("free block %d: %v", p.Block, p.Err)
+	case p.Object == "":
+		return fmt.Sprintf("index block %d: %v", p.Block, p.Err)
+	default:
+		return fmt.Sprintf("block %d of %q: %v", p.Block, p.Object, p.Err)
+	}
+}
+
+func (p ScrubProblem) Unwrap() error {
+	return p.Err
+}
+
+// Scrub walks the index, every object and the free list, checking block
+// headers, chain consistency and, for encrypted or compressed DBs, that
+// payloads can be decoded. Problems are passed to report as they are found.
+// At most ratePerSec blocks are checked per second (no limit when <= 0), and
+// the DB is only locked while checking a block, so Scrub can run in the
+// background. Objects are held with a shared LockObject while being walked.
+func (db *BlockDB) Scrub(ctx context.Context, ratePerSec int, report func(ScrubProblem)) error {
+	s := &scrubber{
+		db:     db,
+		ctx:    ctx,
+		report: report,
+		owners: map[uint32]string{},
+	}
+	if ratePerSec > 0 {
+		s.interval = time.Second / time.Duration(ratePerSec)
+	}
+
+	db.objectsM.RLock()
+	objects := make(map[string]uint32, len(db.objects))
+	for name, meta := range db.objects {
+		objects[name] = meta.StartBlock
+	}
+	db.objectsM.RUnlock()
+
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err := s.chain("", 0)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		unlock := db.LockObject(name, true)
+		err = s.chain(name, objects[name])
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.free()
+}
+
+type scrubber struct {
+	db       *BlockDB
+	ctx      context.Context
+	report   func(ScrubProblem)
+	interval time.Duration
+	owners   map[uint32]string
+}
+
+func (s *scrubber) wait() error {
+	if s.interval == 0 {
+		return s.ctx.Err()
+	}
+
+	t := time.NewTimer(s.interval)
+	defer t.Stop()
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (s *scrubber) chain(name string, start uint32) error {
+	seen := map[uint32]struct{}{}
+
+	next := start
+	for {
+		err := s.wait()
+		if err != nil {
+			return err
+		}
+
+		b, err := s.db.scrubBlock(next, false)
+		if err != nil {
+			if errors.Is(err, ErrClosed) {
+				return err
+			}
+			s.report(ScrubProblem{Block: next, Object: name, Err: err})
+			return nil
+		}
+		seen[next] = struct{}{}
+		if owner, ok := s.owners[next]; ok {
+			s.report(ScrubProblem{Block: next, Object: name, Err: fmt.Errorf("block also used by %q", owner)})
+		}
+		s.owners[next] = name
+
+		if b.Next == 0 {
+			return nil
+		}
+		if _, ok := seen[b.Next]; ok {
+			s.report(ScrubProblem{Block: next, Object: name, Err: fmt.Errorf("chain loops back to block %d", b.Next)})
+			return nil
+		}
+		next = b.Next
+	}
+}
+
+func (s *scrubber) free() error {
+	s.db.m.Lock()
+	free := make([]uint32, 0, len(s.db.freeBlocks))
+	for idx := range s.db.freeBlocks {
+		free = append(free, idx)
+	}
+	s.db.m.Unlock()
+	sort.Slice(free, func(i, j int) bool {
+		return free[i] < free[j]
+	})
+
+	for _, idx := range free {
+		err := s.wait()
+		if err != nil {
+			return err
+		}
+
+		_, err = s.db.scrubBlock(idx, true)
+		if errors.Is(err, ErrClosed) {
+			return err
+		}
+		if err != nil {
+			s.report(ScrubProblem{Block: idx, Free: true, Err: err})
+			continue
+		}
+		if owner, ok := s.owners[idx]; ok {
+			s.report(ScrubProblem{Block: idx, Free: true, Err: fmt.Errorf("block also used by %q", owner)})
+		}
+	}
+
+	return nil
+}
+
+// scrubBlock checks the header and payload of block idx. Free blocks that got
+// allocated since the free list was listed are skipped.
+func (db *BlockDB) scrubBlock(idx uint32, free bool) (*BlockMeta, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	if idx >= db.meta.BlockCount {
+		return nil, fmt.Errorf("block is past the last block %d", db.meta.BlockCount-1)
+	}
+	if _, ok := db.freeBlocks[idx]; free && !ok {
+		return nil, nil
+	}
+
+	b, err := db.readHeader(idx)
+	if err != nil {
+		return nil, err
+	}
+	if b.Next >= db.meta.BlockCount {
+		return b, fmt.Errorf("next pointer %d is past the last block", b.Next)
+	}
+	if free {
+		if b.End != 0 {
+			return b, fmt.Errorf("free block holds %d bytes", b.End)
+		}
+		return b, nil
+	}
+	if b.End > db.blockCap() {
+		return b, fmt.Errorf("end offset %d is past the block capacity %d", b.End, db.blockCap())
+	}
+	if b.Flags&BlockFlagCompressed != 0 && b.Stored > db.payloadCap() {
+		return b, fmt.Errorf("stored size %d is past the payload capacity %d", b.Stored, db.payloadCap())
+	}
+	if db.encoded() {
+		_, err = db.readPayload(b)
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,57 @@
+package block
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+var ErrReadOnly = errors.New("block DB is read-only")
+
+type readOnlyFile struct {
+	*io.SectionReader
+}
+
+func (readOnlyFile) Write(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// OpenShared opens a read-only DB over r. Reads go through ReadAt instead of
+// a shared cursor, so objects of the DB can be read from multiple goroutines
+// concurrently without locking it. DBs that weren't shut down cleanly have to
+// be recovered first, by opening them with Open.
+func OpenShared(r io.ReaderAt, opts ...Option) (*BlockDB, error) {
+	return open(readOnlyFile{io.NewSectionReader(r, 0, math.MaxInt64)}, r, opts...)
+}
+
+func (db *BlockDB) isClosed() bool {
+	return atomic.LoadInt32(&db.closed) != 0
+}
+
+// readerAt returns a reader positioned at off in the file.
+func (db *BlockDB) readerAt(off int64) (io.Reader, error) {
+	if db.ra != nil {
+		return io.NewSectionReader(db.ra, off, math.MaxInt64-off), nil
+	}
+
+	_, err := db.f.Seek(off, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.f, nil
+}
+
+// lockDB locks the DB around object I/O, objects of shared DBs don't need it.
+func (o *Object) lockDB() {
+	if o.db.ra == nil {
+		o.db.m.Lock()
+	}
+}
+
+func (o *Object) unlockDB() {
+	if o.db.ra == nil {
+		o.db.m.Unlock()
+	}
+}
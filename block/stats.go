@@ -1,6 +1,10 @@
 package block
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"sort"
+)
 
 type Stats struct {
 	DBMeta DBMeta
@@ -9,66 +13,162 @@ type Stats struct {
 	IndexObjectStats ObjectStats
 	FreeBlocks       uint32
 	BlockMetaSize    int
+	Fragmentation    FragmentationStats
+	FreeSpace        FreeSpaceStats
+	Recovery         RecoveryStats
+}
+
+type FreeSpaceStats struct {
+	Runs         []BlockRun     // free blocks grouped by position
+	RunHistogram map[uint32]int // runs count by length, rounded up to a power of 2
+	TailBlocks   uint32         // free blocks at the end of the file
+}
+
+type BlockRun struct {
+	Start  uint32
+	Length uint32
+}
+
+type FragmentationStats struct {
+	Objects      int // objects split in more than one run of blocks
+	Runs         int
+	Blocks       int
+	WastedBytes  int64 // unused payload bytes in allocated blocks
+	MaxRuns      int
+	MaxRunsName  string
+	RunsPerBlock float64 // 1 when every block is on its own
 }
 
 func (db *BlockDB) Stats() (Stats, error) {
 	var err error
 
+	db.objectsM.RLock()
+	defer db.objectsM.RUnlock()
 	db.m.Lock()
 	defer db.m.Unlock()
+	if db.isClosed() {
+		return Stats{}, ErrClosed
+	}
 
 	stats := Stats{
 		DBMeta:        db.meta,
 		Objects:       uint32(len(db.objects)),
-		BlockMetaSize: BlockMeta{}.Size(),
+		BlockMetaSize: db.blockMetaSize(),
+		Recovery:      db.recovery,
 	}
 
 	stats.IndexObjectStats = db.indexObj.Stats()
 
-	stats.FreeBlocks, err = db.countFreeBlocks()
+	stats.Fragmentation, err = db.fragmentationStats(stats.IndexObjectStats)
 	if err != nil {
 		return stats, err
 	}
 
+	stats.FreeBlocks = uint32(len(db.freeBlocks))
+	stats.FreeSpace = db.freeSpaceStats()
+
 	return stats, nil
 }
 
-func (db *BlockDB) countFreeBlocks() (uint32, error) {
-	if db.meta.FirstFreeBlock == 0 {
-		return 0, nil
+func (db *BlockDB) fragmentationStats(indexStats ObjectStats) (FragmentationStats, error) {
+	var frag FragmentationStats
+
+	add := func(name string, objStats ObjectStats) {
+		if objStats.Runs > 1 {
+			frag.Objects++
+		}
+		if objStats.Runs > frag.MaxRuns {
+			frag.MaxRuns = objStats.Runs
+			frag.MaxRunsName = name
+		}
+		frag.Runs += objStats.Runs
+		frag.Blocks += objStats.Blocks
+		for _, wasted := range objStats.Wasted {
+			frag.WastedBytes += int64(wasted)
+		}
 	}
 
-	meta := BlockMeta{
-		pos: db.sizeMeta + int64(db.meta.FirstFreeBlock)*int64(db.meta.BlockSize),
-		idx: db.meta.FirstFreeBlock,
+	add("", indexStats)
+	for name, meta := range db.objects {
+		blocks, err := db.blocks(meta.StartBlock)
+		if err != nil {
+			return frag, err
+		}
+		add(name, db.objectStats(blocks))
 	}
-	_, err := db.f.Seek(meta.pos, io.SeekStart)
-	if err != nil {
-		return 0, err
+
+	if frag.Blocks > 0 {
+		frag.RunsPerBlock = float64(frag.Runs) / float64(frag.Blocks)
 	}
-	_, err = meta.ReadFrom(db.f)
-	if err != nil {
-		return 0, err
+
+	return frag, nil
+}
+
+func (db *BlockDB) freeSpaceStats() FreeSpaceStats {
+	stats := FreeSpaceStats{
+		RunHistogram: map[uint32]int{},
 	}
 
-	var count uint32 = 1
+	free := make([]uint32, 0, len(db.freeBlocks))
+	for idx := range db.freeBlocks {
+		free = append(free, idx)
+	}
+	sort.Slice(free, func(i, j int) bool {
+		return free[i] < free[j]
+	})
+
+	for i, idx := range free {
+		if i == 0 || free[i-1]+1 != idx {
+			stats.Runs = append(stats.Runs, BlockRun{Start: idx})
+		}
+		stats.Runs[len(stats.Runs)-1].Length++
+	}
+
+	for _, run := range stats.Runs {
+		bucket := uint32(1)
+		for bucket < run.Length {
+			bucket <<= 1
+		}
+		stats.RunHistogram[bucket]++
+	}
 
-	for meta.Next != 0 {
-		meta = BlockMeta{
-			pos: db.sizeMeta + int64(meta.Next)*int64(db.meta.BlockSize),
-			idx: meta.Next,
+	if len(stats.Runs) > 0 {
+		last := stats.Runs[len(stats.Runs)-1]
+		if last.Start+last.Length == db.meta.BlockCount {
+			stats.TailBlocks = last.Length
 		}
-		_, err = db.f.Seek(meta.pos, io.SeekStart)
+	}
+
+	return stats
+}
+
+func (db *BlockDB) loadFreeBlocks() error {
+	db.freeBlocks = map[uint32]BlockMeta{}
+	db.freeTail = 0
+
+	next := db.meta.FirstFreeBlock
+	for next != 0 {
+		if _, ok := db.freeBlocks[next]; ok {
+			return fmt.Errorf("free list loops back to block %d", next)
+		}
+		if next >= db.meta.BlockCount {
+			return fmt.Errorf("free list points to block %d, past the last block", next)
+		}
+
+		meta := db.newBlockMeta(next)
+		_, err := db.f.Seek(meta.pos, io.SeekStart)
 		if err != nil {
-			return 0, err
+			return err
 		}
 		_, err = meta.ReadFrom(db.f)
 		if err != nil {
-			return 0, err
+			return err
 		}
 
-		count++
+		db.freeBlocks[next] = *meta
+		db.freeTail = next
+		next = meta.Next
 	}
 
-	return count, nil
+	return nil
 }
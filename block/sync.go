@@ -0,0 +1,92 @@
+package block
+
+import "errors"
+
+var ErrSyncUnsupported = errors.New("file does not support Sync")
+
+type syncer interface {
+	Sync() error
+}
+
+func (t *tracedFile) Sync() error {
+	s, ok := t.f.(syncer)
+	if !ok {
+		return ErrSyncUnsupported
+	}
+
+	return s.Sync()
+}
+
+// barrier flushes pending writes to stable storage when running with WithSync.
+func (db *BlockDB) barrier() error {
+	if !db.sync {
+		return nil
+	}
+
+	return db.f.(syncer).Sync()
+}
+
+func (db *BlockDB) writeFirstFreeBlock() error {
+	err := db.barrier()
+	if err != nil {
+		return err
+	}
+	err = db.meta.WriteFirstFreeBlock(db.f)
+	if err != nil {
+		return err
+	}
+
+	return db.barrier()
+}
+
+func (db *BlockDB) writeBlockCount() error {
+	err := db.barrier()
+	if err != nil {
+		return err
+	}
+	err = db.meta.WriteBlockCount(db.f)
+	if err != nil {
+		return err
+	}
+
+	return db.barrier()
+}
+
+// writeFlags persists the flags, along with the generation when blocks were
+// stamped since it was last written, at no extra write.
+func (db *BlockDB) writeFlags() error {
+	err := db.barrier()
+	if err != nil {
+		return err
+	}
+	if db.meta.Generation == db.saved {
+		err = db.meta.WriteFlags(db.f)
+	} else {
+		err = db.meta.WriteFlagsAndGeneration(db.f)
+	}
+	if err != nil {
+		return err
+	}
+	db.saved = db.meta.Generation
+
+	return db.barrier()
+}
+
+// writeGeneration persists the generation when blocks were stamped since it
+// was last written.
+func (db *BlockDB) writeGeneration() error {
+	if db.meta.Generation == db.saved {
+		return nil
+	}
+	err := db.barrier()
+	if err != nil {
+		return err
+	}
+	err = db.meta.WriteGeneration(db.f)
+	if err != nil {
+		return err
+	}
+	db.saved = db.meta.Generation
+
+	return db.barrier()
+}
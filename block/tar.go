@@ -0,0 +1,309 @@
+package block
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// PAX records of the global header ExportTar starts archives with.
+const (
+	tarRecordBlockSize = "KVSTORE.blocksize"
+	tarRecordFlags     = "KVSTORE.flags"
+	tarRecordKeyCheck  = "KVSTORE.keycheck"
+)
+
+// tarSegmentSize is the number of object bytes sealed together in the archives
+// of encrypted DBs.
+const tarSegmentSize = 64 << 10
+
+// ExportTar writes every object of the DB as a file of a tar archive, named
+// after the object. The archive starts with a global header recording the
+// block size, the compression and the encryption of the DB. The files of
+// encrypted DBs are sealed with the DB key, so that the archive holds no
+// plaintext.
+func (db *BlockDB) ExportTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	meta := db.Meta()
+	modTime := time.Unix(0, meta.CreatedAt)
+
+	records := map[string]string{
+		tarRecordBlockSize: strconv.FormatUint(uint64(meta.BlockSize), 10),
+		tarRecordFlags:     strconv.FormatUint(uint64(meta.Flags&(FlagEncrypted|FlagCompressed)), 10),
+	}
+	if db.aead != nil {
+		records[tarRecordKeyCheck] = hex.EncodeToString(meta.KeyCheck[:])
+	}
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: records,
+	})
+	if err != nil {
+		return fmt.Errorf("writing global header: %w", err)
+	}
+
+	for _, name := range db.List("") {
+		obj, err := db.Open(name)
+		if err != nil {
+			return err
+		}
+
+		size := obj.Size()
+		if db.aead != nil {
+			size = db.sealedSize(size)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     0600,
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return fmt.Errorf("writing header for %q: %w", name, err)
+		}
+		if db.aead != nil {
+			err = db.sealSegments(tw, obj, name, obj.Size())
+		} else {
+			_, err = io.Copy(tw, obj)
+		}
+		if err != nil {
+			return fmt.Errorf("exporting %q: %w", name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// RestoreTar creates a DB in the empty file f from an archive written by
+// ExportTar, with the block size and the compression of the exported DB. The
+// archives of encrypted DBs need the key of the exported DB, given with
+// WithCipher, which the new DB is encrypted with. The other options are
+// applied after the ones read from the archive.
+func RestoreTar(f io.ReadWriteSeeker, r io.Reader, opts ...Option) (*BlockDB, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var archiveOpts []Option
+	if hdr != nil && hdr.Typeflag == tar.TypeXGlobalHeader {
+		if s, ok := hdr.PAXRecords[tarRecordBlockSize]; ok {
+			blockSize, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid block size %q: %w", s, err)
+			}
+			archiveOpts = append(archiveOpts, WithBlockSize(uint32(blockSize)))
+		}
+		flags, err := tarFlags(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if flags&FlagCompressed != 0 {
+			archiveOpts = append(archiveOpts, WithCompression())
+		}
+	}
+
+	db, err := Create(f, append(archiveOpts, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	err = importTar(db, tr, hdr)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// ImportTar creates an object for every file of the tar archive, replacing
+// existing objects with the same names. Other entries are skipped. The files
+// of archives exported from encrypted DBs are opened with the key of db,
+// which has to be the key of the exported DB.
+func ImportTar(db *BlockDB, r io.Reader) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return importTar(db, tr, hdr)
+}
+
+// importTar imports the files of tr, starting with the one of hdr, nil when
+// the archive is empty.
+func importTar(db *BlockDB, tr *tar.Reader, hdr *tar.Header) error {
+	sealed := false
+	for hdr != nil {
+		var err error
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			sealed, err = db.tarSealed(hdr)
+		} else {
+			err = importTarFile(db, tr, hdr, sealed)
+		}
+		if err != nil {
+			return err
+		}
+
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func importTarFile(db *BlockDB, tr *tar.Reader, hdr *tar.Header, sealed bool) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	obj, err := db.Create(hdr.Name)
+	if err != nil {
+		return fmt.Errorf("creating %q: %w", hdr.Name, err)
+	}
+	if sealed {
+		err = db.openSegments(obj, tr, hdr.Name, hdr.Size)
+	} else {
+		_, err = io.Copy(obj, tr)
+	}
+	if err != nil {
+		return fmt.Errorf("importing %q: %w", hdr.Name, err)
+	}
+
+	return nil
+}
+
+func tarFlags(hdr *tar.Header) (uint32, error) {
+	s, ok := hdr.PAXRecords[tarRecordFlags]
+	if !ok {
+		return 0, nil
+	}
+	flags, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid archive flags %q: %w", s, err)
+	}
+
+	return uint32(flags), nil
+}
+
+// tarSealed reports whether the files following the global header hdr are
+// sealed, checking that the key of db is then the one of the DB the archive
+// was exported from.
+func (db *BlockDB) tarSealed(hdr *tar.Header) (bool, error) {
+	flags, err := tarFlags(hdr)
+	if err != nil || flags&FlagEncrypted == 0 {
+		return false, err
+	}
+	if db.aead == nil {
+		return false, ErrKeyRequired
+	}
+
+	var check [keyCheckSize]byte
+	b, err := hex.DecodeString(hdr.PAXRecords[tarRecordKeyCheck])
+	if err != nil || len(b) != keyCheckSize {
+		return false, fmt.Errorf("invalid archive key check %q", hdr.PAXRecords[tarRecordKeyCheck])
+	}
+	copy(check[:], b)
+
+	return true, openKeyCheck(db.aead, check)
+}
+
+// sealedSize is the size of an object of size bytes once sealed in segments.
+func (db *BlockDB) sealedSize(size int64) int64 {
+	segments := (size + tarSegmentSize - 1) / tarSegmentSize
+
+	return size + segments*int64(db.aead.NonceSize()+db.aead.Overhead())
+}
+
+// segmentAD binds a sealed segment to its position in the named object of
+// size bytes, so that segments can't be reordered, dropped or moved to
+// another object.
+func segmentAD(name string, segment uint64, size int64) []byte {
+	ad := make([]byte, 16, 16+len(name))
+	binary.LittleEndian.PutUint64(ad, segment)
+	binary.LittleEndian.PutUint64(ad[8:], uint64(size))
+
+	return append(ad, name...)
+}
+
+// sealSegments writes the size bytes of r to w sealed in segments of
+// tarSegmentSize bytes, each prefixed by its nonce.
+func (db *BlockDB) sealSegments(w io.Writer, r io.Reader, name string, size int64) error {
+	nonceSize := db.aead.NonceSize()
+	buf := make([]byte, nonceSize+tarSegmentSize+db.aead.Overhead())
+
+	for segment, left := uint64(0), size; left > 0; segment++ {
+		n := int64(tarSegmentSize)
+		if left < n {
+			n = left
+		}
+		nonce := buf[:nonceSize]
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return err
+		}
+		p := buf[nonceSize : nonceSize+int(n)]
+		_, err = io.ReadFull(r, p)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(db.aead.Seal(nonce, nonce, p, segmentAD(name, segment, size)))
+		if err != nil {
+			return err
+		}
+		left -= n
+	}
+
+	return nil
+}
+
+// openSegments writes to w the object sealed by sealSegments in the sealed
+// bytes of r.
+func (db *BlockDB) openSegments(w io.Writer, r io.Reader, name string, sealed int64) error {
+	nonceSize := db.aead.NonceSize()
+	overhead := int64(nonceSize + db.aead.Overhead())
+	segments := (sealed + tarSegmentSize + overhead - 1) / (tarSegmentSize + overhead)
+	size := sealed - segments*overhead
+	if size < 0 || db.sealedSize(size) != sealed {
+		return fmt.Errorf("invalid sealed size %d", sealed)
+	}
+	buf := make([]byte, nonceSize+tarSegmentSize+db.aead.Overhead())
+
+	for segment, left := uint64(0), size; left > 0; segment++ {
+		n := int64(tarSegmentSize)
+		if left < n {
+			n = left
+		}
+		p := buf[:n+overhead]
+		_, err := io.ReadFull(r, p)
+		if err != nil {
+			return err
+		}
+		p, err = db.aead.Open(p[nonceSize:nonceSize], p[:nonceSize], p[nonceSize:], segmentAD(name, segment, size))
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", segment, ErrAuthFailed)
+		}
+		_, err = w.Write(p)
+		if err != nil {
+			return err
+		}
+		left -= n
+	}
+
+	return nil
+}
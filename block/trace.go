@@ -0,0 +1,125 @@
+package block
+
+import (
+	"io"
+	"time"
+)
+
+type TraceOp int
+
+const (
+	TraceRead TraceOp = iota
+	TraceWrite
+	TraceSeek
+	TraceGrow
+	TraceAlloc
+	TraceFree
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	default:
+		return "unknown"
+	case TraceRead:
+		return "read"
+	case TraceWrite:
+		return "write"
+	case TraceSeek:
+		return "seek"
+	case TraceGrow:
+		return "grow"
+	case TraceAlloc:
+		return "alloc"
+	case TraceFree:
+		return "free"
+	}
+}
+
+type TraceEvent struct {
+	Op TraceOp
+
+	// Offset is the file offset for reads, writes and seeks, Block the first
+	// block affected by grows, allocs and frees.
+	Offset int64
+	Block  uint32
+	// Size is in bytes for reads and writes, and in blocks otherwise.
+	Size     int64
+	Duration time.Duration
+	Err      error
+}
+
+type Tracer interface {
+	Trace(e TraceEvent)
+}
+
+type TracerFunc func(e TraceEvent)
+
+func (fn TracerFunc) Trace(e TraceEvent) {
+	fn(e)
+}
+
+type tracedFile struct {
+	f      io.ReadWriteSeeker
+	tracer Tracer
+	pos    int64
+}
+
+func (t *tracedFile) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.f.Read(p)
+	t.tracer.Trace(TraceEvent{
+		Op:       TraceRead,
+		Offset:   t.pos,
+		Size:     int64(n),
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	t.pos += int64(n)
+
+	return n, err
+}
+
+func (t *tracedFile) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.f.Write(p)
+	t.tracer.Trace(TraceEvent{
+		Op:       TraceWrite,
+		Offset:   t.pos,
+		Size:     int64(n),
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	t.pos += int64(n)
+
+	return n, err
+}
+
+func (t *tracedFile) Seek(offset int64, whence int) (int64, error) {
+	start := time.Now()
+	pos, err := t.f.Seek(offset, whence)
+	t.tracer.Trace(TraceEvent{
+		Op:       TraceSeek,
+		Offset:   pos,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	if err == nil {
+		t.pos = pos
+	}
+
+	return pos, err
+}
+
+func (db *BlockDB) trace(op TraceOp, block uint32, size int64, start time.Time, err error) {
+	if db.tracer == nil {
+		return
+	}
+
+	db.tracer.Trace(TraceEvent{
+		Op:       op,
+		Block:    block,
+		Size:     size,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
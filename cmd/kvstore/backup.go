@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// Backup writes a backup of the store at fpath to out, "-" for stdout, with
+// kvstore.BackupFile, so that the store isn't written to and other processes
+// don't write to it during the backup. Files are written next to out then
+// renamed, so that out is never left incomplete.
+func Backup(fpath, out string) error {
+	if out == "-" {
+		return kvstore.BackupFile(fpath, os.Stdout, dbOptions...)
+	}
+	if same, err := sameFile(fpath, out); err != nil || same {
+		if err == nil {
+			err = invalidf("backing up a store to itself")
+		}
+		return err
+	}
+
+	return writeReplacing(out, func(f *os.File) error {
+		return kvstore.BackupFile(fpath, f, dbOptions...)
+	})
+}
+
+// Restore creates the store at fpath from the backup file, "-" for stdin.
+// Without force, fpath must not be an existing non-empty file. The store is
+// restored to a file next to fpath then renamed over it, so that fpath is
+// left as it was when the backup can't be restored.
+func Restore(backup, fpath string, force bool) error {
+	if info, err := os.Stat(fpath); err == nil && info.Size() != 0 && !force {
+		return fmt.Errorf("%s: %w, use --force to replace it", fpath, os.ErrExist)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	in := os.Stdin
+	if backup != "-" {
+		if same, err := sameFile(backup, fpath); err != nil || same {
+			if err == nil {
+				err = invalidf("restoring a backup over itself")
+			}
+			return err
+		}
+		var err error
+		in, err = os.Open(backup)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	return writeReplacing(fpath, func(f *os.File) error {
+		err := kvstore.Restore(f, in, dbOptions...)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		store, err := kvstore.NewReadOnly(f, dbOptions...)
+		if err != nil {
+			return fmt.Errorf("opening the restored store: %w", err)
+		}
+
+		return store.Close()
+	})
+}
+
+// sameFile reports whether a and b are the same file, false when either
+// doesn't exist.
+func sameFile(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(infoA, infoB), nil
+}
+
+// writeReplacing calls write with a temporary file of the directory of fpath,
+// then syncs it and renames it over fpath. The temporary file is removed when
+// any step fails, fpath being left as it was.
+func writeReplacing(fpath string, write func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), filepath.Base(fpath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// Op is a line of an ndjson batch. Values are JSON, unlike the values of the
+// set lines of a script, which are stored as strings like with set.
+type Op struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// Batch applies the ops read from r within a single write transaction, none
+// of them being applied when one is invalid or r can't be read to the end. The script format has a
+// "set <bucket> <key> <value>" or "delete <bucket> <key>" command per line,
+// quoted like in the shell, blank lines and lines starting with # being
+// skipped. The ndjson format has an Op per line. It returns the number of ops
+// applied.
+func Batch(store kvstore.Store, r io.Reader, format string) (int, error) {
+	if format != "script" && format != "ndjson" {
+		return 0, invalidf("unknown format %q", format)
+	}
+
+	tx := store.Writer()
+	defer tx.Rollback()
+
+	var n, line int
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxValueSize)
+	for s.Scan() {
+		line++
+		var (
+			op  Op
+			err error
+		)
+		text := strings.TrimSpace(s.Text())
+		if text == "" || format == "script" && strings.HasPrefix(text, "#") {
+			continue
+		}
+		if format == "ndjson" {
+			err = json.Unmarshal([]byte(text), &op)
+		} else {
+			op, err = parseScriptLine(text)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch op.Op {
+		case "set":
+			if op.Value == nil {
+				return 0, invalidf("line %d: set without a value", line)
+			}
+			err = tx.Set(op.Bucket, op.Key, op.Value)
+		case "delete":
+			err = tx.Delete(op.Bucket, op.Key)
+		default:
+			return 0, invalidf("line %d: unknown op %q", line, op.Op)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("line %d: %w", line+1, err)
+	}
+
+	err := tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func parseScriptLine(line string) (Op, error) {
+	args, err := splitArgs(line)
+	if err != nil {
+		return Op{}, err
+	}
+	op := Op{Op: strings.ToLower(args[0])}
+	switch {
+	case op.Op == "set" && len(args) == 4:
+		op.Bucket, op.Key = args[1], args[2]
+		op.Value, err = json.Marshal(args[3])
+	case op.Op == "delete" && len(args) == 3:
+		op.Bucket, op.Key = args[1], args[2]
+	case op.Op == "set":
+		err = invalidf("usage: set <bucket> <key> <value>")
+	case op.Op == "delete":
+		err = invalidf("usage: delete <bucket> <key>")
+	}
+
+	return op, err
+}
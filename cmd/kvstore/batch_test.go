@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yazgazan/kvstore"
+)
+
+func newTestStore(t *testing.T) kvstore.Store {
+	t.Helper()
+
+	store, err := kvstore.NewFromFile(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatalf("NewFromFile(...): unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store
+}
+
+// storeValues returns the JSON values of keys in bucket, "" for the keys that
+// aren't set.
+func storeValues(t *testing.T, store kvstore.Store, bucket string, keys ...string) []string {
+	t.Helper()
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		var v json.RawMessage
+		err := store.Get(bucket, key, &v)
+		if err != nil && !errors.Is(err, kvstore.ErrKeyNotFound) {
+			t.Fatalf("store.Get(%q, %q): unexpected error: %v", bucket, key, err)
+		}
+		values[i] = string(v)
+	}
+
+	return values
+}
+
+func TestBatch(t *testing.T) {
+	store := newTestStore(t)
+	err := Set(store, "b", "old", "kept")
+	if err != nil {
+		t.Errorf("Set(...): unexpected error: %v", err)
+		return
+	}
+
+	n, err := Batch(store, strings.NewReader(`
+# a comment
+set b k1 v1
+  SET b "k 2" 'a value'
+
+set b old "new value"
+delete b old
+set b k3 "x"
+delete b k3
+`), "script")
+	if err != nil || n != 6 {
+		t.Errorf("Batch(script) = %d, %v, expected 6 ops", n, err)
+		return
+	}
+	got := strings.Join(storeValues(t, store, "b", "k1", "k 2", "old", "k3"), ",")
+	if expected := `"v1","a value",,`; got != expected {
+		t.Errorf("values after Batch(script) = %s, expected %s", got, expected)
+	}
+
+	n, err = Batch(store, strings.NewReader(`{"op": "set", "bucket": "b", "key": "k1", "value": {"n": 1}}
+
+{"op": "delete", "bucket": "b", "key": "k 2"}
+`), "ndjson")
+	if err != nil || n != 2 {
+		t.Errorf("Batch(ndjson) = %d, %v, expected 2 ops", n, err)
+		return
+	}
+	got = strings.Join(storeValues(t, store, "b", "k1", "k 2"), ",")
+	if expected := `{"n":1},`; got != expected {
+		t.Errorf("values after Batch(ndjson) = %s, expected %s", got, expected)
+	}
+
+	_, err = Batch(store, strings.NewReader("set b k v"), "csv")
+	if err == nil {
+		t.Errorf("Batch(csv): expected an error")
+	}
+}
+
+func TestBatchAbort(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		input  string
+		line   int
+	}{
+		{"script", "set b k1 v1\nset b k2 v2\nfrobnicate b k1\nset b k3 v3", 3},
+		{"script", "set b k1 v1\n\nset b k2\nset b k3 v3", 3},
+		{"script", "set b k1 v1\nset b k2 v2 extra", 2},
+		{"script", "delete b k1 extra\nset b k1 v1", 1},
+		{"script", "set b k1 v1\nset b k2 \"v2\nset b k3 v3", 2},
+		{"script", "set b k1 v1\nset b k2 v2\\", 2},
+		{"ndjson", `{"op": "set", "bucket": "b", "key": "k1", "value": 1}` + "\n" + `{"op": "set", "bucket": "b", "key": "k2"}`, 2},
+		{"ndjson", `{"op": "set", "bucket": "b", "key": "k1", "value": 1}` + "\n" + `{"op": "set", "bucket": `, 2},
+		{"ndjson", `{"op": "set", "bucket": "b", "key": "k1", "value": 1}` + "\n" + `{"op": "rename", "bucket": "b", "key": "k1"}`, 2},
+		{"ndjson", `{"op": "delete", "bucket": "b", "key": "old"}` + "\n" + `set b k1 v1`, 2},
+	} {
+		store := newTestStore(t)
+		err := Set(store, "b", "old", "kept")
+		if err != nil {
+			t.Errorf("Set(...): unexpected error: %v", err)
+			return
+		}
+
+		n, err := Batch(store, strings.NewReader(test.input), test.format)
+		if err == nil || n != 0 {
+			t.Errorf("Batch(%s, %q) = %d, %v, expected an error", test.format, test.input, n, err)
+			continue
+		}
+		if prefix := fmt.Sprintf("line %d: ", test.line); !strings.HasPrefix(err.Error(), prefix) {
+			t.Errorf("Batch(%s, %q): error %q doesn't name the line", test.format, test.input, err)
+		}
+		got := strings.Join(storeValues(t, store, "b", "old", "k1", "k2", "k3"), ",")
+		if expected := `"kept",,,`; got != expected {
+			t.Errorf("values after Batch(%s, %q) = %s, expected none of the ops to be applied (%s)", test.format, test.input, got, expected)
+		}
+	}
+}
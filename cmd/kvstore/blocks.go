@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/yazgazan/kvstore/block"
+)
+
+// mapWidth is the number of blocks per row of an allocation map.
+const mapWidth = 64
+
+// blockOwners returns the name of the object owning each block, "index" for
+// the index object and "" for the blocks no chain reaches, which are free.
+// Chains stop at a block out of range or already owned.
+func blockOwners(blocks []block.BlockMeta, objects []block.ObjectMeta) []string {
+	owners := make([]string, len(blocks))
+	chains := append([]block.ObjectMeta{{Name: "index"}}, objects...)
+	for _, o := range chains {
+		for idx := o.StartBlock; int(idx) < len(blocks) && owners[idx] == ""; {
+			owners[idx] = o.Name
+			idx = blocks[idx].Next
+			if idx == 0 {
+				break
+			}
+		}
+	}
+
+	return owners
+}
+
+// Blocks writes the blocks of the block DB at fpath to w, opening it
+// read-only. With allocMap, an allocation map is written instead, in the text
+// or svg format. The json format writes the blocks and the free runs, with or
+// without allocMap.
+func Blocks(fpath string, w io.Writer, allocMap bool, format string) error {
+	if format != "text" && format != "svg" && format != "json" {
+		return invalidf("unknown format %q", format)
+	}
+	db, closeDB, err := openBlockDB(fpath)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	objects := db.Objects()
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	blocks, err := db.Blocks()
+	if err != nil {
+		return err
+	}
+	owners := blockOwners(blocks, objects)
+
+	if format == "json" {
+		return blocksJSON(w, blocks, owners)
+	}
+	if !allocMap {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "BLOCK\tOWNER\tEND\tNEXT")
+		for i, b := range blocks {
+			owner := owners[i]
+			if owner == "" {
+				owner = "-"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\n", i, owner, b.End, b.Next)
+		}
+		return tw.Flush()
+	}
+
+	names := []string{"index"}
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+	if format == "svg" {
+		return blocksSVG(w, owners, names)
+	}
+
+	return blocksText(w, owners, names)
+}
+
+// freeRuns returns the runs of free blocks as [start, length] pairs.
+func freeRuns(owners []string) [][2]int {
+	var runs [][2]int
+	for i := 0; i < len(owners); i++ {
+		if owners[i] != "" {
+			continue
+		}
+		start := i
+		for i < len(owners) && owners[i] == "" {
+			i++
+		}
+		runs = append(runs, [2]int{start, i - start})
+	}
+
+	return runs
+}
+
+type blockOutput struct {
+	Block uint32 `json:"block"`
+	Owner string `json:"owner,omitempty"` // empty for free blocks
+	End   uint32 `json:"end"`
+	Next  uint32 `json:"next"`
+}
+
+type freeRunOutput struct {
+	Start  int `json:"start"`
+	Length int `json:"length"`
+}
+
+func blocksJSON(w io.Writer, blocks []block.BlockMeta, owners []string) error {
+	var out struct {
+		Blocks   []blockOutput   `json:"blocks"`
+		FreeRuns []freeRunOutput `json:"free_runs"`
+	}
+	out.Blocks = make([]blockOutput, len(blocks))
+	for i, b := range blocks {
+		out.Blocks[i] = blockOutput{Block: uint32(i), Owner: owners[i], End: b.End, Next: b.Next}
+	}
+	out.FreeRuns = []freeRunOutput{}
+	for _, run := range freeRuns(owners) {
+		out.FreeRuns = append(out.FreeRuns, freeRunOutput{Start: run[0], Length: run[1]})
+	}
+
+	return json.NewEncoder(w).Encode(out)
+}
+
+const mapSymbols = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func blocksText(w io.Writer, owners, names []string) error {
+	symbols := map[string]byte{}
+	fmt.Fprintln(w, "legend: . free, # index")
+	for i, name := range names[1:] {
+		symbols[name] = mapSymbols[i%len(mapSymbols)]
+		fmt.Fprintf(w, "  %c %s\n", symbols[name], name)
+	}
+	symbols["index"] = '#'
+
+	var row strings.Builder
+	for i, owner := range owners {
+		if i%mapWidth == 0 {
+			if i > 0 {
+				fmt.Fprintln(w, row.String())
+				row.Reset()
+			}
+			fmt.Fprintf(&row, "%8d ", i)
+		}
+		if owner == "" {
+			row.WriteByte('.')
+			continue
+		}
+		row.WriteByte(symbols[owner])
+	}
+	if row.Len() > 0 {
+		fmt.Fprintln(w, row.String())
+	}
+
+	runs := freeRuns(owners)
+	fmt.Fprintf(w, "%d free runs\n", len(runs))
+	for _, run := range runs {
+		fmt.Fprintf(w, "  %d blocks at %d\n", run[1], run[0])
+	}
+
+	return nil
+}
+
+func blocksSVG(w io.Writer, owners, names []string) error {
+	const cell = 10
+	colors := map[string]string{"index": "#333333"}
+	for i, name := range names[1:] {
+		colors[name] = fmt.Sprintf("hsl(%d, 60%%, 55%%)", (i*137)%360)
+	}
+
+	rows := (len(owners) + mapWidth - 1) / mapWidth
+	legend := (len(names) + 1) * 16
+	width, height := mapWidth*cell, rows*cell+legend+8
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"monospace\" font-size=\"12\">\n", width, height)
+	for i, owner := range owners {
+		color, title := "#eeeeee", "free"
+		if owner != "" {
+			color, title = colors[owner], owner
+		}
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\" stroke=\"white\"><title>%d: %s</title></rect>\n",
+			(i%mapWidth)*cell, (i/mapWidth)*cell, cell, cell, color, i, xmlEscape(title))
+	}
+	y := rows*cell + 8
+	entries := append([]string{""}, names...)
+	for _, name := range entries {
+		color, label := "#eeeeee", "free"
+		if name != "" {
+			color, label = colors[name], name
+		}
+		fmt.Fprintf(w, "<rect x=\"0\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/><text x=\"%d\" y=\"%d\">%s</text>\n",
+			y, cell, cell, color, cell+6, y+cell, xmlEscape(label))
+		y += 16
+	}
+	_, err := fmt.Fprintln(w, "</svg>")
+
+	return err
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;").Replace(s)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// copyBatch is the number of entries written per transaction by Copy.
+const copyBatch = 1000
+
+type CopyOptions struct {
+	Bucket string // only copy this bucket
+	Prefix string // only copy the keys with this prefix
+}
+
+// Copy writes the entries of src selected by opts to dst, creating buckets as
+// needed and overwriting the keys dst already has. The entries are read in a
+// single transaction of src and written in batches of copyBatch. It returns
+// the number of entries copied.
+func Copy(src, dst kvstore.Store, opts CopyOptions) (int, error) {
+	buckets, err := src.Buckets()
+	if err != nil {
+		return 0, err
+	}
+	if opts.Bucket != "" {
+		if !contains(buckets, opts.Bucket) {
+			return 0, fmt.Errorf("bucket %q not found", opts.Bucket)
+		}
+		buckets = []string{opts.Bucket}
+	}
+
+	rtx := src.Reader()
+	defer rtx.Rollback()
+
+	var (
+		copied int
+		wtx    kvstore.WriteTx
+		n      int
+	)
+	defer func() {
+		if wtx != nil {
+			wtx.Rollback()
+		}
+	}()
+	for _, b := range buckets {
+		keys, err := rtx.Keys(b, kvstore.KeyFilter{Prefix: opts.Prefix})
+		if err != nil {
+			return copied, err
+		}
+		for _, k := range keys {
+			var v json.RawMessage
+			err = rtx.Get(b, k, &v)
+			if err != nil {
+				return copied, fmt.Errorf("%s/%s: %w", b, k, err)
+			}
+			if wtx == nil {
+				wtx = dst.Writer()
+			}
+			err = wtx.Set(b, k, v)
+			if err != nil {
+				return copied, err
+			}
+			n++
+			if n < copyBatch {
+				continue
+			}
+			err = wtx.Commit()
+			wtx = nil
+			if err != nil {
+				return copied, err
+			}
+			copied, n = copied+n, 0
+		}
+	}
+	if wtx != nil {
+		err = wtx.Commit()
+		wtx = nil
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+	}
+
+	return copied, rtx.Commit()
+}
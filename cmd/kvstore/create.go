@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+
+	"github.com/yazgazan/kvstore"
+	"github.com/yazgazan/kvstore/block"
+)
+
+// Create creates a store at fpath, which must not exist, with blocks of
+// blockSize bytes and preallocate free blocks to grow into.
+func Create(fpath string, blockSize, preallocate uint32) error {
+	if blockSize < block.MinimumBlockSize {
+		return invalidf("invalid block size %d (should be greater or equal to %d)", blockSize, block.MinimumBlockSize)
+	}
+
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	err = create(f, blockSize, preallocate)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fpath)
+	}
+
+	return err
+}
+
+func create(f *os.File, blockSize, preallocate uint32) error {
+	db, err := block.Create(f, append([]block.Option{block.WithBlockSize(blockSize)}, dbOptions...)...)
+	if err != nil {
+		return err
+	}
+	if preallocate > 0 {
+		err = db.Grow(preallocate)
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+
+	store, err := kvstore.New(f, dbOptions...)
+	if err != nil {
+		return err
+	}
+
+	return store.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/yazgazan/kvstore"
+)
+
+type DiffOptions struct {
+	Bucket string // only compare this bucket
+	Values bool   // write the values of the keys that differ
+	JSON   bool   // write a JSON object per line instead
+}
+
+// diffEntry is a line written by Diff in the JSON format.
+type diffEntry struct {
+	Op     string          `json:"op"` // "-", "+" or "~"
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	A      json.RawMessage `json:"a,omitempty"`
+	B      json.RawMessage `json:"b,omitempty"`
+}
+
+func writeDiff(w io.Writer, e diffEntry, opts DiffOptions) error {
+	if !opts.Values {
+		e.A, e.B = nil, nil
+	}
+	if opts.JSON {
+		return json.NewEncoder(w).Encode(e)
+	}
+
+	_, err := fmt.Fprintf(w, "%s %s/%s\n", e.Op, e.Bucket, e.Key)
+	if err == nil && e.Op == "~" && opts.Values {
+		_, err = fmt.Fprintf(w, "  a: %s\n  b: %s\n", e.A, e.B)
+	}
+
+	return err
+}
+
+type DiffStats struct {
+	OnlyA, OnlyB, Differ int
+}
+
+func (s DiffStats) Equal() bool {
+	return s.OnlyA == 0 && s.OnlyB == 0 && s.Differ == 0
+}
+
+// Diff compares the entries of a and b, writing a line per key only in a
+// ("-"), only in b ("+") or whose values differ ("~"). Buckets and keys are
+// sorted. With opts.JSON, the lines are JSON objects with the op, the bucket,
+// the key and, with opts.Values, the values.
+func Diff(a, b kvstore.Store, w io.Writer, opts DiffOptions) (DiffStats, error) {
+	var stats DiffStats
+
+	bucketsA, err := a.Buckets()
+	if err != nil {
+		return stats, err
+	}
+	bucketsB, err := b.Buckets()
+	if err != nil {
+		return stats, err
+	}
+	buckets := bucketsA
+	for _, name := range bucketsB {
+		if !contains(buckets, name) {
+			buckets = append(buckets, name)
+		}
+	}
+	if opts.Bucket != "" {
+		if !contains(buckets, opts.Bucket) {
+			return stats, &entryError{Bucket: opts.Bucket, Err: kvstore.ErrBucketNotFound}
+		}
+		buckets = []string{opts.Bucket}
+	}
+	sort.Strings(buckets)
+
+	txA := a.Reader()
+	defer txA.Rollback()
+	txB := b.Reader()
+	defer txB.Rollback()
+
+	for _, bucket := range buckets {
+		keysA, err := txA.Keys(bucket, kvstore.KeyFilter{})
+		if err != nil {
+			return stats, err
+		}
+		keysB, err := txB.Keys(bucket, kvstore.KeyFilter{})
+		if err != nil {
+			return stats, err
+		}
+
+		for len(keysA) != 0 || len(keysB) != 0 {
+			switch {
+			case len(keysB) == 0 || len(keysA) != 0 && keysA[0] < keysB[0]:
+				stats.OnlyA++
+				err = writeDiff(w, diffEntry{Op: "-", Bucket: bucket, Key: keysA[0]}, opts)
+				keysA = keysA[1:]
+			case len(keysA) == 0 || keysB[0] < keysA[0]:
+				stats.OnlyB++
+				err = writeDiff(w, diffEntry{Op: "+", Bucket: bucket, Key: keysB[0]}, opts)
+				keysB = keysB[1:]
+			default:
+				key := keysA[0]
+				keysA, keysB = keysA[1:], keysB[1:]
+				var valueA, valueB json.RawMessage
+				err = txA.Get(bucket, key, &valueA)
+				if err != nil {
+					return stats, fmt.Errorf("%s/%s: %w", bucket, key, err)
+				}
+				err = txB.Get(bucket, key, &valueB)
+				if err != nil {
+					return stats, fmt.Errorf("%s/%s: %w", bucket, key, err)
+				}
+				if bytes.Equal(valueA, valueB) {
+					continue
+				}
+				stats.Differ++
+				err = writeDiff(w, diffEntry{Op: "~", Bucket: bucket, Key: key, A: valueA, B: valueB}, opts)
+			}
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	err = txA.Commit()
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, txB.Commit()
+}
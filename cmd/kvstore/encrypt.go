@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+
+	"github.com/yazgazan/kvstore/block"
+)
+
+// readKeyFile returns the cipher key held by the file at fpath, 16, 24 or 32
+// bytes for AES-128, AES-192 or AES-256.
+func readKeyFile(fpath string) ([]byte, error) {
+	key, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+
+	return nil, invalidf("key file %s holds %d bytes, expected 16, 24 or 32", fpath, len(key))
+}
+
+// Encrypt rewrites the block DB at fpath encrypted with key, in the latest
+// format version. An encrypted DB, opened with the key of dbOptions, is
+// encrypted again with the new key.
+func Encrypt(fpath string, key []byte) error {
+	src, closeSrc, err := openBlockDB(fpath)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+
+	meta := src.Meta()
+	opts := []block.Option{
+		block.WithBlockSize(meta.BlockSize),
+		block.WithCipher(key),
+	}
+	if meta.Flags&block.FlagCompressed != 0 {
+		opts = append(opts, block.WithCompression())
+	}
+
+	return rewrite(fpath, src, opts)
+}
+
+// Decrypt rewrites the block DB at fpath, encrypted with key, in plaintext.
+func Decrypt(fpath string, key []byte) error {
+	src, closeSrc, err := openBlockDBWith(fpath, []block.Option{block.WithCipher(key)})
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+
+	meta := src.Meta()
+	opts := []block.Option{
+		block.WithBlockSize(meta.BlockSize),
+	}
+	if meta.Flags&block.FlagCompressed != 0 {
+		opts = append(opts, block.WithCompression())
+	}
+
+	return rewrite(fpath, src, opts)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// Record is a key of a bucket and its JSON value, as written by export.
+type Record struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Export writes the records of bucket, or of every bucket when it is empty, to
+// w. The ndjson format writes one record per line, the json format a single
+// array. Buckets and keys are sorted.
+func Export(store kvstore.Store, w io.Writer, bucket, format string) error {
+	if format != "ndjson" && format != "json" {
+		return invalidf("unknown format %q", format)
+	}
+	buckets, err := store.Buckets()
+	if err != nil {
+		return err
+	}
+	if bucket != "" {
+		if !contains(buckets, bucket) {
+			return &entryError{Bucket: bucket, Err: kvstore.ErrBucketNotFound}
+		}
+		buckets = []string{bucket}
+	}
+	sort.Strings(buckets)
+
+	tx := store.Reader()
+	defer tx.Rollback()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var records []Record
+	for _, b := range buckets {
+		keys, err := tx.List(b)
+		if err != nil {
+			return err
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var v json.RawMessage
+			err = tx.Get(b, k, &v)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", b, k, err)
+			}
+			r := Record{Bucket: b, Key: k, Value: v}
+			if format == "json" {
+				records = append(records, r)
+				continue
+			}
+			err = enc.Encode(r)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if format == "json" {
+		if records == nil {
+			records = []Record{}
+		}
+		err = enc.Encode(records)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func contains(ss []string, needle string) bool {
+	for _, s := range ss {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	Format     string // ndjson or json, as written by Export
+	Batch      int    // records written per transaction
+	DryRun     bool   // validate the records and count them without writing
+	OnConflict string // overwrite, skip or fail when a key already exists
+}
+
+// Import reads records from r and writes them to store, opts.Batch records per
+// transaction. It returns how many records were written, or would be with
+// opts.DryRun, and how many were skipped. An invalid record, or a conflict
+// with opts.OnConflict set to fail, stops the import: the batch holding it is
+// rolled back, the batches committed before it are kept and counted in
+// imported, so that the import can be resumed from the start with OnConflict
+// set to skip. The error names the record by its position in r.
+func Import(store kvstore.Store, r io.Reader, opts ImportOptions) (imported, skipped int, err error) {
+	switch opts.OnConflict {
+	default:
+		return 0, 0, invalidf("unknown conflict policy %q", opts.OnConflict)
+	case "overwrite", "skip", "fail":
+	}
+	if opts.Batch < 1 {
+		return 0, 0, invalidf("invalid batch size %d", opts.Batch)
+	}
+	next, err := recordReader(r, opts.Format)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	existing := map[string]map[string]bool{} // keys by bucket, loaded on first use
+	var (
+		tx    kvstore.WriteTx
+		batch int
+	)
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	for n := 1; ; n++ {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, skipped, fmt.Errorf("record %d: %w", n, err)
+		}
+		if rec.Bucket == "" || rec.Key == "" || rec.Value == nil {
+			return imported, skipped, invalidf("record %d: missing bucket, key or value", n)
+		}
+
+		if tx == nil {
+			tx = store.Writer()
+		}
+		keys, ok := existing[rec.Bucket]
+		if !ok && opts.OnConflict != "overwrite" {
+			list, err := tx.List(rec.Bucket)
+			if err != nil {
+				return imported, skipped, err
+			}
+			keys = make(map[string]bool, len(list))
+			for _, k := range list {
+				keys[k] = true
+			}
+			existing[rec.Bucket] = keys
+		}
+		if keys[rec.Key] {
+			if opts.OnConflict == "fail" {
+				return imported, skipped, fmt.Errorf("record %d: %s/%s: %w", n, rec.Bucket, rec.Key, kvstore.ErrKeyExists)
+			}
+			skipped++
+			continue
+		}
+
+		err = tx.Set(rec.Bucket, rec.Key, rec.Value)
+		if err != nil {
+			return imported, skipped, fmt.Errorf("record %d: %w", n, err)
+		}
+		if keys != nil {
+			keys[rec.Key] = true
+		}
+		batch++
+		if batch < opts.Batch {
+			continue
+		}
+		err = endBatch(tx, opts.DryRun)
+		tx = nil
+		if err != nil {
+			return imported, skipped, err
+		}
+		imported += batch
+		batch = 0
+	}
+
+	if tx != nil {
+		err = endBatch(tx, opts.DryRun)
+		tx = nil
+		if err != nil {
+			return imported, skipped, err
+		}
+		imported += batch
+	}
+
+	return imported, skipped, nil
+}
+
+func endBatch(tx kvstore.WriteTx, dryRun bool) error {
+	if dryRun {
+		return tx.Rollback()
+	}
+
+	return tx.Commit()
+}
+
+// recordReader returns a function reading the records of r one by one, until
+// io.EOF.
+func recordReader(r io.Reader, format string) (func() (Record, error), error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	switch format {
+	default:
+		return nil, invalidf("unknown format %q", format)
+	case "ndjson":
+		return func() (Record, error) {
+			var rec Record
+			err := dec.Decode(&rec)
+
+			return rec, err
+		}, nil
+	case "json":
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok != json.Delim('[') {
+			return nil, invalidf("expected an array of records")
+		}
+
+		return func() (Record, error) {
+			var rec Record
+			if !dec.More() {
+				return rec, io.EOF
+			}
+			err := dec.Decode(&rec)
+
+			return rec, err
+		}, nil
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/yazgazan/kvstore"
+)
+
+func importRecords(keys ...string) string {
+	var lines []string
+	for _, k := range keys {
+		if k == "" {
+			lines = append(lines, `{"bucket": "b", "value": 1}`)
+			continue
+		}
+		lines = append(lines, `{"bucket": "b", "key": "`+k+`", "value": "`+k+`"}`)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestImport(t *testing.T) {
+	store := newTestStore(t)
+
+	imported, skipped, err := Import(store, strings.NewReader(importRecords("k1", "k2", "k3")), ImportOptions{Format: "ndjson", Batch: 2, OnConflict: "overwrite"})
+	if err != nil || imported != 3 || skipped != 0 {
+		t.Errorf("Import(ndjson) = %d, %d, %v, expected 3 records imported", imported, skipped, err)
+		return
+	}
+	imported, skipped, err = Import(store, strings.NewReader(`[
+		{"bucket": "b", "key": "k1", "value": {"n": 1}},
+		{"bucket": "c", "key": "k1", "value": [1, 2]}
+	]`), ImportOptions{Format: "json", Batch: 10, OnConflict: "overwrite"})
+	if err != nil || imported != 2 || skipped != 0 {
+		t.Errorf("Import(json) = %d, %d, %v, expected 2 records imported", imported, skipped, err)
+		return
+	}
+	got := strings.Join(append(storeValues(t, store, "b", "k1", "k2", "k3"), storeValues(t, store, "c", "k1")...), ",")
+	if expected := `{"n":1},"k2","k3",[1,2]`; got != expected {
+		t.Errorf("values after Import(...) = %s, expected %s", got, expected)
+	}
+
+	imported, skipped, err = Import(store, strings.NewReader(importRecords("k2", "k4", "k3")), ImportOptions{Format: "ndjson", Batch: 1, OnConflict: "skip"})
+	if err != nil || imported != 1 || skipped != 2 {
+		t.Errorf("Import(..., skip) = %d, %d, %v, expected 1 record imported and 2 skipped", imported, skipped, err)
+	}
+
+	imported, skipped, err = Import(store, strings.NewReader(importRecords("k5", "k6")), ImportOptions{Format: "ndjson", Batch: 1, DryRun: true, OnConflict: "overwrite"})
+	if err != nil || imported != 2 || skipped != 0 {
+		t.Errorf("Import(..., dry run) = %d, %d, %v, expected 2 records", imported, skipped, err)
+	}
+	if got := strings.Join(storeValues(t, store, "b", "k5", "k6"), ","); got != "," {
+		t.Errorf("values after a dry run = %s, expected none", got)
+	}
+
+	for _, opts := range []ImportOptions{
+		{Format: "csv", Batch: 1, OnConflict: "overwrite"},
+		{Format: "ndjson", Batch: 0, OnConflict: "overwrite"},
+		{Format: "ndjson", Batch: 1, OnConflict: "replace"},
+	} {
+		_, _, err = Import(store, strings.NewReader(importRecords("k7")), opts)
+		if err == nil {
+			t.Errorf("Import(..., %+v): expected an error", opts)
+		}
+	}
+	_, _, err = Import(store, strings.NewReader(`{"bucket": "b", "key": "k7", "value": 1}`), ImportOptions{Format: "json", Batch: 1, OnConflict: "overwrite"})
+	if err == nil {
+		t.Errorf("Import(json) of a record outside of an array: expected an error")
+	}
+}
+
+// TestImportAbort checks that an import stopped by a record keeps the batches
+// committed before it, and can be resumed with OnConflict set to skip.
+func TestImportAbort(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		input    string
+		opts     ImportOptions
+		imported int
+		record   string
+	}{
+		{
+			name:     "missing key",
+			input:    importRecords("k1", "k2", "k3", "", "k5"),
+			opts:     ImportOptions{Format: "ndjson", Batch: 2, OnConflict: "overwrite"},
+			imported: 2,
+			record:   "record 4:",
+		},
+		{
+			name:     "invalid JSON",
+			input:    importRecords("k1", "k2", "k3") + "\n{\"bucket\": \n" + importRecords("k5"),
+			opts:     ImportOptions{Format: "ndjson", Batch: 2, OnConflict: "overwrite"},
+			imported: 2,
+			record:   "record 4:",
+		},
+		{
+			name:     "invalid JSON array",
+			input:    `[` + strings.ReplaceAll(importRecords("k1", "k2", "k3"), "\n", ",") + `, 42, ` + importRecords("k5") + `]`,
+			opts:     ImportOptions{Format: "json", Batch: 1, OnConflict: "overwrite"},
+			imported: 3,
+			record:   "record 4:",
+		},
+		{
+			name:     "conflict",
+			input:    importRecords("k1", "k2", "k3", "old", "k5"),
+			opts:     ImportOptions{Format: "ndjson", Batch: 3, OnConflict: "fail"},
+			imported: 3,
+			record:   "record 4:",
+		},
+	} {
+		store := newTestStore(t)
+		err := Set(store, "b", "old", "kept")
+		if err != nil {
+			t.Errorf("Set(...): unexpected error: %v", err)
+			return
+		}
+
+		imported, _, err := Import(store, strings.NewReader(test.input), test.opts)
+		if err == nil || !strings.HasPrefix(err.Error(), test.record) {
+			t.Errorf("Import(...) %s: got error %v, expected an error about %s", test.name, err, test.record)
+			continue
+		}
+		if test.opts.OnConflict == "fail" && !errors.Is(err, kvstore.ErrKeyExists) {
+			t.Errorf("Import(...) %s: got error %v, expected %v", test.name, err, kvstore.ErrKeyExists)
+		}
+		if imported != test.imported {
+			t.Errorf("Import(...) %s: imported %d records, expected %d", test.name, imported, test.imported)
+		}
+		got := storeValues(t, store, "b", "k1", "k2", "k3", "k5")
+		for i, v := range got {
+			if committed := i < test.imported; committed != (v != "") {
+				t.Errorf("Import(...) %s: value of record %d is %q after the error, expected it committed: %v", test.name, i+1, v, committed)
+			}
+		}
+
+		resumed := importRecords("k1", "k2", "k3", "k5")
+		test.opts.Format, test.opts.OnConflict = "ndjson", "skip"
+		imported, skipped, err := Import(store, strings.NewReader(resumed), test.opts)
+		if err != nil || imported != 4-test.imported || skipped != test.imported {
+			t.Errorf("resuming Import(...) %s = %d, %d, %v, expected %d records imported and %d skipped", test.name, imported, skipped, err, 4-test.imported, test.imported)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yazgazan/kvstore/block"
+)
+
+// Inspect writes the metadata, the object table and the block chains of the
+// block DB at fpath to w, opening it read-only. With object set, only the
+// chain of that object is written, the index object being named "index". With
+// asJSON, they are written as a JSON object.
+func Inspect(fpath string, w io.Writer, object string, asJSON bool) error {
+	db, closeDB, err := openBlockDB(fpath)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	meta := db.Meta()
+	objects := db.Objects()
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	blocks, err := db.Blocks()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return inspectJSON(w, meta, objects, blocks, object)
+	}
+	if object == "" {
+		inspectMeta(w, meta)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "\nOBJECT\tSTART\tLAST\tSIZE")
+		for _, o := range objects {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", o.Name, o.StartBlock, o.LastBlock, o.Size)
+		}
+		err = tw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	chains := []block.ObjectMeta{{Name: "index"}}
+	chains = append(chains, objects...)
+	var found bool
+	for _, o := range chains {
+		if object != "" && o.Name != object {
+			continue
+		}
+		found = true
+		fmt.Fprintf(w, "\n%s:\n", o.Name)
+		inspectChain(w, blocks, o.StartBlock)
+	}
+	if !found {
+		return fmt.Errorf("object %q %w", object, errNotFound)
+	}
+
+	return nil
+}
+
+type metaOutput struct {
+	Version        uint32 `json:"version"`
+	BlockSize      uint32 `json:"block_size"`
+	BlockCount     uint32 `json:"block_count"`
+	FirstFreeBlock uint32 `json:"first_free_block"`
+	Flags          uint32 `json:"flags"`
+
+	// v2
+	Generation uint64     `json:"generation,omitempty"`
+	UUID       string     `json:"uuid,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	OpenedAt   *time.Time `json:"opened_at,omitempty"`
+}
+
+type objectOutput struct {
+	Name       string `json:"name"`
+	StartBlock uint32 `json:"start_block"`
+	LastBlock  uint32 `json:"last_block"`
+	Size       int64  `json:"size"`
+}
+
+type chainLink struct {
+	Block      uint32 `json:"block"`
+	End        uint32 `json:"end"`
+	Next       uint32 `json:"next"`
+	Flags      uint32 `json:"flags"`
+	Generation uint64 `json:"generation"`
+	Problem    string `json:"problem,omitempty"` // the chain stops at this block
+}
+
+func inspectJSON(w io.Writer, meta block.DBMeta, objects []block.ObjectMeta, blocks []block.BlockMeta, object string) error {
+	var out struct {
+		Meta    *metaOutput            `json:"meta,omitempty"`
+		Objects []objectOutput         `json:"objects,omitempty"`
+		Chains  map[string][]chainLink `json:"chains"`
+	}
+	if object == "" {
+		out.Meta = &metaOutput{
+			Version:        meta.Version,
+			BlockSize:      meta.BlockSize,
+			BlockCount:     meta.BlockCount,
+			FirstFreeBlock: meta.FirstFreeBlock,
+			Flags:          meta.Flags,
+		}
+		if meta.Version > 1 {
+			createdAt := time.Unix(0, meta.CreatedAt).UTC()
+			openedAt := time.Unix(0, meta.OpenedAt).UTC()
+			out.Meta.Generation, out.Meta.UUID = meta.Generation, meta.UUIDString()
+			out.Meta.CreatedAt, out.Meta.OpenedAt = &createdAt, &openedAt
+		}
+		out.Objects = make([]objectOutput, len(objects))
+		for i, o := range objects {
+			out.Objects[i] = objectOutput{Name: o.Name, StartBlock: o.StartBlock, LastBlock: o.LastBlock, Size: o.Size}
+		}
+	}
+
+	out.Chains = map[string][]chainLink{}
+	for _, o := range append([]block.ObjectMeta{{Name: "index"}}, objects...) {
+		if object == "" || o.Name == object {
+			out.Chains[o.Name] = chainLinks(blocks, o.StartBlock)
+		}
+	}
+	if len(out.Chains) == 0 {
+		return fmt.Errorf("object %q %w", object, errNotFound)
+	}
+
+	return json.NewEncoder(w).Encode(out)
+}
+
+// openBlockDB opens the block DB at fpath read-only, with dbOptions.
+func openBlockDB(fpath string) (*block.BlockDB, func(), error) {
+	return openBlockDBWith(fpath, dbOptions)
+}
+
+func openBlockDBWith(fpath string, opts []block.Option) (*block.BlockDB, func(), error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := block.OpenShared(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return db, func() {
+		db.Close()
+		f.Close()
+	}, nil
+}
+
+func inspectMeta(w io.Writer, meta block.DBMeta) {
+	var flags []string
+	for _, flag := range []struct {
+		flag uint32
+		name string
+	}{
+		{block.FlagEncrypted, "encrypted"},
+		{block.FlagCompressed, "compressed"},
+		{block.FlagDirty, "dirty"},
+	} {
+		if meta.Flags&flag.flag != 0 {
+			flags = append(flags, flag.name)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "version:\t%d\n", meta.Version)
+	fmt.Fprintf(tw, "block size:\t%d\n", meta.BlockSize)
+	fmt.Fprintf(tw, "block count:\t%d\n", meta.BlockCount)
+	fmt.Fprintf(tw, "first free block:\t%d\n", meta.FirstFreeBlock)
+	fmt.Fprintf(tw, "flags:\t%s\n", strings.TrimSpace(fmt.Sprintf("0x%x %s", meta.Flags, strings.Join(flags, ","))))
+	if meta.Version > 1 {
+		fmt.Fprintf(tw, "generation:\t%d\n", meta.Generation)
+		fmt.Fprintf(tw, "uuid:\t%s\n", meta.UUIDString())
+		fmt.Fprintf(tw, "created at:\t%s\n", time.Unix(0, meta.CreatedAt).UTC().Format(time.RFC3339))
+		fmt.Fprintf(tw, "opened at:\t%s\n", time.Unix(0, meta.OpenedAt).UTC().Format(time.RFC3339))
+	}
+	_ = tw.Flush()
+}
+
+// chainLinks returns the blocks of the chain starting at start, stopping at a
+// block out of range or already visited.
+func chainLinks(blocks []block.BlockMeta, start uint32) []chainLink {
+	var links []chainLink
+	seen := map[uint32]bool{}
+	for idx := start; ; {
+		if int(idx) >= len(blocks) {
+			links = append(links, chainLink{Block: idx, Problem: "past the last block"})
+			break
+		}
+		if seen[idx] {
+			links = append(links, chainLink{Block: idx, Problem: "loops back"})
+			break
+		}
+		seen[idx] = true
+		b := blocks[idx]
+		links = append(links, chainLink{Block: idx, End: b.End, Next: b.Next, Flags: b.Flags, Generation: b.Generation})
+		if b.Next == 0 {
+			break
+		}
+		idx = b.Next
+	}
+
+	return links
+}
+
+// inspectChain writes the blocks of the chain starting at start.
+func inspectChain(w io.Writer, blocks []block.BlockMeta, start uint32) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "BLOCK\tEND\tNEXT\tFLAGS\tGENERATION\t")
+	for _, l := range chainLinks(blocks, start) {
+		if l.Problem != "" {
+			fmt.Fprintf(tw, "%d\t%s\t\t\t\t\n", l.Block, l.Problem)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t0x%x\t%d\t\n", l.Block, l.End, l.Next, l.Flags, l.Generation)
+	}
+	_ = tw.Flush()
+}
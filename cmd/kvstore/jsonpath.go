@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed JSON path expression, a subset of the usual syntax:
+// $ followed by .name, .*, ['name'], [n] and [*] segments.
+type jsonPath []pathSegment
+
+type pathSegment struct {
+	name  string
+	index int
+	kind  segmentKind
+}
+
+type segmentKind int
+
+const (
+	segmentName segmentKind = iota
+	segmentIndex
+	segmentWildcard
+)
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("json path %q doesn't start with $", expr)
+	}
+	rest := expr[1:]
+
+	var path jsonPath
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return nil, fmt.Errorf("json path %q has an empty name", expr)
+			case "*":
+				path = append(path, pathSegment{kind: segmentWildcard})
+			default:
+				path = append(path, pathSegment{name: name})
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q has an unclosed [", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				path = append(path, pathSegment{kind: segmentWildcard})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				path = append(path, pathSegment{name: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("json path %q has an invalid index %q", expr, inner)
+				}
+				path = append(path, pathSegment{index: n, kind: segmentIndex})
+			}
+		default:
+			return nil, fmt.Errorf("json path %q: unexpected %q", expr, rest[0])
+		}
+	}
+
+	return path, nil
+}
+
+// eval returns the nodes of v, decoded by encoding/json, the path selects.
+// Negative indexes count from the end of arrays.
+func (path jsonPath) eval(v interface{}) []interface{} {
+	nodes := []interface{}{v}
+	for _, seg := range path {
+		var next []interface{}
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case map[string]interface{}:
+				switch seg.kind {
+				case segmentName:
+					child, ok := node[seg.name]
+					if ok {
+						next = append(next, child)
+					}
+				case segmentWildcard:
+					for _, child := range node {
+						next = append(next, child)
+					}
+				}
+			case []interface{}:
+				switch seg.kind {
+				case segmentIndex:
+					i := seg.index
+					if i < 0 {
+						i += len(node)
+					}
+					if i >= 0 && i < len(node) {
+						next = append(next, node[i])
+					}
+				case segmentWildcard:
+					next = append(next, node...)
+				}
+			}
+		}
+		nodes = next
+	}
+
+	return nodes
+}
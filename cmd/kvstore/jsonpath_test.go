@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestParseJSONPathErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"a.b",
+		".a",
+		"$.",
+		"$..a",
+		"$.a.",
+		"$[",
+		"$.a[0",
+		"$[]",
+		"$[a]",
+		"$['a]",
+		"$[1.5]",
+		"$a",
+		"$ .a",
+	} {
+		_, err := parseJSONPath(expr)
+		if err == nil {
+			t.Errorf("parseJSONPath(%q): expected an error", expr)
+		}
+	}
+}
+
+func TestJSONPathEval(t *testing.T) {
+	const doc = `{
+		"name": "a",
+		"tags": ["x", "y", "z"],
+		"items": [{"name": "b", "n": 1}, {"name": "c"}, {"id": 3}],
+		"nested": {"a.b": {"c": true}, "empty": []},
+		"value": null
+	}`
+	var v interface{}
+	err := json.Unmarshal([]byte(doc), &v)
+	if err != nil {
+		t.Errorf("json.Unmarshal(...): unexpected error: %v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		expr     string
+		expected []string // sorted
+	}{
+		{"$", []string{mustJSON(v)}},
+		{"$.name", []string{`"a"`}},
+		{"$['name']", []string{`"a"`}},
+		{`$["name"]`, []string{`"a"`}},
+		{"$.missing", nil},
+		{"$.missing.deeper", nil},
+		{"$.name.deeper", nil},
+		{"$.value", []string{"null"}},
+		{"$.tags[0]", []string{`"x"`}},
+		{"$.tags[2]", []string{`"z"`}},
+		{"$.tags[3]", nil},
+		{"$.tags[-1]", []string{`"z"`}},
+		{"$.tags[-3]", []string{`"x"`}},
+		{"$.tags[-4]", nil},
+		{"$.tags[*]", []string{`"x"`, `"y"`, `"z"`}},
+		{"$.tags.*", []string{`"x"`, `"y"`, `"z"`}},
+		{"$.tags.name", nil},
+		{"$.name[0]", nil},
+		{"$[0]", nil},
+		{"$.items[*].name", []string{`"b"`, `"c"`}},
+		{"$.items[1].name", []string{`"c"`}},
+		{"$.items[2].name", nil},
+		{"$.items[*].n", []string{"1"}},
+		{"$.nested['a.b'].c", []string{"true"}},
+		{"$.nested.empty[*]", nil},
+		{"$.nested.empty[0]", nil},
+		{"$.*.c", nil},
+		{"$.nested.*.c", []string{"true"}},
+	} {
+		path, err := parseJSONPath(test.expr)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q): unexpected error: %v", test.expr, err)
+			continue
+		}
+		var got []string
+		for _, node := range path.eval(v) {
+			got = append(got, mustJSON(node))
+		}
+		sort.Strings(got) // object wildcards select the members in any order
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("%s selects %v, expected %v", test.expr, got, test.expected)
+		}
+	}
+}
+
+func mustJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(b)
+}
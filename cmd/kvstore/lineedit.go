@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C is typed.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal, with a history browsed with the up
+// and down arrows and tab completion of the last word. When in isn't a
+// terminal, lines are read as they come.
+type lineEditor struct {
+	in       *os.File
+	out      io.Writer
+	r        *bufio.Reader
+	history  []string
+	complete func(words []string) []string // candidates for the last word
+}
+
+func newLineEditor(in *os.File, out io.Writer, complete func(words []string) []string) *lineEditor {
+	return &lineEditor{
+		in:       in,
+		out:      out,
+		r:        bufio.NewReader(in),
+		complete: complete,
+	}
+}
+
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.in.Fd())
+	if err != nil {
+		line, err := e.r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+
+	fmt.Fprint(e.out, prompt)
+	var (
+		line []byte
+		hist = len(e.history)
+	)
+	redraw := func(line []byte) {
+		fmt.Fprintf(e.out, "\r\x1b[K%s%s", prompt, line)
+	}
+	for {
+		c, err := e.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			if len(line) > 0 {
+				e.history = append(e.history, string(line))
+			}
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case 127, '\b':
+			if len(line) > 0 {
+				_, n := utf8.DecodeLastRune(line)
+				line = line[:len(line)-n]
+				redraw(line)
+			}
+		case '\t':
+			line = e.completeLine(line, redraw)
+		case 27: // escape sequence, only the up and down arrows are handled
+			seq := make([]byte, 2)
+			_, err = io.ReadFull(e.r, seq)
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case seq[0] != '[':
+			case seq[1] == 'A' && hist > 0:
+				hist--
+				line = []byte(e.history[hist])
+				redraw(line)
+			case seq[1] == 'B' && hist < len(e.history):
+				hist++
+				line = nil
+				if hist < len(e.history) {
+					line = []byte(e.history[hist])
+				}
+				redraw(line)
+			}
+		default:
+			if c < ' ' {
+				continue
+			}
+			line = append(line, c)
+			fmt.Fprintf(e.out, "%c", c)
+		}
+	}
+}
+
+// completeLine completes the last word of line with the longest prefix shared
+// by its candidates, listing them when there are several.
+func (e *lineEditor) completeLine(line []byte, redraw func([]byte)) []byte {
+	if e.complete == nil {
+		return line
+	}
+	words := strings.Fields(string(line))
+	if len(line) == 0 || line[len(line)-1] == ' ' {
+		words = append(words, "")
+	}
+	last := words[len(words)-1]
+
+	var candidates []string
+	for _, c := range e.complete(words) {
+		if strings.HasPrefix(c, last) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		return line
+	}
+	sort.Strings(candidates)
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	line = append(line, prefix[len(last):]...)
+	if len(candidates) == 1 {
+		line = append(line, ' ')
+	} else if prefix == last {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	}
+	redraw(line)
+
+	return line
+}
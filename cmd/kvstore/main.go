@@ -1,31 +1,133 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/yazgazan/kvstore"
+	"github.com/yazgazan/kvstore/block"
 )
 
+// readOnly is set by --read-only, for the stores to be opened without writing
+// to them.
+var readOnly bool
+
+// dbOptions are given to the block DBs opened by the commands, with the cipher
+// key read from --key-file.
+var dbOptions []block.Option
+
+// openStore opens the store at fpath with dbOptions, read-only with
+// --read-only.
+func openStore(fpath string) (kvstore.Store, error) {
+	if readOnly {
+		return kvstore.OpenReadOnly(fpath, dbOptions...)
+	}
+
+	return openWritableStore(fpath)
+}
+
+// openWritableStore opens the store at fpath with dbOptions, creating it when
+// it doesn't exist, ignoring --read-only.
+func openWritableStore(fpath string) (kvstore.Store, error) {
+	return kvstore.NewFromFile(fpath, dbOptions...)
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command and returns the status to exit with, the one given to
+// exit or 0.
+func run() (status int) {
+	defer func() {
+		r := recover()
+		if s, ok := r.(exitStatus); ok {
+			status = int(s)
+			return
+		}
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	flag.BoolVar(&jsonOutput, "json", false, "write the results and the errors as JSON")
+	flag.BoolVar(&readOnly, "read-only", false, "open the stores read-only, failing the commands writing to them, the source only for copy")
+	keyFile := flag.String("key-file", "", "read the cipher key from this file, for every store the command opens or creates")
 	flag.Parse()
+	if *keyFile != "" {
+		key, err := readKeyFile(*keyFile)
+		exitOnError(err, "", "")
+		dbOptions = append(dbOptions, block.WithCipher(key))
+	}
 
 	args := flag.Args()
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "copy":
+			copyStores(args[1:])
+			return
+		case "diff":
+			diffStores(args[1:])
+			return
+		case "restore":
+			restore(args[1:])
+			return
+		case "migrate":
+			migrate(args[1:])
+			return
+		case "encrypt", "decrypt":
+			cipherStore(strings.ToLower(args[0]), args[1:])
+			return
+		}
+	}
 	if len(args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <path> <get|list|set|delete|buckets> [command options...]\n", flag.CommandLine.Name())
-		os.Exit(2)
+		usage(
+			"[--json] [--read-only] [--key-file <file>] <copy|diff|restore> [command options...] <path-a> <path-b>",
+			"[--json] [--read-only] [--key-file <file>] <migrate|encrypt|decrypt> [command options...] <path>",
+			"[--json] [--read-only] [--key-file <file>] <path> <create|get|mget|mset|list|keys|set|delete|delete-bucket|rename-key|rename-bucket|buckets|export|import|serve|shell|verify|search|inspect|blocks|object|tail|backup|ttl|expire|gc|batch> [command options...]",
+		)
 	}
 	fpath := args[0]
 	args = args[1:]
-	store, err := kvstore.NewFromFile(fpath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	switch strings.ToLower(args[0]) {
+	case "inspect":
+		inspect(fpath, args[1:])
+		return
+	case "blocks":
+		blocks(fpath, args[1:])
+		return
+	case "create":
+		createStore(fpath, args[1:])
+		return
+	case "object":
+		object(fpath, args[1:])
+		return
+	case "tail":
+		tail(fpath, args[1:])
+		return
+	case "backup":
+		backup(fpath, args[1:])
+		return
 	}
+	store, err := openStore(fpath)
+	exitOnError(err, "", "")
 	defer store.Close()
 
 	cmd := (args[0])
@@ -33,55 +135,307 @@ func main() {
 
 	switch strings.ToLower(cmd) {
 	default:
-		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", cmd)
-		os.Exit(2)
+		printError("usage", fmt.Sprintf("unknown command %q", cmd), "", "")
+		exit(exitUsage)
 	case "get":
-		if len(args) != 2 {
-			fmt.Fprintf(os.Stderr, "Usage: %s <path> get <bucket> <key>\n", flag.CommandLine.Name())
-			os.Exit(2)
+		fs := flag.NewFlagSet("get", flag.ContinueOnError)
+		var opts GetOptions
+		fs.BoolVar(&opts.Pretty, "pretty", false, "indent the values")
+		fs.BoolVar(&opts.Raw, "raw", false, "write the exact stored bytes of a single value")
+		output := fs.String("output", "", "write to this file instead of stdout")
+		parseFlags(fs, args)
+		if fs.NArg() < 2 {
+			usage("<path> get [--pretty|--raw] [--output <file>] <bucket> <key> [key...]")
 		}
-		err = Get(store, args[0], args[1])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		opts.Object = jsonOutput
+		key := ""
+		if fs.NArg() == 2 {
+			key = fs.Arg(1)
 		}
-	case "list":
+		w := io.Writer(os.Stdout)
+		var f *os.File
+		if *output != "" {
+			f, err = os.Create(*output)
+			exitOnError(err, "", "")
+			w = f
+		}
+		err = Get(store, w, fs.Arg(0), fs.Args()[1:], opts)
+		if f != nil {
+			cerr := f.Close()
+			if err == nil {
+				err = cerr
+			}
+		}
+		exitOnError(err, fs.Arg(0), key)
+	case "mget":
+		fs := flag.NewFlagSet("mget", flag.ContinueOnError)
+		pretty := fs.Bool("pretty", false, "indent the object")
+		parseFlags(fs, args)
+		if fs.NArg() < 2 {
+			usage("<path> mget [--pretty] <bucket> <key> [key...]")
+		}
+		err = Get(store, os.Stdout, fs.Arg(0), fs.Args()[1:], GetOptions{Pretty: *pretty, Object: true})
+		exitOnError(err, fs.Arg(0), "")
+	case "mset":
 		if len(args) != 1 {
-			fmt.Fprintf(os.Stderr, "Usage: %s <path> list <bucket>\n", flag.CommandLine.Name())
-			os.Exit(2)
+			usage("<path> mset <bucket> < object")
 		}
-		err = List(store, args[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		n, err := MSet(store, os.Stdin, args[0])
+		exitOnError(err, args[0], "")
+		if jsonOutput {
+			emit(struct {
+				Set int `json:"set"`
+			}{n})
+			return
 		}
+		fmt.Fprintf(os.Stderr, "set %d keys\n", n)
+	case "list", "keys":
+		fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+		var opts ListOptions
+		fs.BoolVar(&opts.Values, "values", false, "list the values along the keys")
+		fs.StringVar(&opts.Format, "format", "table", "output format, table, json or csv")
+		fs.BoolVar(&opts.Print0, "print0", strings.ToLower(cmd) == "keys", "end the keys with a NUL byte instead of a newline, for xargs -0")
+		fs.StringVar(&opts.Prefix, "prefix", "", "only list the keys with this prefix")
+		fs.StringVar(&opts.Glob, "glob", "", "only list the keys matching this glob pattern")
+		fs.StringVar(&opts.Regex, "regex", "", "only list the keys matching this regular expression")
+		fs.StringVar(&opts.After, "after", "", "only list the keys sorted after this one")
+		fs.IntVar(&opts.Limit, "limit", 0, "list at most this many keys")
+		parseFlags(fs, args)
+		if fs.NArg() != 1 {
+			usage(
+				"<path> list [--values] [--format table|json|csv] [--print0] [--prefix <prefix>] [--glob <pattern>] [--regex <expr>] [--after <key>] [--limit <n>] <bucket>",
+				"<path> keys [--prefix <prefix>] [--glob <pattern>] [--regex <expr>] [--after <key>] [--limit <n>] <bucket>",
+			)
+		}
+		if jsonOutput {
+			opts.Format, opts.Print0 = "json", false
+		}
+		err = List(store, os.Stdout, fs.Arg(0), opts)
+		exitOnError(err, fs.Arg(0), "")
 	case "set":
 		if len(args) != 3 {
-			fmt.Fprintf(os.Stderr, "Usage: %s <path> set <bucket> <key> <value>\n", flag.CommandLine.Name())
-			os.Exit(2)
+			usage("<path> set <bucket> <key> <value>")
 		}
 		err = Set(store, args[0], args[1], args[2])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
+		exitOnError(err, args[0], args[1])
+		emitOK()
 	case "delete":
 		if len(args) != 2 {
-			fmt.Fprintf(os.Stderr, "Usage: %s <path> delete <bucket> <key>\n", flag.CommandLine.Name())
-			os.Exit(2)
+			usage("<path> delete <bucket> <key>")
 		}
 		err = Delete(store, args[0], args[1])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		exitOnError(err, args[0], args[1])
+		emitOK()
+	case "delete-bucket":
+		fs := flag.NewFlagSet("delete-bucket", flag.ContinueOnError)
+		yes := fs.Bool("yes", false, "delete without asking for confirmation")
+		dryRun := fs.Bool("dry-run", false, "print the number of keys that would be removed")
+		parseFlags(fs, args)
+		if fs.NArg() != 1 {
+			usage("<path> delete-bucket [--yes] [--dry-run] <bucket>")
+		}
+		bucket := fs.Arg(0)
+		n, err := DeleteBucket(store, os.Stdin, os.Stderr, bucket, *yes, *dryRun)
+		exitOnError(err, bucket, "")
+		if jsonOutput {
+			emit(struct {
+				Bucket  string `json:"bucket"`
+				Keys    int    `json:"keys"`
+				Deleted bool   `json:"deleted"`
+			}{bucket, n, !*dryRun})
+			return
+		}
+		if *dryRun {
+			fmt.Fprintf(os.Stderr, "would delete bucket %q and its %d keys\n", bucket, n)
+			return
 		}
+		fmt.Fprintf(os.Stderr, "deleted bucket %q and its %d keys\n", bucket, n)
+	case "rename-key":
+		if len(args) != 3 {
+			usage("<path> rename-key <bucket> <old> <new>")
+		}
+		err = RenameKey(store, args[0], args[1], args[2])
+		exitOnError(err, args[0], args[1])
+		emitOK()
+	case "rename-bucket":
+		if len(args) != 2 {
+			usage("<path> rename-bucket <old> <new>")
+		}
+		err = RenameBucket(store, args[0], args[1])
+		exitOnError(err, args[0], "")
+		emitOK()
 	case "buckets":
+		if jsonOutput {
+			buckets, err := store.Buckets()
+			exitOnError(err, "", "")
+			sort.Strings(buckets)
+			emit(buckets)
+			return
+		}
 		err = Buckets(store)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		exitOnError(err, "", "")
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		bucket := fs.String("bucket", "", "only export this bucket")
+		format := fs.String("format", "ndjson", "output format, ndjson or json")
+		parseFlags(fs, args)
+		if fs.NArg() != 0 {
+			usage("<path> export [--bucket <bucket>] [--format ndjson|json]")
+		}
+		err = Export(store, os.Stdout, *bucket, *format)
+		exitOnError(err, *bucket, "")
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ContinueOnError)
+		var opts ImportOptions
+		fs.StringVar(&opts.Format, "format", "ndjson", "input format, ndjson or json")
+		fs.IntVar(&opts.Batch, "batch", 1000, "records written per transaction, the ones committed before an invalid record are kept")
+		fs.BoolVar(&opts.DryRun, "dry-run", false, "check the records without writing them")
+		fs.StringVar(&opts.OnConflict, "on-conflict", "overwrite", "when a key exists: overwrite, skip or fail")
+		parseFlags(fs, args)
+		if fs.NArg() > 1 {
+			usage("<path> import [--format ndjson|json] [--batch <n>] [--dry-run] [--on-conflict overwrite|skip|fail] [file]")
+		}
+		r := io.Reader(os.Stdin)
+		if fs.NArg() == 1 && fs.Arg(0) != "-" {
+			f, err := os.Open(fs.Arg(0))
+			exitOnError(err, "", "")
+			defer f.Close()
+			r = f
+		}
+		imported, skipped, err := Import(store, r, opts)
+		if jsonOutput {
+			emit(struct {
+				Imported int  `json:"imported"`
+				Skipped  int  `json:"skipped"`
+				DryRun   bool `json:"dry_run"`
+			}{imported, skipped, opts.DryRun})
+		} else {
+			verb := "imported"
+			if opts.DryRun {
+				verb = "would import"
+			}
+			fmt.Fprintf(os.Stderr, "%s %d records, skipped %d\n", verb, imported, skipped)
+		}
+		exitOnError(err, "", "")
+	case "serve":
+		fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+		listen := fs.String("listen", "127.0.0.1:8080", "address to listen on, requests aren't authenticated")
+		writable := fs.Bool("writable", false, "serve PUT and DELETE, writing to the store")
+		parseFlags(fs, args)
+		if fs.NArg() != 0 {
+			usage("<path> serve [--listen <addr>] [--writable]")
+		}
+		err = Serve(store, *listen, *writable)
+		exitOnError(err, "", "")
+	case "shell":
+		if len(args) != 0 {
+			usage("<path> shell")
+		}
+		err = Shell(store, os.Stdin, os.Stdout)
+		exitOnError(err, "", "")
+	case "search":
+		fs := flag.NewFlagSet("search", flag.ContinueOnError)
+		expr := fs.String("jsonpath", "", "only search the nodes this JSON path selects, like $.items[*].name")
+		parseFlags(fs, args)
+		if fs.NArg() != 2 {
+			usage("<path> search [--jsonpath <expr>] <bucket> <query>")
+		}
+		keys, err := Search(store, fs.Arg(0), fs.Arg(1), *expr)
+		exitOnError(err, fs.Arg(0), "")
+		if jsonOutput {
+			emit(keys)
+			return
+		}
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+	case "ttl":
+		if len(args) != 2 && len(args) != 3 {
+			usage("<path> ttl <bucket> <key> [duration|none]")
+		}
+		if len(args) == 3 {
+			err = SetTTL(store, args[0], args[1], args[2])
+			exitOnError(err, args[0], args[1])
+			emitOK()
+			return
+		}
+		expiry, err := TTL(store, args[0], args[1])
+		exitOnError(err, args[0], args[1])
+		if jsonOutput {
+			emit(ttlResult(expiry))
+			return
+		}
+		fmt.Println(formatTTL(expiry))
+	case "expire":
+		fs := flag.NewFlagSet("expire", flag.ContinueOnError)
+		scan := fs.Bool("scan", false, "delete the expired keys of every bucket")
+		parseFlags(fs, args)
+		if fs.NArg() != 0 || !*scan {
+			usage("<path> expire --scan")
+		}
+		n, err := store.PurgeExpired()
+		exitOnError(err, "", "")
+		if jsonOutput {
+			emit(struct {
+				Purged int `json:"purged"`
+			}{n})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "purged %d expired keys\n", n)
+	case "gc":
+		if len(args) != 0 {
+			usage("<path> gc")
+		}
+		report, err := store.GC()
+		exitOnError(err, "", "")
+		if jsonOutput {
+			emit(struct {
+				Chunks     int   `json:"chunks"`
+				ChunkBytes int64 `json:"chunk_bytes"`
+				Blocks     int   `json:"blocks"`
+				BlockBytes int64 `json:"block_bytes"`
+			}{report.Chunks, report.ChunkBytes, report.Blocks, report.BlockBytes})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "freed %d chunks (%d bytes) and %d blocks (%d bytes)\n", report.Chunks, report.ChunkBytes, report.Blocks, report.BlockBytes)
+	case "batch":
+		fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+		format := fs.String("format", "script", "input format, script or ndjson")
+		parseFlags(fs, args)
+		if fs.NArg() != 0 {
+			usage("<path> batch [--format script|ndjson] < ops")
+		}
+		n, err := Batch(store, os.Stdin, *format)
+		exitOnError(err, "", "")
+		if jsonOutput {
+			emit(struct {
+				Applied int `json:"applied"`
+			}{n})
+			return
+		}
+		fmt.Fprintf(os.Stderr, "applied %d ops\n", n)
+	case "verify":
+		fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+		repair := fs.Bool("repair", false, "repair the buckets with problems")
+		parseFlags(fs, args)
+		if fs.NArg() != 0 {
+			usage("<path> verify [--repair]")
+		}
+		ok, err := Verify(store, os.Stdout, *repair, jsonOutput)
+		exitOnError(err, "", "")
+		if !ok {
+			exit(exitProblems)
 		}
 	}
+
+	return 0
+}
+
+// emitOK writes an okResult in JSON mode, for the commands with no output.
+func emitOK() {
+	if jsonOutput {
+		emit(okResult{OK: true})
+	}
 }
 
 func Buckets(store kvstore.Store) error {
@@ -98,35 +452,516 @@ func Buckets(store kvstore.Store) error {
 	return nil
 }
 
-func List(store kvstore.Store, bucket string) error {
+type ListOptions struct {
+	Values bool   // list the values along the keys
+	Format string // table, json or csv
+	Print0 bool   // end the keys with a NUL byte, in the table format
+
+	Prefix string
+	Glob   string // path.Match pattern
+	Regex  string
+	After  string // only keys sorted after this one
+	Limit  int    // no limit when <= 0
+}
+
+// filter returns the KeyFilter selecting the keys to list, the glob and the
+// regex being matched while walking the bucket.
+func (opts ListOptions) filter() (kvstore.KeyFilter, error) {
+	f := kvstore.KeyFilter{
+		Prefix: opts.Prefix,
+		After:  opts.After,
+		Limit:  opts.Limit,
+	}
+	var re *regexp.Regexp
+	if opts.Regex != "" {
+		var err error
+		re, err = regexp.Compile(opts.Regex)
+		if err != nil {
+			return f, err
+		}
+	}
+	if opts.Glob != "" {
+		_, err := path.Match(opts.Glob, "")
+		if err != nil {
+			return f, fmt.Errorf("glob %q: %w", opts.Glob, err)
+		}
+	}
+	if opts.Glob == "" && re == nil {
+		return f, nil
+	}
+	f.Match = func(key string) bool {
+		if opts.Glob != "" {
+			ok, _ := path.Match(opts.Glob, key)
+			if !ok {
+				return false
+			}
+		}
+
+		return re == nil || re.MatchString(key)
+	}
+
+	return f, nil
+}
+
+// List writes the sorted keys of bucket selected by opts to w, with their
+// values when opts.Values is set. The table format writes a key per line,
+// followed by its value in an aligned column, or each key followed by a NUL
+// byte with opts.Print0. The json format writes an array of keys, or an object
+// of the values by key, and the csv format a key,value header then a row per
+// key.
+func List(store kvstore.Store, w io.Writer, bucket string, opts ListOptions) error {
+	switch opts.Format {
+	case "", "table", "json", "csv":
+	default:
+		return invalidf("unknown format %q", opts.Format)
+	}
+	if opts.Print0 && (opts.Values || opts.Format == "json" || opts.Format == "csv") {
+		return invalidf("--print0 only lists keys, in the table format")
+	}
+	f, err := opts.filter()
+	if err != nil {
+		return err
+	}
+
 	tx := store.Reader()
 	defer tx.Rollback()
 
-	keys, err := tx.List(bucket)
+	keys, err := tx.Keys(bucket, f)
 	if err != nil {
 		return err
 	}
+	var values []json.RawMessage
+	if opts.Values {
+		values = make([]json.RawMessage, len(keys))
+		for i, k := range keys {
+			err = tx.Get(bucket, k, &values[i])
+			if err != nil {
+				return &entryError{Bucket: bucket, Key: k, Err: err}
+			}
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
-	sort.Strings(keys)
-	for _, k := range keys {
-		fmt.Println(k)
+	switch opts.Format {
+	case "json":
+		var v interface{} = keys
+		if opts.Values {
+			byKey := make(map[string]json.RawMessage, len(keys))
+			for i, k := range keys {
+				byKey[k] = values[i]
+			}
+			v = byKey
+		}
+		if !opts.Values && keys == nil {
+			v = []string{}
+		}
+		return json.NewEncoder(w).Encode(v)
+	case "csv":
+		cw := csv.NewWriter(w)
+		header := []string{"key"}
+		if opts.Values {
+			header = append(header, "value")
+		}
+		err = cw.Write(header)
+		for i, k := range keys {
+			if err != nil {
+				break
+			}
+			row := []string{k}
+			if opts.Values {
+				row = append(row, string(values[i]))
+			}
+			err = cw.Write(row)
+		}
+		if err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
 	}
 
-	return nil
+	if opts.Print0 {
+		bw := bufio.NewWriter(w)
+		for _, k := range keys {
+			bw.WriteString(k)
+			bw.WriteByte(0)
+		}
+		return bw.Flush()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, k := range keys {
+		if opts.Values {
+			_, err = fmt.Fprintf(tw, "%s\t%s\n", k, values[i])
+		} else {
+			_, err = fmt.Fprintln(tw, k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
 }
 
-func Get(store kvstore.Store, bucket, key string) error {
-	var b json.RawMessage
+func copyStores(args []string) {
+	fs := flag.NewFlagSet("copy", flag.ContinueOnError)
+	var opts CopyOptions
+	fs.StringVar(&opts.Bucket, "bucket", "", "only copy this bucket")
+	fs.StringVar(&opts.Prefix, "prefix", "", "only copy the keys with this prefix")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		usage("copy [--bucket <bucket>] [--prefix <prefix>] <src-path> <dst-path>")
+	}
+	if filepath.Clean(fs.Arg(0)) == filepath.Clean(fs.Arg(1)) {
+		exitOnError(invalidf("source and destination are the same store"), "", "")
+	}
 
-	err := store.Get(bucket, key, &b)
+	src, err := openStore(fs.Arg(0))
+	exitOnError(err, "", "")
+	dst, err := openWritableStore(fs.Arg(1))
+	if err != nil {
+		src.Close()
+		exitOnError(err, "", "")
+	}
+
+	copied, err := Copy(src, dst, opts)
+	if jsonOutput {
+		emit(struct {
+			Copied int `json:"copied"`
+		}{copied})
+	} else {
+		fmt.Fprintf(os.Stderr, "copied %d entries\n", copied)
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	src.Close()
+	exitOnError(err, opts.Bucket, "")
+}
+
+// diffStores exits with exitProblems when the stores differ.
+func diffStores(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	var opts DiffOptions
+	fs.StringVar(&opts.Bucket, "bucket", "", "only compare this bucket")
+	fs.BoolVar(&opts.Values, "values", false, "print the values of the keys that differ")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		usage("diff [--bucket <bucket>] [--values] <path-a> <path-b>")
+	}
+	if filepath.Clean(fs.Arg(0)) == filepath.Clean(fs.Arg(1)) {
+		exitOnError(invalidf("comparing a store with itself"), "", "")
+	}
+	for _, fpath := range fs.Args() {
+		_, err := os.Stat(fpath)
+		exitOnError(err, "", "")
+	}
+	opts.JSON = jsonOutput
+
+	a, err := openStore(fs.Arg(0))
+	exitOnError(err, "", "")
+	b, err := openStore(fs.Arg(1))
+	if err != nil {
+		a.Close()
+		exitOnError(err, "", "")
+	}
+
+	stats, err := Diff(a, b, os.Stdout, opts)
+	a.Close()
+	b.Close()
+	exitOnError(err, opts.Bucket, "")
+	if !jsonOutput {
+		fmt.Fprintf(os.Stderr, "%d only in %s, %d only in %s, %d differ\n", stats.OnlyA, fs.Arg(0), stats.OnlyB, fs.Arg(1), stats.Differ)
+	}
+	if !stats.Equal() {
+		exit(exitProblems)
+	}
+}
+
+func inspect(fpath string, args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	object := fs.String("object", "", "only print the block chain of this object, index for the index")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usage("<path> inspect [--object <name>]")
+	}
+
+	err := Inspect(fpath, os.Stdout, *object, jsonOutput)
+	exitOnError(err, "", "")
+}
+
+func blocks(fpath string, args []string) {
+	fs := flag.NewFlagSet("blocks", flag.ContinueOnError)
+	allocMap := fs.Bool("map", false, "render an allocation map")
+	format := fs.String("format", "text", "allocation map format, text or svg")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usage("<path> blocks [--map [--format text|svg]]")
+	}
+	if jsonOutput {
+		*allocMap, *format = false, "json"
+	}
+
+	err := Blocks(fpath, os.Stdout, *allocMap, *format)
+	exitOnError(err, "", "")
+}
+
+func createStore(fpath string, args []string) {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	blockSize := fs.Uint("block-size", block.DefaultBlockSize, "size of the blocks in bytes")
+	preallocate := fs.Uint("preallocate", 0, "number of free blocks to allocate up front")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usage("<path> create [--block-size <bytes>] [--preallocate <blocks>]")
+	}
+	if readOnly {
+		exitOnError(kvstore.ErrReadOnly, "", "")
+	}
+	if *blockSize > math.MaxUint32 || *preallocate > math.MaxUint32 {
+		exitOnError(invalidf("--block-size and --preallocate must fit in 32 bits"), "", "")
+	}
+
+	err := Create(fpath, uint32(*blockSize), uint32(*preallocate))
+	exitOnError(err, "", "")
+	emitOK()
+}
+
+func object(fpath string, args []string) {
+	const objectUsage = "<path> object <ls [prefix]|cat <name>|put [--force] <name>|rm <name>>"
+	if len(args) == 0 {
+		usage(objectUsage)
+	}
+	fs := flag.NewFlagSet("object "+args[0], flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace an existing object, for put")
+	parseFlags(fs, args[1:])
+
+	switch cmd := strings.ToLower(args[0]); {
+	case cmd == "ls" && fs.NArg() <= 1:
+		objects, err := ObjectList(fpath, fs.Arg(0))
+		exitOnError(err, "", "")
+		if !jsonOutput {
+			exitOnError(writeObjectList(os.Stdout, objects), "", "")
+			return
+		}
+		out := make([]objectOutput, len(objects))
+		for i, o := range objects {
+			out[i] = objectOutput{Name: o.Name, StartBlock: o.StartBlock, LastBlock: o.LastBlock, Size: o.Size}
+		}
+		emit(out)
+	case cmd == "cat" && fs.NArg() == 1:
+		err := ObjectCat(fpath, os.Stdout, fs.Arg(0))
+		exitOnError(err, "", "")
+	case cmd == "put" && fs.NArg() == 1:
+		if readOnly {
+			exitOnError(kvstore.ErrReadOnly, "", "")
+		}
+		n, err := ObjectPut(fpath, os.Stdin, fs.Arg(0), *force)
+		exitOnError(err, "", "")
+		if jsonOutput {
+			emit(struct {
+				Name string `json:"name"`
+				Size int64  `json:"size"`
+			}{fs.Arg(0), n})
+		}
+	case cmd == "rm" && fs.NArg() == 1:
+		if readOnly {
+			exitOnError(kvstore.ErrReadOnly, "", "")
+		}
+		err := ObjectRemove(fpath, fs.Arg(0))
+		exitOnError(err, "", "")
+		emitOK()
+	default:
+		usage(objectUsage)
+	}
+}
+
+func tail(fpath string, args []string) {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	var opts TailOptions
+	fs.DurationVar(&opts.Interval, "interval", time.Second, "time between polls of the store")
+	fs.BoolVar(&opts.Existing, "existing", false, "print the values of the bucket when starting")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		usage("<path> tail [--interval <duration>] [--existing] <bucket>")
+	}
+	opts.JSON = jsonOutput
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := Tail(ctx, fpath, os.Stdout, fs.Arg(0), opts)
+	exitOnError(err, fs.Arg(0), "")
+}
+
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := fs.Uint("to-version", block.LatestVersion, "format version to migrate to")
+	check := fs.Bool("check", false, "only print the version of the store and whether it needs migrating")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		usage("migrate [--to-version <version>] [--check] <path>")
+	}
+	if *to > math.MaxUint32 {
+		exitOnError(invalidf("unsupported version %d, latest supported version is %d", *to, block.LatestVersion), "", "")
+	}
+	target := uint32(*to)
+
+	var (
+		version uint32
+		err     error
+	)
+	if *check {
+		version, err = MigrateCheck(fs.Arg(0))
+	} else {
+		if readOnly {
+			exitOnError(kvstore.ErrReadOnly, "", "")
+		}
+		version, err = Migrate(fs.Arg(0), target)
+	}
+	exitOnError(err, "", "")
+
+	if jsonOutput {
+		emit(struct {
+			Version  uint32 `json:"version"`
+			Target   uint32 `json:"target"`
+			Migrated bool   `json:"migrated"`
+		}{version, target, !*check && version != target})
+		return
+	}
+	switch {
+	case version == target:
+		fmt.Printf("version %d, no migration needed\n", version)
+	case *check:
+		fmt.Printf("version %d, needs migrating to version %d\n", version, target)
+	default:
+		fmt.Printf("migrated from version %d to version %d\n", version, target)
+	}
+}
+
+// cipherStore runs encrypt and decrypt, whose flags can follow the path.
+func cipherStore(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "file holding the cipher key, of 16, 24 or 32 bytes")
+	parseFlags(fs, args)
+	var fpath string
+	if fs.NArg() > 0 {
+		fpath = fs.Arg(0)
+		parseFlags(fs, fs.Args()[1:])
+	}
+	if fpath == "" || fs.NArg() != 0 || *keyFile == "" {
+		usage(cmd + " <path> --key-file <file>")
+	}
+	if readOnly {
+		exitOnError(kvstore.ErrReadOnly, "", "")
+	}
+
+	key, err := readKeyFile(*keyFile)
+	exitOnError(err, "", "")
+	if cmd == "encrypt" {
+		err = Encrypt(fpath, key)
+	} else {
+		err = Decrypt(fpath, key)
+	}
+	exitOnError(err, "", "")
+	emitOK()
+}
+
+func backup(fpath string, args []string) {
+	if len(args) != 1 {
+		usage("<path> backup <out-file>")
+	}
+
+	err := Backup(fpath, args[0])
+	exitOnError(err, "", "")
+	if args[0] != "-" {
+		emitOK()
+	}
+}
+
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace an existing store")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		usage("restore [--force] <backup> <path>")
+	}
+	if readOnly {
+		exitOnError(kvstore.ErrReadOnly, "", "")
+	}
+
+	err := Restore(fs.Arg(0), fs.Arg(1), *force)
+	exitOnError(err, "", "")
+	emitOK()
+}
+
+type GetOptions struct {
+	Pretty bool // indent the values
+	Raw    bool // write the stored bytes of a single value, without a newline
+	Object bool // write an object of the values by key
+}
+
+// Get writes the values of keys to w, one per line, read in a single
+// transaction.
+func Get(store kvstore.Store, w io.Writer, bucket string, keys []string, opts GetOptions) error {
+	if opts.Raw && (opts.Pretty || opts.Object) {
+		return invalidf("--raw can't be combined with --pretty or --json")
+	}
+	if opts.Raw && len(keys) != 1 {
+		return invalidf("--raw takes a single key")
+	}
+
+	tx := store.Reader()
+	defer tx.Rollback()
+
+	values := make([]json.RawMessage, len(keys))
+	for i, key := range keys {
+		err := tx.Get(bucket, key, &values[i])
+		if err != nil {
+			return &entryError{Bucket: bucket, Key: key, Err: err}
+		}
+		if values[i] == nil {
+			return &entryError{Bucket: bucket, Key: key, Err: kvstore.ErrKeyNotFound}
+		}
+	}
+	err := tx.Commit()
 	if err != nil {
 		return err
 	}
-	os.Stdout.Write(b)
+
+	if opts.Object {
+		byKey := make(map[string]json.RawMessage, len(keys))
+		for i, key := range keys {
+			byKey[key] = values[i]
+		}
+		enc := json.NewEncoder(w)
+		if opts.Pretty {
+			enc.SetIndent("", "  ")
+		}
+		return enc.Encode(byKey)
+	}
+	for _, v := range values {
+		if opts.Raw {
+			_, err = w.Write(v)
+			return err
+		}
+		if opts.Pretty {
+			var buf bytes.Buffer
+			err = json.Indent(&buf, v, "", "  ")
+			if err != nil {
+				return err
+			}
+			v = buf.Bytes()
+		}
+		_, err = fmt.Fprintf(w, "%s\n", v)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -162,3 +997,72 @@ func Delete(store kvstore.Store, bucket, key string) error {
 
 	return err
 }
+
+// DeleteBucket deletes the bucket once confirmed on in, prompting on out,
+// unless yes is set. With dryRun, nothing is deleted. It returns the number of
+// keys of the bucket.
+func DeleteBucket(store kvstore.Store, in io.Reader, out io.Writer, bucket string, yes, dryRun bool) (int, error) {
+	buckets, err := store.Buckets()
+	if err != nil {
+		return 0, err
+	}
+	if !contains(buckets, bucket) {
+		return 0, &entryError{Bucket: bucket, Err: kvstore.ErrBucketNotFound}
+	}
+
+	rtx := store.Reader()
+	keys, err := rtx.List(bucket)
+	rtx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return len(keys), nil
+	}
+	if !yes {
+		fmt.Fprintf(out, "Delete bucket %q and its %d keys? [y/N] ", bucket, len(keys))
+		answer, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return len(keys), err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+		default:
+			return len(keys), errors.New("aborted")
+		}
+	}
+
+	tx := store.Writer()
+	defer tx.Rollback()
+
+	err = tx.DeleteBucket(bucket)
+	if err != nil {
+		return len(keys), err
+	}
+
+	return len(keys), tx.Commit()
+}
+
+func RenameKey(store kvstore.Store, bucket, oldKey, newKey string) error {
+	tx := store.Writer()
+	defer tx.Rollback()
+
+	err := tx.RenameKey(bucket, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func RenameBucket(store kvstore.Store, oldBucket, newBucket string) error {
+	tx := store.Writer()
+	defer tx.Rollback()
+
+	err := tx.RenameBucket(oldBucket, newBucket)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
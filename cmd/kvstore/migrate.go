@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/yazgazan/kvstore/block"
+)
+
+// MigrateCheck returns the format version of the block DB at fpath.
+func MigrateCheck(fpath string) (uint32, error) {
+	db, closeDB, err := openBlockDB(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer closeDB()
+
+	return db.Meta().Version, nil
+}
+
+// Migrate rewrites the block DB at fpath in the format version to. The block
+// size, the compression and the encryption are kept. It returns the version
+// the DB was in, nothing being done when it is already in version to.
+func Migrate(fpath string, to uint32) (uint32, error) {
+	if to == 0 || to > block.LatestVersion {
+		return 0, invalidf("unsupported version %d, latest supported version is %d", to, block.LatestVersion)
+	}
+
+	src, closeSrc, err := openBlockDB(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer closeSrc()
+	meta := src.Meta()
+	if meta.Version == to {
+		return meta.Version, nil
+	}
+	opts := []block.Option{
+		block.WithBlockSize(meta.BlockSize),
+		block.WithVersion(to),
+	}
+	if meta.Flags&(block.FlagEncrypted|block.FlagCompressed) != 0 && to == 1 {
+		return meta.Version, invalidf("version 1 DBs can't be encrypted nor compressed")
+	}
+	if meta.Flags&block.FlagCompressed != 0 {
+		opts = append(opts, block.WithCompression())
+	}
+	if meta.Flags&block.FlagEncrypted != 0 {
+		opts = append(opts, dbOptions...) // the DB was opened with its key
+	}
+
+	return meta.Version, rewrite(fpath, src, opts)
+}
+
+// rewrite copies the objects of src, the block DB at fpath, to a temporary
+// file of the same directory created with opts, then renames it over fpath,
+// so that the DB is either rewritten or left as it was.
+func rewrite(fpath string, src *block.BlockDB, opts []block.Option) error {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), filepath.Base(fpath)+".rewrite-*")
+	if err != nil {
+		return err
+	}
+	err = copyObjects(tmp, src, opts)
+	if err == nil {
+		err = tmp.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func copyObjects(f *os.File, src *block.BlockDB, opts []block.Option) error {
+	dst, err := block.Create(f, opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range src.Objects() {
+		r, err := src.Open(o.Name)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		w, err := dst.Create(o.Name)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		_, err = io.Copy(w, r)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// MSet reads a JSON object of values by key from r, as written by mget, and
+// sets them in bucket in a single transaction. It returns the number of keys
+// set.
+func MSet(store kvstore.Store, r io.Reader, bucket string) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return 0, invalidf("expected an object of values by key")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if tok != json.Delim('{') {
+		return 0, invalidf("expected an object of values by key")
+	}
+
+	tx := store.Writer()
+	defer tx.Rollback()
+
+	var n int
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		key := tok.(string)
+		var v json.RawMessage
+		err = dec.Decode(&v)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+		err = tx.Set(bucket, key, v)
+		if err != nil {
+			return 0, &entryError{Bucket: bucket, Key: key, Err: err}
+		}
+		n++
+	}
+	_, err = dec.Token()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
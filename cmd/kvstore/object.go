@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/yazgazan/kvstore/block"
+)
+
+// openBlockDBForWrite opens the block DB at fpath with dbOptions, creating it
+// when the file is empty, or missing with create set.
+func openBlockDBForWrite(fpath string, create bool) (*block.BlockDB, func() error, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(fpath, flags, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	var db *block.BlockDB
+	if fi.Size() == 0 {
+		db, err = block.Create(f, dbOptions...)
+	} else {
+		db, err = block.Open(f, dbOptions...)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return db, func() error {
+		err := db.Close()
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+
+		return err
+	}, nil
+}
+
+func objectError(name string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("object %q %w", name, errNotFound)
+	}
+
+	return err
+}
+
+// ObjectList returns the objects of the block DB at fpath whose name starts
+// with prefix, sorted by name.
+func ObjectList(fpath, prefix string) ([]block.ObjectMeta, error) {
+	db, closeDB, err := openBlockDB(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB()
+
+	var objects []block.ObjectMeta
+	for _, o := range db.Objects() {
+		if strings.HasPrefix(o.Name, prefix) {
+			objects = append(objects, o)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
+}
+
+func writeObjectList(w io.Writer, objects []block.ObjectMeta) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tSTART")
+	for _, o := range objects {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", o.Name, o.Size, o.StartBlock)
+	}
+
+	return tw.Flush()
+}
+
+// ObjectCat writes the content of the object name of the block DB at fpath to
+// w.
+func ObjectCat(fpath string, w io.Writer, name string) error {
+	db, closeDB, err := openBlockDB(fpath)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	obj, err := db.Open(name)
+	if err != nil {
+		return objectError(name, err)
+	}
+	_, err = io.Copy(w, obj)
+
+	return err
+}
+
+// ObjectPut writes the content of r to the object name of the block DB at
+// fpath, which is created if needed. Without force, the object must not exist.
+// It returns the size of the object.
+func ObjectPut(fpath string, r io.Reader, name string, force bool) (int64, error) {
+	db, closeDB, err := openBlockDBForWrite(fpath, true)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := putObject(db, r, name, force)
+	cerr := closeDB()
+	if err == nil {
+		err = cerr
+	}
+
+	return n, err
+}
+
+func putObject(db *block.BlockDB, r io.Reader, name string, force bool) (int64, error) {
+	_, err := db.Open(name)
+	if err == nil && !force {
+		return 0, fmt.Errorf("object %q: %w, use --force to replace it", name, os.ErrExist)
+	}
+
+	obj, err := db.Create(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return io.Copy(obj, r)
+}
+
+// ObjectRemove deletes the object name of the block DB at fpath.
+func ObjectRemove(fpath, name string) error {
+	db, closeDB, err := openBlockDBForWrite(fpath, false)
+	if err != nil {
+		return err
+	}
+
+	err = objectError(name, db.Delete(name))
+	cerr := closeDB()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+
+	"github.com/yazgazan/kvstore"
+	"github.com/yazgazan/kvstore/block"
+)
+
+// jsonOutput is set by --json, for the results and the errors of the commands
+// to be written as JSON.
+var jsonOutput bool
+
+// Exit statuses, by class of error.
+const (
+	exitError    = 1 // not classified
+	exitUsage    = 2 // wrong command line
+	exitNotFound = 3 // bucket, key, object or file not found
+	exitExists   = 4 // bucket, key or file already exists
+	exitInvalid  = 5 // invalid argument or input
+	exitProblems = 6 // verify found problems, or diff differences
+	exitReadOnly = 7 // write to a store opened with --read-only
+)
+
+// exitStatus is panicked with by exit and recovered by run, which returns it
+// once the deferred calls, like closing the store, have run.
+type exitStatus int
+
+// exit ends the command with status. Unlike os.Exit, the deferred calls run
+// first, so that the store is closed and its pools checkpointed.
+func exit(status int) {
+	panic(exitStatus(status))
+}
+
+// errNotFound is wrapped by the errors about what isn't a bucket or a key, like
+// the objects of the block DB.
+var errNotFound = errors.New("not found")
+
+// invalidError is an error with the arguments or the input of a command.
+type invalidError struct {
+	msg string
+}
+
+func (e invalidError) Error() string {
+	return e.msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return invalidError{msg: fmt.Sprintf(format, args...)}
+}
+
+// entryError is an error about a bucket, or a key of a bucket.
+type entryError struct {
+	Bucket string
+	Key    string // empty for the errors about the whole bucket
+	Err    error
+}
+
+func (e *entryError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("bucket %q: %v", e.Bucket, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+func (e *entryError) Unwrap() error {
+	return e.Err
+}
+
+// errorClass returns the code of err written in JSON mode and the status to
+// exit with.
+func errorClass(err error) (string, int) {
+	var (
+		invalid   invalidError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		numErr    *strconv.NumError
+		reErr     *syntax.Error
+	)
+	switch {
+	case errors.Is(err, kvstore.ErrKeyNotFound), errors.Is(err, kvstore.ErrBucketNotFound),
+		errors.Is(err, errNotFound), errors.Is(err, fs.ErrNotExist):
+		return "not_found", exitNotFound
+	case errors.Is(err, kvstore.ErrKeyExists), errors.Is(err, kvstore.ErrBucketExists), errors.Is(err, fs.ErrExist):
+		return "exists", exitExists
+	case errors.As(err, &invalid), errors.As(err, &syntaxErr), errors.As(err, &typeErr),
+		errors.As(err, &numErr), errors.As(err, &reErr), errors.Is(err, path.ErrBadPattern):
+		return "invalid", exitInvalid
+	case errors.Is(err, kvstore.ErrReadOnly), errors.Is(err, block.ErrReadOnly):
+		return "read_only", exitReadOnly
+	}
+
+	return "error", exitError
+}
+
+type errorOutput struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Bucket  string `json:"bucket,omitempty"`
+		Key     string `json:"key,omitempty"`
+	} `json:"error"`
+}
+
+func printError(code, msg, bucket, key string) {
+	if !jsonOutput {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+		return
+	}
+
+	var out errorOutput
+	out.Error.Code, out.Error.Message = code, msg
+	out.Error.Bucket, out.Error.Key = bucket, key
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(out)
+}
+
+// exitOnError writes err to stderr and exits with the status of its class,
+// unless err is nil. The bucket and key it is about, when known, are given in
+// JSON mode, those of an entryError taking precedence.
+func exitOnError(err error, bucket, key string) {
+	if err == nil {
+		return
+	}
+
+	var eerr *entryError
+	if errors.As(err, &eerr) {
+		bucket, key = eerr.Bucket, eerr.Key
+	}
+	code, status := errorClass(err)
+	printError(code, err.Error(), bucket, key)
+	exit(status)
+}
+
+// usage writes the usage lines of a command to stderr, without the name of
+// the program, and exits with exitUsage.
+func usage(lines ...string) {
+	name := flag.CommandLine.Name()
+	if jsonOutput {
+		printError("usage", "usage: "+name+" "+strings.Join(lines, "\n       "+name+" "), "", "")
+		exit(exitUsage)
+	}
+
+	for i, line := range lines {
+		prefix := "Usage:"
+		if i > 0 {
+			prefix = "      "
+		}
+		fmt.Fprintf(os.Stderr, "%s %s %s\n", prefix, name, line)
+	}
+	exit(exitUsage)
+}
+
+// parseFlags parses the flags of a command, exiting with exitUsage on errors.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if jsonOutput {
+		fs.SetOutput(io.Discard)
+	}
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		exit(0)
+	}
+	if err != nil {
+		if jsonOutput {
+			printError("usage", err.Error(), "", "")
+		}
+		exit(exitUsage)
+	}
+}
+
+// emit writes the result of a command to stdout in JSON mode.
+func emit(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	exitOnError(enc.Encode(v), "", "")
+}
+
+// okResult is the result of the commands that write nothing but errors.
+type okResult struct {
+	OK bool `json:"ok"`
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// Search returns the sorted keys of bucket whose value contains query. With a
+// JSON path expression, query is looked for in the nodes it selects instead of
+// the whole value, strings being matched on their content.
+func Search(store kvstore.Store, bucket, query, expr string) ([]string, error) {
+	var path jsonPath
+	if expr != "" {
+		var err error
+		path, err = parseJSONPath(expr)
+		if err != nil {
+			return nil, invalidError{msg: err.Error()}
+		}
+	}
+
+	tx := store.Reader()
+	defer tx.Rollback()
+
+	keys, err := tx.Keys(bucket, kvstore.KeyFilter{})
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, k := range keys {
+		var v json.RawMessage
+		err = tx.Get(bucket, k, &v)
+		if err != nil {
+			return nil, &entryError{Bucket: bucket, Key: k, Err: err}
+		}
+		ok, err := matchValue(v, query, path)
+		if err != nil {
+			return nil, &entryError{Bucket: bucket, Key: k, Err: err}
+		}
+		if ok {
+			found = append(found, k)
+		}
+	}
+
+	return found, tx.Commit()
+}
+
+func matchValue(v json.RawMessage, query string, path jsonPath) (bool, error) {
+	if path == nil {
+		return bytes.Contains(v, []byte(query)), nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(v))
+	dec.UseNumber()
+	var decoded interface{}
+	err := dec.Decode(&decoded)
+	if err != nil {
+		return false, err
+	}
+	for _, node := range path.eval(decoded) {
+		s, ok := node.(string)
+		if !ok {
+			b, err := json.Marshal(node)
+			if err != nil {
+				return false, err
+			}
+			s = string(b)
+		}
+		if strings.Contains(s, query) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yazgazan/kvstore"
+)
+
+const maxValueSize = 32 << 20
+
+// Timeouts of the HTTP server, so that slow or idle clients can't hold
+// connections, and the store, forever. Reading a request allows for bodies of
+// up to maxValueSize.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = time.Minute
+	writeTimeout      = time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+// Server exposes a store over HTTP:
+//
+//	GET    /buckets                 the bucket names
+//	GET    /buckets/<bucket>        the keys of a bucket
+//	GET    /buckets/<bucket>/<key>  the value of a key
+//	PUT    /buckets/<bucket>/<key>  sets a key to the JSON value in the body
+//	DELETE /buckets/<bucket>/<key>  deletes a key
+//
+// Lists are JSON arrays, sorted. Errors are returned as {"error": "..."}.
+//
+// Requests aren't authenticated: anyone who can reach the server can read
+// every key, and write and delete keys when Writable is set. PUT and DELETE
+// fail with 403 Forbidden otherwise. Only listen on addresses reachable by
+// trusted clients, like the loopback address the serve command defaults to.
+type Server struct {
+	Store    kvstore.Store
+	Writable bool // allow PUT and DELETE
+}
+
+// Serve runs a Server for store on addr, until interrupted. PUT and DELETE
+// are only served when writable is set.
+func Serve(store kvstore.Store, addr string, writable bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           Server{Store: store, Writable: writable},
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	err := srv.Shutdown(context.Background())
+	if err != nil {
+		return err
+	}
+	err = <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/buckets")
+	if len(p) == len(r.URL.Path) || p != "" && p[0] != '/' {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		s.buckets(w)
+	case bucket == "":
+		methodNotAllowed(w, http.MethodGet)
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket)
+	case key == "":
+		methodNotAllowed(w, http.MethodGet)
+	case r.Method == http.MethodGet:
+		s.get(w, bucket, key)
+	case (r.Method == http.MethodPut || r.Method == http.MethodDelete) && !s.Writable:
+		writeError(w, http.StatusForbidden, errors.New("server is read-only, writes need --writable"))
+	case r.Method == http.MethodPut:
+		s.set(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		s.delete(w, bucket, key)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func (s Server) buckets(w http.ResponseWriter) {
+	buckets, err := s.Store.Buckets()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Strings(buckets)
+	writeJSON(w, http.StatusOK, buckets)
+}
+
+func (s Server) list(w http.ResponseWriter, bucket string) {
+	tx := s.Store.Reader()
+	defer tx.Rollback()
+
+	keys, err := tx.List(bucket)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if keys == nil {
+		writeError(w, http.StatusNotFound, errors.New("bucket not found"))
+		return
+	}
+	sort.Strings(keys)
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func (s Server) get(w http.ResponseWriter, bucket, key string) {
+	var v json.RawMessage
+	err := s.Store.Get(bucket, key, &v)
+	if err == nil && v == nil {
+		err = kvstore.ErrKeyNotFound
+	}
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s Server) set(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if !json.Valid(b) {
+		writeError(w, http.StatusBadRequest, errors.New("body isn't valid JSON"))
+		return
+	}
+
+	tx := s.Store.Writer()
+	defer tx.Rollback()
+
+	err = tx.Set(bucket, key, json.RawMessage(b))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s Server) delete(w http.ResponseWriter, bucket, key string) {
+	tx := s.Store.Writer()
+	defer tx.Rollback()
+
+	var v json.RawMessage
+	err := tx.Get(bucket, key, &v)
+	if err == nil && v == nil {
+		err = kvstore.ErrKeyNotFound
+	}
+	if err == nil {
+		err = tx.Delete(bucket, key)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func statusOf(err error) int {
+	if errors.Is(err, kvstore.ErrKeyNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, kvstore.ErrReadOnly) {
+		return http.StatusForbidden
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
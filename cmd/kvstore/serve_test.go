@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	store := newTestStore(t)
+	srv := httptest.NewServer(Server{Store: store, Writable: true})
+	defer srv.Close()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+		resp   string
+		allow  string
+	}{
+		{http.MethodGet, "/buckets", "", http.StatusOK, "[]\n", ""},
+		{http.MethodPut, "/buckets/b/k1", `{"n": 1}`, http.StatusNoContent, "", ""},
+		{http.MethodPut, "/buckets/b/k2", `"two"`, http.StatusNoContent, "", ""},
+		{http.MethodPut, "/buckets/a/k", `true`, http.StatusNoContent, "", ""},
+		{http.MethodPut, "/buckets/b/k3", `not json`, http.StatusBadRequest, `{"error":"body isn't valid JSON"}` + "\n", ""},
+		{http.MethodGet, "/buckets", "", http.StatusOK, `["a","b"]` + "\n", ""},
+		{http.MethodGet, "/buckets/", "", http.StatusOK, `["a","b"]` + "\n", ""},
+		{http.MethodGet, "/buckets/b", "", http.StatusOK, `["k1","k2"]` + "\n", ""},
+		{http.MethodGet, "/buckets/b/k1", "", http.StatusOK, `{"n":1}` + "\n", ""},
+		{http.MethodGet, "/buckets/b/k2", "", http.StatusOK, `"two"` + "\n", ""},
+		{http.MethodPut, "/buckets/b/k2", `[2]`, http.StatusNoContent, "", ""},
+		{http.MethodGet, "/buckets/b/k2", "", http.StatusOK, "[2]\n", ""},
+		{http.MethodDelete, "/buckets/b/k1", "", http.StatusNoContent, "", ""},
+		{http.MethodGet, "/buckets/b/k1", "", http.StatusNotFound, `{"error":"key not found"}` + "\n", ""},
+		{http.MethodDelete, "/buckets/b/k1", "", http.StatusNotFound, `{"error":"key not found"}` + "\n", ""},
+		{http.MethodGet, "/buckets/b", "", http.StatusOK, `["k2"]` + "\n", ""},
+		{http.MethodGet, "/buckets/missing", "", http.StatusNotFound, `{"error":"bucket not found"}` + "\n", ""},
+		{http.MethodGet, "/buckets/missing/k", "", http.StatusNotFound, `{"error":"key not found"}` + "\n", ""},
+		{http.MethodGet, "/", "", http.StatusNotFound, `{"error":"not found"}` + "\n", ""},
+		{http.MethodGet, "/bucketsb", "", http.StatusNotFound, `{"error":"not found"}` + "\n", ""},
+		{http.MethodPost, "/buckets", "", http.StatusMethodNotAllowed, `{"error":"method not allowed"}` + "\n", "GET"},
+		{http.MethodDelete, "/buckets/b", "", http.StatusMethodNotAllowed, `{"error":"method not allowed"}` + "\n", "GET"},
+		{http.MethodPost, "/buckets/b/k2", "{}", http.StatusMethodNotAllowed, `{"error":"method not allowed"}` + "\n", "GET, PUT, DELETE"},
+	} {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Errorf("http.NewRequest(...): unexpected error: %v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.method, test.path, err)
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s %s: unexpected error reading the response: %v", test.method, test.path, err)
+			return
+		}
+		if resp.StatusCode != test.status || string(body) != test.resp {
+			t.Errorf("%s %s = %d %q, expected %d %q", test.method, test.path, resp.StatusCode, body, test.status, test.resp)
+		}
+		if allow := resp.Header.Get("Allow"); allow != test.allow {
+			t.Errorf("%s %s: Allow header is %q, expected %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	store := newTestStore(t)
+	err := Set(store, "b", "k", "v")
+	if err != nil {
+		t.Errorf("Set(...): unexpected error: %v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		method string
+		body   string
+		status int
+	}{
+		{http.MethodPut, `"w"`, http.StatusForbidden},
+		{http.MethodDelete, "", http.StatusForbidden},
+		{http.MethodGet, "", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		Server{Store: store}.ServeHTTP(w, httptest.NewRequest(test.method, "/buckets/b/k", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s /buckets/b/k on a read-only server = %d %q, expected %d", test.method, w.Code, w.Body, test.status)
+		}
+	}
+	if got := storeValues(t, store, "b", "k"); got[0] != `"v"` {
+		t.Errorf("value after writes to a read-only server = %s, expected \"v\"", got[0])
+	}
+}
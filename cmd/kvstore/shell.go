@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/yazgazan/kvstore"
+)
+
+var shellCommands = []string{"buckets", "delete", "exit", "get", "help", "list", "set"}
+
+// Shell reads commands from in until exit or the end of the input, running
+// them against store. Command history and completion of the command and
+// bucket names are available when in is a terminal.
+func Shell(store kvstore.Store, in *os.File, out io.Writer) error {
+	e := newLineEditor(in, out, func(words []string) []string {
+		switch len(words) {
+		case 1:
+			return shellCommands
+		case 2:
+			switch words[0] {
+			case "get", "set", "delete", "list":
+				buckets, _ := store.Buckets()
+				return buckets
+			}
+		}
+
+		return nil
+	})
+
+	for {
+		line, err := e.readLine("kvstore> ")
+		if err == errInterrupted {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		err = runShellCommand(store, out, args[0], args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+}
+
+func runShellCommand(store kvstore.Store, out io.Writer, cmd string, args []string) error {
+	usage := func(u string) error {
+		return fmt.Errorf("usage: %s", u)
+	}
+
+	switch strings.ToLower(cmd) {
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	case "help":
+		fmt.Fprintln(out, "Commands: get <bucket> <key> [key...], set <bucket> <key> <value>, delete <bucket> <key>, list <bucket>, buckets, exit")
+		fmt.Fprintln(out, "Arguments with spaces can be quoted, or the spaces escaped with a backslash.")
+		return nil
+	case "get":
+		if len(args) < 2 {
+			return usage("get <bucket> <key> [key...]")
+		}
+		return Get(store, out, args[0], args[1:], GetOptions{})
+	case "list":
+		if len(args) != 1 {
+			return usage("list <bucket>")
+		}
+		return List(store, out, args[0], ListOptions{})
+	case "set":
+		if len(args) != 3 {
+			return usage("set <bucket> <key> <value>")
+		}
+		return Set(store, args[0], args[1], args[2])
+	case "delete":
+		if len(args) != 2 {
+			return usage("delete <bucket> <key>")
+		}
+		return Delete(store, args[0], args[1])
+	case "buckets":
+		if len(args) != 0 {
+			return usage("buckets")
+		}
+		return Buckets(store)
+	}
+}
+
+// splitArgs splits line into words separated by spaces. Single quotes keep
+// what they enclose as is, a backslash elsewhere escapes the next character,
+// like a space. Quotes enclosing nothing are an empty word.
+func splitArgs(line string) ([]string, error) {
+	var (
+		args  []string
+		word  strings.Builder
+		quote rune
+		in    bool // in a word
+		esc   bool
+	)
+	for _, r := range line {
+		switch {
+		case esc:
+			word.WriteRune(r)
+			esc = false
+		case quote != '\'' && r == '\\':
+			esc, in = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, in = r, true
+		case r == ' ' || r == '\t':
+			if in {
+				args = append(args, word.String())
+				word.Reset()
+				in = false
+			}
+		default:
+			word.WriteRune(r)
+			in = true
+		}
+	}
+	if quote != 0 {
+		return nil, invalidf("unterminated quote")
+	}
+	if esc {
+		return nil, invalidf("nothing to escape after the trailing backslash")
+	}
+	if in {
+		args = append(args, word.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", nil},
+		{"   \t ", nil},
+		{"get bucket key", []string{"get", "bucket", "key"}},
+		{"  get\tbucket   key  ", []string{"get", "bucket", "key"}},
+		{`set b k "a value"`, []string{"set", "b", "k", "a value"}},
+		{`set b k 'a value'`, []string{"set", "b", "k", "a value"}},
+		{`set b k a\ value`, []string{"set", "b", "k", "a value"}},
+		{`a\\b`, []string{`a\b`}},
+		{`a\'b`, []string{`a'b`}},
+		{`\ `, []string{" "}},
+		{`"a \"quoted\" value"`, []string{`a "quoted" value`}},
+		{`"a\\b"`, []string{`a\b`}},
+		{`'a\ b'`, []string{`a\ b`}},
+		{`'a "b" c'`, []string{`a "b" c`}},
+		{`"it's"`, []string{"it's"}},
+		{`pre"fix ed"post`, []string{"prefix edpost"}},
+		{`""`, []string{""}},
+		{`''`, []string{""}},
+		{`set b "" ''`, []string{"set", "b", "", ""}},
+		{`a "" b`, []string{"a", "", "b"}},
+	} {
+		got, err := splitArgs(test.line)
+		if err != nil {
+			t.Errorf("splitArgs(%q): unexpected error: %v", test.line, err)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.expected) {
+			t.Errorf("splitArgs(%q) = %q, expected %q", test.line, got, test.expected)
+		}
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	for _, line := range []string{
+		`"`,
+		`'`,
+		`get "bucket key`,
+		`get 'bucket key`,
+		`get "bucket\"`,
+		`get bucket\`,
+		`get 'bucket\' "key`,
+	} {
+		got, err := splitArgs(line)
+		if err == nil {
+			t.Errorf("splitArgs(%q) = %q, expected an error", line, got)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// tailRetries is the number of polls in a row Tail lets fail, as the store can
+// be read in the middle of an update made by another process.
+const tailRetries = 5
+
+type TailOptions struct {
+	Interval time.Duration // between polls
+	Existing bool          // write the values the bucket holds when starting
+	JSON     bool          // write records as export does, instead of keys and values
+}
+
+// Tail writes the keys of bucket that are set, with their new value, until ctx
+// is done. There is no change feed to follow: the store at fpath is opened
+// read-only every opts.Interval when its size or modification time changed,
+// and the bucket compared with the previous poll. Values changed and changed
+// back between two polls aren't seen.
+func Tail(ctx context.Context, fpath string, w io.Writer, bucket string, opts TailOptions) error {
+	if opts.Interval <= 0 {
+		return invalidf("invalid interval %v", opts.Interval)
+	}
+
+	var (
+		sums   map[string][sha256.Size]byte // of the values, by key
+		lastFi os.FileInfo
+		failed int
+	)
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			return err
+		}
+		if lastFi == nil || fi.Size() != lastFi.Size() || !fi.ModTime().Equal(lastFi.ModTime()) {
+			records, newSums, err := tailPoll(fpath, bucket, sums)
+			if err != nil {
+				failed++
+				if failed > tailRetries {
+					return err
+				}
+			} else {
+				if sums != nil || opts.Existing {
+					err = writeTail(w, records, opts.JSON)
+					if err != nil {
+						return err
+					}
+				}
+				sums, lastFi, failed = newSums, fi, 0
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// tailPoll returns the records of bucket whose value isn't the one summed in
+// sums, and the sums of all the values.
+func tailPoll(fpath, bucket string, sums map[string][sha256.Size]byte) ([]Record, map[string][sha256.Size]byte, error) {
+	store, err := kvstore.OpenReadOnly(fpath, dbOptions...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer store.Close()
+
+	tx := store.Reader()
+	defer tx.Rollback()
+
+	keys, err := tx.Keys(bucket, kvstore.KeyFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []Record
+	newSums := make(map[string][sha256.Size]byte, len(keys))
+	for _, k := range keys {
+		var v json.RawMessage
+		err = tx.Get(bucket, k, &v)
+		if err != nil {
+			return nil, nil, &entryError{Bucket: bucket, Key: k, Err: err}
+		}
+		if v == nil {
+			continue // expired
+		}
+		sum := sha256.Sum256(v)
+		newSums[k] = sum
+		if old, ok := sums[k]; !ok || old != sum {
+			records = append(records, Record{Bucket: bucket, Key: k, Value: v})
+		}
+	}
+
+	return records, newSums, tx.Commit()
+}
+
+func writeTail(w io.Writer, records []Record, asJSON bool) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		var err error
+		if asJSON {
+			err = enc.Encode(r)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\t%s\n", r.Key, r.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
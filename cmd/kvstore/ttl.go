@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/yazgazan/kvstore"
+)
+
+// TTL returns the expiry of the key, zero if it doesn't expire.
+func TTL(store kvstore.Store, bucket, key string) (time.Time, error) {
+	tx := store.Reader()
+	defer tx.Rollback()
+
+	return tx.Expiry(bucket, key)
+}
+
+// formatTTL returns the time left before expiry, "none" for a zero expiry.
+func formatTTL(expiry time.Time) string {
+	if expiry.IsZero() {
+		return "none"
+	}
+
+	return time.Until(expiry).Round(time.Second).String()
+}
+
+type ttlOutput struct {
+	Expiry  *time.Time `json:"expiry"`      // null when the key doesn't expire
+	Seconds *int64     `json:"ttl_seconds"` // left before the expiry
+}
+
+func ttlResult(expiry time.Time) ttlOutput {
+	if expiry.IsZero() {
+		return ttlOutput{}
+	}
+	expiry = expiry.UTC()
+	seconds := int64(time.Until(expiry).Round(time.Second) / time.Second)
+
+	return ttlOutput{Expiry: &expiry, Seconds: &seconds}
+}
+
+// SetTTL sets the key to expire after ttl, a duration. A ttl of 0 or "none"
+// clears the expiry.
+func SetTTL(store kvstore.Store, bucket, key, ttl string) error {
+	var expiry time.Time
+	if ttl != "none" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return invalidError{msg: err.Error()}
+		}
+		if d < 0 {
+			return invalidf("negative TTL")
+		}
+		if d > 0 {
+			expiry = time.Now().Add(d)
+		}
+	}
+
+	tx := store.Writer()
+	defer tx.Rollback()
+
+	err := tx.SetExpiry(bucket, key, expiry)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/yazgazan/kvstore"
+)
+
+type verifyOutput struct {
+	Recovered      bool     `json:"recovered"`
+	CutChains      int      `json:"cut_chains"`
+	DroppedObjects []string `json:"dropped_objects"`
+	FreeBlocks     uint32   `json:"free_blocks"`
+	Problems       []string `json:"problems"`
+	Repaired       []string `json:"repaired"` // "" for the list of buckets
+	Freed          int      `json:"freed"`
+	Remaining      []string `json:"remaining"`
+}
+
+func problemStrings(problems []kvstore.Problem) []string {
+	s := make([]string, len(problems))
+	for i, p := range problems {
+		s[i] = p.Error()
+	}
+
+	return s
+}
+
+// Verify checks the store, repairing what can be, and writes a report to w,
+// as a JSON object with asJSON. It returns whether the store is left without
+// problems.
+func Verify(store kvstore.Store, w io.Writer, repair, asJSON bool) (bool, error) {
+	report, err := store.Verify(repair)
+	if err != nil {
+		return false, err
+	}
+	if asJSON {
+		r := report.Recovery
+		out := verifyOutput{
+			Recovered:      r.Recovered,
+			CutChains:      r.CutChains,
+			DroppedObjects: append([]string{}, r.DroppedObjects...),
+			FreeBlocks:     r.FreeBlocks,
+			Problems:       problemStrings(report.Problems),
+			Repaired:       append([]string{}, report.Repaired...),
+			Freed:          report.Freed,
+			Remaining:      problemStrings(report.Remaining),
+		}
+		return len(report.Remaining) == 0, json.NewEncoder(w).Encode(out)
+	}
+
+	if r := report.Recovery; r.Recovered {
+		fmt.Fprintf(w, "recovered from an interrupted update: %d chains cut, %d objects dropped, %d free blocks\n", r.CutChains, len(r.DroppedObjects), r.FreeBlocks)
+		for _, name := range r.DroppedObjects {
+			fmt.Fprintf(w, "  dropped object %q\n", name)
+		}
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintf(w, "problem: %v\n", p)
+	}
+	for _, name := range report.Repaired {
+		if name == "" {
+			fmt.Fprintln(w, "repaired the list of buckets")
+			continue
+		}
+		fmt.Fprintf(w, "repaired bucket %q\n", name)
+	}
+	if len(report.Repaired) != 0 {
+		fmt.Fprintf(w, "freed %d chunks\n", report.Freed)
+	}
+
+	switch {
+	case len(report.Problems) == 0:
+		fmt.Fprintln(w, "no problems found")
+	case !repair:
+		fmt.Fprintf(w, "%d problems found\n", len(report.Problems))
+	default:
+		for _, p := range report.Remaining {
+			fmt.Fprintf(w, "remaining: %v\n", p)
+		}
+		fmt.Fprintf(w, "%d problems found, %d remaining\n", len(report.Problems), len(report.Remaining))
+	}
+
+	return len(report.Remaining) == 0, nil
+}
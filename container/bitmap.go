@@ -0,0 +1,598 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// Bitmap is a compressed set of uint32, split like a roaring bitmap into
+// containers of the values sharing their upper 16 bits. Containers holding up
+// to bitmapArrayMax values are sorted arrays of their lower 16 bits, larger
+// ones are 8KiB bitsets, each container being a chunk of its own.
+type Bitmap struct {
+	m *sync.RWMutex
+
+	pool      *Pool
+	headChunk *Chunk
+	dir       *Chunk
+	entries   []bitmapEntry
+	count     int64
+}
+
+// The head chunk holds the directory pointer:
+//
+//	dir    int64
+//	magic  [4]byte
+//
+// The directory holds an entry per container, sorted by key:
+//
+//	key    uint16, the upper 16 bits of the container values
+//	card   uint32, the number of values in the container
+//	ptr    int64
+var (
+	sizeBitmapHead  = sizePtr + len(bitmapMagic)
+	sizeBitmapEntry = 2 + 4 + sizePtr
+)
+
+var bitmapMagic = [4]byte{'k', 'v', 'b', 'm'}
+
+const (
+	bitmapArrayMax = 4096
+	bitmapWords    = 1 << 16 / 64
+)
+
+type bitmapEntry struct {
+	key  uint16
+	card uint32
+	ptr  ChunkPtr
+}
+
+func NewBitmap(f io.ReadWriteSeeker) (*Bitmap, error) {
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	bm := &Bitmap{
+		m: &sync.RWMutex{},
+
+		pool: pool,
+	}
+
+	if pool.Size() == 0 {
+		bm.headChunk, err = pool.Alloc(uint32(sizeBitmapHead))
+		if err != nil {
+			return nil, err
+		}
+		bm.dir, err = pool.Alloc(uint32(16 * sizeBitmapEntry))
+		if err != nil {
+			return nil, err
+		}
+
+		return bm, bm.writeHead()
+	}
+
+	bm.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := bm.headChunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sizeBitmapHead || !bytes.Equal(b[sizePtr:], bitmapMagic[:]) {
+		return nil, fmt.Errorf("invalid bitmap header: %d bytes", len(b))
+	}
+	bm.dir, err = pool.Get(ChunkPtr(binary.LittleEndian.Uint64(b)))
+	if err != nil {
+		return nil, err
+	}
+	b, err = bm.dir.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%sizeBitmapEntry != 0 {
+		return nil, fmt.Errorf("invalid bitmap directory: %d bytes", len(b))
+	}
+	for ; len(b) > 0; b = b[sizeBitmapEntry:] {
+		e := bitmapEntry{
+			key:  binary.LittleEndian.Uint16(b),
+			card: binary.LittleEndian.Uint32(b[2:]),
+			ptr:  ChunkPtr(binary.LittleEndian.Uint64(b[6:])),
+		}
+		bm.entries = append(bm.entries, e)
+		bm.count += int64(e.card)
+	}
+
+	return bm, nil
+}
+
+func (bm *Bitmap) writeHead() error {
+	b := make([]byte, sizeBitmapHead)
+	binary.LittleEndian.PutUint64(b, uint64(bm.dir.Ptr()))
+	copy(b[sizePtr:], bitmapMagic[:])
+
+	_, err := bm.headChunk.Write(b)
+
+	return err
+}
+
+func (bm *Bitmap) writeDir() error {
+	b := make([]byte, len(bm.entries)*sizeBitmapEntry)
+	for i, e := range bm.entries {
+		binary.LittleEndian.PutUint16(b[i*sizeBitmapEntry:], e.key)
+		binary.LittleEndian.PutUint32(b[i*sizeBitmapEntry+2:], e.card)
+		binary.LittleEndian.PutUint64(b[i*sizeBitmapEntry+6:], uint64(e.ptr))
+	}
+
+	if len(b) > int(bm.dir.Cap()) {
+		dir, err := bm.dir.Realloc(uint32(2 * len(b)))
+		if err != nil {
+			return err
+		}
+		moved := dir != bm.dir
+		bm.dir = dir
+		if moved {
+			err = bm.writeHead()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := bm.dir.Write(b)
+
+	return err
+}
+
+// find returns the index of the container with key, or where it would be
+// inserted and false.
+func (bm *Bitmap) find(key uint16) (int, bool) {
+	i := sort.Search(len(bm.entries), func(i int) bool {
+		return bm.entries[i].key >= key
+	})
+
+	return i, i < len(bm.entries) && bm.entries[i].key == key
+}
+
+func (bm *Bitmap) readContainer(e bitmapEntry) (*bitmapContainer, error) {
+	chunk, err := bm.pool.Get(e.ptr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBitmapContainer(b, int(e.card))
+}
+
+// writeContainer replaces container i with c, removing it if c is empty.
+func (bm *Bitmap) writeContainer(i int, c *bitmapContainer) error {
+	e := &bm.entries[i]
+	bm.count += int64(c.card()) - int64(e.card)
+	e.card = uint32(c.card())
+
+	if c.card() == 0 {
+		ptr := e.ptr
+		bm.entries = append(bm.entries[:i], bm.entries[i+1:]...)
+		err := bm.writeDir()
+		if err != nil || ptr == 0 {
+			return err
+		}
+		chunk, err := bm.pool.Get(ptr)
+		if err != nil {
+			return err
+		}
+
+		return chunk.Free()
+	}
+
+	b := c.encode()
+	if e.ptr == 0 {
+		chunk, err := bm.pool.AllocAndWrite(b)
+		if err != nil {
+			return err
+		}
+		e.ptr = chunk.Ptr()
+
+		return bm.writeDir()
+	}
+
+	chunk, err := bm.pool.Get(e.ptr)
+	if err != nil {
+		return err
+	}
+	if len(b) > int(chunk.Cap()) {
+		// arrays grow a value at a time, leave them some room
+		n := 2 * len(b)
+		if n > 8*bitmapWords {
+			n = 8 * bitmapWords
+		}
+		chunk, err = chunk.Realloc(uint32(n))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = chunk.Write(b)
+	if err != nil {
+		return err
+	}
+	e.ptr = chunk.Ptr()
+
+	return bm.writeDir()
+}
+
+// Len returns the number of values in the bitmap.
+func (bm *Bitmap) Len() int64 {
+	bm.m.RLock()
+	defer bm.m.RUnlock()
+
+	return bm.count
+}
+
+// Contains reports whether x is in the bitmap.
+func (bm *Bitmap) Contains(x uint32) (bool, error) {
+	bm.m.RLock()
+	defer bm.m.RUnlock()
+
+	i, ok := bm.find(uint16(x >> 16))
+	if !ok {
+		return false, nil
+	}
+	c, err := bm.readContainer(bm.entries[i])
+	if err != nil {
+		return false, err
+	}
+
+	return c.contains(uint16(x)), nil
+}
+
+// Add adds x to the bitmap, returning false if it already was in it.
+func (bm *Bitmap) Add(x uint32) (bool, error) {
+	bm.m.Lock()
+	defer bm.m.Unlock()
+
+	key := uint16(x >> 16)
+	i, ok := bm.find(key)
+	c := &bitmapContainer{}
+	if ok {
+		var err error
+		c, err = bm.readContainer(bm.entries[i])
+		if err != nil {
+			return false, err
+		}
+	} else {
+		bm.entries = append(bm.entries, bitmapEntry{})
+		copy(bm.entries[i+1:], bm.entries[i:])
+		bm.entries[i] = bitmapEntry{key: key}
+	}
+	if !c.add(uint16(x)) {
+		return false, nil
+	}
+
+	return true, bm.writeContainer(i, c)
+}
+
+// Remove removes x from the bitmap, returning false if it wasn't in it.
+func (bm *Bitmap) Remove(x uint32) (bool, error) {
+	bm.m.Lock()
+	defer bm.m.Unlock()
+
+	i, ok := bm.find(uint16(x >> 16))
+	if !ok {
+		return false, nil
+	}
+	c, err := bm.readContainer(bm.entries[i])
+	if err != nil {
+		return false, err
+	}
+	if !c.remove(uint16(x)) {
+		return false, nil
+	}
+
+	return true, bm.writeContainer(i, c)
+}
+
+// Iterate calls f on the values of the bitmap in increasing order until it
+// returns false.
+func (bm *Bitmap) Iterate(f func(x uint32) bool) error {
+	bm.m.RLock()
+	defer bm.m.RUnlock()
+
+	for _, e := range bm.entries {
+		c, err := bm.readContainer(e)
+		if err != nil {
+			return err
+		}
+		if !c.iterate(func(low uint16) bool {
+			return f(uint32(e.key)<<16 | uint32(low))
+		}) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// containers returns the containers of the bitmap by key.
+func (bm *Bitmap) containers() (map[uint16]*bitmapContainer, error) {
+	bm.m.RLock()
+	defer bm.m.RUnlock()
+
+	containers := make(map[uint16]*bitmapContainer, len(bm.entries))
+	for _, e := range bm.entries {
+		c, err := bm.readContainer(e)
+		if err != nil {
+			return nil, err
+		}
+		containers[e.key] = c
+	}
+
+	return containers, nil
+}
+
+// Union adds the values of other to the bitmap.
+func (bm *Bitmap) Union(other *Bitmap) error {
+	if other == bm {
+		return nil
+	}
+	containers, err := other.containers()
+	if err != nil {
+		return err
+	}
+
+	bm.m.Lock()
+	defer bm.m.Unlock()
+
+	keys := make([]int, 0, len(containers))
+	for key := range containers {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		oc := containers[uint16(key)]
+		i, ok := bm.find(uint16(key))
+		if !ok {
+			bm.entries = append(bm.entries, bitmapEntry{})
+			copy(bm.entries[i+1:], bm.entries[i:])
+			bm.entries[i] = bitmapEntry{key: uint16(key)}
+			err = bm.writeContainer(i, oc)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		c, err := bm.readContainer(bm.entries[i])
+		if err != nil {
+			return err
+		}
+		words := c.words()
+		for j, w := range oc.words() {
+			words[j] |= w
+		}
+		err = bm.writeContainer(i, bitmapContainerFromWords(words))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Intersect removes the values that aren't in other from the bitmap.
+func (bm *Bitmap) Intersect(other *Bitmap) error {
+	if other == bm {
+		return nil
+	}
+	containers, err := other.containers()
+	if err != nil {
+		return err
+	}
+
+	bm.m.Lock()
+	defer bm.m.Unlock()
+
+	for i := 0; i < len(bm.entries); {
+		e := bm.entries[i]
+		c := &bitmapContainer{}
+		if oc, ok := containers[e.key]; ok {
+			c, err = bm.readContainer(e)
+			if err != nil {
+				return err
+			}
+			words := c.words()
+			for j, w := range oc.words() {
+				words[j] &= w
+			}
+			c = bitmapContainerFromWords(words)
+		}
+		err = bm.writeContainer(i, c)
+		if err != nil {
+			return err
+		}
+		if c.card() > 0 {
+			i++
+		}
+	}
+
+	return nil
+}
+
+// bitmapContainer holds either the sorted values of an array container, or
+// the words of a bitset container.
+type bitmapContainer struct {
+	array []uint16
+	bits  []uint64
+	n     int // cardinality of the bitset
+}
+
+func decodeBitmapContainer(b []byte, card int) (*bitmapContainer, error) {
+	c := &bitmapContainer{}
+	if card <= bitmapArrayMax {
+		if len(b) != 2*card {
+			return nil, fmt.Errorf("invalid array container: %d bytes for %d values", len(b), card)
+		}
+		c.array = make([]uint16, card)
+		for i := range c.array {
+			c.array[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+
+		return c, nil
+	}
+
+	if len(b) != 8*bitmapWords {
+		return nil, fmt.Errorf("invalid bitset container: %d bytes", len(b))
+	}
+	c.bits = make([]uint64, bitmapWords)
+	for i := range c.bits {
+		c.bits[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	c.n = card
+
+	return c, nil
+}
+
+func bitmapContainerFromWords(words []uint64) *bitmapContainer {
+	c := &bitmapContainer{bits: words}
+	for _, w := range words {
+		c.n += bits.OnesCount64(w)
+	}
+	if c.n > bitmapArrayMax {
+		return c
+	}
+
+	array := make([]uint16, 0, c.n)
+	c.iterate(func(x uint16) bool {
+		array = append(array, x)
+		return true
+	})
+
+	return &bitmapContainer{array: array}
+}
+
+func (c *bitmapContainer) encode() []byte {
+	if c.bits == nil {
+		b := make([]byte, 2*len(c.array))
+		for i, x := range c.array {
+			binary.LittleEndian.PutUint16(b[2*i:], x)
+		}
+
+		return b
+	}
+
+	b := make([]byte, 8*len(c.bits))
+	for i, w := range c.bits {
+		binary.LittleEndian.PutUint64(b[8*i:], w)
+	}
+
+	return b
+}
+
+func (c *bitmapContainer) card() int {
+	if c.bits == nil {
+		return len(c.array)
+	}
+
+	return c.n
+}
+
+// words returns the container as a bitset, copied if it already is one.
+func (c *bitmapContainer) words() []uint64 {
+	words := make([]uint64, bitmapWords)
+	if c.bits != nil {
+		copy(words, c.bits)
+		return words
+	}
+	for _, x := range c.array {
+		words[x/64] |= 1 << (x % 64)
+	}
+
+	return words
+}
+
+func (c *bitmapContainer) search(x uint16) (int, bool) {
+	i := sort.Search(len(c.array), func(i int) bool {
+		return c.array[i] >= x
+	})
+
+	return i, i < len(c.array) && c.array[i] == x
+}
+
+func (c *bitmapContainer) contains(x uint16) bool {
+	if c.bits != nil {
+		return c.bits[x/64]&(1<<(x%64)) != 0
+	}
+	_, ok := c.search(x)
+
+	return ok
+}
+
+func (c *bitmapContainer) add(x uint16) bool {
+	if c.contains(x) {
+		return false
+	}
+	if c.bits == nil && len(c.array) == bitmapArrayMax {
+		c.bits, c.n, c.array = c.words(), len(c.array), nil
+	}
+	if c.bits != nil {
+		c.bits[x/64] |= 1 << (x % 64)
+		c.n++
+		return true
+	}
+
+	i, _ := c.search(x)
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = x
+
+	return true
+}
+
+func (c *bitmapContainer) remove(x uint16) bool {
+	if !c.contains(x) {
+		return false
+	}
+	if c.bits == nil {
+		i, _ := c.search(x)
+		c.array = append(c.array[:i], c.array[i+1:]...)
+		return true
+	}
+
+	c.bits[x/64] &^= 1 << (x % 64)
+	c.n--
+	if c.n <= bitmapArrayMax {
+		*c = *bitmapContainerFromWords(c.bits)
+	}
+
+	return true
+}
+
+func (c *bitmapContainer) iterate(f func(x uint16) bool) bool {
+	if c.bits == nil {
+		for _, x := range c.array {
+			if !f(x) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i, w := range c.bits {
+		for w != 0 {
+			j := bits.TrailingZeros64(w)
+			if !f(uint16(i*64 + j)) {
+				return false
+			}
+			w &^= 1 << j
+		}
+	}
+
+	return true
+}
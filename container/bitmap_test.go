@@ -0,0 +1,152 @@
+package container_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestBitmap(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	bm, err := container.NewBitmap(buf)
+	if err != nil {
+		t.Errorf("NewBitmap(nil): unexpected error: %v", err)
+		return
+	}
+
+	expected := map[uint32]bool{}
+	// a dense container, turned into a bitset, and sparse ones
+	for x := uint32(0); x < 6000; x++ {
+		expected[x] = true
+	}
+	for x := uint32(1 << 20); x < 1<<30; x += 1<<20 + 7 {
+		expected[x] = true
+	}
+	expected[1<<32-1] = true
+	for x := range expected {
+		added, err := bm.Add(x)
+		if err != nil {
+			t.Errorf("bm.Add(%d): unexpected error: %v", x, err)
+			return
+		}
+		if !added {
+			t.Errorf("bm.Add(%d) = false, expected true", x)
+		}
+	}
+	added, err := bm.Add(42)
+	if err != nil || added {
+		t.Errorf("bm.Add(42) = %v, %v on an existing value, expected false, nil", added, err)
+	}
+	for x := uint32(0); x < 6000; x += 3 {
+		removed, err := bm.Remove(x)
+		if err != nil || !removed {
+			t.Errorf("bm.Remove(%d) = %v, %v, expected true, nil", x, removed, err)
+			return
+		}
+		delete(expected, x)
+	}
+	removed, err := bm.Remove(123456)
+	if err != nil || removed {
+		t.Errorf("bm.Remove(123456) = %v, %v, expected false, nil", removed, err)
+	}
+
+	bm, err = container.NewBitmap(buf)
+	if err != nil {
+		t.Errorf("NewBitmap(...): unexpected error: %v", err)
+		return
+	}
+	if n := bm.Len(); n != int64(len(expected)) {
+		t.Errorf("bm.Len() = %d, expected %d", n, len(expected))
+	}
+	for _, x := range []uint32{0, 1, 2, 3, 5999, 6000, 1 << 20, 1<<32 - 1, 1<<32 - 2} {
+		ok, err := bm.Contains(x)
+		if err != nil {
+			t.Errorf("bm.Contains(%d): unexpected error: %v", x, err)
+			return
+		}
+		if ok != expected[x] {
+			t.Errorf("bm.Contains(%d) = %v, expected %v", x, ok, expected[x])
+		}
+	}
+	checkBitmap(t, bm, expected)
+
+	other, err := container.NewBitmap(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewBitmap(nil): unexpected error: %v", err)
+		return
+	}
+	for _, x := range []uint32{0, 1, 3, 7, 1<<20 + 7, 1 << 31} {
+		_, err = other.Add(x)
+		if err != nil {
+			t.Errorf("other.Add(%d): unexpected error: %v", x, err)
+			return
+		}
+	}
+
+	err = bm.Union(other)
+	if err != nil {
+		t.Errorf("bm.Union(...): unexpected error: %v", err)
+		return
+	}
+	for _, x := range []uint32{0, 3, 1<<20 + 7, 1 << 31} {
+		expected[x] = true
+	}
+	checkBitmap(t, bm, expected)
+
+	err = bm.Intersect(other)
+	if err != nil {
+		t.Errorf("bm.Intersect(...): unexpected error: %v", err)
+		return
+	}
+	checkBitmap(t, bm, map[uint32]bool{0: true, 1: true, 3: true, 7: true, 1<<20 + 7: true, 1 << 31: true})
+
+	for _, x := range []uint32{0, 1, 3, 7, 1<<20 + 7, 1 << 31} {
+		_, err = bm.Remove(x)
+		if err != nil {
+			t.Errorf("bm.Remove(%d): unexpected error: %v", x, err)
+			return
+		}
+	}
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunks, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(chunks) != 2 {
+		t.Errorf("pool.Allocated() = %d chunks after removing everything, expected the head and directory", len(chunks))
+	}
+}
+
+func checkBitmap(t *testing.T, bm *container.Bitmap, expected map[uint32]bool) {
+	t.Helper()
+
+	var want []uint32
+	for x := range expected {
+		want = append(want, x)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+	var got []uint32
+	err := bm.Iterate(func(x uint32) bool {
+		got = append(got, x)
+		return true
+	})
+	if err != nil {
+		t.Errorf("bm.Iterate(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("bm.Iterate(...) returned %d values, expected %d", len(got), len(want))
+	}
+	if n := bm.Len(); n != int64(len(want)) {
+		t.Errorf("bm.Len() = %d, expected %d", n, len(want))
+	}
+}
@@ -0,0 +1,207 @@
+package container
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// ErrNoBloomFilter is returned by RebuildBloomFilter for maps created without
+// WithBloomFilter.
+var ErrNoBloomFilter = errors.New("map has no bloom filter")
+
+// Bits per key and number of hashes of the bloom filters, for a false
+// positive rate of about 1% when holding as many keys as they were sized for.
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// The bloom filter of a map is kept in memory and in a chunk of its own:
+//
+//	hashes   uint32
+//	deletes  uint32, keys deleted since the filter was last rebuilt
+//	bits     []byte
+//
+// Bits are set before a key is stored, so the filter never misses a key even
+// when a Store is interrupted. Deleted keys can't be removed from the filter,
+// which is rebuilt from the buckets once more keys were deleted than the map
+// holds.
+type bloomFilter struct {
+	chunk   *Chunk
+	hashes  int
+	deletes uint32
+	bits    []byte
+}
+
+var sizeBloomHeader = 2 * binarySizePanic(uint32(0))
+
+func newBloomFilter(pool *Pool, keys int) (*bloomFilter, error) {
+	if keys < 1 {
+		keys = 1
+	}
+	f := &bloomFilter{
+		hashes: bloomHashes,
+		bits:   make([]byte, (keys*bloomBitsPerKey+7)/8),
+	}
+
+	var err error
+	f.chunk, err = pool.AllocAndWrite(f.encode())
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func readBloomFilter(pool *Pool, ptr ChunkPtr) (*bloomFilter, error) {
+	chunk, err := pool.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= sizeBloomHeader {
+		return nil, fmt.Errorf("invalid bloom filter: %d bytes", len(b))
+	}
+
+	return &bloomFilter{
+		chunk:   chunk,
+		hashes:  int(binary.LittleEndian.Uint32(b)),
+		deletes: binary.LittleEndian.Uint32(b[4:]),
+		bits:    b[sizeBloomHeader:],
+	}, nil
+}
+
+func (f *bloomFilter) encode() []byte {
+	b := make([]byte, sizeBloomHeader, sizeBloomHeader+len(f.bits))
+	binary.LittleEndian.PutUint32(b, uint32(f.hashes))
+	binary.LittleEndian.PutUint32(b[4:], f.deletes)
+
+	return append(b, f.bits...)
+}
+
+// positions calls fn with the bit positions of key, using double hashing on
+// the halves of its FNV-1a hash.
+func (f *bloomFilter) positions(key []byte, fn func(bit uint64)) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+
+	n := uint64(len(f.bits)) * 8
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		fn((h1 + i*h2) % n)
+	}
+}
+
+func (f *bloomFilter) mayContain(key []byte) bool {
+	ok := true
+	f.positions(key, func(bit uint64) {
+		ok = ok && f.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+
+	return ok
+}
+
+// add sets the bits of key, writing the bytes that changed.
+func (f *bloomFilter) add(key []byte) error {
+	var err error
+	f.positions(key, func(bit uint64) {
+		mask := byte(1 << (bit % 8))
+		if err != nil || f.bits[bit/8]&mask != 0 {
+			return
+		}
+		f.bits[bit/8] |= mask
+		_, err = f.chunk.WriteAt(f.bits[bit/8:bit/8+1], int64(sizeBloomHeader)+int64(bit/8))
+	})
+
+	return err
+}
+
+func (f *bloomFilter) writeDeletes() error {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, f.deletes)
+	_, err := f.chunk.WriteAt(b, 4)
+
+	return err
+}
+
+// bloomDelete records that a key was deleted, rebuilding the filter once it
+// holds more deleted keys than live ones.
+func (m *HashMap) bloomDelete() error {
+	if m.bloom == nil {
+		return nil
+	}
+
+	m.bloom.deletes++
+	if int64(m.bloom.deletes) <= m.count {
+		return m.bloom.writeDeletes()
+	}
+
+	return m.rebuildBloomFilter()
+}
+
+// RebuildBloomFilter clears the stale bits of deleted keys from the bloom
+// filter of a map created with WithBloomFilter. It is done automatically once
+// more keys were deleted than the map holds.
+func (m *HashMap) RebuildBloomFilter() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.bloom == nil {
+		return ErrNoBloomFilter
+	}
+
+	return m.update(m.rebuildBloomFilter)
+}
+
+func (m *HashMap) rebuildBloomFilter() error {
+	f := &bloomFilter{
+		chunk:  m.bloom.chunk,
+		hashes: m.bloom.hashes,
+		bits:   make([]byte, len(m.bloom.bits)),
+	}
+
+	var itErr error
+	err := m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
+		if b.Type != bucketTypeList || b.Head == 0 {
+			return true
+		}
+		node, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		for err == nil && node != nil {
+			var key []byte
+			key, err = node.KeyBytes()
+			if err != nil {
+				break
+			}
+			f.positions(key, func(bit uint64) {
+				f.bits[bit/8] |= 1 << (bit % 8)
+			})
+			node, err = node.Next()
+		}
+		if err != nil {
+			itErr = err
+			return false
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if itErr != nil {
+		return itErr
+	}
+
+	_, err = f.chunk.Write(f.encode())
+	if err != nil {
+		return err
+	}
+	m.bloom = f
+
+	return nil
+}
@@ -0,0 +1,767 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BTreeMaxKeys is the default number of keys a node holds before it is split.
+const BTreeMaxKeys = 64
+
+// BTree is a B+tree mapping keys to values in key order. Keys and values are
+// stored in chunks of their own, nodes only hold pointers to them. Entries are
+// kept in the leaves, which are linked to each other for range scans, while
+// inner nodes hold copies of the keys separating their children.
+type BTree struct {
+	m *sync.RWMutex
+
+	pool      *Pool
+	headChunk *Chunk
+	root      ChunkPtr
+	count     int64
+	maxKeys   int
+}
+
+// The head chunk holds the tree header:
+//
+//	root     int64
+//	count    int64
+//	maxKeys  uint32
+//	magic    [4]byte
+//
+// Nodes are chunks of a fixed size:
+//
+//	leaf     uint8
+//	n        uint16
+//	next     int64, the next leaf
+//	keys     maxKeys * int64
+//	ptrs     (maxKeys + 1) * int64, values in leaves, children otherwise
+var (
+	sizePtr         = binarySizePanic(ChunkPtr(0))
+	sizeBTreeHeader = sizePtr + sizeCount + binarySizePanic(uint32(0)) + len(btreeMagic)
+)
+
+var btreeMagic = [4]byte{'k', 'v', 'b', 't'}
+
+type btreeNode struct {
+	chunk *Chunk
+	leaf  bool
+	next  ChunkPtr
+	keys  []btreeKey
+	ptrs  []ChunkPtr
+}
+
+type btreeKey struct {
+	ptr ChunkPtr
+	b   []byte // loaded lazily
+}
+
+func NewBTree(f io.ReadWriteSeeker, opts ...BTreeOption) (*BTree, error) {
+	cfg := &btreeConfig{
+		maxKeys: BTreeMaxKeys,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.maxKeys < 3 || cfg.maxKeys > 1<<16-1 {
+		return nil, fmt.Errorf("invalid number of keys per node %d", cfg.maxKeys)
+	}
+
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &BTree{
+		m: &sync.RWMutex{},
+
+		pool:    pool,
+		maxKeys: cfg.maxKeys,
+	}
+
+	if pool.Size() == 0 {
+		t.headChunk, err = pool.Alloc(uint32(sizeBTreeHeader))
+		if err != nil {
+			return nil, err
+		}
+		root, err := t.newNode(true)
+		if err != nil {
+			return nil, err
+		}
+		err = t.writeNode(root)
+		if err != nil {
+			return nil, err
+		}
+		t.root = root.chunk.Ptr()
+
+		return t, t.writeHead()
+	}
+
+	t.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := t.headChunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sizeBTreeHeader || !bytes.Equal(b[sizeBTreeHeader-len(btreeMagic):], btreeMagic[:]) {
+		return nil, fmt.Errorf("invalid b-tree header: %d bytes", len(b))
+	}
+	t.root = ChunkPtr(binary.LittleEndian.Uint64(b))
+	t.count = int64(binary.LittleEndian.Uint64(b[sizePtr:]))
+	t.maxKeys = int(binary.LittleEndian.Uint32(b[sizePtr+sizeCount:]))
+	if t.maxKeys < 3 {
+		return nil, fmt.Errorf("invalid number of keys per node %d", t.maxKeys)
+	}
+
+	return t, nil
+}
+
+func (t *BTree) writeHead() error {
+	b := make([]byte, sizeBTreeHeader)
+	binary.LittleEndian.PutUint64(b, uint64(t.root))
+	binary.LittleEndian.PutUint64(b[sizePtr:], uint64(t.count))
+	binary.LittleEndian.PutUint32(b[sizePtr+sizeCount:], uint32(t.maxKeys))
+	copy(b[sizePtr+sizeCount+4:], btreeMagic[:])
+
+	_, err := t.headChunk.Write(b)
+
+	return err
+}
+
+// Len returns the number of entries in the tree.
+func (t *BTree) Len() int64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.count
+}
+
+func (t *BTree) nodeSize() int {
+	return 1 + 2 + sizePtr + t.maxKeys*sizePtr + (t.maxKeys+1)*sizePtr
+}
+
+func (t *BTree) minKeys() int {
+	return t.maxKeys / 2
+}
+
+func (t *BTree) newNode(leaf bool) (*btreeNode, error) {
+	chunk, err := t.pool.Alloc(uint32(t.nodeSize()))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &btreeNode{
+		chunk: chunk,
+		leaf:  leaf,
+	}
+	if !leaf {
+		n.ptrs = make([]ChunkPtr, 0, t.maxKeys+1)
+	}
+
+	return n, nil
+}
+
+func (t *BTree) readNode(ptr ChunkPtr) (*btreeNode, error) {
+	chunk, err := t.pool.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != t.nodeSize() {
+		return nil, fmt.Errorf("node 0x%x: expected to read %d bytes, read %d", ptr, t.nodeSize(), len(b))
+	}
+
+	n := &btreeNode{
+		chunk: chunk,
+		leaf:  b[0] == 1,
+		next:  ChunkPtr(binary.LittleEndian.Uint64(b[3:])),
+	}
+	size := int(binary.LittleEndian.Uint16(b[1:]))
+	if size > t.maxKeys {
+		return nil, fmt.Errorf("node 0x%x: %d keys, expected at most %d", ptr, size, t.maxKeys)
+	}
+	nPtrs := size
+	if !n.leaf {
+		nPtrs++
+	}
+
+	off := 3 + sizePtr
+	n.keys = make([]btreeKey, size)
+	for i := range n.keys {
+		n.keys[i].ptr = ChunkPtr(binary.LittleEndian.Uint64(b[off+i*sizePtr:]))
+	}
+	off += t.maxKeys * sizePtr
+	n.ptrs = make([]ChunkPtr, nPtrs)
+	for i := range n.ptrs {
+		n.ptrs[i] = ChunkPtr(binary.LittleEndian.Uint64(b[off+i*sizePtr:]))
+	}
+
+	return n, nil
+}
+
+func (t *BTree) writeNode(n *btreeNode) error {
+	b := make([]byte, t.nodeSize())
+	if n.leaf {
+		b[0] = 1
+	}
+	binary.LittleEndian.PutUint16(b[1:], uint16(len(n.keys)))
+	binary.LittleEndian.PutUint64(b[3:], uint64(n.next))
+
+	off := 3 + sizePtr
+	for i, k := range n.keys {
+		binary.LittleEndian.PutUint64(b[off+i*sizePtr:], uint64(k.ptr))
+	}
+	off += t.maxKeys * sizePtr
+	for i, ptr := range n.ptrs {
+		binary.LittleEndian.PutUint64(b[off+i*sizePtr:], uint64(ptr))
+	}
+
+	_, err := n.chunk.Write(b)
+
+	return err
+}
+
+func (t *BTree) keyBytes(n *btreeNode, i int) ([]byte, error) {
+	if n.keys[i].b != nil {
+		return n.keys[i].b, nil
+	}
+
+	chunk, err := t.pool.Get(n.keys[i].ptr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	n.keys[i].b = b
+
+	return b, nil
+}
+
+func (t *BTree) newKey(b []byte) (btreeKey, error) {
+	chunk, err := t.pool.AllocAndWrite(b)
+	if err != nil {
+		return btreeKey{}, err
+	}
+
+	return btreeKey{ptr: chunk.Ptr(), b: b}, nil
+}
+
+func (t *BTree) free(ptrs ...ChunkPtr) error {
+	for _, ptr := range ptrs {
+		chunk, err := t.pool.Get(ptr)
+		if err != nil {
+			return err
+		}
+		err = chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// search returns the index of the first key of n greater or equal to key,
+// and whether it is equal.
+func (t *BTree) search(n *btreeNode, key []byte) (int, bool, error) {
+	lo, hi := 0, len(n.keys)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		b, err := t.keyBytes(n, mid)
+		if err != nil {
+			return 0, false, err
+		}
+		if bytes.Compare(b, key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == len(n.keys) {
+		return lo, false, nil
+	}
+
+	b, err := t.keyBytes(n, lo)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return lo, bytes.Equal(b, key), nil
+}
+
+// child returns the index of the child of n that key belongs to. Separators
+// are the first keys of their right subtree.
+func (t *BTree) child(n *btreeNode, key []byte) (int, error) {
+	i, found, err := t.search(n, key)
+	if found {
+		i++
+	}
+
+	return i, err
+}
+
+// leaf returns the leaf key belongs to.
+func (t *BTree) leaf(key []byte) (*btreeNode, error) {
+	n, err := t.readNode(t.root)
+	for err == nil && !n.leaf {
+		var i int
+		i, err = t.child(n, key)
+		if err != nil {
+			return nil, err
+		}
+		n, err = t.readNode(n.ptrs[i])
+	}
+
+	return n, err
+}
+
+func (t *BTree) Load(key []byte) ([]byte, bool, error) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	n, err := t.leaf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	i, found, err := t.search(n, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	chunk, err := t.pool.Get(n.ptrs[i])
+	if err != nil {
+		return nil, true, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, true, err
+	}
+
+	return b, true, nil
+}
+
+func (t *BTree) Store(key, value []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	valueChunk, err := t.pool.AllocAndWrite(value)
+	if err != nil {
+		return err
+	}
+	root, err := t.readNode(t.root)
+	if err != nil {
+		return err
+	}
+	split, err := t.insert(root, key, valueChunk.Ptr())
+	if err != nil {
+		return err
+	}
+	if split != nil {
+		newRoot, err := t.newNode(false)
+		if err != nil {
+			return err
+		}
+		newRoot.keys = append(newRoot.keys, split.key)
+		newRoot.ptrs = append(newRoot.ptrs, root.chunk.Ptr(), split.right)
+		err = t.writeNode(newRoot)
+		if err != nil {
+			return err
+		}
+		t.root = newRoot.chunk.Ptr()
+	}
+
+	return t.writeHead()
+}
+
+// btreeSplit is the separator and right half of a node that overflowed.
+type btreeSplit struct {
+	key   btreeKey
+	right ChunkPtr
+}
+
+func (t *BTree) insert(n *btreeNode, key []byte, value ChunkPtr) (*btreeSplit, error) {
+	if n.leaf {
+		i, found, err := t.search(n, key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			old := n.ptrs[i]
+			n.ptrs[i] = value
+			err = t.writeNode(n)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, t.free(old)
+		}
+
+		k, err := t.newKey(key)
+		if err != nil {
+			return nil, err
+		}
+		n.keys = insertKey(n.keys, i, k)
+		n.ptrs = insertPtr(n.ptrs, i, value)
+		t.count++
+	} else {
+		i, err := t.child(n, key)
+		if err != nil {
+			return nil, err
+		}
+		child, err := t.readNode(n.ptrs[i])
+		if err != nil {
+			return nil, err
+		}
+		split, err := t.insert(child, key, value)
+		if err != nil || split == nil {
+			return nil, err
+		}
+		n.keys = insertKey(n.keys, i, split.key)
+		n.ptrs = insertPtr(n.ptrs, i+1, split.right)
+	}
+
+	if len(n.keys) <= t.maxKeys {
+		return nil, t.writeNode(n)
+	}
+
+	return t.split(n)
+}
+
+// split moves the upper half of n to a new node. Leaves copy their first key
+// to the parent, inner nodes move their middle key to it.
+func (t *BTree) split(n *btreeNode) (*btreeSplit, error) {
+	right, err := t.newNode(n.leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	var sep btreeKey
+	mid := len(n.keys) / 2
+	if n.leaf {
+		right.keys = append(right.keys, n.keys[mid:]...)
+		right.ptrs = append(right.ptrs, n.ptrs[mid:]...)
+		n.keys, n.ptrs = n.keys[:mid], n.ptrs[:mid]
+		right.next, n.next = n.next, right.chunk.Ptr()
+
+		b, err := t.keyBytes(right, 0)
+		if err != nil {
+			return nil, err
+		}
+		sep, err = t.newKey(b)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sep = n.keys[mid]
+		right.keys = append(right.keys, n.keys[mid+1:]...)
+		right.ptrs = append(right.ptrs, n.ptrs[mid+1:]...)
+		n.keys, n.ptrs = n.keys[:mid], n.ptrs[:mid+1]
+	}
+
+	err = t.writeNode(right)
+	if err != nil {
+		return nil, err
+	}
+	err = t.writeNode(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &btreeSplit{key: sep, right: right.chunk.Ptr()}, nil
+}
+
+func (t *BTree) Delete(key []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	root, err := t.readNode(t.root)
+	if err != nil {
+		return err
+	}
+	found, err := t.delete(root, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("key %q not found", key)
+	}
+	t.count--
+
+	if root.leaf || len(root.keys) > 0 {
+		return t.writeHead()
+	}
+	t.root = root.ptrs[0]
+	err = t.writeHead()
+	if err != nil {
+		return err
+	}
+
+	return root.chunk.Free()
+}
+
+func (t *BTree) delete(n *btreeNode, key []byte) (bool, error) {
+	if n.leaf {
+		i, found, err := t.search(n, key)
+		if err != nil || !found {
+			return false, err
+		}
+		k, v := n.keys[i], n.ptrs[i]
+		n.keys = removeKey(n.keys, i)
+		n.ptrs = removePtr(n.ptrs, i)
+		err = t.writeNode(n)
+		if err != nil {
+			return false, err
+		}
+
+		return true, t.free(k.ptr, v)
+	}
+
+	i, err := t.child(n, key)
+	if err != nil {
+		return false, err
+	}
+	child, err := t.readNode(n.ptrs[i])
+	if err != nil {
+		return false, err
+	}
+	found, err := t.delete(child, key)
+	if err != nil || !found {
+		return found, err
+	}
+	if len(child.keys) >= t.minKeys() {
+		return true, nil
+	}
+
+	return true, t.rebalance(n, i, child)
+}
+
+// rebalance refills the underfull child i of n, borrowing a key from one of
+// its siblings or merging with it.
+func (t *BTree) rebalance(n *btreeNode, i int, child *btreeNode) error {
+	if i > 0 {
+		left, err := t.readNode(n.ptrs[i-1])
+		if err != nil {
+			return err
+		}
+		if len(left.keys) > t.minKeys() {
+			return t.borrowLeft(n, i, left, child)
+		}
+
+		return t.merge(n, i-1, left, child)
+	}
+
+	right, err := t.readNode(n.ptrs[i+1])
+	if err != nil {
+		return err
+	}
+	if len(right.keys) > t.minKeys() {
+		return t.borrowRight(n, i, child, right)
+	}
+
+	return t.merge(n, i, child, right)
+}
+
+func (t *BTree) borrowLeft(n *btreeNode, i int, left, child *btreeNode) error {
+	var old ChunkPtr
+	last := len(left.keys) - 1
+	if child.leaf {
+		child.keys = insertKey(child.keys, 0, left.keys[last])
+		child.ptrs = insertPtr(child.ptrs, 0, left.ptrs[last])
+		left.keys, left.ptrs = left.keys[:last], left.ptrs[:last]
+
+		b, err := t.keyBytes(child, 0)
+		if err != nil {
+			return err
+		}
+		old = n.keys[i-1].ptr
+		n.keys[i-1], err = t.newKey(b)
+		if err != nil {
+			return err
+		}
+	} else {
+		child.keys = insertKey(child.keys, 0, n.keys[i-1])
+		child.ptrs = insertPtr(child.ptrs, 0, left.ptrs[last+1])
+		n.keys[i-1] = left.keys[last]
+		left.keys, left.ptrs = left.keys[:last], left.ptrs[:last+1]
+	}
+
+	err := t.writeNodes(left, child, n)
+	if err != nil || old == 0 {
+		return err
+	}
+
+	return t.free(old)
+}
+
+func (t *BTree) borrowRight(n *btreeNode, i int, child, right *btreeNode) error {
+	var old ChunkPtr
+	if child.leaf {
+		child.keys = append(child.keys, right.keys[0])
+		child.ptrs = append(child.ptrs, right.ptrs[0])
+		right.keys, right.ptrs = right.keys[1:], right.ptrs[1:]
+
+		b, err := t.keyBytes(right, 0)
+		if err != nil {
+			return err
+		}
+		old = n.keys[i].ptr
+		n.keys[i], err = t.newKey(b)
+		if err != nil {
+			return err
+		}
+	} else {
+		child.keys = append(child.keys, n.keys[i])
+		child.ptrs = append(child.ptrs, right.ptrs[0])
+		n.keys[i] = right.keys[0]
+		right.keys, right.ptrs = right.keys[1:], right.ptrs[1:]
+	}
+
+	err := t.writeNodes(child, right, n)
+	if err != nil || old == 0 {
+		return err
+	}
+
+	return t.free(old)
+}
+
+// merge moves the content of right, the child i+1 of n, to left and frees it.
+func (t *BTree) merge(n *btreeNode, i int, left, right *btreeNode) error {
+	sep := n.keys[i]
+	ptrs := []ChunkPtr{right.chunk.Ptr()}
+	if left.leaf {
+		left.next = right.next
+		ptrs = append(ptrs, sep.ptr)
+	} else {
+		left.keys = append(left.keys, sep)
+	}
+	left.keys = append(left.keys, right.keys...)
+	left.ptrs = append(left.ptrs, right.ptrs...)
+	n.keys = removeKey(n.keys, i)
+	n.ptrs = removePtr(n.ptrs, i+1)
+
+	err := t.writeNodes(left, n)
+	if err != nil {
+		return err
+	}
+
+	return t.free(ptrs...)
+}
+
+func (t *BTree) writeNodes(nodes ...*btreeNode) error {
+	for _, n := range nodes {
+		err := t.writeNode(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertKey(kk []btreeKey, i int, k btreeKey) []btreeKey {
+	kk = append(kk, btreeKey{})
+	copy(kk[i+1:], kk[i:])
+	kk[i] = k
+
+	return kk
+}
+
+func insertPtr(pp []ChunkPtr, i int, ptr ChunkPtr) []ChunkPtr {
+	pp = append(pp, 0)
+	copy(pp[i+1:], pp[i:])
+	pp[i] = ptr
+
+	return pp
+}
+
+func removeKey(kk []btreeKey, i int) []btreeKey {
+	return append(kk[:i], kk[i+1:]...)
+}
+
+func removePtr(pp []ChunkPtr, i int) []ChunkPtr {
+	return append(pp[:i], pp[i+1:]...)
+}
+
+// Range calls f on every entry in key order until it returns false.
+func (t *BTree) Range(f func(key, value []byte) bool) error {
+	return t.Scan(nil, nil, f)
+}
+
+// Scan calls f on the entries with keys from start, included, to end,
+// excluded, in key order until it returns false. A nil start or end leaves
+// the range open on that side.
+func (t *BTree) Scan(start, end []byte, f func(key, value []byte) bool) error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.scan(start, func(key []byte) bool {
+		return end == nil || bytes.Compare(key, end) < 0
+	}, f)
+}
+
+// RangePrefix calls f on the entries whose key starts with prefix, in key
+// order, until it returns false.
+func (t *BTree) RangePrefix(prefix []byte, f func(key, value []byte) bool) error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.scan(prefix, func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	}, f)
+}
+
+// scan calls f on the entries from start, in key order, as long as both f and
+// in return true.
+func (t *BTree) scan(start []byte, in func(key []byte) bool, f func(key, value []byte) bool) error {
+	n, err := t.leaf(start)
+	if err != nil {
+		return err
+	}
+	i, _, err := t.search(n, start)
+	if err != nil {
+		return err
+	}
+
+	for {
+		for ; i < len(n.keys); i++ {
+			key, err := t.keyBytes(n, i)
+			if err != nil {
+				return err
+			}
+			if !in(key) {
+				return nil
+			}
+			chunk, err := t.pool.Get(n.ptrs[i])
+			if err != nil {
+				return err
+			}
+			value, err := chunk.ReadAll()
+			if err != nil {
+				return err
+			}
+
+			if !f(key, value) {
+				return nil
+			}
+		}
+		if n.next == 0 {
+			return nil
+		}
+
+		n, err = t.readNode(n.next)
+		if err != nil {
+			return err
+		}
+		i = 0
+	}
+}
@@ -0,0 +1,173 @@
+package container_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestBTree(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	tree, err := container.NewBTree(buf, container.WithMaxKeys(4))
+	if err != nil {
+		t.Errorf("NewBTree(nil): unexpected error: %v", err)
+		return
+	}
+
+	expected := map[string]string{}
+	for _, i := range rand.Perm(500) {
+		key, value := fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)
+		err = tree.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("tree.Store(%q, %q): unexpected error: %v", key, value, err)
+			return
+		}
+		expected[key] = value
+	}
+	err = tree.Store([]byte("key-042"), []byte("updated"))
+	if err != nil {
+		t.Errorf("tree.Store(%q, ...): unexpected error: %v", "key-042", err)
+		return
+	}
+	expected["key-042"] = "updated"
+
+	for i, key := range rand.Perm(500) {
+		if i%2 == 0 {
+			continue
+		}
+		k := fmt.Sprintf("key-%03d", key)
+		err = tree.Delete([]byte(k))
+		if err != nil {
+			t.Errorf("tree.Delete(%q): unexpected error: %v", k, err)
+			return
+		}
+		delete(expected, k)
+	}
+	err = tree.Delete([]byte("missing"))
+	if err == nil {
+		t.Errorf("tree.Delete(%q): expected error, got nil", "missing")
+	}
+
+	tree, err = container.NewBTree(buf)
+	if err != nil {
+		t.Errorf("NewBTree(...): unexpected error: %v", err)
+		return
+	}
+	if n := tree.Len(); n != int64(len(expected)) {
+		t.Errorf("tree.Len() = %d, expected %d", n, len(expected))
+	}
+	for _, key := range []string{"key-000", "key-042", "key-250", "key-499", "missing"} {
+		value, ok, err := tree.Load([]byte(key))
+		if err != nil {
+			t.Errorf("tree.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		expectedValue, expectedOK := expected[key]
+		if ok != expectedOK || string(value) != expectedValue {
+			t.Errorf("tree.Load(%q) = %q, %v, expected %q, %v", key, value, ok, expectedValue, expectedOK)
+		}
+	}
+
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var got []string
+	err = tree.Range(func(key, value []byte) bool {
+		if string(value) != expected[string(key)] {
+			t.Errorf("tree.Range(...): value for %q = %q, expected %q", key, value, expected[string(key)])
+		}
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("tree.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Errorf("tree.Range(...) = %v, expected %v", got, keys)
+	}
+
+	for _, tc := range []struct {
+		start, end string
+	}{
+		{start: "key-100", end: "key-200"},
+		{start: "key-1005", end: "key-2"},
+		{start: "key-450"},
+		{start: "a", end: "b"},
+	} {
+		var expectedKeys []string
+		for _, key := range keys {
+			if key >= tc.start && (tc.end == "" || key < tc.end) {
+				expectedKeys = append(expectedKeys, key)
+			}
+		}
+		var end []byte
+		if tc.end != "" {
+			end = []byte(tc.end)
+		}
+
+		got = nil
+		err = tree.Scan([]byte(tc.start), end, func(key, _ []byte) bool {
+			got = append(got, string(key))
+			return true
+		})
+		if err != nil {
+			t.Errorf("tree.Scan(%q, %q, ...): unexpected error: %v", tc.start, tc.end, err)
+			return
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expectedKeys) {
+			t.Errorf("tree.Scan(%q, %q, ...) = %v, expected %v", tc.start, tc.end, got, expectedKeys)
+		}
+	}
+
+	var expectedKeys []string
+	for _, key := range keys {
+		if key[:6] == "key-04" {
+			expectedKeys = append(expectedKeys, key)
+		}
+	}
+	got = nil
+	err = tree.RangePrefix([]byte("key-04"), func(key, _ []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("tree.RangePrefix(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expectedKeys) {
+		t.Errorf("tree.RangePrefix(%q, ...) = %v, expected %v", "key-04", got, expectedKeys)
+	}
+
+	for _, key := range keys {
+		err = tree.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("tree.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	if n := tree.Len(); n != 0 {
+		t.Errorf("tree.Len() = %d, expected 0", n)
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunks, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(chunks) != 2 {
+		t.Errorf("pool.Allocated() = %d chunks after deleting everything, expected the head and root", len(chunks))
+	}
+}
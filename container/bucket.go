@@ -13,15 +13,15 @@ type hashBucket struct {
 	Head ChunkPtr
 
 	pool  *Pool
+	cfg   *hashMapConfig
 	chunk *Chunk
 	idx   int
 }
 
 var (
-	sizeType        = binarySizePanic(hashBucket{}.Type)
-	sizeHead        = binarySizePanic(hashBucket{}.Head)
-	sizeHashBucket  = sizeType + sizeHead
-	sizeHashBuckets = HashMapN * sizeHashBucket
+	sizeType       = binarySizePanic(hashBucket{}.Type)
+	sizeHead       = binarySizePanic(hashBucket{}.Head)
+	sizeHashBucket = sizeType + sizeHead
 )
 
 type bucketType uint8
@@ -31,14 +31,21 @@ const (
 	bucketTypeBuckets
 )
 
-type hashBuckets [HashMapN]*hashBucket
+type hashBuckets []*hashBucket
 
-func newHashBuckets(pool *Pool, chunk *Chunk) hashBuckets {
-	var hh hashBuckets
+func newHashBuckets(pool *Pool, cfg *hashMapConfig, chunk *Chunk) hashBuckets {
+	return newHeadBuckets(pool, cfg, chunk, cfg.fanOut)
+}
+
+// newHeadBuckets returns a table of fanOut buckets, which only differs from
+// the fan-out of the map for the grown head table of a resizable map.
+func newHeadBuckets(pool *Pool, cfg *hashMapConfig, chunk *Chunk, fanOut int) hashBuckets {
+	hh := make(hashBuckets, fanOut)
 
 	for i := range hh {
 		hh[i] = &hashBucket{
 			pool:  pool,
+			cfg:   cfg,
 			chunk: chunk,
 			idx:   i,
 		}
@@ -48,47 +55,146 @@ func newHashBuckets(pool *Pool, chunk *Chunk) hashBuckets {
 }
 
 func (bb hashBuckets) WriteTo(chunk *Chunk) error {
-	buf := bytes.NewBuffer(make([]byte, 0, sizeHashBuckets))
+	_, err := chunk.Write(bb.encode())
+
+	return err
+}
+
+func (bb hashBuckets) encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(bb)*sizeHashBucket))
 
 	for _, bucket := range bb {
 		_ = binary.Write(buf, binary.LittleEndian, bucket.Type)
 		_ = binary.Write(buf, binary.LittleEndian, bucket.Head)
 	}
 
-	_, err := chunk.Write(buf.Bytes())
-
-	return err
+	return buf.Bytes()
 }
 
-func (bb *hashBuckets) ReadFrom(chunk *Chunk) error {
-	b, err := chunk.ReadAll()
+func (bb hashBuckets) ReadFrom(chunk *Chunk) error {
+	buf := getBuffer()
+	b, err := chunk.ReadInto(*buf)
 	if err != nil {
 		return err
 	}
-	if len(b) != sizeHashBuckets {
-		return fmt.Errorf("expected to read %d bytes, read %d", sizeHashBuckets, len(b))
+	defer putBuffer(buf, b)
+	if size := len(bb) * sizeHashBucket; len(b) != size {
+		return fmt.Errorf("expected to read %d bytes, read %d", size, len(b))
 	}
 
-	buf := bytes.NewBuffer(b)
-
-	for _, bucket := range bb {
-		_ = binary.Read(buf, binary.LittleEndian, &bucket.Type)
-		_ = binary.Read(buf, binary.LittleEndian, &bucket.Head)
-	}
+	bb.decode(b)
 
 	return nil
 }
 
+// decode reads the buckets from b, which must hold the whole table. Tables
+// are decoded on every lookup, so this avoids binary.Read and its allocations.
+func (bb hashBuckets) decode(b []byte) {
+	for i, bucket := range bb {
+		entry := b[i*sizeHashBucket:]
+		bucket.Type = bucketType(entry[0])
+		bucket.Head = ChunkPtr(binary.LittleEndian.Uint64(entry[1:]))
+	}
+}
+
 func (bb hashBuckets) bucket(key []byte) *hashBucket {
-	salt := []byte(strconv.FormatInt(bb[0].chunk.pos, 32))
-	h := hashKey(append(salt, key...))
+	return bb.saltedBucket(bb[0].chunk.pos, key)
+}
+
+// altBucket is the second bucket of key with CollisionTwoChoice, salted with
+// the complement of the table position.
+func (bb hashBuckets) altBucket(key []byte) *hashBucket {
+	return bb.saltedBucket(^bb[0].chunk.pos, key)
+}
 
-	return bb[h.Sum32()%HashMapN]
+func (bb hashBuckets) saltedBucket(salt int64, key []byte) *hashBucket {
+	buf := getBuffer()
+	salted := append(strconv.AppendInt(*buf, salt, 32), key...)
+	h := bb[0].cfg.hash(salted)
+	putBuffer(buf, salted)
+	if bb[0].cfg.mix {
+		h = mix32(h)
+	}
+
+	return bb[h%uint32(len(bb))]
 }
 
+// mix32 is the murmur3 finalizer. It spreads all bits of h over the low ones,
+// which FNV-1a alone doesn't: with a small power of two fan-out, keys that
+// only differ in high bits of their bytes would never be told apart.
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
+
+// findBucket returns the list bucket of key. With CollisionTwoChoice and
+// CollisionCuckoo, it is the one holding key, or the shorter one when neither
+// does. With CollisionRobinHood, it is the one holding key, or the one a new
+// key would be added to when probing without moving entries.
 func (bb hashBuckets) findBucket(key []byte) (*hashBucket, error) {
 	bucket := bb.bucket(key)
+	switch bb[0].cfg.collision {
+	case CollisionTwoChoice, CollisionCuckoo:
+		if alt := bb.altBucket(key); alt != bucket {
+			return bb.chooseBucket(key, bucket, alt)
+		}
+	case CollisionRobinHood:
+		return bb.probeBucket(key, bucket)
+	}
+
+	return bb.listBucket(key, bucket)
+}
+
+// chooseBucket returns the list bucket holding key among the ones reached
+// from first and second, or the one with the shortest list.
+func (bb hashBuckets) chooseBucket(key []byte, first, second *hashBucket) (*hashBucket, error) {
+	var (
+		best     *hashBucket
+		bestSize int64
+	)
+	for _, bucket := range []*hashBucket{first, second} {
+		bucket, err := bb.listBucket(key, bucket)
+		if err != nil {
+			return nil, err
+		}
+		if bucket.Head == 0 {
+			if best == nil || bestSize > 0 {
+				best, bestSize = bucket, 0
+			}
+			continue
+		}
+
+		head, err := NewKVNodeFromChunkPtr(bucket.pool, bucket.Head)
+		if err != nil {
+			return nil, err
+		}
+		node, err := findHashMapItem(head, key)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			return bucket, nil
+		}
+		size, err := head.ListSize()
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || size < bestSize {
+			best, bestSize = bucket, size
+		}
+	}
 
+	return best, nil
+}
+
+// listBucket returns bucket when it holds a list, or the list bucket of key in
+// the tables nested under it.
+func (bb hashBuckets) listBucket(key []byte, bucket *hashBucket) (*hashBucket, error) {
 	switch bucket.Type {
 	default:
 		return nil, fmt.Errorf("invalid bucket type %v", bucket.Type)
@@ -97,7 +203,7 @@ func (bb hashBuckets) findBucket(key []byte) (*hashBucket, error) {
 		if err != nil {
 			return nil, err
 		}
-		newBuckets := newHashBuckets(chunk.pool, chunk)
+		newBuckets := newHashBuckets(chunk.pool, bb[0].cfg, chunk)
 		err = newBuckets.ReadFrom(chunk)
 		if err != nil {
 			return nil, err
@@ -109,13 +215,53 @@ func (bb hashBuckets) findBucket(key []byte) (*hashBucket, error) {
 	}
 }
 
-func (bb hashBuckets) Upsert(key []byte, value ChunkPtr) error {
+// Upsert stores value for key, expiring at expiry unless it is 0, returning
+// the value it replaced, 0 when the key is new. Freeing the old value is left
+// to the caller.
+func (bb hashBuckets) Upsert(key []byte, value ChunkPtr, expiry int64) (ChunkPtr, error) {
 	bucket, err := bb.findBucket(key)
+	if err != nil {
+		return 0, err
+	}
+	if !bb[0].cfg.movesEntries() {
+		return bucket.Upsert(key, value, expiry)
+	}
+
+	if bucket.Head != 0 {
+		node, err := bucket.findHashMapItem(key)
+		if err != nil {
+			return 0, err
+		}
+		if node != nil {
+			return bucket.setValue(node, value, expiry)
+		}
+	}
+	keyChunk, err := bb[0].pool.AllocAndWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if bb[0].cfg.collision == CollisionCuckoo {
+		return 0, bb.cuckooInsert(bucket, key, keyChunk.Ptr(), value, expiry)
+	}
+
+	return 0, bb.robinHoodInsert(key, keyChunk.Ptr(), value, expiry)
+}
+
+// insert adds key, which bb must not hold yet, moving entries to make room
+// for it with CollisionCuckoo and CollisionRobinHood.
+func (bb hashBuckets) insert(keyBytes []byte, key, value ChunkPtr, expiry int64) error {
+	if bb[0].cfg.collision == CollisionRobinHood {
+		return bb.robinHoodInsert(keyBytes, key, value, expiry)
+	}
+	bucket, err := bb.findBucket(keyBytes)
 	if err != nil {
 		return err
 	}
+	if bb[0].cfg.collision == CollisionCuckoo {
+		return bb.cuckooInsert(bucket, keyBytes, key, value, expiry)
+	}
 
-	return bucket.Upsert(key, value)
+	return bucket.Append(keyBytes, key, value, expiry)
 }
 
 func (b *hashBucket) Write() error {
@@ -131,47 +277,233 @@ func (b *hashBucket) Write() error {
 
 var errorBucketFull = errors.New("bucket full")
 
-func (b *hashBucket) Upsert(key []byte, value ChunkPtr) error {
+func (b *hashBucket) Upsert(key []byte, value ChunkPtr, expiry int64) (ChunkPtr, error) {
 	if b.Head == 0 {
 		keyChunk, err := b.pool.AllocAndWrite(key)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		return b.Append(key, keyChunk.Ptr(), value)
+		return 0, b.Append(key, keyChunk.Ptr(), value, expiry)
 	}
 
 	node, err := b.findHashMapItem(key)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if node == nil {
 		keyChunk, err := b.pool.AllocAndWrite(key)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		return b.Append(key, keyChunk.Ptr(), value)
+		return 0, b.Append(key, keyChunk.Ptr(), value, expiry)
+	}
+
+	return b.setValue(node, value, expiry)
+}
+
+// setValue replaces the value and expiry of node, returning the old value.
+// A node getting an expiry is moved to a larger chunk when its own is too
+// small, its neighbors or b being updated to point to it.
+func (b *hashBucket) setValue(node *KVNode, value ChunkPtr, expiry int64) (ChunkPtr, error) {
+	old := node.value
+	node.value, node.expiry = value, expiry
+	if int(node.chunk.Cap()) >= nodeSize(expiry) {
+		return old, node.Write()
 	}
 
-	old, err := node.SetValue(value)
+	chunk := node.chunk
+	node.chunk = nil
+	err := node.Write()
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	if node.isHead() {
+		b.Head = node.Ptr()
+		err = b.Write()
+	} else {
+		var prev *KVNode
+		prev, err = node.Prev()
+		if err == nil {
+			prev.next = node.Ptr()
+			err = prev.Write()
+		}
 	}
-	oldChunk, err := b.pool.Get(old)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	next, err := node.Next()
+	if err != nil {
+		return 0, err
+	}
+	if next != nil {
+		next.prev = node.Ptr()
+		err = next.Write()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return old, chunk.Free()
+}
+
+// UpsertBatch stores values for keys, which must all belong to b, returning
+// the values they replaced and the keys that are new. The new nodes are
+// linked after the head in one go when they fit in the list, otherwise they
+// are added one at a time, overflowing into a nested table like with Upsert.
+func (b *hashBucket) UpsertBatch(keys [][]byte, values []ChunkPtr) (old []ChunkPtr, added [][]byte, err error) {
+	var (
+		head     *KVNode
+		size     int64
+		existing = map[string]*KVNode{}
+	)
+	if b.Head != 0 {
+		head, err = NewKVNodeFromChunkPtr(b.pool, b.Head)
+		for node := head; err == nil && node != nil; node, err = node.Next() {
+			var key []byte
+			key, err = node.KeyBytes()
+			if err != nil {
+				break
+			}
+			existing[string(key)] = node
+			size++
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var newValues []ChunkPtr
+	for i, key := range keys {
+		node, ok := existing[string(key)]
+		if !ok {
+			added = append(added, key)
+			newValues = append(newValues, values[i])
+			continue
+		}
+		ptr, err := b.setValue(node, values[i], 0)
+		if err != nil {
+			return old, nil, err
+		}
+		old = append(old, ptr)
+	}
+	if len(added) == 0 {
+		return old, nil, nil
+	}
+	if size+int64(len(added)) > int64(b.cfg.maxList) && b.cfg.nests() {
+		return old, added, b.appendEach(added, newValues)
+	}
+
+	nodes := make([]*KVNode, len(added))
+	for i, key := range added {
+		keyChunk, err := b.pool.AllocAndWrite(key)
+		if err != nil {
+			return old, nil, err
+		}
+		chunk, err := b.pool.Alloc(uint32(sizeKVNode))
+		if err != nil {
+			return old, nil, err
+		}
+		nodes[i] = &KVNode{
+			pool:  b.pool,
+			chunk: chunk,
+
+			key:   keyChunk.Ptr(),
+			value: newValues[i],
+		}
 	}
+	for i, node := range nodes {
+		if i > 0 {
+			node.prev = nodes[i-1].Ptr()
+		}
+		if i < len(nodes)-1 {
+			node.next = nodes[i+1].Ptr()
+		}
+	}
+	first, last := nodes[0], nodes[len(nodes)-1]
+
+	if head == nil {
+		first.prev = ChunkPtr(-len(nodes))
+		for _, node := range nodes {
+			err = node.Write()
+			if err != nil {
+				return old, nil, err
+			}
+		}
+		b.Head = first.Ptr()
+
+		return old, added, b.Write()
+	}
+
+	first.prev, last.next = head.Ptr(), head.next
+	for _, node := range nodes {
+		err = node.Write()
+		if err != nil {
+			return old, nil, err
+		}
+	}
+	next, err := head.Next()
+	if err != nil {
+		return old, nil, err
+	}
+	if next != nil {
+		next.prev = last.Ptr()
+		err = next.Write()
+		if err != nil {
+			return old, nil, err
+		}
+	}
+	head.next = first.Ptr()
+	head.prev = ChunkPtr(-(size + int64(len(nodes))))
+
+	return old, added, head.Write()
+}
 
-	return oldChunk.Free()
+// appendEach adds new keys one at a time, continuing in the nested table once
+// b overflowed into one.
+func (b *hashBucket) appendEach(keys [][]byte, values []ChunkPtr) error {
+	var nested hashBuckets
+	for i, key := range keys {
+		if b.Type == bucketTypeList {
+			keyChunk, err := b.pool.AllocAndWrite(key)
+			if err != nil {
+				return err
+			}
+			err = b.Append(key, keyChunk.Ptr(), values[i], 0)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if nested == nil {
+			chunk, err := b.pool.Get(b.Head)
+			if err != nil {
+				return err
+			}
+			nested = newHashBuckets(b.pool, b.cfg, chunk)
+			err = nested.ReadFrom(chunk)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := nested.Upsert(key, values[i], 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (b *hashBucket) Append(keyBytes []byte, key, value ChunkPtr) error {
+func (b *hashBucket) Append(keyBytes []byte, key, value ChunkPtr, expiry int64) error {
 	if b.Type != bucketTypeList {
 		return fmt.Errorf("cannot append to bucket of type %v", b.Type)
 	}
 
 	if b.Head == 0 {
-		head, err := NewKVNode(b.pool, key, value)
+		head, err := newKVNode(b.pool, key, value, expiry)
 		if err != nil {
 			return err
 		}
@@ -190,17 +522,17 @@ func (b *hashBucket) Append(keyBytes []byte, key, value ChunkPtr) error {
 	if err != nil {
 		return err
 	}
-	if size < HashMapMaxList {
-		_, err = head.Append(key, value)
+	if size < int64(b.cfg.maxList) || !b.cfg.nests() {
+		_, err = head.append(key, value, expiry)
 
 		return err
 	}
 
-	chunk, err := b.pool.Alloc(uint32(sizeHashBuckets))
+	chunk, err := b.pool.Alloc(uint32(b.cfg.tableSize()))
 	if err != nil {
 		return err
 	}
-	newBuckets := newHashBuckets(b.pool, chunk)
+	newBuckets := newHashBuckets(b.pool, b.cfg, chunk)
 	err = newBuckets.WriteTo(chunk)
 	if err != nil {
 		return err
@@ -212,12 +544,7 @@ func (b *hashBucket) Append(keyBytes []byte, key, value ChunkPtr) error {
 		if err != nil {
 			return err
 		}
-		bucket, err := newBuckets.findBucket(nodeKey)
-		if err != nil {
-			return err
-		}
-
-		err = bucket.Append(nodeKey, node.key, node.value)
+		err = newBuckets.insert(nodeKey, node.key, node.value, node.expiry)
 		if err != nil {
 			return err
 		}
@@ -228,12 +555,7 @@ func (b *hashBucket) Append(keyBytes []byte, key, value ChunkPtr) error {
 		}
 	}
 
-	bucket, err := newBuckets.findBucket(keyBytes)
-	if err != nil {
-		return err
-	}
-
-	err = bucket.Append(keyBytes, key, value)
+	err = newBuckets.insert(keyBytes, key, value, expiry)
 	if err != nil {
 		return err
 	}
@@ -263,12 +585,12 @@ func findHashMapItem(n *KVNode, needle []byte) (*KVNode, error) {
 	}
 
 	for n != nil {
-		key, err := n.KeyBytes()
+		ok, err := n.hasKey(needle)
 		if err != nil {
 			return nil, err
 		}
 
-		if bytes.Equal(key, needle) {
+		if ok {
 			return n, nil
 		}
 
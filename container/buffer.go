@@ -0,0 +1,220 @@
+package container
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+const writeBufferPage = 4096
+
+// writeBuffer stages the writes to f in memory, by pages, until flush writes
+// them out in offset order, coalescing adjacent pages. Reads are served from
+// the staged pages, and from f for the rest.
+type writeBuffer struct {
+	f        io.ReadWriteSeeker
+	max      int
+	pos      int64
+	size     int64 // size of the file once flushed
+	fileSize int64 // size of f
+	pages    map[int64][]byte
+}
+
+func newWriteBuffer(f io.ReadWriteSeeker, max int) (*writeBuffer, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeBuffer{
+		f:        f,
+		max:      max,
+		size:     size,
+		fileSize: size,
+		pages:    map[int64][]byte{},
+	}, nil
+}
+
+func (b *writeBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errors.New("invalid whence")
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = offset
+
+	return offset, nil
+}
+
+// readFile reads p from f at off, the bytes past the end of f being zeroes.
+func (b *writeBuffer) readFile(p []byte, off int64) error {
+	for i := range p {
+		p[i] = 0
+	}
+	if off >= b.fileSize {
+		return nil
+	}
+	if n := b.fileSize - off; n < int64(len(p)) {
+		p = p[:n]
+	}
+
+	_, err := b.f.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(b.f, p)
+
+	return err
+}
+
+func (b *writeBuffer) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if n := b.size - b.pos; n < int64(len(p)) {
+		p = p[:n]
+	}
+
+	var n int
+	for n < len(p) {
+		idx, off := b.pos/writeBufferPage, b.pos%writeBufferPage
+		end := len(p)
+		if rest := n + writeBufferPage - int(off); rest < end {
+			end = rest
+		}
+
+		if page, ok := b.pages[idx]; ok {
+			copy(p[n:end], page[off:])
+		} else {
+			err := b.readFile(p[n:end], b.pos)
+			if err != nil {
+				return n, err
+			}
+		}
+		b.pos += int64(end - n)
+		n = end
+	}
+
+	return n, nil
+}
+
+func (b *writeBuffer) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		idx, off := b.pos/writeBufferPage, b.pos%writeBufferPage
+		page, ok := b.pages[idx]
+		if !ok {
+			page = make([]byte, writeBufferPage)
+			err := b.readFile(page, idx*writeBufferPage)
+			if err != nil {
+				return n, err
+			}
+			b.pages[idx] = page
+		}
+
+		copied := copy(page[off:], p[n:])
+		n += copied
+		b.pos += int64(copied)
+		if b.pos > b.size {
+			b.size = b.pos
+		}
+	}
+
+	if len(b.pages)*writeBufferPage <= b.max {
+		return n, nil
+	}
+
+	return n, b.flush()
+}
+
+// flush writes the staged pages to f.
+func (b *writeBuffer) flush() error {
+	idxs := make([]int64, 0, len(b.pages))
+	for idx := range b.pages {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool {
+		return idxs[i] < idxs[j]
+	})
+
+	for i := 0; i < len(idxs); {
+		first := idxs[i]
+		var run []byte
+		for ; i < len(idxs) && idxs[i] == first+int64(len(run)/writeBufferPage); i++ {
+			run = append(run, b.pages[idxs[i]]...)
+		}
+		start := first * writeBufferPage
+		if n := b.size - start; n < int64(len(run)) {
+			run = run[:n]
+		}
+
+		_, err := b.f.Seek(start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = b.f.Write(run)
+		if err != nil {
+			return err
+		}
+	}
+	b.pages = map[int64][]byte{}
+	b.fileSize = b.size
+
+	return nil
+}
+
+// Truncate flushes the staged pages and truncates f, which must implement
+// Truncater.
+func (b *writeBuffer) Truncate(size int64) error {
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+	err = b.f.(Truncater).Truncate(size)
+	if err != nil {
+		return err
+	}
+	b.size, b.fileSize = size, size
+
+	return nil
+}
+
+// Flush writes the writes staged by a pool opened with WithWriteBuffer to the
+// file, in offset order. It is a no-op for other pools.
+func (p *Pool) Flush() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.buffer == nil {
+		return nil
+	}
+
+	return p.buffer.flush()
+}
+
+// truncater returns the file of the pool when it can be truncated.
+func (p *Pool) truncater() (Truncater, bool) {
+	t, ok := p.f.(Truncater)
+
+	return t, ok && canTruncate(p.f)
+}
+
+// canTruncate tells if f, or the file it stands for, can be truncated.
+func canTruncate(f io.ReadWriteSeeker) bool {
+	switch f := f.(type) {
+	case *undoLog:
+		return canTruncate(f.f)
+	case *writeBuffer:
+		return canTruncate(f.f)
+	}
+	_, ok := f.(Truncater)
+
+	return ok
+}
@@ -0,0 +1,29 @@
+package container
+
+import "sync"
+
+// maxPooledBuffer is the capacity past which buffers aren't put back in the
+// pool, so that a few large values don't stay allocated.
+const maxPooledBuffer = 64 << 10
+
+// buffers holds the scratch buffers used to read nodes and keys, so that
+// lookups don't allocate a slice for every chunk they read.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+// putBuffer returns b to the pool, b being the last slice read into it.
+func putBuffer(buf *[]byte, b []byte) {
+	if cap(b) > maxPooledBuffer {
+		return
+	}
+	*buf = b[:0]
+	buffers.Put(buf)
+}
@@ -0,0 +1,155 @@
+package container
+
+import (
+	"container/list"
+	"io"
+)
+
+// track adds the allocated chunk c to the cache, evicting the least recently
+// used chunks past the cache size.
+func (p *Pool) track(c *Chunk) {
+	if c.elem != nil {
+		p.cache.MoveToFront(c.elem)
+		return
+	}
+	c.elem = p.cache.PushFront(c)
+
+	for p.cache.Len() > p.cacheSize && p.cache.Len() > 1 {
+		old := p.cache.Remove(p.cache.Back()).(*Chunk)
+		old.elem = nil
+		delete(p.chunks, old.pos)
+	}
+}
+
+func (p *Pool) untrack(c *Chunk) {
+	if c.elem == nil {
+		return
+	}
+	p.cache.Remove(c.elem)
+	c.elem = nil
+}
+
+func (p *Pool) touch(c *Chunk) {
+	if c.elem != nil {
+		p.cache.MoveToFront(c.elem)
+	}
+}
+
+// resident makes c the in-memory copy of its chunk before it is used. An
+// evicted chunk takes over the state of the copy loaded since, or reads its
+// header back from the file, so that several copies never disagree.
+func (p *Pool) resident(c *Chunk) error {
+	other, ok := p.chunks[c.pos]
+	if ok && other == c {
+		p.touch(c)
+		return nil
+	}
+	if ok {
+		c.cap, c.size, c.free = other.cap, other.size, other.free
+		if other.free {
+			// free chunks are never evicted, c is a stale copy
+			return nil
+		}
+		p.untrack(other)
+		p.chunks[c.pos] = c
+		p.track(c)
+
+		return nil
+	}
+
+	_, err := p.f.Seek(c.pos, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = c.readHeaderFrom(p.f)
+	if err != nil || c.free {
+		// a free chunk would be resident, c was freed and merged away
+		return err
+	}
+	p.chunks[c.pos] = c
+	p.track(c)
+
+	return nil
+}
+
+// payloadCache keeps copies of the most recently read chunk payloads, by
+// chunk position, up to a number of bytes. Entries are updated when the chunk
+// is written and dropped when it is freed or moved.
+type payloadCache struct {
+	max   int
+	size  int
+	lru   *list.List // *cachedPayload, most recently used first
+	elems map[int64]*list.Element
+}
+
+type cachedPayload struct {
+	pos int64
+	b   []byte
+}
+
+func newPayloadCache(max int) *payloadCache {
+	return &payloadCache{
+		max:   max,
+		lru:   list.New(),
+		elems: map[int64]*list.Element{},
+	}
+}
+
+func (c *payloadCache) get(pos int64) ([]byte, bool) {
+	e, ok := c.elems[pos]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*cachedPayload).b, true
+}
+
+// put caches b, which must not be modified afterwards, as the payload of the
+// chunk at pos, evicting the least recently used payloads past the cache size.
+func (c *payloadCache) put(pos int64, b []byte) {
+	c.drop(pos)
+	if len(b) > c.max {
+		return
+	}
+	entry := &cachedPayload{pos: pos, b: b}
+	c.elems[pos] = c.lru.PushFront(entry)
+	c.size += len(b)
+
+	for c.size > c.max {
+		c.drop(c.lru.Back().Value.(*cachedPayload).pos)
+	}
+}
+
+// update writes b at off in the cached payload of the chunk at pos, if any,
+// truncating it after b when truncate is set.
+func (c *payloadCache) update(pos int64, b []byte, off int64, truncate bool) {
+	cached, ok := c.get(pos)
+	if !ok {
+		return
+	}
+	if off > int64(len(cached)) {
+		// the payload now has bytes the cache never saw
+		c.drop(pos)
+		return
+	}
+
+	end := off + int64(len(b))
+	if !truncate && end < int64(len(cached)) {
+		end = int64(len(cached))
+	}
+	updated := make([]byte, end)
+	copy(updated, cached)
+	copy(updated[off:], b)
+	c.put(pos, updated)
+}
+
+func (c *payloadCache) drop(pos int64) {
+	e, ok := c.elems[pos]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.elems, pos)
+	c.size -= len(e.Value.(*cachedPayload).b)
+}
@@ -0,0 +1,197 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// A checkpoint is a free chunk at the end of the pool holding the free list,
+// so that opening the pool doesn't have to scan every chunk header. Its
+// payload is laid out as:
+//
+//	free chunks: nFree * (pos int64, cap uint32)
+//	count  uint32 // chunks in the pool, the checkpoint included
+//	nFree  uint32
+//	crc    uint32 // IEEE CRC of the free chunks, count and nFree
+//	magic  [8]byte
+//
+// The magic is cleared before the pool is first modified after the
+// checkpoint was written, turning it into a plain free chunk.
+var checkpointMagic = [8]byte{'k', 'v', 'p', 'o', 'o', 'l', 'c', 'k'}
+
+const (
+	sizeCheckpointEntry   = 8 + 4
+	sizeCheckpointTrailer = 4 + 4 + 4 + 8
+)
+
+// Checkpoint appends the free list to the pool, to be loaded instead of
+// scanning the chunks on the next NewPool. It is a no-op for an empty pool or
+// when the pool is unchanged since the last checkpoint.
+func (p *Pool) Checkpoint() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.checkpoint != nil || p.count == 0 {
+		return nil
+	}
+
+	free := make([]*Chunk, 0, len(p.freeChunks))
+	for _, chunk := range p.freeChunks {
+		if chunk.wide {
+			// the free list only holds 32 bits caps, the pool is scanned
+			return nil
+		}
+		free = append(free, chunk)
+	}
+	sort.Slice(free, func(i, j int) bool {
+		return free[i].pos < free[j].pos
+	})
+
+	payload := &bytes.Buffer{}
+	for _, chunk := range free {
+		_ = binary.Write(payload, binary.LittleEndian, chunk.pos)
+		_ = binary.Write(payload, binary.LittleEndian, uint32(chunk.cap))
+	}
+	_ = binary.Write(payload, binary.LittleEndian, uint32(p.count+1))
+	_ = binary.Write(payload, binary.LittleEndian, uint32(len(free)))
+	_ = binary.Write(payload, binary.LittleEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	payload.Write(checkpointMagic[:])
+
+	pos, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	chunk := &Chunk{
+		pool: p,
+		pos:  pos,
+
+		cap:  uint64(payload.Len()),
+		size: uint64(payload.Len()),
+		free: true,
+	}
+	b := &bytes.Buffer{}
+	err = chunk.writeHeaderTo(b)
+	if err != nil {
+		return err
+	}
+	b.Write(payload.Bytes())
+	_, err = p.f.Write(b.Bytes())
+	if err != nil {
+		return err
+	}
+
+	p.chunks[chunk.pos] = chunk
+	p.count++
+	p.checkpoint = chunk
+
+	return nil
+}
+
+// invalidateCheckpoint clears the magic of the checkpoint, if any, before the
+// pool is modified.
+func (p *Pool) invalidateCheckpoint() error {
+	chunk := p.checkpoint
+	if chunk == nil {
+		return nil
+	}
+
+	_, err := p.f.Seek(chunk.end()-int64(len(checkpointMagic)), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = p.f.Write(make([]byte, len(checkpointMagic)))
+	if err != nil {
+		return err
+	}
+	p.checkpoint = nil
+	p.addFree(chunk)
+
+	return nil
+}
+
+// loadCheckpoint loads the free list from the checkpoint ending the pool. It
+// returns false when there is no valid checkpoint.
+func (p *Pool) loadCheckpoint() (bool, error) {
+	fileEnd, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	headerSize := int64(p.headerSize())
+	if fileEnd < headerSize+sizeCheckpointTrailer {
+		return false, nil
+	}
+
+	_, err = p.f.Seek(fileEnd-sizeCheckpointTrailer, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	trailer := make([]byte, sizeCheckpointTrailer)
+	_, err = io.ReadFull(p.f, trailer)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(trailer[12:], checkpointMagic[:]) {
+		return false, nil
+	}
+	count := binary.LittleEndian.Uint32(trailer[0:])
+	nFree := int64(binary.LittleEndian.Uint32(trailer[4:]))
+	crc := binary.LittleEndian.Uint32(trailer[8:])
+
+	chunk := &Chunk{
+		pool: p,
+		pos:  fileEnd - headerSize - nFree*sizeCheckpointEntry - sizeCheckpointTrailer,
+	}
+	if chunk.pos < 0 {
+		return false, nil
+	}
+	_, err = p.f.Seek(chunk.pos, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	err = chunk.readHeaderFrom(p.f)
+	if err != nil {
+		return false, err
+	}
+	if !chunk.free || chunk.end() != fileEnd {
+		return false, nil
+	}
+
+	entries := make([]byte, nFree*sizeCheckpointEntry)
+	_, err = io.ReadFull(p.f, entries)
+	if err != nil {
+		return false, err
+	}
+	h := crc32.NewIEEE()
+	_, _ = h.Write(entries)
+	_, _ = h.Write(trailer[:8])
+	if h.Sum32() != crc {
+		return false, nil
+	}
+
+	free := make([]*Chunk, 0, nFree)
+	for b := entries; len(b) > 0; b = b[sizeCheckpointEntry:] {
+		c := &Chunk{
+			pool: p,
+			pos:  int64(binary.LittleEndian.Uint64(b)),
+			cap:  uint64(binary.LittleEndian.Uint32(b[8:])),
+			free: true,
+		}
+		if c.pos < 0 || c.end() > chunk.pos {
+			return false, nil
+		}
+		free = append(free, c)
+	}
+
+	for _, c := range free {
+		p.chunks[c.pos] = c
+		p.addFree(c)
+	}
+	p.chunks[chunk.pos] = chunk
+	p.count = int(count)
+	p.checkpoint = chunk
+
+	return true, nil
+}
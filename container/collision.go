@@ -0,0 +1,303 @@
+package container
+
+import "fmt"
+
+const (
+	// cuckooMoves is how many entries CollisionCuckoo moves at most, each
+	// to the other bucket of its key, to make room for a new key.
+	cuckooMoves = 2
+	// robinHoodProbes is how many buckets past the one a key hashes to
+	// CollisionRobinHood probes at most, bounded by the fan-out of the table.
+	robinHoodProbes = 8
+)
+
+// nests tells if full lists overflow into nested tables.
+func (c hashMapConfig) nests() bool {
+	return c.collision != CollisionChain && c.collision != CollisionRobinHood
+}
+
+// movesEntries tells if storing a new key can move other entries to another
+// bucket.
+func (c hashMapConfig) movesEntries() bool {
+	return c.collision == CollisionCuckoo || c.collision == CollisionRobinHood
+}
+
+// size returns the number of entries in the list of b.
+func (b *hashBucket) size() (int64, error) {
+	if b.Head == 0 {
+		return 0, nil
+	}
+	head, err := NewKVNodeFromChunkPtr(b.pool, b.Head)
+	if err != nil {
+		return 0, err
+	}
+
+	return head.ListSize()
+}
+
+// move moves node, holding key, from the list of b to the one of to.
+func (b *hashBucket) move(node *KVNode, key []byte, to *hashBucket) error {
+	err := to.Append(key, node.key, node.value, node.expiry)
+	if err != nil {
+		return err
+	}
+	newHead, err := node.Delete()
+	if err != nil {
+		return err
+	}
+	b.Head = newHead
+
+	return b.Write()
+}
+
+// otherBucket returns the bucket of key with CollisionCuckoo that isn't b,
+// which is b itself when both buckets of key are the same.
+func (bb hashBuckets) otherBucket(key []byte, b *hashBucket) *hashBucket {
+	if bucket := bb.bucket(key); bucket != b {
+		return bucket
+	}
+
+	return bb.altBucket(key)
+}
+
+// cuckooInsert adds key to bucket, as returned by findBucket, unless its list
+// is full and room can be made in one of the two buckets of key. Only lists
+// are moved from, so when no room is made the key overflows into a nested
+// table like with CollisionTwoChoice.
+func (bb hashBuckets) cuckooInsert(bucket *hashBucket, keyBytes []byte, key, value ChunkPtr, expiry int64) error {
+	size, err := bucket.size()
+	if err != nil {
+		return err
+	}
+	if size < int64(bb[0].cfg.maxList) {
+		return bucket.Append(keyBytes, key, value, expiry)
+	}
+
+	visited := map[*hashBucket]bool{}
+	for _, b := range []*hashBucket{bb.bucket(keyBytes), bb.altBucket(keyBytes)} {
+		if b.Type != bucketTypeList || visited[b] {
+			continue
+		}
+		ok, err := bb.makeRoom(b, cuckooMoves-1, visited)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return b.Append(keyBytes, key, value, expiry)
+		}
+	}
+
+	return bucket.Append(keyBytes, key, value, expiry)
+}
+
+// makeRoom moves an entry of the full list of b to its other bucket, first
+// making room there too for up to depth more entries. visited holds the
+// buckets already tried, which are never moved to.
+func (bb hashBuckets) makeRoom(b *hashBucket, depth int, visited map[*hashBucket]bool) (bool, error) {
+	visited[b] = true
+
+	type candidate struct {
+		node *KVNode
+		key  []byte
+		to   *hashBucket
+	}
+	var candidates []candidate
+	node, err := NewKVNodeFromChunkPtr(b.pool, b.Head)
+	for err == nil && node != nil {
+		var key []byte
+		key, err = node.KeyBytes()
+		if err != nil {
+			break
+		}
+		to := bb.otherBucket(key, b)
+		if to != b && to.Type == bucketTypeList && !visited[to] {
+			var size int64
+			size, err = to.size()
+			if err != nil {
+				break
+			}
+			if size < int64(bb[0].cfg.maxList) {
+				return true, b.move(node, key, to)
+			}
+			candidates = append(candidates, candidate{node: node, key: key, to: to})
+		}
+		node, err = node.Next()
+	}
+	if err != nil || depth == 0 {
+		return false, err
+	}
+
+	for _, c := range candidates {
+		if visited[c.to] {
+			continue
+		}
+		ok, err := bb.makeRoom(c.to, depth-1, visited)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, b.move(c.node, c.key, c.to)
+		}
+	}
+
+	return false, nil
+}
+
+// probeLimit is how far from the bucket its key hashes to an entry can be
+// with CollisionRobinHood.
+func (bb hashBuckets) probeLimit() int {
+	if len(bb)-1 < robinHoodProbes {
+		return len(bb) - 1
+	}
+
+	return robinHoodProbes
+}
+
+// distance returns how far the bucket at idx is from the one key hashes to.
+func (bb hashBuckets) distance(key []byte, idx int) int {
+	return (idx - bb.bucket(key).idx + len(bb)) % len(bb)
+}
+
+// probeBucket returns the bucket holding key among the ones following home,
+// stopping at the first list with room and at the probe limit. Every entry
+// is in a list that only follows full lists, so key can't be further.
+func (bb hashBuckets) probeBucket(key []byte, home *hashBucket) (*hashBucket, error) {
+	limit := bb.probeLimit()
+	for d := 0; ; d++ {
+		b := bb[(home.idx+d)%len(bb)]
+		if b.Type != bucketTypeList {
+			return nil, fmt.Errorf("invalid bucket type %v", b.Type)
+		}
+		if b.Head == 0 {
+			return b, nil
+		}
+		head, err := NewKVNodeFromChunkPtr(b.pool, b.Head)
+		if err != nil {
+			return nil, err
+		}
+		node, err := findHashMapItem(head, key)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			return b, nil
+		}
+		size, err := head.ListSize()
+		if err != nil {
+			return nil, err
+		}
+		if size < int64(bb[0].cfg.maxList) || d == limit {
+			return b, nil
+		}
+	}
+}
+
+// robinHoodInsert adds key to the first list with room following the bucket
+// it hashes to. Going through a full list, the entry closest to its own
+// bucket is moved on instead when it is closer than the key being added.
+func (bb hashBuckets) robinHoodInsert(keyBytes []byte, key, value ChunkPtr, expiry int64) error {
+	limit := bb.probeLimit()
+	idx := bb.bucket(keyBytes).idx
+	for d := 0; ; d++ {
+		b := bb[(idx+d)%len(bb)]
+		size, err := b.size()
+		if err != nil {
+			return err
+		}
+		if size < int64(bb[0].cfg.maxList) || d == limit {
+			return b.Append(keyBytes, key, value, expiry)
+		}
+
+		var (
+			victim    *KVNode
+			victimKey []byte
+			victimD   int
+		)
+		node, err := NewKVNodeFromChunkPtr(b.pool, b.Head)
+		for err == nil && node != nil {
+			var nodeKey []byte
+			nodeKey, err = node.KeyBytes()
+			if err != nil {
+				break
+			}
+			if nodeD := bb.distance(nodeKey, b.idx); victim == nil || nodeD < victimD {
+				victim, victimKey, victimD = node, nodeKey, nodeD
+			}
+			node, err = node.Next()
+		}
+		if err != nil {
+			return err
+		}
+		if victimD >= d {
+			continue
+		}
+
+		newHead, err := victim.Delete()
+		if err != nil {
+			return err
+		}
+		b.Head = newHead
+		err = b.Write()
+		if err != nil {
+			return err
+		}
+		err = b.Append(keyBytes, key, value, expiry)
+		if err != nil {
+			return err
+		}
+		keyBytes, key, value, expiry = victimKey, victim.key, victim.value, victim.expiry
+		idx, d = (b.idx-victimD+len(bb))%len(bb), victimD
+	}
+}
+
+// backShift refills the list of b, which an entry was just deleted from, with
+// an entry that probed past it, doing so again for the list that entry left.
+// Lists that weren't full can't have been probed past.
+func (bb hashBuckets) backShift(b *hashBucket) error {
+	limit := bb.probeLimit()
+	for {
+		size, err := b.size()
+		if err != nil || size != int64(bb[0].cfg.maxList)-1 {
+			return err
+		}
+
+		var from *hashBucket
+		for gap := 1; gap <= limit; gap++ {
+			next := bb[(b.idx+gap)%len(bb)]
+			if next.Head == 0 {
+				return nil
+			}
+			node, err := NewKVNodeFromChunkPtr(next.pool, next.Head)
+			for err == nil && node != nil {
+				var key []byte
+				key, err = node.KeyBytes()
+				if err != nil {
+					break
+				}
+				if bb.distance(key, next.idx) >= gap {
+					err = next.move(node, key, b)
+					from = next
+					break
+				}
+				node, err = node.Next()
+			}
+			if err != nil {
+				return err
+			}
+			if from != nil {
+				break
+			}
+			nextSize, err := next.size()
+			if err != nil {
+				return err
+			}
+			if nextSize < int64(bb[0].cfg.maxList) {
+				return nil
+			}
+		}
+		if from == nil {
+			return nil
+		}
+		b = from
+	}
+}
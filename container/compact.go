@@ -0,0 +1,190 @@
+package container
+
+import (
+	"bytes"
+	"io"
+)
+
+// Truncater is implemented by the files that can be truncated, like *os.File.
+// Compact and Vacuum shrink the file of a pool that implements it.
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// Compact moves the allocated chunks toward the start of the pool, merging
+// the free space into a single chunk at the end. The file is truncated after
+// the last allocated chunk when it implements Truncater.
+//
+// relocate is called after each chunk has moved, so that its owner can
+// rewrite its pointers. If relocate fails, Compact stops and returns the error,
+// the chunk staying at its new position. Chunks obtained before Compact must
+// be fetched again with Get. Compact isn't atomic, an interrupted compaction
+// can leave the pool unreadable.
+func (p *Pool) Compact(relocate func(old, new ChunkPtr) error) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := p.invalidateCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	var chunks []*Chunk
+	_, err = p.walk(func(chunk *Chunk, _ bool) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	fileEnd := chunks[len(chunks)-1].end()
+
+	var dst int64
+	for _, chunk := range chunks {
+		if chunk.free {
+			continue
+		}
+		if chunk.pos == dst {
+			dst = chunk.end()
+			continue
+		}
+
+		old := chunk.Ptr()
+		err = p.move(chunk, dst)
+		if err == nil {
+			err = relocate(old, chunk.Ptr())
+		}
+		if err != nil {
+			_ = p.reload()
+			return err
+		}
+		dst = chunk.end()
+	}
+
+	if dst < fileEnd {
+		err = p.releaseTail(dst, fileEnd)
+		if err != nil {
+			_ = p.reload()
+			return err
+		}
+	}
+
+	return p.reload()
+}
+
+// Vacuum truncates the free chunks ending the pool off its file, returning
+// how many bytes were reclaimed. Unlike Compact, no chunk moves. It is a no-op
+// when the file doesn't implement Truncater.
+func (p *Pool) Vacuum() (int64, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	t, ok := p.truncater()
+	if !ok {
+		return 0, nil
+	}
+	fileEnd, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if p.checkpoint != nil && p.checkpoint.end() == fileEnd {
+		err = p.invalidateCheckpoint()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var tail []*Chunk
+	end := fileEnd
+	for chunk, ok := p.freeEnds[end]; ok; chunk, ok = p.freeEnds[end] {
+		tail = append(tail, chunk)
+		end = chunk.pos
+	}
+	if len(tail) == 0 {
+		return 0, nil
+	}
+
+	err = t.Truncate(end)
+	if err != nil {
+		return 0, err
+	}
+	for _, chunk := range tail {
+		p.removeFree(chunk)
+		delete(p.chunks, chunk.pos)
+		p.count--
+	}
+
+	return fileEnd - end, nil
+}
+
+// move copies the allocated chunk c to dst, before its current position,
+// and turns the space left up to its former end into a free chunk.
+func (p *Pool) move(c *Chunk, dst int64) error {
+	oldEnd := c.end()
+	headerSize := int64(c.headerSize())
+
+	_, err := p.f.Seek(c.pos+headerSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, c.used())
+	_, err = io.ReadFull(p.f, payload)
+	if err != nil {
+		return err
+	}
+
+	p.payloads.drop(c.pos)
+	c.pos = dst
+	buf := &bytes.Buffer{}
+	err = c.writeHeaderTo(buf)
+	if err != nil {
+		return err
+	}
+	buf.Write(payload)
+	_, err = p.f.Seek(dst, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = p.f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	rest, err := p.spanChunk(c.end(), oldEnd)
+	if err != nil {
+		return err
+	}
+
+	return rest.writeHeader()
+}
+
+// releaseTail truncates the file at pos, or marks everything from pos to end
+// as a single free chunk when the file can't be truncated.
+func (p *Pool) releaseTail(pos, end int64) error {
+	if t, ok := p.truncater(); ok {
+		return t.Truncate(pos)
+	}
+
+	rest, err := p.spanChunk(pos, end)
+	if err != nil {
+		return err
+	}
+
+	return rest.writeHeader()
+}
+
+// reload drops the in-memory state of the pool and scans it again.
+func (p *Pool) reload() error {
+	for e := p.cache.Front(); e != nil; e = e.Next() {
+		e.Value.(*Chunk).elem = nil
+	}
+	p.cache.Init()
+	p.chunks = map[int64]*Chunk{}
+	p.freeChunks = map[int64]*Chunk{}
+	p.freeEnds = map[int64]*Chunk{}
+	p.freeSizes = nil
+
+	return p.scan()
+}
@@ -0,0 +1,116 @@
+package container
+
+import "time"
+
+// StoreWithExpiry stores value for key until expiry. Expired entries are
+// skipped by Load, Range and the other lookups, but are only removed by
+// Delete, PurgeExpired or when the key is stored again, and are counted by Len
+// until then. Store clears the expiry of a key.
+func (m *HashMap) StoreWithExpiry(key, value []byte, expiry time.Time) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.update(func() error {
+		valueChunk, err := m.pool.AllocAndWrite(value)
+		if err != nil {
+			return err
+		}
+
+		return m.store(m.headBuckets, key, valueChunk, expiryNanos(expiry))
+	})
+}
+
+// Expiry returns the expiry of key, the zero time if it doesn't expire, and
+// false if the map doesn't have it.
+func (m *HashMap) Expiry(key []byte) (time.Time, bool, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	node, err := m.findNode(key)
+	if err != nil || node == nil {
+		return time.Time{}, false, err
+	}
+	if node.expiry == 0 {
+		return time.Time{}, true, nil
+	}
+
+	return time.Unix(0, node.expiry), true, nil
+}
+
+// PurgeExpired deletes the expired entries, returning how many were deleted.
+func (m *HashMap) PurgeExpired() (int, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	var n int
+	err := m.update(func() error {
+		var err error
+		n, err = m.purgeExpired()
+		return err
+	})
+
+	return n, err
+}
+
+func (m *HashMap) purgeExpired() (int, error) {
+	now := time.Now().UnixNano()
+	var (
+		keys  [][]byte
+		itErr error
+	)
+	err := m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
+		if b.Type != bucketTypeList || b.Head == 0 {
+			return true
+		}
+		node, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		for err == nil && node != nil {
+			if node.expired(now) {
+				var key []byte
+				key, err = node.KeyBytes()
+				if err != nil {
+					break
+				}
+				keys = append(keys, key)
+			}
+			node, err = node.Next()
+		}
+		if err != nil {
+			itErr = err
+			return false
+		}
+
+		return true
+	})
+	if err == nil {
+		err = itErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		err = m.delete(key)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+func expiryNanos(expiry time.Time) int64 {
+	if expiry.IsZero() {
+		return 0
+	}
+	nanos := expiry.UnixNano()
+	if nanos == 0 {
+		// 0 means no expiry, the epoch is long gone anyway
+		return 1
+	}
+
+	return nanos
+}
+
+func (n *KVNode) expired(now int64) bool {
+	return n.expiry != 0 && n.expiry <= now
+}
@@ -1,13 +1,17 @@
 package container
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
-	"hash"
 	"hash/fnv"
 	"io"
 	"sync"
+	"time"
 )
 
+// Default fan-out of bucket tables, and number of entries a list can hold
+// before it overflows into a nested table.
 const (
 	HashMapN       = 128
 	HashMapMaxList = 32
@@ -17,12 +21,191 @@ type HashMap struct {
 	m *sync.RWMutex
 
 	pool             *Pool
+	cfg              *hashMapConfig
 	headBuckets      hashBuckets
 	headBucketsChunk *Chunk
+	count            int64
+	persistCount     bool // the head chunk has room for the count after the buckets
+	indexHead        ChunkPtr
+	orderHead        ChunkPtr // insertion order list, oldest key first
+	orderTail        ChunkPtr
+	bloom            *bloomFilter
+
+	pinM     *sync.Mutex
+	pinned   map[ChunkPtr]int // chunks referenced by snapshots
+	deferred map[ChunkPtr]int // frees of pinned chunks, done once unpinned
+}
+
+// The head chunk holds the head buckets, followed by the entry count and the
+// map header:
+//
+//	buckets  fanOut * (type uint8, head int64)
+//	count    int64
+//	index    int64, only with the ordered magics or flag
+//	bloom    int64, only with the bloom magics or flag
+//	order    2 * int64, head and tail, only with the insertion order flag
+//	table    int64 and fanOut uint32, the grown head table, only with the
+//	         resize flag
+//	flags    uint32, only with the extended magic
+//	fanOut   uint32
+//	maxList  uint32
+//	magic    [4]byte
+//
+// The extended magic is used by maps with features that have no magic of
+// their own, the flags telling which fields the header has. Once a resizable
+// map grew its head table, the buckets of the head chunk are left empty and
+// the table is read from its own chunk.
+//
+// Maps created before the header existed have a fan-out of HashMapN and a
+// list threshold of HashMapMaxList, don't mix hashes, and may not have the
+// count either.
+var (
+	sizeCount     = binarySizePanic(int64(0))
+	sizeIndexHead = binarySizePanic(ChunkPtr(0))
+	sizeMapHeader = binarySizePanic(uint32(0))*2 + len(mapHeaderMagic)
+	sizeMapFlags  = binarySizePanic(uint32(0))
+	sizeHeadTable = sizePtr + binarySizePanic(uint32(0))
+)
+
+// Flags of the extended map header.
+const (
+	mapFlagOrdered = 1 << iota
+	mapFlagBloom
+	mapFlagInsertionOrder
+	mapFlagResize
+	mapFlagChain
+	mapFlagTwoChoice
+	mapFlagCuckoo
+	mapFlagRobinHood
+
+	mapFlagsCollision = mapFlagChain | mapFlagTwoChoice | mapFlagCuckoo | mapFlagRobinHood
+	mapFlagsKnown     = mapFlagOrdered | mapFlagBloom | mapFlagInsertionOrder | mapFlagResize | mapFlagsCollision
+)
+
+var (
+	mapHeaderMagic             = [4]byte{'k', 'v', 'h', 'm'}
+	orderedMapHeaderMagic      = [4]byte{'k', 'v', 'h', 'o'}
+	bloomMapHeaderMagic        = [4]byte{'k', 'v', 'h', 'b'}
+	orderedBloomMapHeaderMagic = [4]byte{'k', 'v', 'h', 'p'}
+	extendedMapHeaderMagic     = [4]byte{'k', 'v', 'h', 'x'}
+)
+
+// headerSize is the size of the map header following the count.
+func (c hashMapConfig) headerSize() int {
+	return c.flagsOffset() - c.tableSize() - sizeCount + c.flagsSize() + sizeMapHeader
+}
+
+// extended tells if the map header needs the extended magic and flags.
+func (c hashMapConfig) extended() bool {
+	return c.insertionOrder || c.resize || c.collision != CollisionNest
 }
 
-func NewHashMap(f io.ReadWriteSeeker) (*HashMap, error) {
-	pool, err := NewPool(f)
+func (c hashMapConfig) flags() uint32 {
+	var flags uint32
+	if c.ordered {
+		flags |= mapFlagOrdered
+	}
+	if c.bloomKeys > 0 {
+		flags |= mapFlagBloom
+	}
+	if c.insertionOrder {
+		flags |= mapFlagInsertionOrder
+	}
+	if c.resize {
+		flags |= mapFlagResize
+	}
+	switch c.collision {
+	case CollisionChain:
+		flags |= mapFlagChain
+	case CollisionTwoChoice:
+		flags |= mapFlagTwoChoice
+	case CollisionCuckoo:
+		flags |= mapFlagCuckoo
+	case CollisionRobinHood:
+		flags |= mapFlagRobinHood
+	}
+
+	return flags
+}
+
+func (c hashMapConfig) flagsSize() int {
+	if c.extended() {
+		return sizeMapFlags
+	}
+
+	return 0
+}
+
+// Offsets of the optional header fields in the head chunk.
+func (c hashMapConfig) indexOffset() int {
+	return c.tableSize() + sizeCount
+}
+
+func (c hashMapConfig) bloomOffset() int {
+	if c.ordered {
+		return c.indexOffset() + sizeIndexHead
+	}
+
+	return c.indexOffset()
+}
+
+func (c hashMapConfig) orderOffset() int {
+	if c.bloomKeys > 0 {
+		return c.bloomOffset() + sizePtr
+	}
+
+	return c.bloomOffset()
+}
+
+func (c hashMapConfig) headTableOffset() int {
+	if c.insertionOrder {
+		return c.orderOffset() + 2*sizePtr
+	}
+
+	return c.orderOffset()
+}
+
+func (c hashMapConfig) flagsOffset() int {
+	if c.resize {
+		return c.headTableOffset() + sizeHeadTable
+	}
+
+	return c.headTableOffset()
+}
+
+func (c hashMapConfig) magic() [4]byte {
+	switch {
+	case c.extended():
+		return extendedMapHeaderMagic
+	case c.ordered && c.bloomKeys > 0:
+		return orderedBloomMapHeaderMagic
+	case c.ordered:
+		return orderedMapHeaderMagic
+	case c.bloomKeys > 0:
+		return bloomMapHeaderMagic
+	}
+
+	return mapHeaderMagic
+}
+
+func NewHashMap(f io.ReadWriteSeeker, opts ...HashMapOption) (*HashMap, error) {
+	cfg := &hashMapConfig{
+		hash:    fnv32a,
+		fanOut:  HashMapN,
+		maxList: HashMapMaxList,
+		mix:     true,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.fanOut < 2 || cfg.maxList < 1 {
+		return nil, fmt.Errorf("invalid fan-out %d or list threshold %d", cfg.fanOut, cfg.maxList)
+	}
+	if cfg.collision > CollisionRobinHood {
+		return nil, fmt.Errorf("invalid collision strategy %d", cfg.collision)
+	}
+
+	pool, err := NewPool(f, cfg.poolOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -31,44 +214,243 @@ func NewHashMap(f io.ReadWriteSeeker) (*HashMap, error) {
 		m: &sync.RWMutex{},
 
 		pool: pool,
+		cfg:  cfg,
+
+		pinM:     &sync.Mutex{},
+		pinned:   map[ChunkPtr]int{},
+		deferred: map[ChunkPtr]int{},
 	}
 
 	if pool.Size() == 0 {
-		m.headBucketsChunk, err = pool.Alloc(uint32(sizeHashBuckets))
+		m.headBucketsChunk, err = pool.Alloc(uint32(cfg.tableSize() + sizeCount + cfg.headerSize()))
 		if err != nil {
 			return nil, err
 		}
-		m.headBuckets = newHashBuckets(m.pool, m.headBucketsChunk)
+		m.headBuckets = newHashBuckets(m.pool, m.cfg, m.headBucketsChunk)
+		m.persistCount = true
 
-		err = m.headBuckets.WriteTo(m.headBucketsChunk)
+		b := make([]byte, sizeCount+cfg.headerSize())
+		if cfg.bloomKeys > 0 {
+			m.bloom, err = newBloomFilter(pool, cfg.bloomKeys)
+			if err != nil {
+				return nil, err
+			}
+			binary.LittleEndian.PutUint64(b[cfg.bloomOffset()-cfg.tableSize():], uint64(m.bloom.chunk.Ptr()))
+		}
+		if cfg.extended() {
+			binary.LittleEndian.PutUint32(b[cfg.flagsOffset()-cfg.tableSize():], cfg.flags())
+		}
+		magic := cfg.magic()
+		n := len(b) - sizeMapHeader
+		binary.LittleEndian.PutUint32(b[n:], uint32(cfg.fanOut))
+		binary.LittleEndian.PutUint32(b[n+4:], uint32(cfg.maxList))
+		copy(b[n+8:], magic[:])
+		_, err = m.headBucketsChunk.Write(append(m.headBuckets.encode(), b...))
+		if err != nil {
+			return nil, err
+		}
 
-		return m, err
+		return m, nil
 	}
 
 	m.headBucketsChunk, err = pool.Get(0)
 	if err != nil {
 		return nil, err
 	}
-	m.headBuckets = newHashBuckets(m.pool, m.headBucketsChunk)
 
-	err = m.headBuckets.ReadFrom(m.headBucketsChunk)
+	err = m.readHead()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// readHead reads the map header, the head buckets and the entry count. The
+// fan-out, list threshold, ordered index, insertion order and bloom filter are
+// taken from the header, overriding the options. Maps created before the count was stored
+// are counted once, and the count is only kept in memory when the head chunk
+// has no room for it.
+func (m *HashMap) readHead() error {
+	b, err := m.headBucketsChunk.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	n := len(b)
+	if n >= sizeCount+sizeMapHeader {
+		magic := b[n-len(mapHeaderMagic):]
+		if bytes.Equal(magic, extendedMapHeaderMagic[:]) && n >= sizeCount+sizeMapFlags+sizeMapHeader {
+			flags := binary.LittleEndian.Uint32(b[n-sizeMapHeader-sizeMapFlags:])
+			collision := flags & mapFlagsCollision
+			if flags&^mapFlagsKnown != 0 || collision&(collision-1) != 0 {
+				return fmt.Errorf("unsupported map flags 0x%x", flags)
+			}
+			m.cfg.ordered = flags&mapFlagOrdered != 0
+			m.cfg.insertionOrder = flags&mapFlagInsertionOrder != 0
+			m.cfg.resize = flags&mapFlagResize != 0
+			m.cfg.collision = CollisionNest
+			switch collision {
+			case mapFlagChain:
+				m.cfg.collision = CollisionChain
+			case mapFlagTwoChoice:
+				m.cfg.collision = CollisionTwoChoice
+			case mapFlagCuckoo:
+				m.cfg.collision = CollisionCuckoo
+			case mapFlagRobinHood:
+				m.cfg.collision = CollisionRobinHood
+			}
+			m.cfg.bloomKeys = 0
+			if flags&mapFlagBloom != 0 {
+				m.cfg.bloomKeys = 1
+			}
+
+			return m.readHeader(b)
+		}
+		for _, cfg := range []hashMapConfig{
+			{},
+			{ordered: true},
+			{bloomKeys: 1},
+			{ordered: true, bloomKeys: 1},
+		} {
+			expected := cfg.magic()
+			if bytes.Equal(magic, expected[:]) {
+				m.cfg.ordered, m.cfg.bloomKeys = cfg.ordered, cfg.bloomKeys
+				m.cfg.insertionOrder, m.cfg.resize, m.cfg.collision = false, false, CollisionNest
+				return m.readHeader(b)
+			}
+		}
+	}
+
+	m.cfg.fanOut, m.cfg.maxList, m.cfg.mix = HashMapN, HashMapMaxList, false
+	m.cfg.ordered, m.cfg.bloomKeys, m.cfg.insertionOrder = false, 0, false
+	m.cfg.resize, m.cfg.collision = false, CollisionNest
+	m.headBuckets = newHashBuckets(m.pool, m.cfg, m.headBucketsChunk)
+	size := m.cfg.tableSize()
+	switch n {
+	default:
+		return fmt.Errorf("expected to read %d bytes, read %d", size+sizeCount, n)
+	case size + sizeCount:
+		m.headBuckets.decode(b)
+		m.count = int64(binary.LittleEndian.Uint64(b[size:]))
+		m.persistCount = true
 
-	return m, err
+		return nil
+	case size:
+		m.headBuckets.decode(b)
+	}
+
+	m.count, err = m.countEntries()
+	if err != nil {
+		return err
+	}
+	if m.headBucketsChunk.Cap() < uint32(size+sizeCount) {
+		return nil
+	}
+	m.persistCount = true
+
+	return m.writeCount()
 }
 
-func hashKey(b []byte) hash.Hash32 {
+func (m *HashMap) readHeader(b []byte) error {
+	n := len(b)
+	m.cfg.fanOut = int(binary.LittleEndian.Uint32(b[n-sizeMapHeader:]))
+	m.cfg.maxList = int(binary.LittleEndian.Uint32(b[n-sizeMapHeader+4:]))
+	if m.cfg.fanOut < 2 || m.cfg.maxList < 1 || n != m.cfg.tableSize()+sizeCount+m.cfg.headerSize() {
+		return fmt.Errorf("invalid map header: fan-out %d, list threshold %d, %d bytes", m.cfg.fanOut, m.cfg.maxList, n)
+	}
+	m.headBuckets = newHashBuckets(m.pool, m.cfg, m.headBucketsChunk)
+	m.headBuckets.decode(b)
+	m.count = int64(binary.LittleEndian.Uint64(b[m.cfg.tableSize():]))
+	m.persistCount = true
+	if m.cfg.ordered {
+		m.indexHead = ChunkPtr(binary.LittleEndian.Uint64(b[m.cfg.indexOffset():]))
+	}
+	if m.cfg.insertionOrder {
+		m.orderHead = ChunkPtr(binary.LittleEndian.Uint64(b[m.cfg.orderOffset():]))
+		m.orderTail = ChunkPtr(binary.LittleEndian.Uint64(b[m.cfg.orderOffset()+sizePtr:]))
+	}
+	if m.cfg.resize {
+		err := m.readHeadTable(b[m.cfg.headTableOffset():])
+		if err != nil {
+			return err
+		}
+	}
+	if m.cfg.bloomKeys == 0 {
+		return nil
+	}
+
+	var err error
+	m.bloom, err = readBloomFilter(m.pool, ChunkPtr(binary.LittleEndian.Uint64(b[m.cfg.bloomOffset():])))
+
+	return err
+}
+
+func (m *HashMap) countEntries() (int64, error) {
+	var (
+		count int64
+		itErr error
+	)
+	err := m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
+		if b.Type != bucketTypeList || b.Head == 0 {
+			return true
+		}
+		head, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		if err != nil {
+			itErr = err
+			return false
+		}
+		size, err := head.ListSize()
+		if err != nil {
+			itErr = err
+			return false
+		}
+		count += size
+
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, itErr
+}
+
+func (m *HashMap) writeCount() error {
+	if !m.persistCount {
+		return nil
+	}
+
+	b := make([]byte, sizeCount)
+	binary.LittleEndian.PutUint64(b, uint64(m.count))
+	_, err := m.headBucketsChunk.WriteAt(b, int64(m.cfg.tableSize()))
+
+	return err
+}
+
+// Len returns the number of entries in the map.
+func (m *HashMap) Len() (int64, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	return m.count, nil
+}
+
+func fnv32a(b []byte) uint32 {
 	h := fnv.New32a()
 
 	_, _ = h.Write(b)
 
-	return h
+	return h.Sum32()
 }
 
 func (m *HashMap) Delete(key []byte) error {
 	m.m.Lock()
 	defer m.m.Unlock()
 
-	return m.delete(key)
+	return m.update(func() error {
+		return m.delete(key)
+	})
 }
 
 func (m *HashMap) delete(key []byte) error {
@@ -92,6 +474,7 @@ func (m *HashMap) delete(key []byte) error {
 		return fmt.Errorf("key %q not found", key)
 	}
 
+	keyPtr, valuePtr := node.key, node.value
 	newHead, err := node.Delete()
 	if err != nil {
 		return err
@@ -99,10 +482,166 @@ func (m *HashMap) delete(key []byte) error {
 
 	bucket.Head = newHead
 	err = bucket.Write()
+	if err != nil {
+		return err
+	}
+	if m.cfg.collision == CollisionRobinHood {
+		err = m.headBuckets.backShift(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	m.count--
+	err = m.writeCount()
+	if err != nil {
+		return err
+	}
+	err = m.freeChunks(keyPtr, valuePtr)
+	if err != nil {
+		return err
+	}
+	err = m.indexDelete(key)
+	if err != nil {
+		return err
+	}
+	err = m.orderDelete(key)
+	if err != nil {
+		return err
+	}
+
+	return m.bloomDelete()
+}
+
+// Clear removes every entry, freeing the nodes, keys, values and nested
+// bucket tables. The head buckets are reset first, so that an interrupted
+// Clear only leaks chunks that Scavenge can reclaim.
+func (m *HashMap) Clear() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.update(m.clear)
+}
+
+func (m *HashMap) clear() error {
+	reachable, err := m.reachable()
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range m.headBuckets {
+		bucket.Type = bucketTypeList
+		bucket.Head = 0
+	}
+	_, err = m.headBuckets[0].chunk.WriteAt(m.headBuckets.encode(), 0)
+	if err != nil {
+		return err
+	}
+	m.count = 0
+	err = m.writeCount()
+	if err != nil {
+		return err
+	}
+	m.indexHead = 0
+	err = m.writeIndexHead()
+	if err != nil {
+		return err
+	}
+	m.orderHead, m.orderTail = 0, 0
+	err = m.writeOrderEnds()
+	if err != nil {
+		return err
+	}
+	if m.bloom != nil {
+		delete(reachable, m.bloom.chunk.Ptr())
+		err = m.rebuildBloomFilter()
+		if err != nil {
+			return err
+		}
+	}
+
+	ptrs := make([]ChunkPtr, 0, len(reachable))
+	for ptr, n := range reachable {
+		for i := 0; i < n; i++ {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+
+	return m.freeChunks(ptrs...)
+}
+
+// freeChunks frees the chunks at ptrs, deferring those pinned by a snapshot
+// until it is released.
+func (m *HashMap) freeChunks(ptrs ...ChunkPtr) error {
+	m.pinM.Lock()
+	defer m.pinM.Unlock()
+
+	for _, ptr := range ptrs {
+		if m.pinned[ptr] > 0 {
+			m.deferred[ptr]++
+			continue
+		}
+		chunk, err := m.pool.Get(ptr)
+		if err != nil {
+			return err
+		}
+		err = chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// update runs fn as an update of the pool, so that it is rolled back as a
+// whole when it fails or is interrupted, for pools opened with WithUndoLog.
+func (m *HashMap) update(fn func() error) error {
+	err := m.pool.Begin()
+	if err != nil {
+		return err
+	}
+
+	m.pinM.Lock()
+	deferred := make(map[ChunkPtr]int, len(m.deferred))
+	for ptr, n := range m.deferred {
+		deferred[ptr] = n
+	}
+	m.pinM.Unlock()
+
+	err = fn()
+	if err == nil {
+		return m.pool.Commit()
+	}
+
+	rbErr := m.pool.Rollback()
+	if rbErr == ErrNoUndoLog {
+		return err
+	}
+	if rbErr == nil {
+		rbErr = m.reload()
+	}
+	if rbErr != nil {
+		return fmt.Errorf("%w, rolling back: %v", err, rbErr)
+	}
+	m.pinM.Lock()
+	m.deferred = deferred
+	m.pinM.Unlock()
 
 	return err
 }
 
+// reload reads the head back from the pool once an update was rolled back.
+func (m *HashMap) reload() error {
+	var err error
+	m.headBucketsChunk, err = m.pool.Get(0)
+	if err != nil {
+		return err
+	}
+	m.bloom = nil
+
+	return m.readHead()
+}
+
 func (m *HashMap) Load(key []byte) ([]byte, bool, error) {
 	m.m.RLock()
 	defer m.m.RUnlock()
@@ -111,58 +650,300 @@ func (m *HashMap) Load(key []byte) ([]byte, bool, error) {
 }
 
 func (m *HashMap) load(key []byte) ([]byte, bool, error) {
-	bucket, err := m.headBuckets.findBucket(key)
+	node, err := m.findNode(key)
+	if err != nil || node == nil {
+		return nil, false, err
+	}
+
+	b, err := node.ValueBytes()
 	if err != nil {
+		return nil, true, err
+	}
+
+	return b, true, nil
+}
+
+// LoadInto is like Load, but reads the value into buf when it is large
+// enough, so that a caller reusing buf doesn't allocate a slice per value.
+func (m *HashMap) LoadInto(key, buf []byte) ([]byte, bool, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	node, err := m.findNode(key)
+	if err != nil || node == nil {
 		return nil, false, err
 	}
+	chunk, err := node.Value()
+	if err != nil {
+		return nil, true, err
+	}
+	b, err := chunk.ReadInto(buf)
+
+	return b, true, err
+}
+
+// findNode returns the node holding key, nil if the map doesn't have it or
+// it expired.
+func (m *HashMap) findNode(key []byte) (*KVNode, error) {
+	if m.bloom != nil && !m.bloom.mayContain(key) {
+		return nil, nil
+	}
+
+	bucket, err := m.headBuckets.findBucket(key)
+	if err != nil {
+		return nil, err
+	}
 
 	var head *KVNode
 	if bucket.Head != 0 {
 		head, err = NewKVNodeFromChunkPtr(m.pool, bucket.Head)
 		if err != nil {
-			return nil, false, err
+			return nil, err
 		}
 	}
 	node, err := findHashMapItem(head, key)
+	if err != nil || node == nil || node.expired(time.Now().UnixNano()) {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (m *HashMap) Store(key, value []byte) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.update(func() error {
+		valueChunk, err := m.pool.AllocAndWrite(value)
+		if err != nil {
+			return err
+		}
+
+		return m.store(m.headBuckets, key, valueChunk, 0)
+	})
+}
+
+// CompareAndSwap stores new for key if its current value is equal to old. It
+// returns false, storing nothing, when the key doesn't exist.
+func (m *HashMap) CompareAndSwap(key, old, new []byte) (bool, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	current, ok, err := m.load(key)
+	if err != nil || !ok || !bytes.Equal(current, old) {
+		return false, err
+	}
+
+	err = m.update(func() error {
+		valueChunk, err := m.pool.AllocAndWrite(new)
+		if err != nil {
+			return err
+		}
+
+		return m.store(m.headBuckets, key, valueChunk, 0)
+	})
 	if err != nil {
-		return nil, false, err
+		return false, err
 	}
-	if node == nil {
-		return nil, false, nil
+
+	return true, nil
+}
+
+// LoadOrStore returns the existing value for key if present. Otherwise it
+// stores value and returns it, loaded being false.
+func (m *HashMap) LoadOrStore(key, value []byte) ([]byte, bool, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	actual, ok, err := m.load(key)
+	if err != nil || ok {
+		return actual, ok, err
 	}
 
-	b, err := node.ValueBytes()
+	err = m.update(func() error {
+		valueChunk, err := m.pool.AllocAndWrite(value)
+		if err != nil {
+			return err
+		}
+
+		return m.store(m.headBuckets, key, valueChunk, 0)
+	})
 	if err != nil {
-		return nil, true, err
+		return nil, false, err
 	}
 
-	return b, true, nil
+	return value, false, nil
 }
 
-func (m *HashMap) Store(key, value []byte) error {
+// KV is a key and its value, as given to StoreBatch.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// StoreBatch stores all of items, the last one winning when a key is given
+// more than once. Values are allocated in one pass and the items are grouped
+// by bucket, so that each list is read and linked to once, and the count
+// written once.
+func (m *HashMap) StoreBatch(items []KV) error {
 	m.m.Lock()
 	defer m.m.Unlock()
 
-	valueChunk, err := m.pool.AllocAndWrite(value)
+	return m.update(func() error {
+		return m.storeBatch(items)
+	})
+}
+
+func (m *HashMap) storeBatch(items []KV) error {
+	last := make(map[string]int, len(items))
+	for i, item := range items {
+		last[string(item.Key)] = i
+	}
+	if m.cfg.movesEntries() {
+		// entries can move to other buckets on every store, so they can't
+		// be grouped by bucket upfront.
+		for i, item := range items {
+			if last[string(item.Key)] != i {
+				continue
+			}
+			valueChunk, err := m.pool.AllocAndWrite(item.Value)
+			if err != nil {
+				return err
+			}
+			err = m.store(m.headBuckets, item.Key, valueChunk, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	type group struct {
+		bucket *hashBucket
+		keys   [][]byte
+		values []ChunkPtr
+	}
+	type bucketID struct {
+		table ChunkPtr
+		idx   int
+	}
+	var (
+		groups []*group
+		byID   = map[bucketID]*group{}
+	)
+	for i, item := range items {
+		if last[string(item.Key)] != i {
+			continue
+		}
+		if m.bloom != nil {
+			err := m.bloom.add(item.Key)
+			if err != nil {
+				return err
+			}
+		}
+		bucket, err := m.headBuckets.findBucket(item.Key)
+		if err != nil {
+			return err
+		}
+		valueChunk, err := m.pool.AllocAndWrite(item.Value)
+		if err != nil {
+			return err
+		}
+
+		id := bucketID{table: bucket.chunk.Ptr(), idx: bucket.idx}
+		g := byID[id]
+		if g == nil {
+			g = &group{bucket: bucket}
+			byID[id] = g
+			groups = append(groups, g)
+		}
+		g.keys = append(g.keys, item.Key)
+		g.values = append(g.values, valueChunk.Ptr())
+	}
+
+	var (
+		old   []ChunkPtr
+		added [][]byte
+	)
+	for _, g := range groups {
+		groupOld, groupAdded, err := g.bucket.UpsertBatch(g.keys, g.values)
+		if err != nil {
+			return err
+		}
+		old = append(old, groupOld...)
+		added = append(added, groupAdded...)
+	}
+	m.count += int64(len(added))
+	err := m.writeCount()
+	if err != nil {
+		return err
+	}
+	err = m.freeChunks(old...)
 	if err != nil {
 		return err
 	}
+	for _, key := range added {
+		err = m.indexInsert(key)
+		if err != nil {
+			return err
+		}
+		err = m.orderAppend(key)
+		if err != nil {
+			return err
+		}
+	}
 
-	return m.store(m.headBuckets, key, valueChunk)
+	return m.growIfLoaded()
 }
 
-func (m *HashMap) store(bb hashBuckets, key []byte, value *Chunk) error {
-	return m.headBuckets.Upsert(key, value.Ptr())
+func (m *HashMap) store(bb hashBuckets, key []byte, value *Chunk, expiry int64) error {
+	if m.bloom != nil {
+		err := m.bloom.add(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	old, err := m.headBuckets.Upsert(key, value.Ptr(), expiry)
+	if err != nil {
+		return err
+	}
+	if old != 0 {
+		return m.freeChunks(old)
+	}
+	m.count++
+	err = m.writeCount()
+	if err != nil {
+		return err
+	}
+	err = m.indexInsert(key)
+	if err != nil {
+		return err
+	}
+	err = m.orderAppend(key)
+	if err != nil {
+		return err
+	}
+
+	return m.growIfLoaded()
 }
 
+// Range calls f on every entry until it returns false, in insertion order for
+// maps created with WithInsertionOrder and in hash order otherwise.
 func (m *HashMap) Range(f func(key, value []byte) bool) error {
 	m.m.RLock()
 	defer m.m.RUnlock()
 
+	if m.cfg.insertionOrder {
+		return m.rangeInsertionOrder(f)
+	}
+
 	return m.rangeKeyValues(f)
 }
 
 func (m *HashMap) rangeKeyValues(f func(key, value []byte) bool) error {
+	now := time.Now().UnixNano()
 	var itErr error
 	err := m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
 		if b.Type != bucketTypeList || b.Head == 0 {
@@ -175,20 +956,22 @@ func (m *HashMap) rangeKeyValues(f func(key, value []byte) bool) error {
 		}
 
 		for node != nil {
-			key, err := node.KeyBytes()
-			if err != nil {
-				itErr = err
-				return false
-			}
-			value, err := node.ValueBytes()
-			if err != nil {
-				itErr = err
-				return false
-			}
+			if !node.expired(now) {
+				key, err := node.KeyBytes()
+				if err != nil {
+					itErr = err
+					return false
+				}
+				value, err := node.ValueBytes()
+				if err != nil {
+					itErr = err
+					return false
+				}
 
-			ok := f(key, value)
-			if !ok {
-				return false
+				ok := f(key, value)
+				if !ok {
+					return false
+				}
 			}
 
 			node, err = node.Next()
@@ -210,39 +993,104 @@ func (m *HashMap) rangeKeyValues(f func(key, value []byte) bool) error {
 	return nil
 }
 
+// Checkpoint saves the free list of the pool, so that the next NewHashMap on
+// the same file doesn't have to scan it.
+func (m *HashMap) Checkpoint() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.pool.Checkpoint()
+}
+
+// Flush writes out the writes buffered by a map opened with a WithWriteBuffer
+// pool option.
+func (m *HashMap) Flush() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.pool.Flush()
+}
+
 type HashMapStats struct {
 	PoolSize int
 	MaxLoad  float64
 	MaxDepth int
+
+	Entries      int64
+	BucketLoad   []int // number of list buckets by number of entries
+	KeyBytes     int64
+	ValueBytes   int64
+	NestedTables int
+	// ChunkOverhead is the size of the chunk headers and unused capacity of
+	// the tables, nodes, keys and values.
+	ChunkOverhead int64
+	// PoolWasted is the unused capacity of all the allocated chunks of the
+	// pool.
+	PoolWasted int64
+	// PoolFree is the capacity of the free chunks of the pool.
+	PoolFree int64
 }
 
 func (m *HashMap) Stats() (HashMapStats, error) {
 	m.m.RLock()
-	m.m.RUnlock()
+	defer m.m.RUnlock()
+	poolStats, err := m.pool.Stats()
+	if err != nil {
+		return HashMapStats{}, err
+	}
 	stats := HashMapStats{
-		PoolSize: m.pool.Size(),
+		PoolSize:      poolStats.Chunks,
+		PoolWasted:    poolStats.WastedBytes,
+		PoolFree:      poolStats.FreeBytes,
+		BucketLoad:    make([]int, m.cfg.maxList+1),
+		ChunkOverhead: chunkOverhead(m.headBucketsChunk),
+	}
+	if table := m.headBuckets[0].chunk; table != m.headBucketsChunk {
+		stats.ChunkOverhead += chunkOverhead(table)
 	}
 
 	var itErr error
-	counts := map[ChunkPtr]float64{}
-	err := m.iterateBuckets(func(depth int, bb hashBuckets, b *hashBucket) bool {
+	loads := map[ChunkPtr]float64{}
+	err = m.iterateBuckets(func(depth int, bb hashBuckets, b *hashBucket) bool {
 		if depth > stats.MaxDepth {
 			stats.MaxDepth = depth
 		}
-		if b.Type != bucketTypeList || b.Head == 0 {
+		if b.Type == bucketTypeBuckets {
+			chunk, err := m.pool.Get(b.Head)
+			if err != nil {
+				itErr = err
+				return false
+			}
+			stats.NestedTables++
+			stats.ChunkOverhead += chunkOverhead(chunk)
 			return true
 		}
-		head, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
-		if err != nil {
-			itErr = err
-			return false
+		if b.Head == 0 {
+			stats.BucketLoad[0]++
+			return true
+		}
+
+		var size int
+		node, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		for err == nil && node != nil {
+			err = m.nodeStats(&stats, node)
+			if err != nil {
+				break
+			}
+			size++
+
+			node, err = node.Next()
 		}
-		size, err := head.ListSize()
 		if err != nil {
 			itErr = err
 			return false
 		}
-		counts[bb[0].chunk.Ptr()] += float64(size)
+		if size >= len(stats.BucketLoad) {
+			stats.BucketLoad = append(stats.BucketLoad, make([]int, size-len(stats.BucketLoad)+1)...)
+		}
+		stats.BucketLoad[size]++
+		stats.Entries += int64(size)
+		loads[bb[0].chunk.Ptr()] += float64(size) / float64(len(bb))
 
 		return true
 	})
@@ -250,11 +1098,10 @@ func (m *HashMap) Stats() (HashMapStats, error) {
 		return stats, err
 	}
 	if itErr != nil {
-		return stats, err
+		return stats, itErr
 	}
 
-	for _, c := range counts {
-		load := c / float64(HashMapN)
+	for _, load := range loads {
 		if load > stats.MaxLoad {
 			stats.MaxLoad = load
 		}
@@ -263,6 +1110,27 @@ func (m *HashMap) Stats() (HashMapStats, error) {
 	return stats, nil
 }
 
+func (m *HashMap) nodeStats(stats *HashMapStats, node *KVNode) error {
+	key, err := node.Key()
+	if err != nil {
+		return err
+	}
+	value, err := node.Value()
+	if err != nil {
+		return err
+	}
+
+	stats.KeyBytes += int64(key.Size64())
+	stats.ValueBytes += int64(value.Size64())
+	stats.ChunkOverhead += chunkOverhead(node.chunk) + chunkOverhead(key) + chunkOverhead(value)
+
+	return nil
+}
+
+func chunkOverhead(c *Chunk) int64 {
+	return int64(c.headerSize()) + int64(c.Cap64()) - int64(c.Size64())
+}
+
 func (m *HashMap) iterateBuckets(f func(depth int, bb hashBuckets, b *hashBucket) bool) error {
 	_, err := m.iterateBuckets2(m.headBuckets, 0, f)
 
@@ -283,7 +1151,7 @@ func (m *HashMap) iterateBuckets2(head hashBuckets, depth int, f func(depth int,
 		if err != nil {
 			return false, err
 		}
-		bb := newHashBuckets(m.pool, chunk)
+		bb := newHashBuckets(m.pool, m.cfg, chunk)
 
 		err = bb.ReadFrom(chunk)
 		if err != nil {
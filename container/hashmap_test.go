@@ -2,9 +2,16 @@ package container_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"math/rand"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/yazgazan/kvstore/container"
 )
@@ -307,6 +314,1695 @@ func TestHashMap(t *testing.T) {
 	}
 }
 
+func TestHashMapDeleteFrees(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+
+	const N = 100
+	storeAll := func(prefix string) bool {
+		for i := 0; i < N; i++ {
+			key := []byte(fmt.Sprintf("%s-key-%03d", prefix, i))
+			err := m.Store(key, []byte(fmt.Sprintf("%s-value-%03d", prefix, i)))
+			if err != nil {
+				t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+				return false
+			}
+		}
+
+		return true
+	}
+	if !storeAll("a") {
+		return
+	}
+	for i := 0; i < N; i++ {
+		key := []byte(fmt.Sprintf("a-key-%03d", i))
+		err = m.Delete(key)
+		if err != nil {
+			t.Errorf("m.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	size := len(buf.(*readWriteSeeker).b)
+	if !storeAll("b") {
+		return
+	}
+	if grown := len(buf.(*readWriteSeeker).b); grown != size {
+		t.Errorf("map grew from %d to %d bytes storing as many entries as were deleted", size, grown)
+	}
+
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() = %d, expected no leaked chunks", freed)
+	}
+
+	// leak a few chunks, like Delete used to
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		_, err = pool.AllocAndWrite([]byte("leaked"))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+	}
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	freed, err = m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 3 {
+		t.Errorf("m.Scavenge() = %d, expected 3", freed)
+	}
+	for i := 0; i < N; i++ {
+		key := []byte(fmt.Sprintf("b-key-%03d", i))
+		_, ok, err := m.Load(key)
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		if !ok {
+			t.Errorf("m.Load(%q): not found after scavenging", key)
+		}
+	}
+}
+
+func TestHashMapVerify(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf, container.WithOrderedIndex(), container.WithInsertionOrder())
+	if err != nil {
+		t.Errorf("NewHashMap(nil, ...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		err = m.Store(key, []byte(fmt.Sprintf("value-%03d", i)))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = m.Link([]byte("linked"), []byte("key-000"))
+	if err != nil {
+		t.Errorf("m.Link(...): unexpected error: %v", err)
+		return
+	}
+	problems, err := m.Verify()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("m.Verify() = %v, %v, expected no problems", problems, err)
+		return
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		_, err = pool.AllocAndWrite([]byte("leaked"))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+	}
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	problems, err = m.Verify()
+	if err != nil || len(problems) != 3 {
+		t.Errorf("m.Verify() = %v, %v, expected 3 leaked chunks", problems, err)
+		return
+	}
+
+	freed, err := m.Repair()
+	if err != nil || freed != 3 {
+		t.Errorf("m.Repair() = %d, %v, expected 3", freed, err)
+		return
+	}
+	problems, err = m.Verify()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("m.Verify() = %v, %v, expected no problems after Repair", problems, err)
+	}
+	n, err := m.Len()
+	if err != nil || n != 51 {
+		t.Errorf("m.Len() = %d, %v, expected 51", n, err)
+	}
+}
+
+func TestHashMapLen(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+
+	for _, op := range []struct {
+		key      string
+		delete   bool
+		expected int64
+	}{
+		{key: "foo", expected: 1},
+		{key: "bar", expected: 2},
+		{key: "foo", expected: 2},
+		{key: "foo", delete: true, expected: 1},
+		{key: "baz", expected: 2},
+	} {
+		if op.delete {
+			err = m.Delete([]byte(op.key))
+		} else {
+			err = m.Store([]byte(op.key), []byte("value"))
+		}
+		if err != nil {
+			t.Errorf("updating %q: unexpected error: %v", op.key, err)
+			return
+		}
+		n, err := m.Len()
+		if err != nil {
+			t.Errorf("m.Len(): unexpected error: %v", err)
+			return
+		}
+		if n != op.expected {
+			t.Errorf("m.Len() = %d after updating %q, expected %d", n, op.key, op.expected)
+		}
+	}
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	n, err := m.Len()
+	if err != nil {
+		t.Errorf("m.Len(): unexpected error: %v", err)
+		return
+	}
+	if n != 2 {
+		t.Errorf("m.Len() = %d after reopening, expected 2", n)
+	}
+
+	// maps created before the count was stored only have the head buckets
+	legacy := newReadWriteSeeker(nil)
+	pool, err := container.NewPool(legacy)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	_, err = pool.AllocAndWrite(make([]byte, container.HashMapN*(1+8)))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		m, err = container.NewHashMap(legacy)
+		if err != nil {
+			t.Errorf("NewHashMap(legacy): unexpected error: %v", err)
+			return
+		}
+		err = m.Store([]byte(fmt.Sprint(i)), []byte("value"))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+		n, err = m.Len()
+		if err != nil {
+			t.Errorf("m.Len(): unexpected error: %v", err)
+			return
+		}
+		if n != int64(i+1) {
+			t.Errorf("m.Len() = %d on legacy map, expected %d", n, i+1)
+		}
+	}
+}
+
+func TestHashMapClear(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+
+	// enough entries for lists to overflow into nested bucket tables
+	const N = 5000
+	for i := 0; i < N; i++ {
+		err = m.Store([]byte(strconv.Itoa(i)), []byte("value"))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+	}
+	stats, err := m.Stats()
+	if err != nil {
+		t.Errorf("m.Stats(): unexpected error: %v", err)
+		return
+	}
+	if stats.MaxDepth < 2 {
+		t.Errorf("m.Stats().MaxDepth = %d, expected nested bucket tables", stats.MaxDepth)
+	}
+
+	err = m.Clear()
+	if err != nil {
+		t.Errorf("m.Clear(): unexpected error: %v", err)
+		return
+	}
+	n, err := m.Len()
+	if err != nil {
+		t.Errorf("m.Len(): unexpected error: %v", err)
+		return
+	}
+	if n != 0 {
+		t.Errorf("m.Len() = %d after m.Clear(), expected 0", n)
+	}
+	err = m.Range(func(key, _ []byte) bool {
+		t.Errorf("m.Range(...): unexpected key %q after m.Clear()", key)
+		return false
+	})
+	if err != nil {
+		t.Errorf("m.Range(...): unexpected error: %v", err)
+		return
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(allocated) != 1 {
+		t.Errorf("len(pool.Allocated()) = %d after m.Clear(), expected only the head buckets", len(allocated))
+	}
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	err = m.Store([]byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Errorf("m.Store(...): unexpected error: %v", err)
+		return
+	}
+	got, ok, err := m.Load([]byte("foo"))
+	if err != nil || !ok || string(got) != "bar" {
+		t.Errorf("m.Load(\"foo\") = %q, %v, %v, expected \"bar\", true, <nil>", got, ok, err)
+	}
+}
+
+func TestHashMapShrink(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+
+	const (
+		N    = 5000
+		Kept = 10
+	)
+	for i := 0; i < N; i++ {
+		err = m.Store([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+	}
+	for i := Kept; i < N; i++ {
+		err = m.Delete([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("m.Delete(...): unexpected error: %v", err)
+			return
+		}
+	}
+
+	err = m.Shrink()
+	if err != nil {
+		t.Errorf("m.Shrink(): unexpected error: %v", err)
+		return
+	}
+	stats, err := m.Stats()
+	if err != nil {
+		t.Errorf("m.Stats(): unexpected error: %v", err)
+		return
+	}
+	if stats.MaxDepth != 1 {
+		t.Errorf("m.Stats().MaxDepth = %d after m.Shrink(), expected 1", stats.MaxDepth)
+	}
+	for i := 0; i < Kept; i++ {
+		key := []byte(strconv.Itoa(i))
+		got, ok, err := m.Load(key)
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		if !ok || !bytes.Equal(got, key) {
+			t.Errorf("m.Load(%q) = %q, %v after m.Shrink(), expected %q, true", key, got, ok, key)
+		}
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	// the head buckets, and a node, key and value per entry
+	if expected := 1 + 3*Kept; len(allocated) != expected {
+		t.Errorf("len(pool.Allocated()) = %d after m.Shrink(), expected %d", len(allocated), expected)
+	}
+}
+
+func TestHashMapWithHash(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	var calls int
+	hash := func(b []byte) uint32 {
+		calls++
+		return crc32.ChecksumIEEE(b)
+	}
+	m, err := container.NewHashMap(buf, container.WithHash(hash))
+	if err != nil {
+		t.Errorf("NewHashMap(nil, WithHash(...)): unexpected error: %v", err)
+		return
+	}
+
+	const N = 1000
+	for i := 0; i < N; i++ {
+		err = m.Store([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+	}
+	if calls < N {
+		t.Errorf("hash called %d times storing %d keys", calls, N)
+	}
+
+	m, err = container.NewHashMap(buf, container.WithHash(hash))
+	if err != nil {
+		t.Errorf("NewHashMap(..., WithHash(...)): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < N; i++ {
+		key := []byte(strconv.Itoa(i))
+		got, ok, err := m.Load(key)
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		if !ok || !bytes.Equal(got, key) {
+			t.Errorf("m.Load(%q) = %q, %v, expected %q, true", key, got, ok, key)
+		}
+	}
+}
+
+func TestHashMapFanOut(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	const (
+		fanOut  = 8
+		maxList = 4
+		N       = 500
+	)
+	m, err := container.NewHashMap(buf, container.WithFanOut(fanOut), container.WithMaxList(maxList))
+	if err != nil {
+		t.Errorf("NewHashMap(nil, WithFanOut(%d), WithMaxList(%d)): unexpected error: %v", fanOut, maxList, err)
+		return
+	}
+	for i := 0; i < N; i++ {
+		err = m.Store([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	head, err := pool.Get(0)
+	if err != nil {
+		t.Errorf("pool.Get(0): unexpected error: %v", err)
+		return
+	}
+	// buckets, entry count and map header
+	if expected := uint32(fanOut*(1+8) + 8 + 12); head.Cap() != expected {
+		t.Errorf("head chunk cap = %d, expected %d", head.Cap(), expected)
+	}
+
+	// the persisted layout wins over the options
+	m, err = container.NewHashMap(buf, container.WithFanOut(64))
+	if err != nil {
+		t.Errorf("NewHashMap(..., WithFanOut(64)): unexpected error: %v", err)
+		return
+	}
+	stats, err := m.Stats()
+	if err != nil {
+		t.Errorf("m.Stats(): unexpected error: %v", err)
+		return
+	}
+	// 500 entries in lists of at most 4 need tables at least 3 levels deep
+	if stats.MaxDepth < 3 {
+		t.Errorf("m.Stats().MaxDepth = %d, expected at least 3", stats.MaxDepth)
+	}
+	for i := 0; i < N; i++ {
+		key := []byte(strconv.Itoa(i))
+		got, ok, err := m.Load(key)
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		if !ok || !bytes.Equal(got, key) {
+			t.Errorf("m.Load(%q) = %q, %v, expected %q, true", key, got, ok, key)
+		}
+	}
+
+	_, err = container.NewHashMap(newReadWriteSeeker(nil), container.WithFanOut(1))
+	if err == nil {
+		t.Errorf("NewHashMap(nil, WithFanOut(1)): expected an error")
+	}
+}
+
+func TestHashMapCompareAndSwap(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	err = m.Store([]byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Errorf("m.Store(...): unexpected error: %v", err)
+		return
+	}
+
+	for _, tc := range []struct {
+		key, old, new string
+		swapped       bool
+		expected      string
+	}{
+		{key: "foo", old: "baz", new: "qux", expected: "bar"},
+		{key: "foo", old: "bar", new: "baz", swapped: true, expected: "baz"},
+		{key: "foo", old: "bar", new: "qux", expected: "baz"},
+		{key: "missing", old: "", new: "qux"},
+	} {
+		swapped, err := m.CompareAndSwap([]byte(tc.key), []byte(tc.old), []byte(tc.new))
+		if err != nil {
+			t.Errorf("m.CompareAndSwap(%q, %q, %q): unexpected error: %v", tc.key, tc.old, tc.new, err)
+			return
+		}
+		if swapped != tc.swapped {
+			t.Errorf("m.CompareAndSwap(%q, %q, %q) = %v, expected %v", tc.key, tc.old, tc.new, swapped, tc.swapped)
+		}
+		got, ok, err := m.Load([]byte(tc.key))
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", tc.key, err)
+			return
+		}
+		if ok != (tc.expected != "") || string(got) != tc.expected {
+			t.Errorf("m.Load(%q) = %q, %v, expected %q", tc.key, got, ok, tc.expected)
+		}
+	}
+	n, err := m.Len()
+	if err != nil {
+		t.Errorf("m.Len(): unexpected error: %v", err)
+		return
+	}
+	if n != 1 {
+		t.Errorf("m.Len() = %d, expected 1", n)
+	}
+}
+
+func TestHashMapLoadOrStore(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+
+	for _, tc := range []struct {
+		key, value string
+		loaded     bool
+		expected   string
+	}{
+		{key: "foo", value: "bar", expected: "bar"},
+		{key: "foo", value: "baz", loaded: true, expected: "bar"},
+		{key: "qux", value: "baz", expected: "baz"},
+	} {
+		actual, loaded, err := m.LoadOrStore([]byte(tc.key), []byte(tc.value))
+		if err != nil {
+			t.Errorf("m.LoadOrStore(%q, %q): unexpected error: %v", tc.key, tc.value, err)
+			return
+		}
+		if loaded != tc.loaded || string(actual) != tc.expected {
+			t.Errorf("m.LoadOrStore(%q, %q) = %q, %v, expected %q, %v", tc.key, tc.value, actual, loaded, tc.expected, tc.loaded)
+		}
+	}
+
+	before, err := buf.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Errorf("buf.Seek(0, io.SeekEnd): unexpected error: %v", err)
+		return
+	}
+	_, _, err = m.LoadOrStore([]byte("foo"), []byte("a much longer value that would need a new chunk"))
+	if err != nil {
+		t.Errorf("m.LoadOrStore(...): unexpected error: %v", err)
+		return
+	}
+	after, err := buf.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Errorf("buf.Seek(0, io.SeekEnd): unexpected error: %v", err)
+		return
+	}
+	if after != before {
+		t.Errorf("m.LoadOrStore(...) on an existing key grew the file from %d to %d bytes", before, after)
+	}
+
+	n, err := m.Len()
+	if err != nil {
+		t.Errorf("m.Len(): unexpected error: %v", err)
+		return
+	}
+	if n != 2 {
+		t.Errorf("m.Len() = %d, expected 2", n)
+	}
+}
+
+func TestHashMapRangePrefix(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf, container.WithOrderedIndex(), container.WithFanOut(4), container.WithMaxList(2))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	for _, i := range rand.Perm(50) {
+		key := fmt.Sprintf("key-%02d", i)
+		err = m.Store([]byte(key), []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+	}
+	for _, key := range []string{"key-00", "key-12", "key-49"} {
+		err = m.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("m.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = m.Store([]byte("key-13"), []byte("updated"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", "key-13", err)
+		return
+	}
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() = %d, expected 0", freed)
+	}
+
+	for _, tc := range []struct {
+		prefix   string
+		expected []string
+	}{
+		{prefix: "key-1", expected: []string{"key-10", "key-11", "key-13", "key-14", "key-15", "key-16", "key-17", "key-18", "key-19"}},
+		{prefix: "key-4", expected: []string{"key-40", "key-41", "key-42", "key-43", "key-44", "key-45", "key-46", "key-47", "key-48"}},
+		{prefix: "key-5"},
+		{prefix: "abc"},
+	} {
+		var keys []string
+		err = m.RangePrefix([]byte(tc.prefix), func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			if string(key) == "key-13" && string(value) != "updated" {
+				t.Errorf("m.RangePrefix(%q, ...): value for %q = %q, expected %q", tc.prefix, key, value, "updated")
+			}
+			return true
+		})
+		if err != nil {
+			t.Errorf("m.RangePrefix(%q, ...): unexpected error: %v", tc.prefix, err)
+			return
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(tc.expected) {
+			t.Errorf("m.RangePrefix(%q, ...) = %v, expected %v", tc.prefix, keys, tc.expected)
+		}
+	}
+
+	var n int
+	prev := ""
+	err = m.RangePrefix(nil, func(key, _ []byte) bool {
+		if string(key) <= prev {
+			t.Errorf("m.RangePrefix(nil, ...): %q after %q", key, prev)
+		}
+		prev = string(key)
+		n++
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.RangePrefix(nil, ...): unexpected error: %v", err)
+		return
+	}
+	if n != 47 {
+		t.Errorf("m.RangePrefix(nil, ...) ranged over %d keys, expected 47", n)
+	}
+
+	err = m.Clear()
+	if err != nil {
+		t.Errorf("m.Clear(): unexpected error: %v", err)
+		return
+	}
+	err = m.RangePrefix(nil, func(key, _ []byte) bool {
+		t.Errorf("m.RangePrefix(nil, ...) after m.Clear(): unexpected key %q", key)
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.RangePrefix(nil, ...): unexpected error: %v", err)
+		return
+	}
+
+	m, err = container.NewHashMap(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	err = m.RangePrefix(nil, func(_, _ []byte) bool { return true })
+	if !errors.Is(err, container.ErrNoOrderedIndex) {
+		t.Errorf("m.RangePrefix(...) without an index: expected ErrNoOrderedIndex, got %v", err)
+	}
+}
+
+func TestHashMapRangeKeys(t *testing.T) {
+	m, err := container.NewHashMap(newReadWriteSeeker(nil), container.WithOrderedIndex(), container.WithFanOut(4), container.WithMaxList(2))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	for _, key := range []string{"b", "a2", "a1", "c", "a3", "ab", "a", "expired"} {
+		err = m.Store([]byte(key), []byte("value of "+key))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = m.StoreWithExpiry([]byte("a4"), []byte("gone"), time.Now().Add(-time.Second))
+	if err != nil {
+		t.Errorf("m.StoreWithExpiry(...): unexpected error: %v", err)
+		return
+	}
+	err = m.Delete([]byte("a3"))
+	if err != nil {
+		t.Errorf("m.Delete(...): unexpected error: %v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		prefix, after string
+		limit         int
+		expected      string
+	}{
+		{"", "", 0, "[a a1 a2 ab b c expired]"},
+		{"a", "", 0, "[a a1 a2 ab]"},
+		{"a", "a", 0, "[a1 a2 ab]"},
+		{"a", "a1", 2, "[a2 ab]"},
+		{"a", "a15", 0, "[a2 ab]"},
+		{"a", "0", 0, "[a a1 a2 ab]"},
+		{"a", "ab", 0, "[]"},
+		{"a", "b", 0, "[]"},
+		{"", "b", 0, "[c expired]"},
+		{"", "", 3, "[a a1 a2]"},
+		{"d", "", 0, "[]"},
+		{"0", "", 0, "[]"},
+	} {
+		var after []byte
+		if test.after != "" {
+			after = []byte(test.after)
+		}
+		got := []string{}
+		err = m.RangeKeys([]byte(test.prefix), after, func(key []byte) bool {
+			got = append(got, string(key))
+			return test.limit == 0 || len(got) < test.limit
+		})
+		if err != nil {
+			t.Errorf("m.RangeKeys(%q, %q, ...): unexpected error: %v", test.prefix, test.after, err)
+			return
+		}
+		if fmt.Sprint(got) != test.expected {
+			t.Errorf("m.RangeKeys(%q, %q, ...) with a limit of %d = %v, expected %s", test.prefix, test.after, test.limit, got, test.expected)
+		}
+	}
+
+	m, err = container.NewHashMap(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	err = m.RangeKeys(nil, nil, func(_ []byte) bool { return true })
+	if !errors.Is(err, container.ErrNoOrderedIndex) {
+		t.Errorf("m.RangeKeys(...) without an index: expected ErrNoOrderedIndex, got %v", err)
+	}
+}
+
+func TestHashMapInsertionOrder(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(
+		buf,
+		container.WithInsertionOrder(),
+		container.WithOrderedIndex(),
+		container.WithBloomFilter(100),
+		container.WithFanOut(4),
+		container.WithMaxList(2),
+	)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	var expected []string
+	for _, i := range rand.Perm(50) {
+		key := fmt.Sprintf("key-%02d", i)
+		err = m.Store([]byte(key), []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+		expected = append(expected, key)
+	}
+	// deleting the first, last and a middle key, overwriting one in place
+	for _, key := range []string{expected[0], expected[25], expected[49]} {
+		err = m.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("m.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = m.Store([]byte(expected[10]), []byte("updated"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", expected[10], err)
+		return
+	}
+	expected = append(append(append([]string{}, expected[1:25]...), expected[26:49]...), expected[0])
+	err = m.Store([]byte(expected[len(expected)-1]), []byte("stored again"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", expected[len(expected)-1], err)
+		return
+	}
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	var got []string
+	err = m.Range(func(key, value []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("m.Range(...) = %v, expected %v", got, expected)
+	}
+	var prefixed int
+	err = m.RangePrefix([]byte("key-"), func(_, _ []byte) bool {
+		prefixed++
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.RangePrefix(...): unexpected error: %v", err)
+		return
+	}
+	if prefixed != len(expected) {
+		t.Errorf("m.RangePrefix(...) ranged over %d keys, expected %d", prefixed, len(expected))
+	}
+	err = m.RebuildBloomFilter()
+	if err != nil {
+		t.Errorf("m.RebuildBloomFilter(): unexpected error: %v", err)
+		return
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() = %d, expected 0", freed)
+	}
+
+	err = m.Clear()
+	if err != nil {
+		t.Errorf("m.Clear(): unexpected error: %v", err)
+		return
+	}
+	err = m.Store([]byte("after-clear"), []byte("value"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", "after-clear", err)
+		return
+	}
+	got = nil
+	err = m.Range(func(key, value []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != "[after-clear]" {
+		t.Errorf("m.Range(...) after m.Clear() = %v, expected [after-clear]", got)
+	}
+	freed, err = m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() after m.Clear() = %d, expected 0", freed)
+	}
+}
+
+func TestHashMapExpiry(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf, container.WithFanOut(4), container.WithMaxList(2))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	later := time.Now().Add(time.Hour)
+	earlier := time.Now().Add(-time.Hour)
+
+	expected := map[string]string{}
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("key-%02d", i), strconv.Itoa(i)
+		if i%2 == 0 {
+			err = m.StoreWithExpiry([]byte(key), []byte(value), later)
+		} else {
+			err = m.Store([]byte(key), []byte(value))
+		}
+		if err != nil {
+			t.Errorf("storing %q: unexpected error: %v", key, err)
+			return
+		}
+		expected[key] = value
+	}
+	// the nodes of the odd keys are too small for an expiry and get moved
+	for i := 1; i < 20; i += 4 {
+		key := fmt.Sprintf("key-%02d", i)
+		err = m.StoreWithExpiry([]byte(key), []byte("expired"), earlier)
+		if err != nil {
+			t.Errorf("m.StoreWithExpiry(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+		delete(expected, key)
+	}
+	err = m.Store([]byte("key-01"), []byte("stored again"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", "key-01", err)
+		return
+	}
+	expected["key-01"] = "stored again"
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		value, ok, err := m.Load([]byte(key))
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		if ok != (expected[key] != "") || string(value) != expected[key] {
+			t.Errorf("m.Load(%q) = %q, %v, expected %q", key, value, ok, expected[key])
+		}
+
+		expiry, ok, err := m.Expiry([]byte(key))
+		if err != nil {
+			t.Errorf("m.Expiry(%q): unexpected error: %v", key, err)
+			return
+		}
+		switch {
+		case expected[key] == "":
+			if ok {
+				t.Errorf("m.Expiry(%q) = %v, true, expected the key to have expired", key, expiry)
+			}
+		case i%2 == 0:
+			if !ok || !expiry.Equal(later) {
+				t.Errorf("m.Expiry(%q) = %v, %v, expected %v", key, expiry, ok, later)
+			}
+		default:
+			if !ok || !expiry.IsZero() {
+				t.Errorf("m.Expiry(%q) = %v, %v, expected no expiry", key, expiry, ok)
+			}
+		}
+	}
+	got := map[string]string{}
+	err = m.Range(func(key, value []byte) bool {
+		got[string(key)] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("m.Range(...) = %v, expected %v", got, expected)
+	}
+
+	n, err := m.Len()
+	if err != nil || n != 20 {
+		t.Errorf("m.Len() = %d, %v, expected the expired entries to be counted until purged", n, err)
+	}
+	purged, err := m.PurgeExpired()
+	if err != nil {
+		t.Errorf("m.PurgeExpired(): unexpected error: %v", err)
+		return
+	}
+	if purged != 4 {
+		t.Errorf("m.PurgeExpired() = %d, expected 4", purged)
+	}
+	n, err = m.Len()
+	if err != nil || n != int64(len(expected)) {
+		t.Errorf("m.Len() = %d, %v, expected %d", n, err, len(expected))
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() = %d, expected 0", freed)
+	}
+}
+
+func TestHashMapTableResize(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	var depths []int
+	for _, resize := range []bool{false, true} {
+		opts := []container.HashMapOption{
+			container.WithInsertionOrder(),
+			container.WithFanOut(4),
+			container.WithMaxList(8),
+		}
+		if resize {
+			buf = newReadWriteSeeker(nil)
+			opts = append(opts, container.WithTableResize())
+		}
+		m, err := container.NewHashMap(buf, opts...)
+		if err != nil {
+			t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+			return
+		}
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			err = m.Store([]byte(key), []byte(strconv.Itoa(i)))
+			if err != nil {
+				t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+				return
+			}
+		}
+		stats, err := m.Stats()
+		if err != nil {
+			t.Errorf("m.Stats(): unexpected error: %v", err)
+			return
+		}
+		depths = append(depths, stats.MaxDepth)
+	}
+	if depths[1] >= depths[0] {
+		t.Errorf("stats.MaxDepth = %d with WithTableResize, expected less than the %d of nested tables", depths[1], depths[0])
+	}
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	err = m.StoreBatch([]container.KV{
+		{Key: []byte("batch-0"), Value: []byte("0")},
+		{Key: []byte("batch-1"), Value: []byte("1")},
+	})
+	if err != nil {
+		t.Errorf("m.StoreBatch(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 500; i += 2 {
+		key := fmt.Sprintf("key-%03d", i)
+		err = m.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("m.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() = %d, expected the resizes to leak no chunks", freed)
+	}
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	if n, _ := m.Len(); n != 252 {
+		t.Errorf("m.Len() = %d, expected 252", n)
+	}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value, ok, err := m.Load([]byte(key))
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		if ok != (i%2 == 1) || ok && string(value) != strconv.Itoa(i) {
+			t.Errorf("m.Load(%q) = %q, %v", key, value, ok)
+		}
+	}
+	var ranged int
+	err = m.Range(func(_, _ []byte) bool {
+		ranged++
+		return true
+	})
+	if err != nil {
+		t.Errorf("m.Range(...): unexpected error: %v", err)
+		return
+	}
+	if ranged != 252 {
+		t.Errorf("m.Range(...) called f %d times, expected 252", ranged)
+	}
+
+	err = m.Clear()
+	if err != nil {
+		t.Errorf("m.Clear(): unexpected error: %v", err)
+		return
+	}
+	err = m.Store([]byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Errorf("m.Store(...): unexpected error: %v", err)
+		return
+	}
+	value, ok, err := m.Load([]byte("foo"))
+	if err != nil || !ok || string(value) != "bar" {
+		t.Errorf("m.Load(\"foo\") = %q, %v, %v after Clear, expected \"bar\"", value, ok, err)
+	}
+}
+
+func TestHashMapCollisionStrategy(t *testing.T) {
+	nested := map[container.CollisionStrategy]int{}
+	for _, strategy := range []container.CollisionStrategy{
+		container.CollisionNest,
+		container.CollisionChain,
+		container.CollisionTwoChoice,
+		container.CollisionCuckoo,
+		container.CollisionRobinHood,
+	} {
+		buf := newReadWriteSeeker(nil)
+		m, err := container.NewHashMap(
+			buf,
+			container.WithCollisionStrategy(strategy),
+			container.WithFanOut(8),
+			container.WithMaxList(4),
+		)
+		if err != nil {
+			t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+			return
+		}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			err = m.Store([]byte(key), []byte(strconv.Itoa(i)))
+			if err != nil {
+				t.Errorf("strategy %d: m.Store(%q, ...): unexpected error: %v", strategy, key, err)
+				return
+			}
+		}
+		err = m.StoreBatch([]container.KV{
+			{Key: []byte("key-000"), Value: []byte("batched")},
+			{Key: []byte("batch-0"), Value: []byte("0")},
+		})
+		if err != nil {
+			t.Errorf("strategy %d: m.StoreBatch(...): unexpected error: %v", strategy, err)
+			return
+		}
+		for i := 1; i < 300; i += 2 {
+			key := fmt.Sprintf("key-%03d", i)
+			err = m.Delete([]byte(key))
+			if err != nil {
+				t.Errorf("strategy %d: m.Delete(%q): unexpected error: %v", strategy, key, err)
+				return
+			}
+		}
+		stats, err := m.Stats()
+		if err != nil {
+			t.Errorf("strategy %d: m.Stats(): unexpected error: %v", strategy, err)
+			return
+		}
+		nested[strategy] = stats.NestedTables
+
+		// the strategy is stored in the map
+		m, err = container.NewHashMap(buf)
+		if err != nil {
+			t.Errorf("strategy %d: NewHashMap(...): unexpected error: %v", strategy, err)
+			return
+		}
+		if n, _ := m.Len(); n != 151 {
+			t.Errorf("strategy %d: m.Len() = %d, expected 151", strategy, n)
+		}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			expected := strconv.Itoa(i)
+			if i == 0 {
+				expected = "batched"
+			}
+			value, ok, err := m.Load([]byte(key))
+			if err != nil {
+				t.Errorf("strategy %d: m.Load(%q): unexpected error: %v", strategy, key, err)
+				return
+			}
+			if ok != (i%2 == 0) || ok && string(value) != expected {
+				t.Errorf("strategy %d: m.Load(%q) = %q, %v", strategy, key, value, ok)
+			}
+		}
+		err = m.Store([]byte("key-002"), []byte("updated"))
+		if err != nil {
+			t.Errorf("strategy %d: m.Store(...): unexpected error: %v", strategy, err)
+			return
+		}
+		if n, _ := m.Len(); n != 151 {
+			t.Errorf("strategy %d: m.Len() = %d after overwriting a key, expected 151", strategy, n)
+		}
+		freed, err := m.Scavenge()
+		if err != nil {
+			t.Errorf("strategy %d: m.Scavenge(): unexpected error: %v", strategy, err)
+			return
+		}
+		if freed != 0 {
+			t.Errorf("strategy %d: m.Scavenge() = %d, expected 0", strategy, freed)
+		}
+	}
+	if nested[container.CollisionChain] != 0 {
+		t.Errorf("%d nested tables with CollisionChain, expected none", nested[container.CollisionChain])
+	}
+	if nested[container.CollisionRobinHood] != 0 {
+		t.Errorf("%d nested tables with CollisionRobinHood, expected none", nested[container.CollisionRobinHood])
+	}
+	if nested[container.CollisionCuckoo] > nested[container.CollisionTwoChoice] {
+		t.Errorf("%d nested tables with CollisionCuckoo, expected at most the %d of CollisionTwoChoice", nested[container.CollisionCuckoo], nested[container.CollisionTwoChoice])
+	}
+	if nested[container.CollisionTwoChoice] >= nested[container.CollisionNest] {
+		t.Errorf("%d nested tables with CollisionTwoChoice, expected fewer than the %d of CollisionNest", nested[container.CollisionTwoChoice], nested[container.CollisionNest])
+	}
+
+	// close to the capacity of the head table, moving entries makes room
+	// where CollisionTwoChoice has to nest a table
+	for _, strategy := range []container.CollisionStrategy{
+		container.CollisionTwoChoice,
+		container.CollisionCuckoo,
+		container.CollisionRobinHood,
+	} {
+		m, err := container.NewHashMap(
+			newReadWriteSeeker(nil),
+			container.WithCollisionStrategy(strategy),
+			container.WithFanOut(8),
+			container.WithMaxList(4),
+		)
+		if err != nil {
+			t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+			return
+		}
+		for i := 0; i < 28; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			err = m.Store([]byte(key), []byte(strconv.Itoa(i)))
+			if err != nil {
+				t.Errorf("strategy %d: m.Store(%q, ...): unexpected error: %v", strategy, key, err)
+				return
+			}
+		}
+		stats, err := m.Stats()
+		if err != nil {
+			t.Errorf("strategy %d: m.Stats(): unexpected error: %v", strategy, err)
+			return
+		}
+		if strategy == container.CollisionTwoChoice {
+			if stats.NestedTables == 0 {
+				t.Errorf("no nested tables with CollisionTwoChoice, expected some")
+			}
+			continue
+		}
+		if stats.NestedTables != 0 {
+			t.Errorf("strategy %d: %d nested tables, expected none", strategy, stats.NestedTables)
+		}
+
+		for i := 0; i < 28; i += 2 {
+			key := fmt.Sprintf("key-%03d", i)
+			err = m.Delete([]byte(key))
+			if err != nil {
+				t.Errorf("strategy %d: m.Delete(%q): unexpected error: %v", strategy, key, err)
+				return
+			}
+		}
+		for i := 0; i < 28; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			value, ok, err := m.Load([]byte(key))
+			if err != nil {
+				t.Errorf("strategy %d: m.Load(%q): unexpected error: %v", strategy, key, err)
+				return
+			}
+			if ok != (i%2 == 1) || ok && string(value) != strconv.Itoa(i) {
+				t.Errorf("strategy %d: m.Load(%q) = %q, %v", strategy, key, value, ok)
+			}
+		}
+	}
+
+	_, err := container.NewHashMap(newReadWriteSeeker(nil), container.WithCollisionStrategy(42))
+	if err == nil {
+		t.Errorf("NewHashMap(..., WithCollisionStrategy(42)): expected error, got nil")
+	}
+}
+
+func TestHashMapSnapshot(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	expected := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key-%d", i), strconv.Itoa(i)
+		err = m.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+		expected[key] = value
+	}
+
+	snapshot, err := m.Snapshot()
+	if err != nil {
+		t.Errorf("m.Snapshot(): unexpected error: %v", err)
+		return
+	}
+	if snapshot.Len() != 100 {
+		t.Errorf("snapshot.Len() = %d, expected 100", snapshot.Len())
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if i%2 == 0 {
+			err = m.Delete([]byte(key))
+		} else {
+			err = m.Store([]byte(key), []byte("overwritten"))
+		}
+		if err != nil {
+			t.Errorf("updating %q: unexpected error: %v", key, err)
+			return
+		}
+		err = m.Store([]byte(fmt.Sprintf("new-%d", i)), []byte("new"))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() with a snapshot = %d, expected 0", freed)
+	}
+
+	got := map[string]string{}
+	err = snapshot.Range(func(key, value []byte) bool {
+		got[string(key)] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Errorf("snapshot.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("snapshot.Range(...) = %v, expected %v", got, expected)
+	}
+
+	err = snapshot.Release()
+	if err != nil {
+		t.Errorf("snapshot.Release(): unexpected error: %v", err)
+		return
+	}
+	err = snapshot.Range(func(_, _ []byte) bool { return true })
+	if err == nil {
+		t.Errorf("snapshot.Range(...) after Release: expected error, got nil")
+	}
+	freed, err = m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() after Release = %d, expected 0", freed)
+	}
+
+	v, ok, err := m.Load([]byte("key-1"))
+	if err != nil {
+		t.Errorf("m.Load(%q): unexpected error: %v", "key-1", err)
+		return
+	}
+	if !ok || string(v) != "overwritten" {
+		t.Errorf("m.Load(%q) = %q, %v, expected %q", "key-1", v, ok, "overwritten")
+	}
+	n, err := m.Len()
+	if err != nil {
+		t.Errorf("m.Len(): unexpected error: %v", err)
+		return
+	}
+	if n != 150 {
+		t.Errorf("m.Len() = %d, expected 150", n)
+	}
+}
+
+func TestHashMapLoadReader(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	err = m.Store([]byte("big"), value)
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", "big", err)
+		return
+	}
+
+	_, _, ok, err := m.LoadReader([]byte("missing"))
+	if err != nil {
+		t.Errorf("m.LoadReader(%q): unexpected error: %v", "missing", err)
+		return
+	}
+	if ok {
+		t.Errorf("m.LoadReader(%q) = true, expected false", "missing")
+	}
+
+	r, size, ok, err := m.LoadReader([]byte("big"))
+	if err != nil {
+		t.Errorf("m.LoadReader(%q): unexpected error: %v", "big", err)
+		return
+	}
+	if !ok || size != int64(len(value)) {
+		t.Errorf("m.LoadReader(%q) = %d, %v, expected %d, true", "big", size, ok, len(value))
+	}
+
+	// the reader keeps reading the value it was opened on
+	err = m.Store([]byte("big"), []byte("small"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", "big", err)
+		return
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() with an open reader = %d, expected 0", freed)
+	}
+
+	b := make([]byte, 3)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		t.Errorf("r.Read(...): unexpected error: %v", err)
+		return
+	}
+	if string(b) != "012" {
+		t.Errorf("r.Read(...) = %q, expected %q", b, "012")
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Errorf("io.ReadAll(r): unexpected error: %v", err)
+		return
+	}
+	if !bytes.Equal(rest, value[3:]) {
+		t.Errorf("io.ReadAll(r) read %d bytes, expected the %d bytes of the value", len(rest), len(value)-3)
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Errorf("r.Close(): unexpected error: %v", err)
+		return
+	}
+	_, err = r.Read(b)
+	if err == nil {
+		t.Errorf("r.Read(...) after Close: expected error, got nil")
+	}
+	freed, err = m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() after Close = %d, expected 0", freed)
+	}
+
+	r, size, ok, err = m.LoadReader([]byte("big"))
+	if err != nil {
+		t.Errorf("m.LoadReader(%q): unexpected error: %v", "big", err)
+		return
+	}
+	b, err = io.ReadAll(r)
+	if err != nil {
+		t.Errorf("io.ReadAll(r): unexpected error: %v", err)
+		return
+	}
+	if !ok || size != 5 || string(b) != "small" {
+		t.Errorf("m.LoadReader(%q) read %q, %d, %v, expected %q, 5, true", "big", b, size, ok, "small")
+	}
+	err = r.Close()
+	if err != nil {
+		t.Errorf("r.Close(): unexpected error: %v", err)
+	}
+}
+
+func TestHashMapLoadInto(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		err = m.Store([]byte(key), []byte(strings.Repeat("v", i)))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+	}
+
+	scratch := make([]byte, 0, 8)
+	b, ok, err := m.LoadInto([]byte("key-5"), scratch)
+	if err != nil || !ok || string(b) != "vvvvv" {
+		t.Errorf("m.LoadInto(%q, ...) = %q, %v, %v, expected %q, true, nil", "key-5", b, ok, err, "vvvvv")
+	}
+	if &b[:1][0] != &scratch[:1][0] {
+		t.Errorf("m.LoadInto(%q, ...) allocated a new slice, expected the buffer to be reused", "key-5")
+	}
+	b, ok, err = m.LoadInto([]byte("key-9"), scratch)
+	if err != nil || !ok || string(b) != "vvvvvvvvv" {
+		t.Errorf("m.LoadInto(%q, ...) = %q, %v, %v, expected %q, true, nil", "key-9", b, ok, err, "vvvvvvvvv")
+	}
+	_, ok, err = m.LoadInto([]byte("missing"), scratch)
+	if err != nil || ok {
+		t.Errorf("m.LoadInto(%q, ...) = %v, %v, expected false, nil", "missing", ok, err)
+	}
+
+	// only the node of the key is allocated, the key compared and the value
+	// read without allocating
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _, _ = m.LoadInto([]byte("key-5"), scratch)
+	})
+	if allocs > 2 {
+		t.Errorf("m.LoadInto(...) allocated %v times, expected at most 2", allocs)
+	}
+}
+
+func TestHashMapStoreFromReader(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+
+	for _, test := range []struct {
+		key   string
+		value []byte
+		size  int64
+	}{
+		{key: "sized", value: value, size: int64(len(value))},
+		{key: "unsized", value: value, size: -1},
+		{key: "empty", value: []byte{}, size: -1},
+		{key: "truncated", value: value[:10], size: 10},
+	} {
+		r := io.MultiReader(bytes.NewReader(test.value), bytes.NewReader([]byte("trailing")))
+		if test.size < 0 {
+			r = bytes.NewReader(test.value)
+		}
+		err = m.StoreFromReader([]byte(test.key), r, test.size)
+		if err != nil {
+			t.Errorf("m.StoreFromReader(%q, ..., %d): unexpected error: %v", test.key, test.size, err)
+			return
+		}
+		v, ok, err := m.Load([]byte(test.key))
+		if err != nil {
+			t.Errorf("m.Load(%q): unexpected error: %v", test.key, err)
+			return
+		}
+		if !ok || !bytes.Equal(v, test.value) {
+			t.Errorf("m.Load(%q) = %d bytes, %v, expected the %d bytes stored", test.key, len(v), ok, len(test.value))
+		}
+	}
+
+	err = m.StoreFromReader([]byte("short"), bytes.NewReader(value[:10]), 20)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("m.StoreFromReader(%q, ...) with a short reader = %v, expected %v", "short", err, io.ErrUnexpectedEOF)
+	}
+	errRead := errors.New("read failed")
+	err = m.StoreFromReader([]byte("failing"), io.MultiReader(bytes.NewReader(value), iotest.ErrReader(errRead)), -1)
+	if !errors.Is(err, errRead) {
+		t.Errorf("m.StoreFromReader(%q, ...) with a failing reader = %v, expected %v", "failing", err, errRead)
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		t.Errorf("m.Scavenge(): unexpected error: %v", err)
+		return
+	}
+	if freed != 0 {
+		t.Errorf("m.Scavenge() after failed StoreFromReader calls = %d, expected 0", freed)
+	}
+	n, err := m.Len()
+	if err != nil {
+		t.Errorf("m.Len(): unexpected error: %v", err)
+		return
+	}
+	if n != 4 {
+		t.Errorf("m.Len() = %d, expected 4", n)
+	}
+}
+
+func TestHashMapStats(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf, container.WithFanOut(4), container.WithMaxList(4))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	var keyBytes, valueBytes int64
+	for i := 0; i < 40; i++ {
+		key, value := fmt.Sprintf("key-%d", i), strconv.Itoa(i*1000)
+		err = m.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+		keyBytes += int64(len(key))
+		valueBytes += int64(len(value))
+	}
+
+	stats, err := m.Stats()
+	if err != nil {
+		t.Errorf("m.Stats(): unexpected error: %v", err)
+		return
+	}
+	if stats.Entries != 40 {
+		t.Errorf("m.Stats().Entries = %d, expected 40", stats.Entries)
+	}
+	if stats.KeyBytes != keyBytes || stats.ValueBytes != valueBytes {
+		t.Errorf("m.Stats() = %d key bytes, %d value bytes, expected %d and %d", stats.KeyBytes, stats.ValueBytes, keyBytes, valueBytes)
+	}
+	if stats.NestedTables == 0 {
+		t.Errorf("m.Stats().NestedTables = 0, expected nested tables")
+	}
+	var buckets, entries int
+	for n, count := range stats.BucketLoad {
+		buckets += count
+		entries += n * count
+	}
+	if entries != 40 {
+		t.Errorf("m.Stats().BucketLoad = %v, accounting for %d entries, expected 40", stats.BucketLoad, entries)
+	}
+	if expected := 4 + 4*stats.NestedTables - stats.NestedTables; buckets != expected {
+		t.Errorf("m.Stats().BucketLoad = %v, accounting for %d buckets, expected %d", stats.BucketLoad, buckets, expected)
+	}
+	size, err := buf.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Errorf("buf.Seek(0, io.SeekEnd): unexpected error: %v", err)
+		return
+	}
+	if used := keyBytes + valueBytes + stats.ChunkOverhead; used > size {
+		t.Errorf("m.Stats(): %d bytes of keys, values and overhead, more than the file size %d", used, size)
+	}
+}
+
 func BenchmarkHashMap(b *testing.B) {
 	buildMap := func(b *testing.B) *container.HashMap {
 		b.Helper()
@@ -399,3 +2095,349 @@ func BenchmarkHashMap(b *testing.B) {
 		}
 	})
 }
+
+func TestHashMapBloomFilter(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf, container.WithFanOut(4), container.WithBloomFilter(200))
+	if err != nil {
+		t.Errorf("NewHashMap(nil, WithBloomFilter(200)): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 200; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		err = m.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("m.Store(%q, %q): unexpected error: %v", key, value, err)
+			return
+		}
+	}
+
+	counter := &readCounter{ReadWriteSeeker: buf}
+	m, err = container.NewHashMap(counter)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		value, ok, err := m.Load([]byte(key))
+		if err != nil || !ok || string(value) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("m.Load(%q) = %q, %v, %v, expected %q, true, nil", key, value, ok, err, fmt.Sprintf("value-%d", i))
+			return
+		}
+	}
+	counter.reads = 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("missing-%d", i)
+		_, ok, err := m.Load([]byte(key))
+		if err != nil || ok {
+			t.Errorf("m.Load(%q) = _, %v, %v, expected false, nil", key, ok, err)
+			return
+		}
+	}
+	// each false positive walks a list of about 50 entries
+	if counter.reads > 100*50 {
+		t.Errorf("loading 1000 missing keys read %d times, expected the bloom filter to skip most lookups", counter.reads)
+	}
+
+	for i := 0; i < 150; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		err = m.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("m.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = m.RebuildBloomFilter()
+	if err != nil {
+		t.Errorf("m.RebuildBloomFilter(): unexpected error: %v", err)
+		return
+	}
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, ok, err := m.Load([]byte(key))
+		if err != nil || ok != (i >= 150) {
+			t.Errorf("m.Load(%q) = _, %v, %v, expected %v, nil", key, ok, err, i >= 150)
+			return
+		}
+	}
+
+	err = m.Clear()
+	if err != nil {
+		t.Errorf("m.Clear(): unexpected error: %v", err)
+		return
+	}
+	_, ok, err := m.Load([]byte("key-199"))
+	if err != nil || ok {
+		t.Errorf("m.Load(%q) = _, %v, %v after Clear, expected false, nil", "key-199", ok, err)
+	}
+	freed, err := m.Scavenge()
+	if err != nil || freed != 0 {
+		t.Errorf("m.Scavenge() = %d, %v after Clear, expected 0, nil", freed, err)
+	}
+
+	m, err = container.NewHashMap(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	err = m.RebuildBloomFilter()
+	if !errors.Is(err, container.ErrNoBloomFilter) {
+		t.Errorf("m.RebuildBloomFilter() = %v without a bloom filter, expected %v", err, container.ErrNoBloomFilter)
+	}
+}
+
+func TestHashMapStoreBatch(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf, container.WithFanOut(4), container.WithMaxList(8), container.WithOrderedIndex())
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		err = m.Store([]byte(fmt.Sprintf("key-%d", i)), []byte("old"))
+		if err != nil {
+			t.Errorf("m.Store(...): unexpected error: %v", err)
+			return
+		}
+	}
+
+	expected := map[string]string{}
+	for i := 0; i < 10; i++ {
+		expected[fmt.Sprintf("key-%d", i)] = "old"
+	}
+	var items []container.KV
+	for i := 5; i < 100; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		items = append(items, container.KV{Key: []byte(key), Value: []byte(value)})
+		expected[key] = value
+	}
+	items = append(items, container.KV{Key: []byte("key-7"), Value: []byte("last")})
+	expected["key-7"] = "last"
+
+	err = m.StoreBatch(items)
+	if err != nil {
+		t.Errorf("m.StoreBatch(...): unexpected error: %v", err)
+		return
+	}
+
+	m, err = container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(...): unexpected error: %v", err)
+		return
+	}
+	n, err := m.Len()
+	if err != nil || n != int64(len(expected)) {
+		t.Errorf("m.Len() = %d, %v, expected %d, nil", n, err, len(expected))
+	}
+	for key, value := range expected {
+		b, ok, err := m.Load([]byte(key))
+		if err != nil || !ok || string(b) != value {
+			t.Errorf("m.Load(%q) = %q, %v, %v, expected %q, true, nil", key, b, ok, err, value)
+		}
+	}
+	var indexed int
+	err = m.RangePrefix(nil, func(_, _ []byte) bool {
+		indexed++
+		return true
+	})
+	if err != nil || indexed != len(expected) {
+		t.Errorf("m.RangePrefix(nil, ...) ranged over %d entries, %v, expected %d, nil", indexed, err, len(expected))
+	}
+
+	freed, err := m.Scavenge()
+	if err != nil || freed != 0 {
+		t.Errorf("m.Scavenge() = %d, %v after StoreBatch, expected 0, nil", freed, err)
+	}
+}
+
+func TestHashMapUndoLog(t *testing.T) {
+	file, log := newReadWriteSeeker(nil).(*readWriteSeeker), newReadWriteSeeker(nil).(*readWriteSeeker)
+	opts := []container.HashMapOption{
+		container.WithFanOut(4),
+		container.WithMaxList(4),
+		container.WithOrderedIndex(),
+		container.WithPoolOptions(container.WithUndoLog(log)),
+	}
+	m, err := container.NewHashMap(file, opts...)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	before := map[string]string{}
+	for i := 0; i < 30; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		err = m.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("m.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+		before[key] = value
+	}
+	var items []container.KV
+	for i := 20; i < 50; i++ {
+		key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("new-%d", i)
+		items = append(items, container.KV{Key: []byte(key), Value: []byte(value)})
+	}
+
+	contents := func(m *container.HashMap) (string, error) {
+		got := map[string]string{}
+		err := m.Range(func(key, value []byte) bool {
+			got[string(key)] = string(value)
+			return true
+		})
+
+		return fmt.Sprint(got), err
+	}
+
+	for _, crash := range []bool{false, true} {
+		for writes := 0; ; writes++ {
+			buf := &readWriteSeeker{b: append([]byte(nil), file.b...)}
+			logBuf := &readWriteSeeker{b: append([]byte(nil), log.b...)}
+			opts[len(opts)-1] = container.WithPoolOptions(container.WithUndoLog(logBuf))
+
+			var f io.ReadWriteSeeker = &flakyWriter{ReadWriteSeeker: buf, writes: writes}
+			if crash {
+				f = &failingWriter{ReadWriteSeeker: buf, writes: writes}
+			}
+			m, err := container.NewHashMap(f, opts...)
+			if err != nil {
+				t.Errorf("NewHashMap(...): unexpected error: %v", err)
+				return
+			}
+			err = m.StoreBatch(items)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errWriteFailed) {
+				t.Errorf("crash=%v: m.StoreBatch(...) after %d writes: unexpected error: %v", crash, writes, err)
+				return
+			}
+
+			if crash {
+				m, err = container.NewHashMap(buf, opts...)
+				if err != nil {
+					t.Errorf("NewHashMap(...) after a crash in m.StoreBatch(...): unexpected error: %v", err)
+					return
+				}
+			}
+			got, err := contents(m)
+			if err != nil {
+				t.Errorf("crash=%v: m.Range(...) after %d writes: unexpected error: %v", crash, writes, err)
+				return
+			}
+			if got != fmt.Sprint(before) {
+				t.Errorf("crash=%v: m.StoreBatch(...) failing after %d writes left %s, expected %v", crash, writes, got, before)
+				return
+			}
+			if n, err := m.Len(); err != nil || n != int64(len(before)) {
+				t.Errorf("crash=%v: m.Len() = %d, %v after %d writes, expected %d", crash, n, err, writes, len(before))
+			}
+			freed, err := m.Scavenge()
+			if err != nil || freed != 0 {
+				t.Errorf("crash=%v: m.Scavenge() = %d, %v after %d writes, expected nothing to free", crash, freed, err, writes)
+			}
+		}
+	}
+}
+
+func TestHashMapLink(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	err = m.Store([]byte("a"), []byte("shared value"))
+	if err != nil {
+		t.Errorf("m.Store(...): unexpected error: %v", err)
+		return
+	}
+	snapshot, err := m.Snapshot()
+	if err != nil {
+		t.Errorf("m.Snapshot(): unexpected error: %v", err)
+		return
+	}
+	for _, key := range []string{"b", "c"} {
+		err = m.Link([]byte(key), []byte("a"))
+		if err != nil {
+			t.Errorf("m.Link(%q, %q): unexpected error: %v", key, "a", err)
+			return
+		}
+	}
+	err = m.Link([]byte("d"), []byte("missing"))
+	if err == nil {
+		t.Errorf("m.Link(%q, %q): expected an error", "d", "missing")
+	}
+
+	err = m.Delete([]byte("a"))
+	if err != nil {
+		t.Errorf("m.Delete(...): unexpected error: %v", err)
+		return
+	}
+	for _, key := range []string{"b", "c"} {
+		value, ok, err := m.Load([]byte(key))
+		if err != nil || !ok || string(value) != "shared value" {
+			t.Errorf("m.Load(%q) = %q, %v, %v, expected %q", key, value, ok, err, "shared value")
+		}
+	}
+	err = m.Store([]byte("b"), []byte("own value"))
+	if err != nil {
+		t.Errorf("m.Store(...): unexpected error: %v", err)
+		return
+	}
+	value, ok, err := m.Load([]byte("c"))
+	if err != nil || !ok || string(value) != "shared value" {
+		t.Errorf("m.Load(%q) = %q, %v, %v, expected %q", "c", value, ok, err, "shared value")
+	}
+	err = m.Delete([]byte("c"))
+	if err != nil {
+		t.Errorf("m.Delete(...): unexpected error: %v", err)
+		return
+	}
+	err = snapshot.Release()
+	if err != nil {
+		t.Errorf("snapshot.Release(): unexpected error: %v", err)
+		return
+	}
+
+	freed, err := m.Scavenge()
+	if err != nil || freed != 0 {
+		t.Errorf("m.Scavenge() = %d, %v, expected nothing to free", freed, err)
+	}
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	problems, err := pool.Verify()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("pool.Verify() = %v, %v, expected no problems", problems, err)
+	}
+}
+
+// flakyWriter fails one write after the first ones.
+type flakyWriter struct {
+	io.ReadWriteSeeker
+	writes int
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		w.writes = -1
+		return 0, errWriteFailed
+	}
+	if w.writes > 0 {
+		w.writes--
+	}
+
+	return w.ReadWriteSeeker.Write(p)
+}
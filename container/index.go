@@ -0,0 +1,217 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrNoOrderedIndex is returned by RangePrefix for maps created without
+// WithOrderedIndex.
+var ErrNoOrderedIndex = errors.New("map has no ordered index")
+
+// The ordered index is a list of nodes sorted by key. Each node holds its own
+// copy of the key and no value, values are looked up in the buckets.
+
+func (m *HashMap) writeIndexHead() error {
+	if !m.cfg.ordered {
+		return nil
+	}
+
+	b := make([]byte, sizeIndexHead)
+	binary.LittleEndian.PutUint64(b, uint64(m.indexHead))
+	_, err := m.headBucketsChunk.WriteAt(b, int64(m.cfg.indexOffset()))
+
+	return err
+}
+
+// iterateIndex calls fn on the nodes of the index in order, until it returns
+// false or an error.
+func (m *HashMap) iterateIndex(fn func(node *KVNode) (bool, error)) error {
+	return m.iterateList(m.indexHead, fn)
+}
+
+// iterateList calls fn on the nodes of the list starting at head, until it
+// returns false or an error.
+func (m *HashMap) iterateList(head ChunkPtr, fn func(node *KVNode) (bool, error)) error {
+	if head == 0 {
+		return nil
+	}
+
+	node, err := NewKVNodeFromChunkPtr(m.pool, head)
+	for err == nil && node != nil {
+		var ok bool
+		ok, err = fn(node)
+		if err != nil || !ok {
+			return err
+		}
+
+		node, err = node.Next()
+	}
+
+	return err
+}
+
+func (m *HashMap) indexInsert(key []byte) error {
+	if !m.cfg.ordered {
+		return nil
+	}
+
+	var prev, next *KVNode
+	err := m.iterateIndex(func(node *KVNode) (bool, error) {
+		nodeKey, err := node.KeyBytes()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Compare(nodeKey, key) > 0 {
+			next = node
+			return false, nil
+		}
+		prev = node
+
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keyChunk, err := m.pool.AllocAndWrite(key)
+	if err != nil {
+		return err
+	}
+	node, err := NewKVNode(m.pool, keyChunk.Ptr(), 0)
+	if err != nil {
+		return err
+	}
+	node.prev, node.next = prev.Ptr(), next.Ptr()
+	err = node.Write()
+	if err != nil {
+		return err
+	}
+
+	if next != nil {
+		next.prev = node.Ptr()
+		err = next.Write()
+		if err != nil {
+			return err
+		}
+	}
+	if prev != nil {
+		prev.next = node.Ptr()
+		return prev.Write()
+	}
+	m.indexHead = node.Ptr()
+
+	return m.writeIndexHead()
+}
+
+func (m *HashMap) indexDelete(key []byte) error {
+	if !m.cfg.ordered {
+		return nil
+	}
+
+	var found *KVNode
+	err := m.iterateIndex(func(node *KVNode) (bool, error) {
+		nodeKey, err := node.KeyBytes()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(nodeKey, key) {
+			found = node
+		}
+
+		return found == nil && bytes.Compare(nodeKey, key) < 0, nil
+	})
+	if err != nil || found == nil {
+		return err
+	}
+
+	keyPtr := found.key
+	newHead, err := found.Delete()
+	if err != nil {
+		return err
+	}
+	if newHead != m.indexHead {
+		m.indexHead = newHead
+		err = m.writeIndexHead()
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.freeChunks(keyPtr)
+}
+
+// RangePrefix calls f on the entries whose key starts with prefix, in key
+// order, until it returns false. A nil prefix ranges over the whole map. The
+// map has to be created with WithOrderedIndex.
+func (m *HashMap) RangePrefix(prefix []byte, f func(key, value []byte) bool) error {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	if !m.cfg.ordered {
+		return ErrNoOrderedIndex
+	}
+
+	return m.iterateIndex(func(node *KVNode) (bool, error) {
+		key, err := node.KeyBytes()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Compare(key, prefix) < 0 {
+			return true, nil
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			return false, nil
+		}
+
+		value, ok, err := m.load(key)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return true, nil
+		}
+
+		return f(key, value), nil
+	})
+}
+
+// RangeKeys calls f on the keys starting with prefix and sorted after after,
+// in key order, until it returns false. A nil after starts at the first key
+// with prefix. Unlike RangePrefix, the values aren't read. The map has to be
+// created with WithOrderedIndex.
+func (m *HashMap) RangeKeys(prefix, after []byte, f func(key []byte) bool) error {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	if !m.cfg.ordered {
+		return ErrNoOrderedIndex
+	}
+
+	return m.iterateIndex(func(node *KVNode) (bool, error) {
+		key, err := node.KeyBytes()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Compare(key, prefix) < 0 {
+			return true, nil
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			return false, nil
+		}
+		if after != nil && bytes.Compare(key, after) <= 0 {
+			return true, nil
+		}
+
+		entry, err := m.findNode(key)
+		if err != nil {
+			return false, err
+		}
+		if entry == nil {
+			return true, nil
+		}
+
+		return f(key), nil
+	})
+}
@@ -4,16 +4,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 )
 
+// KVNode is a node of a doubly linked list of keys and values. The head of a
+// list has no previous node, its prev field holds the negated size of the
+// list instead, or 0 when the size isn't known, as in lists written before it
+// was recorded. Nodes of entries that expire are followed by their expiry, in
+// nanoseconds since the Unix epoch, and need a larger chunk.
 type KVNode struct {
 	pool  *Pool
 	chunk *Chunk
 
-	prev  ChunkPtr
-	next  ChunkPtr
-	key   ChunkPtr
-	value ChunkPtr
+	prev   ChunkPtr
+	next   ChunkPtr
+	key    ChunkPtr
+	value  ChunkPtr
+	expiry int64 // 0 when the entry doesn't expire
 }
 
 type kvnodeDTO struct {
@@ -23,7 +30,19 @@ type kvnodeDTO struct {
 	Value ChunkPtr
 }
 
-var sizeKVNode = binarySizePanic(kvnodeDTO{})
+var (
+	sizeKVNode   = binarySizePanic(kvnodeDTO{})
+	sizeKVExpiry = binarySizePanic(int64(0))
+)
+
+// nodeSize is the size of the payload of a node with the given expiry.
+func nodeSize(expiry int64) int {
+	if expiry != 0 {
+		return sizeKVNode + sizeKVExpiry
+	}
+
+	return sizeKVNode
+}
 
 func (n KVNode) dto() kvnodeDTO {
 	return kvnodeDTO{
@@ -35,7 +54,11 @@ func (n KVNode) dto() kvnodeDTO {
 }
 
 func NewKVNode(pool *Pool, key, value ChunkPtr) (*KVNode, error) {
-	chunk, err := pool.Alloc(uint32(sizeKVNode))
+	return newKVNode(pool, key, value, 0)
+}
+
+func newKVNode(pool *Pool, key, value ChunkPtr, expiry int64) (*KVNode, error) {
+	chunk, err := pool.Alloc(uint32(nodeSize(expiry)))
 	if err != nil {
 		return nil, err
 	}
@@ -44,8 +67,10 @@ func NewKVNode(pool *Pool, key, value ChunkPtr) (*KVNode, error) {
 		pool:  pool,
 		chunk: chunk,
 
-		key:   key,
-		value: value,
+		prev:   -1,
+		key:    key,
+		value:  value,
+		expiry: expiry,
 	}
 
 	err = node.Write()
@@ -81,15 +106,18 @@ func (n *KVNode) Ptr() ChunkPtr {
 }
 
 func (n *KVNode) Write() error {
-	buf := bytes.NewBuffer(make([]byte, 0, sizeKVNode))
+	buf := bytes.NewBuffer(make([]byte, 0, nodeSize(n.expiry)))
 
 	err := binary.Write(buf, binary.LittleEndian, n.dto())
 	if err != nil {
 		return err
 	}
+	if n.expiry != 0 {
+		_ = binary.Write(buf, binary.LittleEndian, n.expiry)
+	}
 
 	if n.chunk == nil {
-		n.chunk, err = n.pool.Alloc(uint32(sizeKVNode))
+		n.chunk, err = n.pool.Alloc(uint32(buf.Len()))
 		if err != nil {
 			return err
 		}
@@ -103,23 +131,25 @@ func (n *KVNode) Write() error {
 }
 
 func (n *KVNode) Read() error {
-	b, err := n.chunk.ReadAll()
+	buf := getBuffer()
+	b, err := n.chunk.ReadInto(*buf)
 	if err != nil {
 		return err
 	}
-
-	var dto kvnodeDTO
-
-	buf := bytes.NewBuffer(b)
-	err = binary.Read(buf, binary.LittleEndian, &dto)
-	if err != nil {
-		return err
+	defer putBuffer(buf, b)
+	if len(b) < sizeKVNode {
+		return io.ErrUnexpectedEOF
 	}
 
-	n.prev = dto.Prev
-	n.next = dto.Next
-	n.key = dto.Key
-	n.value = dto.Value
+	// decoded by hand rather than with binary.Read, which allocates
+	n.prev = ChunkPtr(binary.LittleEndian.Uint64(b))
+	n.next = ChunkPtr(binary.LittleEndian.Uint64(b[sizePtr:]))
+	n.key = ChunkPtr(binary.LittleEndian.Uint64(b[2*sizePtr:]))
+	n.value = ChunkPtr(binary.LittleEndian.Uint64(b[3*sizePtr:]))
+	n.expiry = 0
+	if len(b) >= sizeKVNode+sizeKVExpiry {
+		n.expiry = int64(binary.LittleEndian.Uint64(b[sizeKVNode:]))
+	}
 
 	return nil
 }
@@ -137,6 +167,22 @@ func (n *KVNode) KeyBytes() ([]byte, error) {
 	return chunk.ReadAll()
 }
 
+// hasKey compares the key of n to key, reading it in a pooled buffer.
+func (n *KVNode) hasKey(key []byte) (bool, error) {
+	chunk, err := n.pool.Get(n.key)
+	if err != nil {
+		return false, err
+	}
+	buf := getBuffer()
+	b, err := chunk.ReadInto(*buf)
+	if err != nil {
+		return false, err
+	}
+	defer putBuffer(buf, b)
+
+	return bytes.Equal(b, key), nil
+}
+
 func (n *KVNode) Value() (*Chunk, error) {
 	return n.pool.Get(n.value)
 }
@@ -185,8 +231,12 @@ func (n *KVNode) Next() (*KVNode, error) {
 	return node, err
 }
 
+func (n *KVNode) isHead() bool {
+	return n.prev <= 0
+}
+
 func (n *KVNode) Prev() (*KVNode, error) {
-	if n.prev == 0 {
+	if n.isHead() {
 		return nil, nil
 	}
 
@@ -205,12 +255,17 @@ func (n *KVNode) Prev() (*KVNode, error) {
 	return node, err
 }
 
+// ListSize returns the number of nodes from n to the end of the list. It
+// only reads the list when n is the head of a list of unknown size.
 func (n *KVNode) ListSize() (int64, error) {
 	var err error
 
 	if n == nil {
 		return 0, nil
 	}
+	if n.prev < 0 {
+		return int64(-n.prev), nil
+	}
 
 	node := n
 
@@ -226,18 +281,22 @@ func (n *KVNode) ListSize() (int64, error) {
 	return size, nil
 }
 
+// Append adds a node to the list headed by n. The node is inserted right
+// after the head, so that neither the list nor its size have to be read.
 func (n *KVNode) Append(key, value ChunkPtr) (*KVNode, error) {
-	var err error
+	return n.append(key, value, 0)
+}
 
-	lastNode := n
-	for lastNode.next != 0 {
-		lastNode, err = lastNode.Next()
-		if err != nil {
-			return nil, err
-		}
+func (n *KVNode) append(key, value ChunkPtr, expiry int64) (*KVNode, error) {
+	if !n.isHead() {
+		return nil, errors.New(".Append() can only be called on the head node")
+	}
+	size, err := n.ListSize()
+	if err != nil {
+		return nil, err
 	}
 
-	chunk, err := n.pool.Alloc(uint32(sizeKVNode))
+	chunk, err := n.pool.Alloc(uint32(nodeSize(expiry)))
 	if err != nil {
 		return nil, err
 	}
@@ -246,9 +305,11 @@ func (n *KVNode) Append(key, value ChunkPtr) (*KVNode, error) {
 		pool:  n.pool,
 		chunk: chunk,
 
-		prev:  lastNode.chunk.Ptr(),
-		key:   key,
-		value: value,
+		prev:   n.chunk.Ptr(),
+		next:   n.next,
+		key:    key,
+		value:  value,
+		expiry: expiry,
 	}
 
 	err = node.Write()
@@ -256,14 +317,27 @@ func (n *KVNode) Append(key, value ChunkPtr) (*KVNode, error) {
 		return nil, err
 	}
 
-	lastNode.next = node.chunk.Ptr()
-	err = lastNode.Write()
+	next, err := n.Next()
+	if err != nil {
+		return nil, err
+	}
+	if next != nil {
+		next.prev = node.chunk.Ptr()
+		err = next.Write()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n.next = node.chunk.Ptr()
+	n.prev = ChunkPtr(-(size + 1))
+	err = n.Write()
 
 	return node, err
 }
 
 func (n *KVNode) Delete() (newHead ChunkPtr, err error) {
-	if n.prev == 0 {
+	if n.isHead() {
 		err = n.chunk.Free()
 		if err != nil {
 			return n.Ptr(), err
@@ -273,26 +347,55 @@ func (n *KVNode) Delete() (newHead ChunkPtr, err error) {
 			return n.next, err
 		}
 		next.prev = 0
+		if n.prev < 0 {
+			next.prev = n.prev + 1
+		}
 		err = next.Write()
 
 		return n.next, err
 	}
 
 	head := n
-	for head.prev != 0 {
+	for !head.isHead() {
 		head, err = head.Prev()
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	prev, err := n.Prev()
+	prev := head
+	if n.prev != head.Ptr() {
+		prev, err = n.Prev()
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	prev.next = n.next
+	if head.prev < 0 {
+		head.prev++
+	}
 	err = prev.Write()
 	if err != nil {
 		return 0, err
 	}
+	if prev != head && head.prev < 0 {
+		err = head.Write()
+		if err != nil {
+			return 0, err
+		}
+	}
+	next, err := n.Next()
+	if err != nil {
+		return 0, err
+	}
+	if next != nil {
+		next.prev = n.prev
+		err = next.Write()
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	err = n.chunk.Free()
 
@@ -300,7 +403,7 @@ func (n *KVNode) Delete() (newHead ChunkPtr, err error) {
 }
 
 func (n *KVNode) DeleteAll() error {
-	if n.prev != 0 {
+	if !n.isHead() {
 		return errors.New(".DeleteAll() can only be called on the head node")
 	}
 
@@ -0,0 +1,102 @@
+package container_test
+
+import (
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestKVNodeListSize(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	// pointers to the first chunk mean no node
+	_, err = pool.Alloc(8)
+	if err != nil {
+		t.Errorf("pool.Alloc(8): unexpected error: %v", err)
+		return
+	}
+	head, err := container.NewKVNode(pool, 1, 1)
+	if err != nil {
+		t.Errorf("NewKVNode(...): unexpected error: %v", err)
+		return
+	}
+	nodes := []*container.KVNode{head}
+	for i := 2; i <= 10; i++ {
+		node, err := head.Append(container.ChunkPtr(i), container.ChunkPtr(i))
+		if err != nil {
+			t.Errorf("head.Append(%d, %d): unexpected error: %v", i, i, err)
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	_, err = nodes[3].Append(42, 42)
+	if err == nil {
+		t.Errorf("node.Append(...): expected error appending to a node other than the head, got nil")
+	}
+
+	counter := &readCounter{ReadWriteSeeker: buf}
+	pool, err = container.NewPool(counter)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	head, err = container.NewKVNodeFromChunkPtr(pool, head.Ptr())
+	if err != nil {
+		t.Errorf("NewKVNodeFromChunkPtr(...): unexpected error: %v", err)
+		return
+	}
+	counter.reads = 0
+	size, err := head.ListSize()
+	if err != nil || size != 10 {
+		t.Errorf("head.ListSize() = %d, %v, expected 10, nil", size, err)
+	}
+	if counter.reads != 0 {
+		t.Errorf("head.ListSize() read %d times, expected the size to be stored in the head", counter.reads)
+	}
+
+	for _, tc := range []struct {
+		ptr  container.ChunkPtr
+		size int64
+	}{
+		{ptr: nodes[5].Ptr(), size: 9},
+		{ptr: nodes[0].Ptr(), size: 8},
+		{ptr: nodes[9].Ptr(), size: 7},
+	} {
+		node, err := container.NewKVNodeFromChunkPtr(pool, tc.ptr)
+		if err != nil {
+			t.Errorf("NewKVNodeFromChunkPtr(0x%x): unexpected error: %v", tc.ptr, err)
+			return
+		}
+		newHead, err := node.Delete()
+		if err != nil {
+			t.Errorf("node.Delete(): unexpected error: %v", err)
+			return
+		}
+		head, err = container.NewKVNodeFromChunkPtr(pool, newHead)
+		if err != nil {
+			t.Errorf("NewKVNodeFromChunkPtr(0x%x): unexpected error: %v", newHead, err)
+			return
+		}
+		size, err = head.ListSize()
+		if err != nil || size != tc.size {
+			t.Errorf("head.ListSize() = %d, %v after deleting 0x%x, expected %d, nil", size, err, tc.ptr, tc.size)
+		}
+
+		var walked int64
+		for n := head; n != nil; walked++ {
+			n, err = n.Next()
+			if err != nil {
+				t.Errorf("n.Next(): unexpected error: %v", err)
+				return
+			}
+		}
+		if walked != tc.size {
+			t.Errorf("walked %d nodes after deleting 0x%x, expected %d", walked, tc.ptr, tc.size)
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Default size the memtable of an LSM reaches before being flushed to a
+// sorted run, and number of runs above which they are merged.
+const (
+	LSMMemtableSize = 4 << 20
+	LSMMaxRuns      = 4
+)
+
+const (
+	lsmRunSlots      = 64
+	lsmLogChunkSize  = 64 << 10
+	lsmIndexInterval = 16
+)
+
+// LSM is a write-optimized map. Writes are appended to a log and kept in an
+// in-memory table, which is flushed to an immutable sorted run once large
+// enough. Runs are merged in the background when there are too many of them.
+// Lookups check the memtable, then the runs from the newest one.
+type LSM struct {
+	m *sync.RWMutex
+
+	pool      *Pool
+	cfg       *lsmConfig
+	headChunk *Chunk
+
+	memtable map[string]lsmRecord
+	memSize  int
+	log      []*Chunk
+	runs     []*lsmRun // newest first
+
+	mergeDone chan struct{} // nil when no merge is running
+	mergeErr  error
+}
+
+// The head chunk holds the first log chunk and the runs:
+//
+//	log    int64
+//	nRuns  uint32
+//	runs   lsmRunSlots * int64, newest first
+//	magic  [4]byte
+//
+// Log chunks are linked to each other and hold the writes since the last
+// flush:
+//
+//	next     int64
+//	records  (deleted uint8, key length uvarint, key, value length uvarint, value)...
+//
+// Runs hold the records sorted by key, followed by a sparse index:
+//
+//	records   same as the log
+//	index     (key length uvarint, key, offset uvarint) every lsmIndexInterval records
+//	indexOff  int64
+//	count     int64
+var (
+	sizeLSMHead   = sizePtr + binarySizePanic(uint32(0)) + lsmRunSlots*sizePtr + len(lsmMagic)
+	sizeRunFooter = sizePtr + sizeCount
+)
+
+var lsmMagic = [4]byte{'k', 'v', 'l', 's'}
+
+var errLSMRunSlots = errors.New("too many runs")
+
+type lsmRecord struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+type lsmRun struct {
+	chunk    *Chunk
+	index    []lsmIndexEntry
+	indexOff int64
+}
+
+type lsmIndexEntry struct {
+	key []byte
+	off int64
+}
+
+func NewLSM(f io.ReadWriteSeeker, opts ...LSMOption) (*LSM, error) {
+	cfg := &lsmConfig{
+		memtableSize: LSMMemtableSize,
+		maxRuns:      LSMMaxRuns,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.maxRuns < 1 || cfg.maxRuns >= lsmRunSlots {
+		return nil, fmt.Errorf("invalid number of runs %d, expected 1 to %d", cfg.maxRuns, lsmRunSlots-1)
+	}
+
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LSM{
+		m: &sync.RWMutex{},
+
+		pool:     pool,
+		cfg:      cfg,
+		memtable: map[string]lsmRecord{},
+	}
+
+	if pool.Size() == 0 {
+		l.headChunk, err = pool.Alloc(uint32(sizeLSMHead))
+		if err != nil {
+			return nil, err
+		}
+		logChunk, err := l.newLogChunk(lsmLogChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		l.log = []*Chunk{logChunk}
+
+		return l, l.writeHead()
+	}
+
+	l.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	err = l.readHead()
+	if err != nil {
+		return nil, err
+	}
+	err = l.replayLog()
+	if err != nil {
+		return nil, err
+	}
+	l.startMerge()
+
+	return l, nil
+}
+
+func (l *LSM) readHead() error {
+	b, err := l.headChunk.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(b) != sizeLSMHead || !bytes.Equal(b[sizeLSMHead-len(lsmMagic):], lsmMagic[:]) {
+		return fmt.Errorf("invalid lsm header: %d bytes", len(b))
+	}
+
+	logChunk, err := l.pool.Get(ChunkPtr(binary.LittleEndian.Uint64(b)))
+	if err != nil {
+		return err
+	}
+	l.log = []*Chunk{logChunk}
+
+	nRuns := int(binary.LittleEndian.Uint32(b[sizePtr:]))
+	if nRuns > lsmRunSlots {
+		return fmt.Errorf("invalid lsm header: %d runs", nRuns)
+	}
+	for i := 0; i < nRuns; i++ {
+		chunk, err := l.pool.Get(ChunkPtr(binary.LittleEndian.Uint64(b[sizePtr+4+i*sizePtr:])))
+		if err != nil {
+			return err
+		}
+		run, err := loadLSMRun(chunk)
+		if err != nil {
+			return err
+		}
+		l.runs = append(l.runs, run)
+	}
+
+	return nil
+}
+
+func (l *LSM) writeHead() error {
+	if len(l.runs) > lsmRunSlots {
+		return errLSMRunSlots
+	}
+
+	b := make([]byte, sizeLSMHead)
+	binary.LittleEndian.PutUint64(b, uint64(l.log[0].Ptr()))
+	binary.LittleEndian.PutUint32(b[sizePtr:], uint32(len(l.runs)))
+	for i, run := range l.runs {
+		binary.LittleEndian.PutUint64(b[sizePtr+4+i*sizePtr:], uint64(run.chunk.Ptr()))
+	}
+	copy(b[sizeLSMHead-len(lsmMagic):], lsmMagic[:])
+
+	_, err := l.headChunk.Write(b)
+
+	return err
+}
+
+func (l *LSM) newLogChunk(n int) (*Chunk, error) {
+	chunk, err := l.pool.Alloc64(uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	_, err = chunk.Write(make([]byte, sizePtr))
+
+	return chunk, err
+}
+
+func (l *LSM) appendLog(rec lsmRecord) error {
+	b := rec.appendTo(nil)
+
+	last := l.log[len(l.log)-1]
+	if last.Size64()+uint64(len(b)) > last.Cap64() {
+		size := lsmLogChunkSize
+		if sizePtr+len(b) > size {
+			size = sizePtr + len(b)
+		}
+		chunk, err := l.newLogChunk(size)
+		if err != nil {
+			return err
+		}
+		next := make([]byte, sizePtr)
+		binary.LittleEndian.PutUint64(next, uint64(chunk.Ptr()))
+		_, err = last.WriteAt(next, 0)
+		if err != nil {
+			return err
+		}
+		l.log = append(l.log, chunk)
+		last = chunk
+	}
+
+	_, err := last.WriteAt(b, int64(last.Size64()))
+
+	return err
+}
+
+func (l *LSM) replayLog() error {
+	chunk := l.log[0]
+	for {
+		b, err := chunk.ReadAll()
+		if err != nil {
+			return err
+		}
+		if len(b) < sizePtr {
+			return fmt.Errorf("log chunk 0x%x: expected at least %d bytes, read %d", chunk.Ptr(), sizePtr, len(b))
+		}
+		records, err := decodeLSMRecords(b[sizePtr:])
+		if err != nil {
+			return fmt.Errorf("log chunk 0x%x: %w", chunk.Ptr(), err)
+		}
+		for _, rec := range records {
+			l.apply(rec)
+		}
+
+		next := ChunkPtr(binary.LittleEndian.Uint64(b))
+		if next == 0 {
+			return nil
+		}
+		chunk, err = l.pool.Get(next)
+		if err != nil {
+			return err
+		}
+		l.log = append(l.log, chunk)
+	}
+}
+
+// apply adds rec to the memtable. The size counts overwritten records too,
+// so that it also bounds the size of the log.
+func (l *LSM) apply(rec lsmRecord) {
+	l.memtable[string(rec.key)] = rec
+	l.memSize += len(rec.key) + len(rec.value)
+}
+
+func (l *LSM) Load(key []byte) ([]byte, bool, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	return l.load(key)
+}
+
+func (l *LSM) load(key []byte) ([]byte, bool, error) {
+	if rec, ok := l.memtable[string(key)]; ok {
+		return rec.value, !rec.deleted, nil
+	}
+
+	for _, run := range l.runs {
+		rec, ok, err := run.get(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return rec.value, !rec.deleted, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+func (l *LSM) Store(key, value []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.write(lsmRecord{key: key, value: value})
+}
+
+func (l *LSM) Delete(key []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	_, ok, err := l.load(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("key %q not found", key)
+	}
+
+	return l.write(lsmRecord{key: key, deleted: true})
+}
+
+func (l *LSM) write(rec lsmRecord) error {
+	rec.key = append([]byte(nil), rec.key...)
+	rec.value = append([]byte(nil), rec.value...)
+
+	err := l.appendLog(rec)
+	if err != nil {
+		return err
+	}
+	l.apply(rec)
+	if l.memSize < l.cfg.memtableSize {
+		return nil
+	}
+
+	return l.flush()
+}
+
+// Flush writes the memtable to a new run.
+func (l *LSM) Flush() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.flush()
+}
+
+func (l *LSM) flush() error {
+	// writes stall while there are twice as many runs as the maximum, until
+	// the merge catches up
+	stall := 2 * l.cfg.maxRuns
+	if stall > lsmRunSlots {
+		stall = lsmRunSlots
+	}
+	for len(l.runs) >= stall && l.mergeErr == nil {
+		l.startMerge()
+		done := l.mergeDone
+		l.m.Unlock()
+		<-done
+		l.m.Lock()
+	}
+	if l.mergeErr != nil {
+		return l.mergeErr
+	}
+	if len(l.memtable) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(l.memtable))
+	for key := range l.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w := &lsmRunWriter{}
+	for _, key := range keys {
+		w.add(l.memtable[key])
+	}
+	run, err := w.write(l.pool)
+	if err != nil {
+		return err
+	}
+
+	l.runs = append([]*lsmRun{run}, l.runs...)
+	err = l.writeHead()
+	if err != nil {
+		return err
+	}
+	l.memtable = map[string]lsmRecord{}
+	l.memSize = 0
+
+	err = l.resetLog()
+	if err != nil {
+		return err
+	}
+	l.startMerge()
+
+	return nil
+}
+
+// resetLog empties the first log chunk and frees the others. Replaying the
+// log of an interrupted flush again is harmless, its records being older
+// than anything written after them.
+func (l *LSM) resetLog() error {
+	_, err := l.log[0].Write(make([]byte, sizePtr))
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range l.log[1:] {
+		err = chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+	l.log = l.log[:1]
+
+	return nil
+}
+
+// startMerge merges all the runs in the background if there are more than
+// the maximum. The merge reads the runs without holding the lock, and only
+// takes it to replace them.
+func (l *LSM) startMerge() {
+	if l.mergeDone != nil || len(l.runs) <= l.cfg.maxRuns {
+		return
+	}
+
+	runs := append([]*lsmRun(nil), l.runs...)
+	done := make(chan struct{})
+	l.mergeDone = done
+	go func() {
+		defer close(done)
+
+		merged, err := mergeLSMRuns(l.pool, runs)
+
+		l.m.Lock()
+		defer l.m.Unlock()
+		l.mergeDone = nil
+		if err == nil {
+			err = l.replaceRuns(runs, merged)
+		}
+		if err != nil && l.mergeErr == nil {
+			l.mergeErr = err
+		}
+	}()
+}
+
+// replaceRuns replaces runs, the oldest ones, with merged.
+func (l *LSM) replaceRuns(runs []*lsmRun, merged *lsmRun) error {
+	n := len(l.runs) - len(runs)
+	l.runs = l.runs[:n:n]
+	if merged != nil {
+		l.runs = append(l.runs, merged)
+	}
+	err := l.writeHead()
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		err = run.chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeLSMRuns writes the live records of runs to a new run, nil when there
+// are none. Deleted records are dropped since runs include the oldest one.
+func mergeLSMRuns(pool *Pool, runs []*lsmRun) (*lsmRun, error) {
+	cursors := make([]*lsmCursor, len(runs))
+	for i, run := range runs {
+		cursors[i] = &lsmCursor{run: run}
+	}
+
+	w := &lsmRunWriter{}
+	err := mergeLSMCursors(cursors, func(rec lsmRecord) bool {
+		if !rec.deleted {
+			w.add(rec)
+		}
+		return true
+	})
+	if err != nil || w.count == 0 {
+		return nil, err
+	}
+
+	return w.write(pool)
+}
+
+// Close waits for the running merge, if any, and returns the error it
+// failed with. The memtable is kept in the log and doesn't need flushing.
+func (l *LSM) Close() error {
+	l.m.Lock()
+	done := l.mergeDone
+	l.m.Unlock()
+	if done != nil {
+		<-done
+	}
+
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	return l.mergeErr
+}
+
+// Range calls f on every entry in key order until it returns false.
+func (l *LSM) Range(f func(key, value []byte) bool) error {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	keys := make([]string, 0, len(l.memtable))
+	for key := range l.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mem := &lsmCursor{records: make([]lsmRecord, len(keys))}
+	for i, key := range keys {
+		mem.records[i] = l.memtable[key]
+	}
+
+	cursors := []*lsmCursor{mem}
+	for _, run := range l.runs {
+		cursors = append(cursors, &lsmCursor{run: run})
+	}
+
+	return mergeLSMCursors(cursors, func(rec lsmRecord) bool {
+		return rec.deleted || f(rec.key, rec.value)
+	})
+}
+
+// lsmCursor iterates over the records of a run, one index segment at a time,
+// or over records held in memory when it has no run.
+type lsmCursor struct {
+	run     *lsmRun
+	seg     int
+	records []lsmRecord
+}
+
+func (c *lsmCursor) peek() (*lsmRecord, error) {
+	for len(c.records) == 0 {
+		if c.run == nil || c.seg >= len(c.run.index) {
+			return nil, nil
+		}
+		var err error
+		c.records, err = c.run.segment(c.seg)
+		if err != nil {
+			return nil, err
+		}
+		c.seg++
+	}
+
+	return &c.records[0], nil
+}
+
+// mergeLSMCursors calls f on the records of cursors in key order until it
+// returns false. When several cursors hold the same key, the record of the
+// first one is used.
+func mergeLSMCursors(cursors []*lsmCursor, f func(rec lsmRecord) bool) error {
+	for {
+		var next *lsmRecord
+		for _, c := range cursors {
+			rec, err := c.peek()
+			if err != nil {
+				return err
+			}
+			if rec != nil && (next == nil || bytes.Compare(rec.key, next.key) < 0) {
+				next = rec
+			}
+		}
+		if next == nil {
+			return nil
+		}
+
+		rec := *next
+		for _, c := range cursors {
+			head, err := c.peek()
+			if err != nil {
+				return err
+			}
+			if head != nil && bytes.Equal(head.key, rec.key) {
+				c.records = c.records[1:]
+			}
+		}
+
+		if !f(rec) {
+			return nil
+		}
+	}
+}
+
+type lsmRunWriter struct {
+	b     []byte
+	index []byte
+	count int64
+}
+
+func (w *lsmRunWriter) add(rec lsmRecord) {
+	if w.count%lsmIndexInterval == 0 {
+		w.index = appendUvarintBytes(w.index, rec.key)
+		w.index = appendUvarint(w.index, uint64(len(w.b)))
+	}
+	w.b = rec.appendTo(w.b)
+	w.count++
+}
+
+func (w *lsmRunWriter) write(pool *Pool) (*lsmRun, error) {
+	footer := make([]byte, sizeRunFooter)
+	binary.LittleEndian.PutUint64(footer, uint64(len(w.b)))
+	binary.LittleEndian.PutUint64(footer[sizePtr:], uint64(w.count))
+
+	b := append(append(w.b, w.index...), footer...)
+	chunk, err := pool.AllocAndWrite(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadLSMRun(chunk)
+}
+
+func loadLSMRun(chunk *Chunk) (*lsmRun, error) {
+	size := int64(chunk.Size64())
+	if size < int64(sizeRunFooter) {
+		return nil, fmt.Errorf("run 0x%x: expected at least %d bytes, read %d", chunk.Ptr(), sizeRunFooter, size)
+	}
+	footer := make([]byte, sizeRunFooter)
+	_, err := chunk.ReadAt(footer, size-int64(sizeRunFooter))
+	if err != nil {
+		return nil, err
+	}
+
+	run := &lsmRun{
+		chunk:    chunk,
+		indexOff: int64(binary.LittleEndian.Uint64(footer)),
+	}
+	if run.indexOff > size-int64(sizeRunFooter) {
+		return nil, fmt.Errorf("run 0x%x: index offset %d past the end", chunk.Ptr(), run.indexOff)
+	}
+	b := make([]byte, size-int64(sizeRunFooter)-run.indexOff)
+	_, err = chunk.ReadAt(b, run.indexOff)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for len(b) > 0 {
+		key, n := readUvarintBytes(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("run 0x%x: invalid index", chunk.Ptr())
+		}
+		off, m := binary.Uvarint(b[n:])
+		if m <= 0 || int64(off) >= run.indexOff {
+			return nil, fmt.Errorf("run 0x%x: invalid index", chunk.Ptr())
+		}
+		run.index = append(run.index, lsmIndexEntry{key: key, off: int64(off)})
+		b = b[n+m:]
+	}
+
+	return run, nil
+}
+
+func (r *lsmRun) segment(i int) ([]lsmRecord, error) {
+	end := r.indexOff
+	if i+1 < len(r.index) {
+		end = r.index[i+1].off
+	}
+	b := make([]byte, end-r.index[i].off)
+	_, err := r.chunk.ReadAt(b, r.index[i].off)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeLSMRecords(b)
+}
+
+func (r *lsmRun) get(key []byte) (lsmRecord, bool, error) {
+	i := sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].key, key) > 0
+	}) - 1
+	if i < 0 {
+		return lsmRecord{}, false, nil
+	}
+
+	records, err := r.segment(i)
+	if err != nil {
+		return lsmRecord{}, false, err
+	}
+	for _, rec := range records {
+		if bytes.Equal(rec.key, key) {
+			return rec, true, nil
+		}
+	}
+
+	return lsmRecord{}, false, nil
+}
+
+func (rec lsmRecord) appendTo(b []byte) []byte {
+	var deleted byte
+	if rec.deleted {
+		deleted = 1
+	}
+	b = append(b, deleted)
+	b = appendUvarintBytes(b, rec.key)
+
+	return appendUvarintBytes(b, rec.value)
+}
+
+func decodeLSMRecords(b []byte) ([]lsmRecord, error) {
+	var records []lsmRecord
+	for len(b) > 0 {
+		rec := lsmRecord{deleted: b[0] == 1}
+		key, n := readUvarintBytes(b[1:])
+		if n <= 0 {
+			return nil, errors.New("invalid record key")
+		}
+		value, m := readUvarintBytes(b[1+n:])
+		if m <= 0 {
+			return nil, errors.New("invalid record value")
+		}
+		rec.key, rec.value = key, value
+		records = append(records, rec)
+		b = b[1+n+m:]
+	}
+
+	return records, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+
+	return append(b, buf[:n]...)
+}
+
+func appendUvarintBytes(b, v []byte) []byte {
+	return append(appendUvarint(b, uint64(len(v))), v...)
+}
+
+// readUvarintBytes reads a length prefixed byte slice, returning the number
+// of bytes read or a negative number if b is too short.
+func readUvarintBytes(b []byte) ([]byte, int) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return nil, -1
+	}
+
+	return b[n : n+int(size)], n + int(size)
+}
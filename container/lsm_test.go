@@ -0,0 +1,117 @@
+package container_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestLSM(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	l, err := container.NewLSM(buf, container.WithMemtableSize(512), container.WithMaxRuns(2))
+	if err != nil {
+		t.Errorf("NewLSM(nil): unexpected error: %v", err)
+		return
+	}
+
+	expected := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%03d", rand.Intn(300))
+		if _, ok := expected[key]; ok && i%3 == 0 {
+			err = l.Delete([]byte(key))
+			if err != nil {
+				t.Errorf("l.Delete(%q): unexpected error: %v", key, err)
+				return
+			}
+			delete(expected, key)
+			continue
+		}
+
+		value := fmt.Sprintf("value-%d", i)
+		err = l.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("l.Store(%q, %q): unexpected error: %v", key, value, err)
+			return
+		}
+		expected[key] = value
+	}
+	err = l.Delete([]byte("missing"))
+	if err == nil {
+		t.Errorf("l.Delete(%q): expected error, got nil", "missing")
+	}
+
+	for reopen := 0; reopen < 2; reopen++ {
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			value, ok, err := l.Load([]byte(key))
+			if err != nil {
+				t.Errorf("l.Load(%q): unexpected error: %v", key, err)
+				return
+			}
+			expectedValue, expectedOK := expected[key]
+			if ok != expectedOK || string(value) != expectedValue {
+				t.Errorf("l.Load(%q) = %q, %v, expected %q, %v", key, value, ok, expectedValue, expectedOK)
+			}
+		}
+
+		keys := make([]string, 0, len(expected))
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var got []string
+		err = l.Range(func(key, value []byte) bool {
+			if string(value) != expected[string(key)] {
+				t.Errorf("l.Range(...): value for %q = %q, expected %q", key, value, expected[string(key)])
+			}
+			got = append(got, string(key))
+			return true
+		})
+		if err != nil {
+			t.Errorf("l.Range(...): unexpected error: %v", err)
+			return
+		}
+		if fmt.Sprint(got) != fmt.Sprint(keys) {
+			t.Errorf("l.Range(...) = %v, expected %v", got, keys)
+		}
+
+		err = l.Close()
+		if err != nil {
+			t.Errorf("l.Close(): unexpected error: %v", err)
+			return
+		}
+		l, err = container.NewLSM(buf, container.WithMemtableSize(512), container.WithMaxRuns(2))
+		if err != nil {
+			t.Errorf("NewLSM(...): unexpected error: %v", err)
+			return
+		}
+	}
+
+	for key := range expected {
+		err = l.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("l.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = l.Flush()
+	if err != nil {
+		t.Errorf("l.Flush(): unexpected error: %v", err)
+		return
+	}
+	err = l.Range(func(key, _ []byte) bool {
+		t.Errorf("l.Range(...): unexpected key %q after deleting everything", key)
+		return true
+	})
+	if err != nil {
+		t.Errorf("l.Range(...): unexpected error: %v", err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Errorf("l.Close(): unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package container_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+// The model tests apply sequences of operations to a HashMap or a Pool and to
+// an in-memory model of it, checking after every step that they agree and
+// that the pool passes Verify. Sequences are decoded from bytes, so that the
+// same runners back the random tests and the fuzz targets.
+
+var modelMapConfigs = map[string][]container.HashMapOption{
+	"default": nil,
+	"nested":  {container.WithFanOut(2), container.WithMaxList(2)},
+	"ordered": {container.WithFanOut(4), container.WithMaxList(2), container.WithOrderedIndex(), container.WithBloomFilter(16)},
+	"insertion order": {
+		container.WithFanOut(4), container.WithMaxList(2), container.WithInsertionOrder(), container.WithTableResize(),
+	},
+	"chain":      {container.WithFanOut(2), container.WithCollisionStrategy(container.CollisionChain)},
+	"two choice": {container.WithFanOut(4), container.WithMaxList(2), container.WithCollisionStrategy(container.CollisionTwoChoice)},
+	"cuckoo":     {container.WithFanOut(4), container.WithMaxList(2), container.WithCollisionStrategy(container.CollisionCuckoo)},
+	"robin":      {container.WithFanOut(4), container.WithCollisionStrategy(container.CollisionRobinHood)},
+	"cuckoo ordered": {
+		container.WithFanOut(4), container.WithMaxList(2), container.WithCollisionStrategy(container.CollisionCuckoo),
+		container.WithOrderedIndex(), container.WithTableResize(),
+	},
+	"robin ordered": {
+		container.WithFanOut(4), container.WithCollisionStrategy(container.CollisionRobinHood),
+		container.WithOrderedIndex(), container.WithTableResize(),
+	},
+	"buffered": {container.WithFanOut(4), container.WithMaxList(2), container.WithPoolOptions(container.WithWriteBuffer(8192))},
+}
+
+func TestHashMapModel(t *testing.T) {
+	for name, opts := range modelMapConfigs {
+		for seed := int64(0); seed < 8; seed++ {
+			ops := make([]byte, 3*300)
+			rand.New(rand.NewSource(seed)).Read(ops)
+
+			err := runHashMapModel(ops, opts...)
+			if err != nil {
+				t.Errorf("%s, seed %d: %v", name, seed, err)
+			}
+		}
+	}
+}
+
+func FuzzHashMap(f *testing.F) {
+	f.Add(byte(1), []byte{0, 1, 10, 0, 2, 20, 1, 1, 0, 5, 0, 0})
+	f.Add(byte(2), bytes.Repeat([]byte{0, 3, 200, 2, 3, 0}, 20))
+	f.Fuzz(func(t *testing.T, config byte, ops []byte) {
+		names := make([]string, 0, len(modelMapConfigs))
+		for name := range modelMapConfigs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		name := names[int(config)%len(names)]
+
+		err := runHashMapModel(ops, modelMapConfigs[name]...)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	})
+}
+
+// runHashMapModel applies ops, 3 bytes each: the operation, the key and the
+// value length.
+func runHashMapModel(ops []byte, opts ...container.HashMapOption) error {
+	buf := newReadWriteSeeker(nil)
+	m, err := container.NewHashMap(buf, opts...)
+	if err != nil {
+		return fmt.Errorf("NewHashMap(nil): %v", err)
+	}
+	model := map[string][]byte{}
+
+	for step := 0; len(ops) >= 3; step, ops = step+1, ops[3:] {
+		key := []byte(fmt.Sprintf("key-%d", ops[1]%48))
+		value := bytes.Repeat([]byte{byte(step)}, int(ops[2]))
+
+		var desc string
+		switch ops[0] % 11 {
+		case 0, 1, 2:
+			desc = fmt.Sprintf("Store(%q, %d bytes)", key, len(value))
+			err = m.Store(key, value)
+			model[string(key)] = value
+		case 3, 4:
+			desc = fmt.Sprintf("Delete(%q)", key)
+			err = m.Delete(key)
+			_, ok := model[string(key)]
+			if ok != (err == nil) {
+				return fmt.Errorf("step %d: %s = %v, key in model %v", step, desc, err, ok)
+			}
+			err = nil
+			delete(model, string(key))
+		case 5:
+			other := []byte(fmt.Sprintf("key-%d", ops[2]%48))
+			desc = fmt.Sprintf("StoreBatch(%q, %q)", key, other)
+			err = m.StoreBatch([]container.KV{{Key: key, Value: value}, {Key: other, Value: key}})
+			model[string(key)], model[string(other)] = value, key
+		case 6:
+			desc = "Shrink()"
+			err = m.Shrink()
+		case 7:
+			desc = "reopening"
+			err = m.Flush()
+			if err == nil {
+				m, err = container.NewHashMap(buf, opts...)
+			}
+		case 8:
+			desc = "Range(...)"
+			err = checkHashMapRange(m, model)
+		case 9:
+			if ops[2] < 16 {
+				desc = "Clear()"
+				err = m.Clear()
+				model = map[string][]byte{}
+				break
+			}
+			desc = fmt.Sprintf("LoadOrStore(%q, ...)", key)
+			_, _, err = m.LoadOrStore(key, value)
+			if _, ok := model[string(key)]; !ok {
+				model[string(key)] = value
+			}
+		case 10:
+			from := []byte(fmt.Sprintf("key-%d", ops[2]%48))
+			desc = fmt.Sprintf("Link(%q, %q)", key, from)
+			err = m.Link(key, from)
+			fromValue, ok := model[string(from)]
+			if ok != (err == nil) {
+				return fmt.Errorf("step %d: %s = %v, key in model %v", step, desc, err, ok)
+			}
+			err = nil
+			if ok {
+				model[string(key)] = fromValue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %s: %v", step, desc, err)
+		}
+
+		err = checkHashMapStep(m, buf, model, key)
+		if err != nil {
+			return fmt.Errorf("step %d: after %s: %v", step, desc, err)
+		}
+	}
+
+	err = checkHashMapRange(m, model)
+	if err != nil {
+		return err
+	}
+	freed, err := m.Scavenge()
+	if err != nil {
+		return fmt.Errorf("m.Scavenge(): %v", err)
+	}
+	if freed != 0 {
+		return fmt.Errorf("m.Scavenge() freed %d leaked chunks", freed)
+	}
+
+	return nil
+}
+
+// checkHashMapStep checks the length of the map, the value of key and the
+// pool of the map, opened a second time from the file.
+func checkHashMapStep(m *container.HashMap, f io.ReadWriteSeeker, model map[string][]byte, key []byte) error {
+	n, err := m.Len()
+	if err != nil {
+		return err
+	}
+	if n != int64(len(model)) {
+		return fmt.Errorf("m.Len() = %d, expected %d", n, len(model))
+	}
+	value, ok, err := m.Load(key)
+	if err != nil {
+		return fmt.Errorf("m.Load(%q): %v", key, err)
+	}
+	expected, expectedOK := model[string(key)]
+	if ok != expectedOK || !bytes.Equal(value, expected) {
+		return fmt.Errorf("m.Load(%q) = %d bytes, %v, expected %d bytes, %v", key, len(value), ok, len(expected), expectedOK)
+	}
+
+	err = m.Flush()
+	if err != nil {
+		return err
+	}
+	pool, err := container.NewPool(f)
+	if err != nil {
+		return fmt.Errorf("NewPool(...): %v", err)
+	}
+	problems, err := pool.Verify()
+	if err != nil {
+		return fmt.Errorf("pool.Verify(): %v", err)
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("pool.Verify() = %v", problems)
+	}
+	problems, err = m.Verify()
+	if err != nil {
+		return fmt.Errorf("m.Verify(): %v", err)
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("m.Verify() = %v", problems)
+	}
+
+	return nil
+}
+
+func checkHashMapRange(m *container.HashMap, model map[string][]byte) error {
+	seen := map[string]bool{}
+	var err error
+	rangeErr := m.Range(func(key, value []byte) bool {
+		expected, ok := model[string(key)]
+		switch {
+		case seen[string(key)]:
+			err = fmt.Errorf("m.Range(...) returned %q twice", key)
+		case !ok:
+			err = fmt.Errorf("m.Range(...) returned %q, which isn't in the model", key)
+		case !bytes.Equal(value, expected):
+			err = fmt.Errorf("m.Range(...) returned %d bytes for %q, expected %d", len(value), key, len(expected))
+		}
+		seen[string(key)] = true
+
+		return err == nil
+	})
+	if rangeErr != nil {
+		return fmt.Errorf("m.Range(...): %v", rangeErr)
+	}
+	if err != nil {
+		return err
+	}
+	if len(seen) != len(model) {
+		return fmt.Errorf("m.Range(...) returned %d keys, expected %d", len(seen), len(model))
+	}
+
+	return nil
+}
+
+func TestPoolModel(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		for seed := int64(0); seed < 8; seed++ {
+			ops := make([]byte, 3*300)
+			rand.New(rand.NewSource(seed)).Read(ops)
+
+			err := runPoolModel(ops, buffered)
+			if err != nil {
+				t.Errorf("buffered %v, seed %d: %v", buffered, seed, err)
+			}
+		}
+	}
+}
+
+func FuzzPool(f *testing.F) {
+	f.Add(false, []byte{0, 0, 10, 0, 1, 40, 3, 0, 0, 1, 1, 5, 6, 0, 0})
+	f.Add(true, bytes.Repeat([]byte{0, 2, 100, 2, 1, 200, 3, 0, 0, 5, 0, 0}, 10))
+	f.Fuzz(func(t *testing.T, buffered bool, ops []byte) {
+		err := runPoolModel(ops, buffered)
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+	})
+}
+
+// runPoolModel applies ops, 3 bytes each: the operation, the chunk it applies
+// to among the allocated ones, and a size.
+func runPoolModel(ops []byte, buffered bool) error {
+	var opts []container.PoolOption
+	if buffered {
+		opts = append(opts, container.WithWriteBuffer(8192))
+	}
+	buf := truncatingReadWriteSeeker{newReadWriteSeeker(nil).(*readWriteSeeker)}
+	pool, err := container.NewPool(buf, opts...)
+	if err != nil {
+		return fmt.Errorf("NewPool(nil): %v", err)
+	}
+	var (
+		model  = map[container.ChunkPtr][]byte{}
+		chunks = map[container.ChunkPtr]*container.Chunk{}
+	)
+	// pick returns the allocated chunk selected by b, in pointer order.
+	pick := func(b byte) (container.ChunkPtr, *container.Chunk) {
+		ptrs := make([]container.ChunkPtr, 0, len(chunks))
+		for ptr := range chunks {
+			ptrs = append(ptrs, ptr)
+		}
+		sort.Slice(ptrs, func(i, j int) bool {
+			return ptrs[i] < ptrs[j]
+		})
+		ptr := ptrs[int(b)%len(ptrs)]
+
+		return ptr, chunks[ptr]
+	}
+	reload := func() error {
+		for ptr := range model {
+			chunk, err := pool.Get(ptr)
+			if err != nil {
+				return err
+			}
+			chunks[ptr] = chunk
+		}
+
+		return nil
+	}
+
+	for step := 0; len(ops) >= 3; step, ops = step+1, ops[3:] {
+		size := int(ops[2])
+		payload := bytes.Repeat([]byte{byte(step)}, size)
+
+		var desc string
+		switch op := ops[0] % 8; {
+		case op <= 1 || len(chunks) == 0:
+			desc = fmt.Sprintf("Alloc(%d)", size+size/2)
+			var chunk *container.Chunk
+			chunk, err = pool.Alloc(uint32(size + size/2))
+			if err == nil {
+				_, err = chunk.Write(payload)
+			}
+			if err == nil {
+				model[chunk.Ptr()], chunks[chunk.Ptr()] = payload, chunk
+			}
+		case op == 2:
+			ptr, chunk := pick(ops[1])
+			desc = fmt.Sprintf("Free(0x%x)", ptr)
+			err = chunk.Free()
+			delete(model, ptr)
+			delete(chunks, ptr)
+		case op == 3:
+			ptr, chunk := pick(ops[1])
+			desc = fmt.Sprintf("Realloc(0x%x, %d)", ptr, size*2)
+			var grown *container.Chunk
+			grown, err = chunk.Realloc(uint32(size * 2))
+			if err == nil {
+				delete(chunks, ptr)
+				model[grown.Ptr()], chunks[grown.Ptr()] = model[ptr], grown
+				if grown.Ptr() != ptr {
+					delete(model, ptr)
+				}
+			}
+		case op == 4:
+			ptr, chunk := pick(ops[1])
+			off := int64(size) % (int64(chunk.Cap()) + 1)
+			n := int(chunk.Cap()) - int(off)
+			if n > 8 {
+				n = 8
+			}
+			desc = fmt.Sprintf("WriteAt(0x%x, %d bytes, %d)", ptr, n, off)
+			_, err = chunk.WriteAt(payload[:n%(size+1)], off)
+			if err == nil {
+				b := model[ptr]
+				if end := int(off) + n%(size+1); end > len(b) {
+					b = append(b, make([]byte, end-len(b))...)
+				}
+				copy(b[off:], payload[:n%(size+1)])
+				model[ptr] = b
+			}
+		case op == 5:
+			desc = "reopening"
+			if size%2 == 0 {
+				desc = "reopening from a checkpoint"
+				err = pool.Checkpoint()
+			}
+			if err == nil {
+				err = pool.Flush()
+			}
+			if err == nil {
+				pool, err = container.NewPool(buf, opts...)
+			}
+			if err == nil {
+				err = reload()
+			}
+		case op == 6 && ops[1]%2 == 1:
+			desc = "Vacuum()"
+			_, err = pool.Vacuum()
+		case op == 6:
+			desc = "Compact(...)"
+			moved := map[container.ChunkPtr]container.ChunkPtr{}
+			err = pool.Compact(func(old, new container.ChunkPtr) error {
+				moved[old] = new
+				return nil
+			})
+			if err == nil {
+				old := model
+				model = map[container.ChunkPtr][]byte{}
+				for ptr, b := range old {
+					if new, ok := moved[ptr]; ok {
+						ptr = new
+					}
+					model[ptr] = b
+				}
+				chunks = map[container.ChunkPtr]*container.Chunk{}
+				err = reload()
+			}
+		case op == 7:
+			ptr, chunk := pick(ops[1])
+			n := size % (int(chunk.Cap()) + 1)
+			desc = fmt.Sprintf("Write(0x%x, %d bytes)", ptr, n)
+			_, err = chunk.Write(payload[:n])
+			if err == nil {
+				model[ptr] = payload[:n]
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %s: %v", step, desc, err)
+		}
+
+		err = checkPool(pool, model)
+		if err != nil {
+			return fmt.Errorf("step %d: after %s: %v", step, desc, err)
+		}
+	}
+
+	return nil
+}
+
+func checkPool(pool *container.Pool, model map[container.ChunkPtr][]byte) error {
+	problems, err := pool.Verify()
+	if err != nil {
+		return fmt.Errorf("pool.Verify(): %v", err)
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("pool.Verify() = %v", problems)
+	}
+
+	allocated, err := pool.Allocated()
+	if err != nil {
+		return fmt.Errorf("pool.Allocated(): %v", err)
+	}
+	if len(allocated) != len(model) {
+		return fmt.Errorf("%d chunks allocated, expected %d", len(allocated), len(model))
+	}
+	for ptr, expected := range model {
+		chunk, err := pool.Get(ptr)
+		if err != nil {
+			return fmt.Errorf("pool.Get(0x%x): %v", ptr, err)
+		}
+		b, err := chunk.ReadAll()
+		if err != nil {
+			return fmt.Errorf("chunk 0x%x: ReadAll(): %v", ptr, err)
+		}
+		if !bytes.Equal(b, expected) {
+			return fmt.Errorf("chunk 0x%x holds %d bytes, expected %d", ptr, len(b), len(expected))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package container
+
+import "io"
+
+// DefaultChunkCacheSize is the number of allocated chunks a Pool keeps in
+// memory unless WithChunkCache is used.
+const DefaultChunkCacheSize = 4096
+
+// DefaultPayloadCacheSize is how many bytes of chunk payloads a Pool keeps in
+// memory unless WithPayloadCache is used.
+const DefaultPayloadCacheSize = 1 << 20
+
+type poolConfig struct {
+	cacheSize   int
+	payloadSize int
+	writeBuffer int
+	undoLog     io.ReadWriteSeeker
+}
+
+type PoolOption func(c *poolConfig)
+
+// WithChunkCache sets how many allocated chunks are kept in memory, the others
+// are read back from the file when used. Free chunks are always kept.
+func WithChunkCache(n int) PoolOption {
+	return func(c *poolConfig) {
+		c.cacheSize = n
+	}
+}
+
+// WithPayloadCache sets how many bytes of the most recently read chunk
+// payloads are kept in memory, so that reading them again doesn't hit the
+// file. A size of 0 disables the cache.
+func WithPayloadCache(n int) PoolOption {
+	return func(c *poolConfig) {
+		c.payloadSize = n
+	}
+}
+
+// WithWriteBuffer stages the writes to the file in memory, Flush writing them
+// out in offset order. The buffer is flushed on its own once it holds n bytes.
+// Writes staged when the process stops are lost, so Flush has to be called
+// before closing the file.
+func WithWriteBuffer(n int) PoolOption {
+	return func(c *poolConfig) {
+		c.writeBuffer = n
+	}
+}
+
+// WithUndoLog keeps the former content of the pages overwritten by the
+// updates of the pool in log, so that an update from Begin to Commit is
+// atomic: NewPool rolls back the update a crash interrupted. The same log has
+// to be passed every time the pool is opened.
+func WithUndoLog(log io.ReadWriteSeeker) PoolOption {
+	return func(c *poolConfig) {
+		c.undoLog = log
+	}
+}
+
+type btreeConfig struct {
+	maxKeys int
+}
+
+type BTreeOption func(c *btreeConfig)
+
+// WithMaxKeys sets how many keys a node of a BTree holds before being split,
+// BTreeMaxKeys by default. It is stored in the tree when it is created and
+// ignored when opening an existing one.
+func WithMaxKeys(n int) BTreeOption {
+	return func(c *btreeConfig) {
+		c.maxKeys = n
+	}
+}
+
+type lsmConfig struct {
+	memtableSize int
+	maxRuns      int
+}
+
+type LSMOption func(c *lsmConfig)
+
+// WithMemtableSize sets how many bytes of keys and values are written to an
+// LSM before its memtable is flushed, LSMMemtableSize by default.
+func WithMemtableSize(n int) LSMOption {
+	return func(c *lsmConfig) {
+		c.memtableSize = n
+	}
+}
+
+// WithMaxRuns sets how many runs an LSM keeps before merging them,
+// LSMMaxRuns by default.
+func WithMaxRuns(n int) LSMOption {
+	return func(c *lsmConfig) {
+		c.maxRuns = n
+	}
+}
+
+type hashMapConfig struct {
+	hash    func([]byte) uint32
+	fanOut  int
+	maxList int
+	mix     bool // mix hashes before picking a bucket, false for legacy maps
+	ordered bool
+	// insertionOrder keeps the keys in a list in the order they were
+	// first stored
+	insertionOrder bool
+	// resize grows the head table instead of nesting tables under it
+	resize    bool
+	collision CollisionStrategy
+	// bloomKeys is the number of keys the bloom filter is sized for, 0
+	// without a filter
+	bloomKeys int
+	poolOpts  []PoolOption
+}
+
+// tableSize is the size of a bucket table.
+func (c hashMapConfig) tableSize() int {
+	return c.fanOut * sizeHashBucket
+}
+
+type HashMapOption func(c *hashMapConfig)
+
+// WithHash sets the function distributing keys among buckets, FNV-1a by
+// default. Keys are prefixed with a salt specific to each bucket table before
+// being hashed. The function isn't stored in the file and the same one has to
+// be given every time the map is opened.
+func WithHash(hash func([]byte) uint32) HashMapOption {
+	return func(c *hashMapConfig) {
+		c.hash = hash
+	}
+}
+
+// WithFanOut sets the number of buckets of each table, HashMapN by default.
+// It is stored in the map when it is created and ignored when opening an
+// existing one.
+func WithFanOut(n int) HashMapOption {
+	return func(c *hashMapConfig) {
+		c.fanOut = n
+	}
+}
+
+// WithOrderedIndex keeps a list of the keys sorted alongside the buckets, so
+// that RangePrefix can be used. It makes inserting and deleting keys linear
+// in the size of the map, and is only used when creating the map.
+func WithOrderedIndex() HashMapOption {
+	return func(c *hashMapConfig) {
+		c.ordered = true
+	}
+}
+
+// WithInsertionOrder keeps a list of the keys in the order they were first
+// stored, so that Range iterates in that order rather than in hash order.
+// Storing a new key appends it to the list, but deleting one is linear in
+// the size of the map. Like WithOrderedIndex, it is only used when creating
+// the map.
+func WithInsertionOrder() HashMapOption {
+	return func(c *hashMapConfig) {
+		c.insertionOrder = true
+	}
+}
+
+// WithTableResize doubles the head bucket table, rehashing every entry, once
+// the map holds more than half the list threshold of entries per head
+// bucket. Without it, lists overflow into nested tables, which cost a chunk
+// read per level on every operation. Lists can still overflow in a grown
+// table. Like WithOrderedIndex, it is only used when creating the map.
+func WithTableResize() HashMapOption {
+	return func(c *hashMapConfig) {
+		c.resize = true
+	}
+}
+
+// CollisionStrategy is how a map handles the keys hashing to the same bucket,
+// trading the chunks written on stores for the chunks read on lookups.
+type CollisionStrategy uint8
+
+const (
+	// CollisionNest keeps the keys of a bucket in a list, which overflows
+	// into a nested table once it holds the list threshold of entries.
+	CollisionNest CollisionStrategy = iota
+	// CollisionChain keeps the keys of a bucket in a list that never
+	// overflows. No table is written when a list fills up, but lookups walk
+	// the whole list. It is best used along with WithTableResize.
+	CollisionChain
+	// CollisionTwoChoice hashes every key to two buckets of a table and adds
+	// new keys to the shorter of the two lists, a table only being nested
+	// once both are full. Lists are shorter and fewer tables are nested, but
+	// lookups of missing keys walk both lists.
+	CollisionTwoChoice
+	// CollisionCuckoo hashes every key to two buckets like
+	// CollisionTwoChoice, but when both lists are full, keys of one of them
+	// are moved to their other bucket to make room, a table only being
+	// nested when no room could be made. Stores of new keys read more
+	// lists, in exchange for even fewer nested tables.
+	CollisionCuckoo
+	// CollisionRobinHood probes the buckets of the table following the one
+	// a key hashes to, adding the key to the first list with room. A key
+	// probed further than an entry of a full list takes its place, the entry
+	// moving on instead, and deleting a key moves back one of the entries
+	// that probed past its list. Tables are never nested: a key reaching the
+	// probe limit is added to the last list probed, past the list threshold
+	// like with CollisionChain. It is best used along with WithTableResize.
+	CollisionRobinHood
+)
+
+// WithCollisionStrategy sets how keys hashing to the same bucket are stored,
+// CollisionNest by default. Like WithOrderedIndex, it is only used when
+// creating the map.
+func WithCollisionStrategy(s CollisionStrategy) HashMapOption {
+	return func(c *hashMapConfig) {
+		c.collision = s
+	}
+}
+
+// WithBloomFilter keeps a bloom filter sized for n keys alongside the
+// buckets, so that Load can tell most missing keys apart without reading the
+// bucket lists. Like WithOrderedIndex, it is only used when creating the map.
+func WithBloomFilter(n int) HashMapOption {
+	return func(c *hashMapConfig) {
+		c.bloomKeys = n
+	}
+}
+
+// WithPoolOptions sets the options of the pool the map is stored in.
+func WithPoolOptions(opts ...PoolOption) HashMapOption {
+	return func(c *hashMapConfig) {
+		c.poolOpts = append(c.poolOpts, opts...)
+	}
+}
+
+// WithMaxList sets how many entries a bucket list can hold before overflowing
+// into a nested table, HashMapMaxList by default. Like the fan-out, it is
+// only used when creating the map.
+func WithMaxList(n int) HashMapOption {
+	return func(c *hashMapConfig) {
+		c.maxList = n
+	}
+}
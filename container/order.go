@@ -0,0 +1,126 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The insertion order list holds a node for every key, in the order the keys
+// were first stored. Like the ordered index, each node holds its own copy of
+// the key and no value. The head and tail of the list are kept in the map
+// header, so that new keys are appended without walking the list.
+
+func (m *HashMap) writeOrderEnds() error {
+	if !m.cfg.insertionOrder {
+		return nil
+	}
+
+	b := make([]byte, 2*sizePtr)
+	binary.LittleEndian.PutUint64(b, uint64(m.orderHead))
+	binary.LittleEndian.PutUint64(b[sizePtr:], uint64(m.orderTail))
+	_, err := m.headBucketsChunk.WriteAt(b, int64(m.cfg.orderOffset()))
+
+	return err
+}
+
+func (m *HashMap) iterateOrder(fn func(node *KVNode) (bool, error)) error {
+	return m.iterateList(m.orderHead, fn)
+}
+
+func (m *HashMap) orderAppend(key []byte) error {
+	if !m.cfg.insertionOrder {
+		return nil
+	}
+
+	keyChunk, err := m.pool.AllocAndWrite(key)
+	if err != nil {
+		return err
+	}
+	node, err := NewKVNode(m.pool, keyChunk.Ptr(), 0)
+	if err != nil {
+		return err
+	}
+	node.prev = m.orderTail
+	err = node.Write()
+	if err != nil {
+		return err
+	}
+
+	if m.orderTail == 0 {
+		m.orderHead = node.Ptr()
+	} else {
+		tail, err := NewKVNodeFromChunkPtr(m.pool, m.orderTail)
+		if err != nil {
+			return err
+		}
+		tail.next = node.Ptr()
+		err = tail.Write()
+		if err != nil {
+			return err
+		}
+	}
+	m.orderTail = node.Ptr()
+
+	return m.writeOrderEnds()
+}
+
+func (m *HashMap) orderDelete(key []byte) error {
+	if !m.cfg.insertionOrder {
+		return nil
+	}
+
+	var found *KVNode
+	err := m.iterateOrder(func(node *KVNode) (bool, error) {
+		nodeKey, err := node.KeyBytes()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(nodeKey, key) {
+			found = node
+		}
+
+		return found == nil, nil
+	})
+	if err != nil || found == nil {
+		return err
+	}
+
+	ptr, keyPtr, prev := found.Ptr(), found.key, found.prev
+	if found.isHead() {
+		prev = 0
+	}
+	newHead, err := found.Delete()
+	if err != nil {
+		return err
+	}
+	m.orderHead = newHead
+	if m.orderTail == ptr {
+		m.orderTail = prev
+	}
+	err = m.writeOrderEnds()
+	if err != nil {
+		return err
+	}
+
+	return m.freeChunks(keyPtr)
+}
+
+// rangeInsertionOrder calls f on the entries in the order their keys were
+// first stored, until it returns false.
+func (m *HashMap) rangeInsertionOrder(f func(key, value []byte) bool) error {
+	return m.iterateOrder(func(node *KVNode) (bool, error) {
+		key, err := node.KeyBytes()
+		if err != nil {
+			return false, err
+		}
+		value, ok, err := m.load(key)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return true, nil
+		}
+
+		return f(key, value), nil
+	})
+}
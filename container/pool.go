@@ -1,120 +1,375 @@
 package container
 
 import (
-	"bytes"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"sort"
 	"sync"
 )
 
 type Pool struct {
 	m          *sync.RWMutex
 	f          io.ReadWriteSeeker
-	chunks     map[int64]*Chunk
+	chunks     map[int64]*Chunk // resident chunks: free ones and the cached allocated ones
+	cache      *list.List       // allocated resident chunks, most recently used first
+	cacheSize  int
+	payloads   *payloadCache
 	freeChunks map[int64]*Chunk
+	freeEnds   map[int64]*Chunk // free chunks by end position, to find the previous neighbor
+	freeSizes  []*Chunk         // free chunks sorted by cap then position, for bestFit
+	count      int
+	wasted     int64 // unused capacity of the allocated chunks
+	wasteKnown bool  // false until wasted is computed, when loaded from a checkpoint
+	checkpoint *Chunk
+	legacy     bool         // chunk headers have no CRC
+	buffer     *writeBuffer // f, or under undo, when writes are buffered
+	undo       *undoLog     // f when updates are logged
 }
 
-func NewPool(f io.ReadWriteSeeker) (*Pool, error) {
+// NewPool opens the pool stored in f. When the pool ends with a valid
+// checkpoint, only the free list is loaded, otherwise every chunk header is
+// scanned. Allocated chunks are read on demand and only the most recently
+// used ones are kept in memory.
+func NewPool(f io.ReadWriteSeeker, opts ...PoolOption) (*Pool, error) {
+	cfg := poolConfig{
+		cacheSize:   DefaultChunkCacheSize,
+		payloadSize: DefaultPayloadCacheSize,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	pool := &Pool{
 		m:          &sync.RWMutex{},
 		f:          f,
 		chunks:     map[int64]*Chunk{},
+		cache:      list.New(),
+		cacheSize:  cfg.cacheSize,
+		payloads:   newPayloadCache(cfg.payloadSize),
 		freeChunks: map[int64]*Chunk{},
+		freeEnds:   map[int64]*Chunk{},
+	}
+	if cfg.writeBuffer > 0 {
+		var err error
+		pool.buffer, err = newWriteBuffer(f, cfg.writeBuffer)
+		if err != nil {
+			return nil, err
+		}
+		pool.f = pool.buffer
+	}
+	if cfg.undoLog != nil {
+		pool.undo = newUndoLog(pool.f, cfg.undoLog)
+		pool.f = pool.undo
 	}
 
-	_, err := f.Seek(0, io.SeekStart)
+	err := pool.open()
 	if err != nil {
 		return nil, err
 	}
 
-	var pos int64
+	return pool, nil
+}
+
+// detectFormat checks whether the chunk headers of the pool are checksummed,
+// which is the case for all new pools, from the flags of the first one.
+func (p *Pool) detectFormat() error {
+	_, err := p.f.Seek(int64(sizeCap+sizeSize), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	flags := make([]byte, sizeFlags)
+	_, err = io.ReadFull(p.f, flags)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.legacy = flags[0]&chunkFlagChecksum == 0
+
+	return nil
+}
+
+// scan walks every chunk header, loading the free chunks and caching the
+// allocated ones.
+func (p *Pool) scan() error {
+	var wasted int64
+	count, err := p.walk(func(chunk *Chunk, resident bool) {
+		if !chunk.free {
+			wasted += int64(chunk.cap) - int64(chunk.size)
+		}
+		if resident {
+			return
+		}
+		p.chunks[chunk.pos] = chunk
+		if chunk.free {
+			p.addFree(chunk)
+			return
+		}
+		p.track(chunk)
+	})
+	if err != nil {
+		return err
+	}
+	p.count = count
+	p.wasted, p.wasteKnown = wasted, true
+
+	return nil
+}
+
+// walk calls fn with every chunk of the pool, in file order. Resident chunks
+// are passed as they are, the others are read from the file.
+func (p *Pool) walk(fn func(chunk *Chunk, resident bool)) (int, error) {
+	var (
+		pos   int64
+		count int
+	)
 	for {
-		chunk := &Chunk{
-			pool: pool,
+		if chunk, ok := p.chunks[pos]; ok {
+			fn(chunk, true)
+			pos = chunk.end()
+			count++
+			continue
 		}
 
-		err = chunk.readHeaderFrom(f)
+		_, err := p.f.Seek(pos, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		chunk := &Chunk{
+			pool: p,
+			pos:  pos,
+		}
+		err = chunk.readHeaderFrom(p.f)
 		if err == io.EOF {
-			break
+			return count, nil
 		}
-		chunk.pos = pos
-		pos, err = f.Seek(int64(chunk.cap), io.SeekCurrent)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
+		fn(chunk, false)
+		pos = chunk.end()
+		count++
+	}
+}
 
-		pool.chunks[chunk.pos] = chunk
-		if chunk.free {
-			pool.freeChunks[chunk.pos] = chunk
-		}
+// addFree adds c to the free lists. The cap and position of c must not
+// change until it is removed with removeFree.
+func (p *Pool) addFree(c *Chunk) {
+	if old, ok := p.freeChunks[c.pos]; ok {
+		p.removeFree(old)
 	}
+	p.freeChunks[c.pos] = c
+	p.freeEnds[c.end()] = c
 
-	return pool, nil
+	i := p.freeIndex(c.cap, c.pos)
+	p.freeSizes = append(p.freeSizes, nil)
+	copy(p.freeSizes[i+1:], p.freeSizes[i:])
+	p.freeSizes[i] = c
+}
+
+func (p *Pool) removeFree(c *Chunk) {
+	delete(p.freeChunks, c.pos)
+	delete(p.freeEnds, c.end())
+
+	i := p.freeIndex(c.cap, c.pos)
+	if i < len(p.freeSizes) && p.freeSizes[i] == c {
+		p.freeSizes = append(p.freeSizes[:i], p.freeSizes[i+1:]...)
+	}
+}
+
+// freeIndex returns the index of the first chunk of p.freeSizes with a cap
+// over capacity, or of capacity at pos or after.
+func (p *Pool) freeIndex(capacity uint64, pos int64) int {
+	return sort.Search(len(p.freeSizes), func(i int) bool {
+		c := p.freeSizes[i]
+		return c.cap > capacity || c.cap == capacity && c.pos >= pos
+	})
 }
 
 func (p *Pool) Size() int {
 	p.m.RLock()
 	defer p.m.RUnlock()
 
-	return len(p.chunks)
+	return p.count
 }
 
-func (p *Pool) Allocated() []*Chunk {
-	p.m.RLock()
-	defer p.m.RUnlock()
+type PoolStats struct {
+	Chunks     int
+	FreeChunks int
+	FreeBytes  int64
+	// WastedBytes is the capacity of the allocated chunks left unused by
+	// their payloads.
+	WastedBytes int64
+}
 
-	nn := make([]*Chunk, 0, len(p.chunks))
-	for _, n := range p.chunks {
-		if n.free {
-			continue
+// Stats returns the chunk counts and space usage of the pool. The first call
+// on a pool opened from a checkpoint scans the chunk headers.
+func (p *Pool) Stats() (PoolStats, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if !p.wasteKnown {
+		var wasted int64
+		_, err := p.walk(func(chunk *Chunk, _ bool) {
+			if !chunk.free {
+				wasted += int64(chunk.cap) - int64(chunk.size)
+			}
+		})
+		if err != nil {
+			return PoolStats{}, err
 		}
+		p.wasted, p.wasteKnown = wasted, true
+	}
 
-		nn = append(nn, n)
+	stats := PoolStats{
+		Chunks:      p.count,
+		FreeChunks:  len(p.freeChunks),
+		WastedBytes: p.wasted,
+	}
+	for _, chunk := range p.freeChunks {
+		stats.FreeBytes += int64(chunk.cap)
 	}
 
-	return nn
+	return stats, nil
+}
+
+// Allocated returns the chunks in use, scanning the pool. Chunks that aren't
+// resident aren't added to the cache.
+func (p *Pool) Allocated() ([]*Chunk, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var nn []*Chunk
+	_, err := p.walk(func(chunk *Chunk, _ bool) {
+		if chunk.free {
+			return
+		}
+
+		nn = append(nn, chunk)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nn, nil
 }
 
 func (p *Pool) Alloc(n uint32) (*Chunk, error) {
+	return p.Alloc64(uint64(n))
+}
+
+// Alloc64 is Alloc for chunks of any size. Chunks larger than MaxChunkSize
+// get a wide header, pools without checksums reject them with
+// ErrChunkTooLarge.
+func (p *Pool) Alloc64(n uint64) (*Chunk, error) {
 	p.m.Lock()
 	defer p.m.Unlock()
 
-	if len(p.freeChunks) > 0 {
-		for idx, chunk := range p.freeChunks {
-			if chunk.cap < n {
-				continue
-			}
-			chunk.size = 0
-			chunk.free = false
-			err := chunk.writeHeader()
+	return p.alloc(n)
+}
+
+func (p *Pool) alloc(n uint64) (*Chunk, error) {
+	if n > MaxChunkSize && p.legacy {
+		return nil, fmt.Errorf("%d bytes: %w", n, ErrChunkTooLarge)
+	}
+	err := p.invalidateCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if chunk := p.bestFit(n); chunk != nil {
+		p.removeFree(chunk)
+		if chunk.cap-n >= uint64(p.headerSize())+minSplitCap {
+			err = p.split(chunk, n)
 			if err != nil {
+				p.addFree(chunk)
 				return nil, err
 			}
-
-			delete(p.freeChunks, idx)
-			return chunk, nil
 		}
+		chunk.size = 0
+		chunk.free = false
+		err = chunk.writeHeader()
+		if err != nil {
+			chunk.free = true
+			p.addFree(chunk)
+			return nil, err
+		}
+		p.track(chunk)
+		p.wasted += int64(chunk.cap)
+
+		return chunk, nil
 	}
 
 	chunk := &Chunk{
 		pool: p,
 
-		cap: n,
+		cap:  n,
+		wide: n > MaxChunkSize,
 	}
-	err := chunk.initialize()
+	err = chunk.initialize()
 	if err != nil {
 		return nil, err
 	}
 
 	p.chunks[chunk.pos] = chunk
+	p.track(chunk)
+	p.count++
+	p.wasted += int64(n)
 
 	return chunk, nil
 }
 
+// minSplitCap is the smallest cap of the free chunk split off an oversized
+// chunk on allocation; smaller remainders are left in the allocated chunk.
+const minSplitCap = 16
+
+// split shrinks the free chunk c to n bytes, turning the rest of it into a new
+// free chunk. The header of the remainder is written first, so that c still
+// covers it if the second write doesn't happen.
+func (p *Pool) split(c *Chunk, n uint64) error {
+	rest, err := p.spanChunk(c.pos+int64(c.headerSize())+int64(n), c.end())
+	if err != nil {
+		return err
+	}
+	err = rest.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	oldCap := c.cap
+	c.cap = n
+	err = c.writeHeader()
+	if err != nil {
+		c.cap = oldCap
+		return err
+	}
+
+	p.chunks[rest.pos] = rest
+	p.addFree(rest)
+	p.count++
+
+	return nil
+}
+
+// bestFit returns the smallest free chunk that can hold n bytes, the first one
+// in the file among chunks of the same cap.
+func (p *Pool) bestFit(n uint64) *Chunk {
+	i := p.freeIndex(n, math.MinInt64)
+	if i == len(p.freeSizes) {
+		return nil
+	}
+
+	return p.freeSizes[i]
+}
+
 func (p *Pool) AllocAndWrite(b []byte) (*Chunk, error) {
-	chunk, err := p.Alloc(uint32(len(b)))
+	chunk, err := p.Alloc64(uint64(len(b)))
 	if err != nil {
 		return nil, err
 	}
@@ -129,12 +384,44 @@ func (p *Pool) AllocAndWrite(b []byte) (*Chunk, error) {
 }
 
 func (p *Pool) Get(ptr ChunkPtr) (*Chunk, error) {
-	p.m.RLock()
-	defer p.m.RUnlock()
+	p.m.Lock()
+	defer p.m.Unlock()
 
 	chunk, ok := p.chunks[int64(ptr)]
-	if !ok {
-		return nil, fmt.Errorf("chunk not found at 0x%x", ptr)
+	if ok {
+		p.touch(chunk)
+		return chunk, nil
+	}
+
+	chunk, err := p.loadChunk(int64(ptr))
+	if err != nil {
+		return nil, err
+	}
+	p.chunks[chunk.pos] = chunk
+	p.track(chunk)
+
+	return chunk, nil
+}
+
+// loadChunk reads the header of the allocated chunk at pos. Free chunks are
+// always resident, but pos can't be checked to be the start of a chunk.
+func (p *Pool) loadChunk(pos int64) (*Chunk, error) {
+	fileEnd, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.f.Seek(pos, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &Chunk{
+		pool: p,
+		pos:  pos,
+	}
+	err = chunk.readHeaderFrom(p.f)
+	if err != nil || pos < 0 || chunk.free || chunk.end() > fileEnd || chunk.size > chunk.cap {
+		return nil, fmt.Errorf("chunk not found at 0x%x", pos)
 	}
 
 	return chunk, nil
@@ -145,42 +432,190 @@ type ChunkPtr int64
 type Chunk struct {
 	pool *Pool
 	pos  int64
-
-	cap  uint32
-	size uint32
-	free bool
+	elem *list.Element // in pool.cache
+
+	cap    uint64
+	size   uint64
+	free   bool
+	shared bool   // the reference count follows the payload
+	refs   uint32 // of a shared chunk, 0 until read
+	wide   bool   // the header holds 64 bits cap and size
 }
 
+// The cap and size are stored on 32 bits, the high halves following the
+// flags in the header of wide chunks.
 var (
-	sizeCap  = binarySizePanic(Chunk{}.cap)
-	sizeSize = binarySizePanic(Chunk{}.size)
-	sizeFree = binarySizePanic(Chunk{}.free)
+	sizeCap   = binarySizePanic(uint32(0))
+	sizeSize  = binarySizePanic(uint32(0))
+	sizeFlags = binarySizePanic(uint8(0))
+	sizeWide  = sizeCap + sizeSize
+	sizeCRC   = binarySizePanic(uint32(0))
+)
+
+// Chunk header flags. Legacy pools only use chunkFlagFree and
+// chunkFlagShared, and have no CRC after the flags.
+const (
+	chunkFlagFree     = 1 << 0
+	chunkFlagChecksum = 1 << 1
+	chunkFlagShared   = 1 << 2
+	chunkFlagWide     = 1 << 3
 )
 
-func (Chunk) headerSize() int {
-	return sizeCap + sizeSize + sizeFree
+var ErrCorruptChunk = errors.New("corrupt chunk header")
+
+// MaxChunkSize is the largest payload of a chunk with a 32 bits cap and size.
+// Larger chunks get a wide header, which legacy pools don't support.
+const MaxChunkSize = math.MaxUint32
+
+// ErrChunkTooLarge is returned when writing more than MaxChunkSize bytes to a
+// chunk of a legacy pool, or to a chunk that isn't wide.
+var ErrChunkTooLarge = errors.New("chunk payload too large")
+
+func (c Chunk) headerSize() int {
+	if c.wide {
+		return c.pool.headerSize() + sizeWide
+	}
+
+	return c.pool.headerSize()
+}
+
+// spanChunk returns a free chunk covering the bytes from pos to end, which is
+// wide when they don't fit in the cap of a chunk that isn't.
+func (p *Pool) spanChunk(pos, end int64) (*Chunk, error) {
+	c := &Chunk{
+		pool: p,
+		pos:  pos,
+		free: true,
+	}
+	if end-pos-int64(c.headerSize()) > MaxChunkSize {
+		if p.legacy {
+			return nil, fmt.Errorf("%d bytes: %w", end-pos, ErrChunkTooLarge)
+		}
+		c.wide = true
+	}
+	c.cap = uint64(end - pos - int64(c.headerSize()))
+
+	return c, nil
+}
+
+func (p *Pool) headerSize() int {
+	size := sizeCap + sizeSize + sizeFlags
+	if !p.legacy {
+		size += sizeCRC
+	}
+
+	return size
 }
 
 func (c Chunk) Ptr() ChunkPtr {
 	return ChunkPtr(c.pos)
 }
 
+func (c Chunk) end() int64 {
+	return c.pos + int64(c.headerSize()) + int64(c.cap)
+}
+
+// Free frees the chunk, or drops one of its references when it was shared with
+// Retain.
 func (c *Chunk) Free() error {
 	c.pool.m.Lock()
 	defer c.pool.m.Unlock()
 
-	return c.freeChunk()
+	err := c.pool.resident(c)
+	if err != nil {
+		return err
+	}
+
+	return c.release()
 }
 
 func (c *Chunk) freeChunk() error {
+	err := c.pool.invalidateCheckpoint()
+	if err != nil {
+		return err
+	}
+	c.pool.payloads.drop(c.pos)
+	wasted := int64(c.cap) - int64(c.size)
+	c.shared, c.refs = false, 0
+
+	first, last := c.pool.freeNeighbors(c)
+	if first != c || last != c {
+		err = c.pool.merge(first, c, last)
+		if err != nil {
+			return err
+		}
+		c.pool.untrack(c)
+		c.pool.wasted -= wasted
+
+		return nil
+	}
+
 	c.free = true
-	err := c.writeHeader()
+	err = c.writeHeader()
 	if err != nil {
 		c.free = false
 		return err
 	}
 
-	c.pool.freeChunks[c.pos] = c
+	c.pool.untrack(c)
+	c.pool.addFree(c)
+	c.pool.wasted -= wasted
+
+	return nil
+}
+
+// freeNeighbors returns the free chunks physically before and after c, or c
+// itself when there are none or merging them would overflow the cap of the
+// first one.
+func (p *Pool) freeNeighbors(c *Chunk) (first, last *Chunk) {
+	first, last = c, c
+
+	if prev, ok := p.freeEnds[c.pos]; ok {
+		first = prev
+	}
+	if next, ok := p.freeChunks[c.end()]; ok {
+		last = next
+	}
+	if !first.wide && last.end()-first.pos-int64(first.headerSize()) > MaxChunkSize {
+		return c, c
+	}
+
+	return first, last
+}
+
+// merge turns the contiguous chunks from first to last into a single free
+// chunk starting at first. Only the header of first is written, the headers
+// of the other chunks become part of its payload.
+func (p *Pool) merge(first, c, last *Chunk) error {
+	oldCap, oldFree := first.cap, first.free
+	if oldFree {
+		p.removeFree(first)
+	}
+	first.cap = uint64(last.end() - first.pos - int64(first.headerSize()))
+	first.free = true
+	err := first.writeHeader()
+	if err != nil {
+		first.cap, first.free = oldCap, oldFree
+		if oldFree {
+			p.addFree(first)
+		}
+		return err
+	}
+
+	merged := []*Chunk{c}
+	if last != c {
+		merged = append(merged, last)
+	}
+	for _, chunk := range merged {
+		if chunk == first {
+			continue
+		}
+		p.removeFree(chunk)
+		delete(p.chunks, chunk.pos)
+		p.count--
+		chunk.free = true
+	}
+	p.addFree(first)
 
 	return nil
 }
@@ -197,26 +632,68 @@ func (c *Chunk) initialize() error {
 		return err
 	}
 
-	b := bytes.Repeat([]byte{0}, int(c.cap))
-	_, err = c.pool.f.Write(b)
+	return writeZeros(c.pool.f, c.cap)
+}
 
-	return err
+// writeZeros writes n zero bytes to w, a block at a time.
+func writeZeros(w io.Writer, n uint64) error {
+	b := make([]byte, zeroBlockSize)
+	for n > 0 {
+		if n < uint64(len(b)) {
+			b = b[:n]
+		}
+		_, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		n -= uint64(len(b))
+	}
+
+	return nil
 }
 
+const zeroBlockSize = 64 << 10
+
 func (c *Chunk) readHeaderFrom(r io.Reader) error {
-	err := binary.Read(r, binary.LittleEndian, &c.cap)
+	size := c.pool.headerSize()
+	b := make([]byte, size, size+sizeWide)
+	_, err := io.ReadFull(r, b)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &c.size)
-	if err != nil {
-		return err
-	}
+	flags := b[sizeCap+sizeSize]
+	c.free = flags&chunkFlagFree != 0
+	c.shared, c.refs = flags&chunkFlagShared != 0, 0
+	c.wide = flags&chunkFlagWide != 0
 
-	err = binary.Read(r, binary.LittleEndian, &c.free)
-	if err != nil {
-		return err
+	checksum := flags&chunkFlagChecksum != 0
+	if checksum == c.pool.legacy || c.wide && !checksum {
+		return fmt.Errorf("chunk at 0x%x: %w", c.pos, ErrCorruptChunk)
+	}
+	n := sizeCap + sizeSize + sizeFlags
+	c.cap = uint64(binary.LittleEndian.Uint32(b))
+	c.size = uint64(binary.LittleEndian.Uint32(b[sizeCap:]))
+	if c.wide {
+		b = b[:size+sizeWide]
+		_, err = io.ReadFull(r, b[size:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		c.cap |= uint64(binary.LittleEndian.Uint32(b[n:])) << 32
+		c.size |= uint64(binary.LittleEndian.Uint32(b[n+sizeCap:])) << 32
+		n += sizeWide
+	}
+	if checksum {
+		if crc32.ChecksumIEEE(b[:n]) != binary.LittleEndian.Uint32(b[n:]) {
+			return fmt.Errorf("chunk at 0x%x: %w", c.pos, ErrCorruptChunk)
+		}
+	}
+	if c.size > c.cap {
+		return fmt.Errorf("chunk at 0x%x: size %d over cap %d: %w", c.pos, c.size, c.cap, ErrCorruptChunk)
 	}
 
 	return nil
@@ -232,51 +709,108 @@ func (c *Chunk) writeHeader() error {
 }
 
 func (c *Chunk) writeHeaderTo(w io.Writer) error {
-	err := binary.Write(w, binary.LittleEndian, c.cap)
-	if err != nil {
-		return err
-	}
+	b := make([]byte, c.headerSize())
+	binary.LittleEndian.PutUint32(b, uint32(c.cap))
+	binary.LittleEndian.PutUint32(b[sizeCap:], uint32(c.size))
 
-	err = binary.Write(w, binary.LittleEndian, c.size)
-	if err != nil {
-		return err
+	var flags uint8
+	if c.free {
+		flags |= chunkFlagFree
 	}
-
-	err = binary.Write(w, binary.LittleEndian, c.free)
-	if err != nil {
-		return err
+	if c.shared {
+		flags |= chunkFlagShared
+	}
+	if !c.pool.legacy {
+		flags |= chunkFlagChecksum
+	}
+	if c.wide {
+		flags |= chunkFlagWide
+	}
+	b[sizeCap+sizeSize] = flags
+	n := sizeCap + sizeSize + sizeFlags
+	if c.wide {
+		binary.LittleEndian.PutUint32(b[n:], uint32(c.cap>>32))
+		binary.LittleEndian.PutUint32(b[n+sizeCap:], uint32(c.size>>32))
+		n += sizeWide
+	}
+	if !c.pool.legacy {
+		binary.LittleEndian.PutUint32(b[n:], crc32.ChecksumIEEE(b[:n]))
 	}
 
-	return nil
+	_, err := w.Write(b)
+
+	return err
 }
 
 func (c *Chunk) Write(p []byte) (n int, err error) {
-	if len(p) > int(c.cap) {
-		return 0, errors.New("chunk too small")
-	}
-
 	c.pool.m.Lock()
 	defer c.pool.m.Unlock()
 
-	c.size = uint32(len(p))
+	err = c.pool.resident(c)
+	if err != nil {
+		return 0, err
+	}
+	if c.shared {
+		return 0, ErrSharedChunk
+	}
+	if int64(len(p)) > MaxChunkSize && !c.wide {
+		return 0, fmt.Errorf("%d bytes: %w", len(p), ErrChunkTooLarge)
+	}
+	if uint64(len(p)) > c.cap {
+		return 0, errors.New("chunk too small")
+	}
+
+	c.pool.wasted += int64(c.size) - int64(len(p))
+	c.size = uint64(len(p))
 	err = c.writeHeader()
 	if err != nil {
+		c.pool.payloads.drop(c.pos)
 		return 0, err
 	}
 
-	return c.pool.f.Write(p)
+	n, err = c.pool.f.Write(p)
+	if err != nil {
+		c.pool.payloads.drop(c.pos)
+		return n, err
+	}
+	c.pool.payloads.update(c.pos, p, 0, true)
+
+	return n, nil
 }
 
+// WriteAt writes p at off in the payload, growing it when it ends past its
+// size. The bytes between the former end of the payload and off are zeroed.
 func (c *Chunk) WriteAt(p []byte, off int64) (n int, err error) {
-	if int(off)+len(p) > int(c.cap) {
-		return 0, errors.New("chunk too small")
-	}
-
 	c.pool.m.Lock()
 	defer c.pool.m.Unlock()
 
-	if int(off)+len(p) > int(c.size) {
-		c.size = uint32(len(p)) + uint32(off)
+	err = c.pool.resident(c)
+	if err != nil {
+		return 0, err
+	}
+	if c.shared {
+		return 0, ErrSharedChunk
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	if end > MaxChunkSize && !c.wide {
+		return 0, fmt.Errorf("%d bytes: %w", end, ErrChunkTooLarge)
+	}
+	if end > int64(c.cap) {
+		return 0, errors.New("chunk too small")
+	}
+	written := len(p)
+	if gap := off - int64(c.size); gap > 0 {
+		// the space past the payload holds whatever was there before
+		p = append(make([]byte, gap, gap+int64(len(p))), p...)
+		off = int64(c.size)
+	}
+
+	if end > int64(c.size) {
+		c.pool.wasted -= end - int64(c.size)
+		c.size = uint64(end)
 		err = c.writeHeader()
 		if err != nil {
 			return 0, err
@@ -287,44 +821,154 @@ func (c *Chunk) WriteAt(p []byte, off int64) (n int, err error) {
 	if err != nil {
 		return 0, err
 	}
+	n, err = c.pool.f.Write(p)
+	if n -= len(p) - written; n < 0 {
+		n = 0
+	}
+	if err != nil {
+		c.pool.payloads.drop(c.pos)
+		return n, err
+	}
+	c.pool.payloads.update(c.pos, p, off, false)
 
-	return c.pool.f.Write(p)
+	return n, nil
 }
 
 func (c *Chunk) Read(p []byte) (n int, err error) {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	err = c.pool.resident(c)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.read(p)
+}
+
+func (c *Chunk) read(p []byte) (n int, err error) {
 	if len(p) > int(c.size) {
 		p = p[:c.size]
 	}
-
-	c.pool.m.RLock()
-	defer c.pool.m.RUnlock()
+	if len(p) == 0 {
+		// the file can report io.EOF for an empty read past its end
+		return 0, nil
+	}
+	if cached, ok := c.pool.payloads.get(c.pos); ok {
+		return copy(p, cached), nil
+	}
 
 	_, err = c.pool.f.Seek(c.pos+int64(c.headerSize()), io.SeekStart)
 	if err != nil {
 		return 0, err
 	}
+	n, err = c.pool.f.Read(p)
+	if err == nil && n == int(c.size) {
+		c.pool.payloads.put(c.pos, append([]byte{}, p...))
+	}
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes of the payload starting at off, returning io.EOF
+// when it ends before.
+func (c *Chunk) ReadAt(p []byte, off int64) (n int, err error) {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	err = c.pool.resident(c)
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 || off >= int64(c.size) {
+		return 0, io.EOF
+	}
+	short := off+int64(len(p)) > int64(c.size)
+	if short {
+		p = p[:int64(c.size)-off]
+	}
+	if cached, ok := c.pool.payloads.get(c.pos); ok {
+		n = copy(p, cached[off:])
+		if short {
+			err = io.EOF
+		}
+
+		return n, err
+	}
+
+	_, err = c.pool.f.Seek(c.pos+int64(c.headerSize())+off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err = io.ReadFull(c.pool.f, p)
+	if err == nil && short {
+		err = io.EOF
+	}
 
-	return c.pool.f.Read(p)
+	return n, err
 }
 
 func (c *Chunk) ReadAll() ([]byte, error) {
-	b := make([]byte, c.size)
+	return c.ReadInto(nil)
+}
 
-	_, err := c.Read(b)
+// ReadInto reads the payload into buf, reusing its capacity when it is large
+// enough, and returns buf resliced to the payload.
+func (c *Chunk) ReadInto(buf []byte) ([]byte, error) {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
 
-	return b, err
+	err := c.pool.resident(c)
+	if err != nil {
+		return nil, err
+	}
+	if cap(buf) < int(c.size) {
+		buf = make([]byte, c.size)
+	}
+	buf = buf[:c.size]
+
+	_, err = c.read(buf)
+
+	return buf, err
 }
 
+// Size returns the size of the chunk payload. If the chunk was evicted and
+// its header can't be read back, the last known size is returned. Sizes of
+// wide chunks are capped to MaxChunkSize, Size64 returns them whole.
 func (c *Chunk) Size() uint32 {
-	c.pool.m.RLock()
-	defer c.pool.m.RUnlock()
+	return capped(c.Size64())
+}
+
+// Size64 is Size for chunks of any size.
+func (c *Chunk) Size64() uint64 {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	_ = c.pool.resident(c)
 
 	return c.size
 }
 
+// Cap returns the capacity of the chunk payload, capped to MaxChunkSize for
+// wide chunks. Cap64 returns it whole.
 func (c *Chunk) Cap() uint32 {
-	c.pool.m.RLock()
-	defer c.pool.m.RUnlock()
+	return capped(c.Cap64())
+}
+
+// Cap64 is Cap for chunks of any size.
+func (c *Chunk) Cap64() uint64 {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	_ = c.pool.resident(c)
 
 	return c.cap
 }
+
+func capped(n uint64) uint32 {
+	if n > MaxChunkSize {
+		return MaxChunkSize
+	}
+
+	return uint32(n)
+}
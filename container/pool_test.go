@@ -2,8 +2,13 @@ package container_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/yazgazan/kvstore/container"
@@ -18,7 +23,11 @@ func TestPool(t *testing.T) {
 		return
 	}
 
-	chunks := pool.Allocated()
+	chunks, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("NewPool(nil).Allocated(): unexpected error: %v", err)
+		return
+	}
 	if len(chunks) != 0 {
 		t.Errorf("len(NewPool(nil).Allocated()) = %d, expected 0", len(chunks))
 		return
@@ -61,7 +70,11 @@ func TestPool(t *testing.T) {
 		return
 	}
 
-	chunks = pool.Allocated()
+	chunks, err = pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
 	if len(chunks) != 1 {
 		t.Errorf("len(pool.Nodes()) = %d, expected %d", len(chunks), 1)
 		return
@@ -84,6 +97,1520 @@ func TestPool(t *testing.T) {
 	}
 }
 
+func TestPoolCoalesce(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	chunks := make([]*container.Chunk, 5)
+	for i := range chunks {
+		chunks[i], err = pool.Alloc(16)
+		if err != nil {
+			t.Errorf("pool.Alloc(16): unexpected error: %v", err)
+			return
+		}
+	}
+	headerSize := uint32(len(buf.(*readWriteSeeker).b)/len(chunks) - 16)
+
+	for _, i := range []int{1, 3, 2} {
+		err = chunks[i].Free()
+		if err != nil {
+			t.Errorf("chunks[%d].Free(): unexpected error: %v", i, err)
+			return
+		}
+	}
+	if pool.Size() != 3 {
+		t.Errorf("pool.Size() = %d after freeing contiguous chunks, expected 3", pool.Size())
+		return
+	}
+
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	if pool.Size() != 3 {
+		t.Errorf("pool.Size() = %d after reopening, expected 3", pool.Size())
+		return
+	}
+
+	n := 3*16 + 2*headerSize
+	chunk, err := pool.Alloc(n)
+	if err != nil {
+		t.Errorf("pool.Alloc(%d): unexpected error: %v", n, err)
+		return
+	}
+	if chunk.Ptr() != chunks[1].Ptr() {
+		t.Errorf("pool.Alloc(%d).Ptr() = 0x%x, expected 0x%x", n, chunk.Ptr(), chunks[1].Ptr())
+	}
+	if chunk.Cap() != n {
+		t.Errorf("pool.Alloc(%d).Cap() = %d, expected %d", n, chunk.Cap(), n)
+	}
+	if pool.Size() != 3 {
+		t.Errorf("pool.Size() = %d after reusing merged chunk, expected 3", pool.Size())
+	}
+}
+
+func TestPoolBestFit(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	caps := []uint32{256, 1, 32, 1, 64, 1, 16, 1}
+	chunks := make([]*container.Chunk, len(caps))
+	for i, n := range caps {
+		chunks[i], err = pool.Alloc(n)
+		if err != nil {
+			t.Errorf("pool.Alloc(%d): unexpected error: %v", n, err)
+			return
+		}
+	}
+	// freeing every other chunk keeps them from being coalesced
+	for i := 0; i < len(chunks); i += 2 {
+		err = chunks[i].Free()
+		if err != nil {
+			t.Errorf("chunks[%d].Free(): unexpected error: %v", i, err)
+			return
+		}
+	}
+
+	for _, tc := range []struct {
+		n        uint32
+		expected int
+	}{
+		{n: 20, expected: 2},
+		{n: 10, expected: 6},
+		{n: 40, expected: 4},
+		{n: 20, expected: 0},
+	} {
+		chunk, err := pool.Alloc(tc.n)
+		if err != nil {
+			t.Errorf("pool.Alloc(%d): unexpected error: %v", tc.n, err)
+			return
+		}
+		if chunk.Ptr() != chunks[tc.expected].Ptr() {
+			t.Errorf("pool.Alloc(%d).Ptr() = 0x%x, expected the chunk of cap %d at 0x%x", tc.n, chunk.Ptr(), caps[tc.expected], chunks[tc.expected].Ptr())
+		}
+	}
+}
+
+func TestPoolSplit(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	big, err := pool.Alloc(256)
+	if err != nil {
+		t.Errorf("pool.Alloc(256): unexpected error: %v", err)
+		return
+	}
+	headerSize := int64(len(buf.(*readWriteSeeker).b) - 256)
+	_, err = pool.Alloc(1)
+	if err != nil {
+		t.Errorf("pool.Alloc(1): unexpected error: %v", err)
+		return
+	}
+	err = big.Free()
+	if err != nil {
+		t.Errorf("big.Free(): unexpected error: %v", err)
+		return
+	}
+
+	chunk, err := pool.Alloc(32)
+	if err != nil {
+		t.Errorf("pool.Alloc(32): unexpected error: %v", err)
+		return
+	}
+	if chunk.Ptr() != big.Ptr() || chunk.Cap() != 32 {
+		t.Errorf("pool.Alloc(32) = {Ptr: 0x%x, Cap: %d}, expected {Ptr: 0x%x, Cap: 32}", chunk.Ptr(), chunk.Cap(), big.Ptr())
+	}
+	if pool.Size() != 3 {
+		t.Errorf("pool.Size() = %d after splitting a chunk, expected 3", pool.Size())
+	}
+
+	n := uint32(256 - 32 - headerSize)
+	rest, err := pool.Alloc(n)
+	if err != nil {
+		t.Errorf("pool.Alloc(%d): unexpected error: %v", n, err)
+		return
+	}
+	expected := big.Ptr() + container.ChunkPtr(headerSize+32)
+	if rest.Ptr() != expected {
+		t.Errorf("pool.Alloc(%d).Ptr() = 0x%x, expected 0x%x", n, rest.Ptr(), expected)
+	}
+	if pool.Size() != 3 {
+		t.Errorf("pool.Size() = %d after reusing the remainder, expected 3", pool.Size())
+	}
+
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(allocated) != 3 {
+		t.Errorf("len(pool.Allocated()) = %d after reopening, expected 3", len(allocated))
+	}
+}
+
+func TestPoolCheckpoint(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	chunks := make([]*container.Chunk, 50)
+	for i := range chunks {
+		chunks[i], err = pool.AllocAndWrite([]byte(fmt.Sprintf("chunk %d", i)))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+	}
+	for _, i := range []int{10, 20, 21} {
+		err = chunks[i].Free()
+		if err != nil {
+			t.Errorf("chunks[%d].Free(): unexpected error: %v", i, err)
+			return
+		}
+	}
+	err = pool.Checkpoint()
+	if err != nil {
+		t.Errorf("pool.Checkpoint(): unexpected error: %v", err)
+		return
+	}
+	size := pool.Size()
+
+	counter := &readCounter{ReadWriteSeeker: buf}
+	pool, err = container.NewPool(counter)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	if counter.reads >= len(chunks) {
+		t.Errorf("NewPool(...) read %d times from a checkpointed pool of %d chunks", counter.reads, len(chunks))
+	}
+	if pool.Size() != size {
+		t.Errorf("pool.Size() = %d after loading the checkpoint, expected %d", pool.Size(), size)
+	}
+
+	chunk, err := pool.Get(chunks[30].Ptr())
+	if err != nil {
+		t.Errorf("pool.Get(0x%x): unexpected error: %v", chunks[30].Ptr(), err)
+		return
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		t.Errorf("chunk.ReadAll(): unexpected error: %v", err)
+		return
+	}
+	if string(b) != "chunk 30" {
+		t.Errorf("chunk.ReadAll() = %q, expected %q", b, "chunk 30")
+	}
+
+	chunk, err = pool.Alloc(8)
+	if err != nil {
+		t.Errorf("pool.Alloc(8): unexpected error: %v", err)
+		return
+	}
+	if chunk.Ptr() != chunks[10].Ptr() {
+		t.Errorf("pool.Alloc(8).Ptr() = 0x%x, expected the free chunk at 0x%x", chunk.Ptr(), chunks[10].Ptr())
+	}
+
+	// the checkpoint is stale now, opening falls back to a full scan
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(allocated) != len(chunks)-2 {
+		t.Errorf("len(pool.Allocated()) = %d, expected %d", len(allocated), len(chunks)-2)
+	}
+}
+
+func TestPoolChunkCache(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf, container.WithChunkCache(2))
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	chunks := make([]*container.Chunk, 10)
+	for i := range chunks {
+		chunks[i], err = pool.Alloc(16)
+		if err != nil {
+			t.Errorf("pool.Alloc(16): unexpected error: %v", err)
+			return
+		}
+		_, err = chunks[i].Write([]byte(fmt.Sprintf("chunk %d", i)))
+		if err != nil {
+			t.Errorf("chunks[%d].Write(...): unexpected error: %v", i, err)
+			return
+		}
+	}
+
+	for i, chunk := range chunks {
+		other, err := pool.Get(chunk.Ptr())
+		if err != nil {
+			t.Errorf("pool.Get(0x%x): unexpected error: %v", chunk.Ptr(), err)
+			return
+		}
+		_, err = other.Write([]byte(fmt.Sprintf("updated %d", i)))
+		if err != nil {
+			t.Errorf("pool.Get(0x%x).Write(...): unexpected error: %v", chunk.Ptr(), err)
+			return
+		}
+	}
+	for i, chunk := range chunks {
+		expected := fmt.Sprintf("updated %d", i)
+		b, err := chunk.ReadAll()
+		if err != nil {
+			t.Errorf("chunks[%d].ReadAll(): unexpected error: %v", i, err)
+			return
+		}
+		if string(b) != expected {
+			t.Errorf("chunks[%d].ReadAll() = %q, expected %q", i, b, expected)
+		}
+	}
+
+	pool, err = container.NewPool(buf, container.WithChunkCache(2))
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(allocated) != len(chunks) {
+		t.Errorf("len(pool.Allocated()) = %d, expected %d", len(allocated), len(chunks))
+	}
+	for _, chunk := range allocated {
+		if chunk.Size() != uint32(len("updated 0")) {
+			t.Errorf("chunk.Size() = %d for chunk at 0x%x, expected %d", chunk.Size(), chunk.Ptr(), len("updated 0"))
+		}
+	}
+}
+
+func TestPoolPayloadCache(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+	counter := &readCounter{ReadWriteSeeker: buf}
+
+	pool, err := container.NewPool(counter, container.WithPayloadCache(16))
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	chunks := make([]*container.Chunk, 3)
+	for i := range chunks {
+		chunks[i], err = pool.Alloc(16)
+		if err != nil {
+			t.Errorf("pool.Alloc(16): unexpected error: %v", err)
+			return
+		}
+		_, err = chunks[i].Write([]byte(fmt.Sprintf("chunk %d", i)))
+		if err != nil {
+			t.Errorf("chunks[%d].Write(...): unexpected error: %v", i, err)
+			return
+		}
+	}
+
+	readAll := func(i int, expected string, reads int) bool {
+		before := counter.reads
+		b, err := chunks[i].ReadAll()
+		if err != nil {
+			t.Errorf("chunks[%d].ReadAll(): unexpected error: %v", i, err)
+			return false
+		}
+		if string(b) != expected {
+			t.Errorf("chunks[%d].ReadAll() = %q, expected %q", i, b, expected)
+		}
+		if counter.reads-before != reads {
+			t.Errorf("chunks[%d].ReadAll() read %d times from the file, expected %d", i, counter.reads-before, reads)
+		}
+
+		return true
+	}
+
+	if !readAll(0, "chunk 0", 1) || !readAll(0, "chunk 0", 0) {
+		return
+	}
+
+	_, err = chunks[0].WriteAt([]byte("C"), 0)
+	if err != nil {
+		t.Errorf("chunks[0].WriteAt(...): unexpected error: %v", err)
+		return
+	}
+	_, err = chunks[0].WriteAt([]byte("!"), 7)
+	if err != nil {
+		t.Errorf("chunks[0].WriteAt(...): unexpected error: %v", err)
+		return
+	}
+	if !readAll(0, "Chunk 0!", 0) {
+		return
+	}
+	b := make([]byte, 4)
+	n, err := chunks[0].ReadAt(b, 5)
+	if err != io.EOF || string(b[:n]) != " 0!" {
+		t.Errorf("chunks[0].ReadAt(b, 5) = %q, %v, expected %q, EOF", b[:n], err, " 0!")
+	}
+
+	// the cache holds 16 bytes, reading two other chunks evicts the first one
+	if !readAll(1, "chunk 1", 1) || !readAll(2, "chunk 2", 1) || !readAll(0, "Chunk 0!", 1) {
+		return
+	}
+
+	_, err = chunks[0].Write([]byte("new"))
+	if err != nil {
+		t.Errorf("chunks[0].Write(...): unexpected error: %v", err)
+		return
+	}
+	if !readAll(0, "new", 0) {
+		return
+	}
+
+	err = chunks[0].Free()
+	if err != nil {
+		t.Errorf("chunks[0].Free(): unexpected error: %v", err)
+		return
+	}
+	chunks[0], err = pool.Alloc(4)
+	if err != nil {
+		t.Errorf("pool.Alloc(4): unexpected error: %v", err)
+		return
+	}
+	// the stale payload isn't served, and an empty one isn't read at all
+	if !readAll(0, "", 0) {
+		return
+	}
+
+	pool, err = container.NewPool(counter, container.WithPayloadCache(0))
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunks[1], err = pool.Get(chunks[1].Ptr())
+	if err != nil {
+		t.Errorf("pool.Get(0x%x): unexpected error: %v", chunks[1].Ptr(), err)
+		return
+	}
+	if !readAll(1, "chunk 1", 1) || !readAll(1, "chunk 1", 1) {
+		return
+	}
+}
+
+func TestChunkReadInto(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	chunk, err := pool.AllocAndWrite([]byte("payload"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+
+	scratch := make([]byte, 3, 16)
+	b, err := chunk.ReadInto(scratch)
+	if err != nil {
+		t.Errorf("chunk.ReadInto(...): unexpected error: %v", err)
+		return
+	}
+	if string(b) != "payload" {
+		t.Errorf("chunk.ReadInto(...) = %q, expected %q", b, "payload")
+	}
+	if &b[0] != &scratch[0] {
+		t.Errorf("chunk.ReadInto(...) allocated a new slice, expected the buffer to be reused")
+	}
+
+	b, err = chunk.ReadInto(make([]byte, 0, 4))
+	if err != nil {
+		t.Errorf("chunk.ReadInto(...): unexpected error: %v", err)
+		return
+	}
+	if string(b) != "payload" {
+		t.Errorf("chunk.ReadInto(...) with a small buffer = %q, expected %q", b, "payload")
+	}
+}
+
+func TestPoolChunkTooLarge(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	chunk, err := pool.Alloc(8)
+	if err != nil {
+		t.Errorf("pool.Alloc(8): unexpected error: %v", err)
+		return
+	}
+
+	_, err = chunk.WriteAt([]byte("x"), container.MaxChunkSize)
+	if !errors.Is(err, container.ErrChunkTooLarge) {
+		t.Errorf("chunk.WriteAt(..., MaxChunkSize) = %v, expected %v", err, container.ErrChunkTooLarge)
+	}
+	_, err = chunk.WriteAt([]byte("x"), -1)
+	if err == nil {
+		t.Errorf("chunk.WriteAt(..., -1): expected error, got nil")
+	}
+	_, err = chunk.WriteAt([]byte("x"), 8)
+	if err == nil {
+		t.Errorf("chunk.WriteAt(..., 8) past the cap: expected error, got nil")
+	}
+	if chunk.Size() != 0 {
+		t.Errorf("chunk.Size() = %d after failed writes, expected 0", chunk.Size())
+	}
+
+	// legacy pools have no wide chunk headers
+	legacy, err := container.NewPool(newReadWriteSeeker([]byte{3, 0, 0, 0, 3, 0, 0, 0, 0, 'f', 'o', 'o'}))
+	if err != nil {
+		t.Errorf("NewPool(legacy): unexpected error: %v", err)
+		return
+	}
+	_, err = legacy.Alloc64(container.MaxChunkSize + 1)
+	if !errors.Is(err, container.ErrChunkTooLarge) {
+		t.Errorf("legacy.Alloc64(MaxChunkSize+1) = %v, expected %v", err, container.ErrChunkTooLarge)
+	}
+	if legacy.Size() != 1 {
+		t.Errorf("legacy.Size() = %d after a failed allocation, expected 1", legacy.Size())
+	}
+}
+
+// wideChunkHeader returns the header of a chunk with a 64 bits cap and size.
+func wideChunkHeader(capacity, size uint64, free bool) []byte {
+	b := make([]byte, 21)
+	binary.LittleEndian.PutUint32(b, uint32(capacity))
+	binary.LittleEndian.PutUint32(b[4:], uint32(size))
+	b[8] = 1<<1 | 1<<3
+	if free {
+		b[8] |= 1 << 0
+	}
+	binary.LittleEndian.PutUint32(b[9:], uint32(capacity>>32))
+	binary.LittleEndian.PutUint32(b[13:], uint32(size>>32))
+	binary.LittleEndian.PutUint32(b[17:], crc32.ChecksumIEEE(b[:17]))
+
+	return b
+}
+
+func TestPoolWideChunk(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	_, err = pool.AllocAndWrite([]byte("foo"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	rws := buf.(*readWriteSeeker)
+	ptr := container.ChunkPtr(len(rws.b))
+	rws.b = append(rws.b, wideChunkHeader(5, 3, false)...)
+	rws.b = append(rws.b, "bar\x00\x00"...)
+
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunk, err := pool.Get(ptr)
+	if err != nil {
+		t.Errorf("pool.Get(0x%x): unexpected error: %v", ptr, err)
+		return
+	}
+	b, err := chunk.ReadAll()
+	if err != nil || string(b) != "bar" || chunk.Cap() != 5 {
+		t.Errorf("wide chunk = %q (cap %d), %v, expected %q (cap 5)", b, chunk.Cap(), err, "bar")
+	}
+	_, err = chunk.Write([]byte("barbaz"))
+	if err == nil {
+		t.Errorf("chunk.Write(...) past the cap: expected error, got nil")
+	}
+	_, err = chunk.Write([]byte("ba"))
+	if err != nil {
+		t.Errorf("chunk.Write(...): unexpected error: %v", err)
+		return
+	}
+
+	// the wide header is kept when the chunk is rewritten, freed and reused
+	err = chunk.Free()
+	if err != nil {
+		t.Errorf("chunk.Free(): unexpected error: %v", err)
+		return
+	}
+	err = pool.Checkpoint()
+	if err != nil {
+		t.Errorf("pool.Checkpoint(): unexpected error: %v", err)
+		return
+	}
+	if size := container.ChunkPtr(len(rws.b)); size != ptr+21+5 {
+		t.Errorf("pool is %d bytes after a checkpoint with a wide free chunk, expected it to be skipped", size)
+	}
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunk, err = pool.AllocAndWrite([]byte("baz"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	if chunk.Ptr() != ptr || chunk.Cap() != 5 {
+		t.Errorf("pool.AllocAndWrite(...) = 0x%x (cap %d), expected the wide free chunk at 0x%x", chunk.Ptr(), chunk.Cap(), ptr)
+	}
+	problems, err := pool.Verify()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("pool.Verify() = %v, %v, expected no problems", problems, err)
+	}
+
+	// the high halves of the cap and size are read back
+	rws.b = append(rws.b, wideChunkHeader(1<<32+5, 0, true)...)
+	problems, err = pool.Verify()
+	if err != nil {
+		t.Errorf("pool.Verify(): unexpected error: %v", err)
+		return
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Err.Error(), "cap 4294967301") {
+		t.Errorf("pool.Verify() = %v, expected a chunk of cap 4294967301 ending past the file", problems)
+	}
+}
+
+func TestPoolRealloc(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+
+	chunks := make([]*container.Chunk, 4)
+	for i := range chunks {
+		chunks[i], err = pool.AllocAndWrite([]byte(fmt.Sprintf("chunk %d", i)))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+	}
+	err = chunks[1].Free()
+	if err != nil {
+		t.Errorf("chunks[1].Free(): unexpected error: %v", err)
+		return
+	}
+
+	for _, tc := range []struct {
+		name   string
+		idx    int
+		cap    uint32
+		moved  bool
+		chunks int
+	}{
+		{name: "last chunk", idx: 3, cap: 64, chunks: 4},
+		{name: "free neighbor", idx: 0, cap: 10, chunks: 3},
+		{name: "moved", idx: 2, cap: 100, moved: true, chunks: 4},
+	} {
+		chunk, err := chunks[tc.idx].Realloc(tc.cap)
+		if err != nil {
+			t.Errorf("%s: Realloc(%d): unexpected error: %v", tc.name, tc.cap, err)
+			return
+		}
+		if moved := chunk.Ptr() != chunks[tc.idx].Ptr(); moved != tc.moved {
+			t.Errorf("%s: Realloc(%d) moved the chunk = %v, expected %v", tc.name, tc.cap, moved, tc.moved)
+		}
+		if chunk.Cap() < tc.cap {
+			t.Errorf("%s: Realloc(%d).Cap() = %d", tc.name, tc.cap, chunk.Cap())
+		}
+		expected := fmt.Sprintf("chunk %d", tc.idx)
+		b, err := chunk.ReadAll()
+		if err != nil {
+			t.Errorf("%s: chunk.ReadAll(): unexpected error: %v", tc.name, err)
+			return
+		}
+		if string(b) != expected {
+			t.Errorf("%s: chunk.ReadAll() = %q, expected %q", tc.name, b, expected)
+		}
+		if pool.Size() != tc.chunks {
+			t.Errorf("%s: pool.Size() = %d, expected %d", tc.name, pool.Size(), tc.chunks)
+		}
+		chunks[tc.idx] = chunk
+	}
+
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(allocated) != 3 {
+		t.Errorf("len(pool.Allocated()) = %d after reopening, expected 3", len(allocated))
+	}
+}
+
+// chunkHeaderSize is the size of the cap, size, flags and CRC fields of chunks.
+const chunkHeaderSize = 4 + 4 + 1 + 4
+
+func TestPoolWriteAtGap(t *testing.T) {
+	for _, cacheSize := range []int{0, container.DefaultPayloadCacheSize} {
+		f := newReadWriteSeeker(nil)
+		pool, err := container.NewPool(f, container.WithPayloadCache(cacheSize))
+		if err != nil {
+			t.Errorf("NewPool(...): unexpected error: %v", err)
+			return
+		}
+		chunk, err := pool.AllocAndWrite([]byte("stale bytes!"))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+		_, err = chunk.Write([]byte("ab"))
+		if err != nil {
+			t.Errorf("chunk.Write(...): unexpected error: %v", err)
+			return
+		}
+		n, err := chunk.WriteAt([]byte("z"), 6)
+		if err != nil || n != 1 {
+			t.Errorf("chunk.WriteAt(%q, 6) = %d, %v, expected 1", "z", n, err)
+			return
+		}
+
+		// the bytes past the former payload are zeroed, on disk too
+		pool, err = container.NewPool(f, container.WithPayloadCache(cacheSize))
+		if err != nil {
+			t.Errorf("NewPool(...): unexpected error: %v", err)
+			return
+		}
+		chunk, err = pool.Get(chunk.Ptr())
+		if err != nil {
+			t.Errorf("pool.Get(...): unexpected error: %v", err)
+			return
+		}
+		b, err := chunk.ReadAll()
+		if err != nil || string(b) != "ab\x00\x00\x00\x00z" {
+			t.Errorf("chunk.ReadAll() = %q, %v with a cache of %d bytes, expected %q", b, err, cacheSize, "ab\x00\x00\x00\x00z")
+		}
+	}
+}
+
+func TestPoolEmptyPayload(t *testing.T) {
+	// the file returns io.EOF for empty reads at its end, like block objects
+	pool, err := container.NewPool(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	_, err = pool.AllocAndWrite([]byte("value"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	chunk, err := pool.AllocAndWrite(nil)
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(nil): unexpected error: %v", err)
+		return
+	}
+	b, err := chunk.ReadAll()
+	if err != nil || len(b) != 0 {
+		t.Errorf("chunk.ReadAll() = %q, %v on an empty chunk ending the file, expected no error", b, err)
+	}
+	n, err := chunk.Read(make([]byte, 4))
+	if err != nil || n != 0 {
+		t.Errorf("chunk.Read(...) = %d, %v on an empty chunk ending the file, expected 0", n, err)
+	}
+}
+
+func TestPoolCompact(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		var buf io.ReadWriteSeeker = newReadWriteSeeker(nil)
+		if truncate {
+			buf = truncatingReadWriteSeeker{buf.(*readWriteSeeker)}
+		}
+
+		pool, err := container.NewPool(buf)
+		if err != nil {
+			t.Errorf("NewPool(nil): unexpected error: %v", err)
+			return
+		}
+
+		expected := map[container.ChunkPtr]string{}
+		var freed []*container.Chunk
+		for i := 0; i < 8; i++ {
+			payload := fmt.Sprintf("chunk %d%s", i, strings.Repeat(".", i*10))
+			chunk, err := pool.AllocAndWrite([]byte(payload))
+			if err != nil {
+				t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+				return
+			}
+			if i == 1 || i == 4 || i == 5 {
+				freed = append(freed, chunk)
+				continue
+			}
+			expected[chunk.Ptr()] = payload
+		}
+		for _, chunk := range freed {
+			err = chunk.Free()
+			if err != nil {
+				t.Errorf("chunk.Free(): unexpected error: %v", err)
+				return
+			}
+		}
+
+		err = pool.Compact(func(old, new container.ChunkPtr) error {
+			payload, ok := expected[old]
+			if !ok {
+				return fmt.Errorf("unexpected relocation of 0x%x", old)
+			}
+			delete(expected, old)
+			expected[new] = payload
+
+			return nil
+		})
+		if err != nil {
+			t.Errorf("pool.Compact(...): unexpected error: %v", err)
+			return
+		}
+
+		pool, err = container.NewPool(buf)
+		if err != nil {
+			t.Errorf("NewPool(...): unexpected error: %v", err)
+			return
+		}
+		allocated, err := pool.Allocated()
+		if err != nil {
+			t.Errorf("pool.Allocated(): unexpected error: %v", err)
+			return
+		}
+		if len(allocated) != len(expected) {
+			t.Errorf("len(pool.Allocated()) = %d after compacting, expected %d", len(allocated), len(expected))
+		}
+		var end int64
+		for ptr, payload := range expected {
+			chunk, err := pool.Get(ptr)
+			if err != nil {
+				t.Errorf("pool.Get(0x%x): unexpected error: %v", ptr, err)
+				return
+			}
+			b, err := chunk.ReadAll()
+			if err != nil {
+				t.Errorf("chunk.ReadAll(): unexpected error: %v", err)
+				return
+			}
+			if string(b) != payload {
+				t.Errorf("pool.Get(0x%x).ReadAll() = %q, expected %q", ptr, b, payload)
+			}
+			if chunkEnd := int64(ptr) + int64(len(payload)) + chunkHeaderSize; chunkEnd > end {
+				end = chunkEnd
+			}
+		}
+
+		size, err := buf.Seek(0, io.SeekEnd)
+		if err != nil {
+			t.Errorf("buf.Seek(0, io.SeekEnd): unexpected error: %v", err)
+			return
+		}
+		switch {
+		case truncate && size != end:
+			t.Errorf("pool file is %d bytes after compacting, expected %d", size, end)
+		case !truncate && pool.Size() != len(expected)+1:
+			t.Errorf("pool.Size() = %d after compacting, expected %d", pool.Size(), len(expected)+1)
+		}
+	}
+}
+
+func TestPoolWriteBuffer(t *testing.T) {
+	ops := func(pool *container.Pool) error {
+		var chunks []*container.Chunk
+		for i := 0; i < 200; i++ {
+			chunk, err := pool.AllocAndWrite([]byte(fmt.Sprintf("chunk %d%s", i, strings.Repeat(".", i%50))))
+			if err != nil {
+				return err
+			}
+			chunks = append(chunks, chunk)
+		}
+		for i, chunk := range chunks {
+			if i%3 == 0 {
+				err := chunk.Free()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := chunk.ReadAll()
+			if err != nil {
+				return err
+			}
+			if expected := fmt.Sprintf("chunk %d%s", i, strings.Repeat(".", i%50)); string(b) != expected {
+				return fmt.Errorf("chunk %d: read %q, expected %q", i, b, expected)
+			}
+			_, err = chunk.WriteAt([]byte("CHUNK"), 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return pool.Compact(func(_, _ container.ChunkPtr) error {
+			return nil
+		})
+	}
+
+	expected := truncatingReadWriteSeeker{newReadWriteSeeker(nil).(*readWriteSeeker)}
+	pool, err := container.NewPool(expected)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	err = ops(pool)
+	if err != nil {
+		t.Errorf("unbuffered: unexpected error: %v", err)
+		return
+	}
+
+	for _, size := range []int{1 << 20, 4096} {
+		buf := truncatingReadWriteSeeker{newReadWriteSeeker(nil).(*readWriteSeeker)}
+		counter := &writeCounter{truncatingReadWriteSeeker: buf}
+		pool, err := container.NewPool(counter, container.WithWriteBuffer(size))
+		if err != nil {
+			t.Errorf("NewPool(nil, WithWriteBuffer(%d)): unexpected error: %v", size, err)
+			return
+		}
+		_, err = pool.AllocAndWrite([]byte("staged"))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+		if counter.writes != 0 {
+			t.Errorf("WithWriteBuffer(%d): %d writes before Flush, expected none", size, counter.writes)
+		}
+		err = pool.Flush()
+		if err != nil {
+			t.Errorf("pool.Flush(): unexpected error: %v", err)
+			return
+		}
+		if counter.writes != 1 {
+			t.Errorf("WithWriteBuffer(%d): pool.Flush() wrote %d times, expected 1", size, counter.writes)
+		}
+
+		buf.b, buf.pos = nil, 0
+		pool, err = container.NewPool(counter, container.WithWriteBuffer(size))
+		if err != nil {
+			t.Errorf("NewPool(nil, WithWriteBuffer(%d)): unexpected error: %v", size, err)
+			return
+		}
+		err = ops(pool)
+		if err != nil {
+			t.Errorf("WithWriteBuffer(%d): unexpected error: %v", size, err)
+			return
+		}
+		err = pool.Flush()
+		if err != nil {
+			t.Errorf("pool.Flush(): unexpected error: %v", err)
+			return
+		}
+		if !bytes.Equal(buf.b, expected.b) {
+			t.Errorf("WithWriteBuffer(%d): file differs from the unbuffered one, %d bytes instead of %d", size, len(buf.b), len(expected.b))
+		}
+	}
+}
+
+type writeCounter struct {
+	truncatingReadWriteSeeker
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+
+	return w.truncatingReadWriteSeeker.Write(p)
+}
+
+type truncatingReadWriteSeeker struct {
+	*readWriteSeeker
+}
+
+func (buf truncatingReadWriteSeeker) Truncate(size int64) error {
+	buf.b = buf.b[:size]
+
+	return nil
+}
+
+func TestPoolChecksum(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	var chunks []*container.Chunk
+	for _, payload := range []string{"foo", "bar", "baz"} {
+		chunk, err := pool.AllocAndWrite([]byte(payload))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(%q): unexpected error: %v", payload, err)
+			return
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	// a torn write of the cap of the second chunk
+	b := buf.(*readWriteSeeker).b
+	b[chunks[1].Ptr()+1] ^= 0xff
+	_, err = container.NewPool(buf)
+	if !errors.Is(err, container.ErrCorruptChunk) {
+		t.Errorf("NewPool(...) = %v on a corrupt chunk header, expected %v", err, container.ErrCorruptChunk)
+	}
+	b[chunks[1].Ptr()+1] ^= 0xff
+
+	// legacy pools have 9 bytes headers with no CRC
+	legacy := newReadWriteSeeker([]byte{3, 0, 0, 0, 3, 0, 0, 0, 0, 'f', 'o', 'o'})
+	pool, err = container.NewPool(legacy)
+	if err != nil {
+		t.Errorf("NewPool(legacy): unexpected error: %v", err)
+		return
+	}
+	_, err = pool.AllocAndWrite([]byte("bar"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	if size := len(legacy.(*readWriteSeeker).b); size != 24 {
+		t.Errorf("legacy pool is %d bytes after allocating, expected 24", size)
+	}
+	pool, err = container.NewPool(legacy)
+	if err != nil {
+		t.Errorf("NewPool(legacy): unexpected error: %v", err)
+		return
+	}
+	allocated, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(allocated) != 2 {
+		t.Errorf("len(pool.Allocated()) = %d on legacy pool, expected 2", len(allocated))
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	chunk, err := pool.Alloc(16)
+	if err != nil {
+		t.Errorf("pool.Alloc(16): unexpected error: %v", err)
+		return
+	}
+	_, err = chunk.Write([]byte("foo"))
+	if err != nil {
+		t.Errorf("chunk.Write(...): unexpected error: %v", err)
+		return
+	}
+	_, err = chunk.WriteAt([]byte("bar"), 3)
+	if err != nil {
+		t.Errorf("chunk.WriteAt(...): unexpected error: %v", err)
+		return
+	}
+	other, err := pool.AllocAndWrite([]byte("baz"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	other, err = other.Realloc(8)
+	if err != nil {
+		t.Errorf("chunk.Realloc(8): unexpected error: %v", err)
+		return
+	}
+
+	stats, err := pool.Stats()
+	if err != nil {
+		t.Errorf("pool.Stats(): unexpected error: %v", err)
+		return
+	}
+	if stats.WastedBytes != 10+5 {
+		t.Errorf("stats.WastedBytes = %d, expected %d", stats.WastedBytes, 10+5)
+	}
+
+	err = chunk.Free()
+	if err != nil {
+		t.Errorf("chunk.Free(): unexpected error: %v", err)
+		return
+	}
+	// the freed chunk fits the allocation exactly, so it is reused as is
+	_, err = pool.AllocAndWrite(make([]byte, 16))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	stats, err = pool.Stats()
+	if err != nil {
+		t.Errorf("pool.Stats(): unexpected error: %v", err)
+		return
+	}
+	expected := container.PoolStats{Chunks: 2, WastedBytes: 5}
+	if stats != expected {
+		t.Errorf("pool.Stats() = %+v, expected %+v", stats, expected)
+	}
+
+	err = pool.Checkpoint()
+	if err != nil {
+		t.Errorf("pool.Checkpoint(): unexpected error: %v", err)
+		return
+	}
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	stats, err = pool.Stats()
+	if err != nil {
+		t.Errorf("pool.Stats(): unexpected error: %v", err)
+		return
+	}
+	if stats.WastedBytes != 5 {
+		t.Errorf("stats.WastedBytes = %d after loading a checkpoint, expected 5", stats.WastedBytes)
+	}
+}
+
+func TestPoolVerify(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	var chunks []*container.Chunk
+	for _, payload := range []string{"foo", "bar", "baz"} {
+		chunk, err := pool.AllocAndWrite([]byte(payload))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(%q): unexpected error: %v", payload, err)
+			return
+		}
+		chunks = append(chunks, chunk)
+	}
+	err = chunks[0].Free()
+	if err != nil {
+		t.Errorf("chunk.Free(): unexpected error: %v", err)
+		return
+	}
+
+	problems, err := pool.Verify()
+	if err != nil {
+		t.Errorf("pool.Verify(): unexpected error: %v", err)
+		return
+	}
+	if len(problems) != 0 {
+		t.Errorf("pool.Verify() = %v on a sound pool, expected no problems", problems)
+	}
+
+	b := buf.(*readWriteSeeker).b
+	b[chunks[1].Ptr()+1] ^= 0xff
+	problems, err = pool.Verify()
+	if err != nil {
+		t.Errorf("pool.Verify(): unexpected error: %v", err)
+		return
+	}
+	if len(problems) == 0 || problems[0].Pos != int64(chunks[1].Ptr()) || !errors.Is(problems[0], container.ErrCorruptChunk) {
+		t.Errorf("pool.Verify() = %v, expected a corrupt chunk at 0x%x", problems, chunks[1].Ptr())
+	}
+	b[chunks[1].Ptr()+1] ^= 0xff
+
+	buf.(*readWriteSeeker).b = append(b, 1, 2, 3)
+	problems, err = pool.Verify()
+	if err != nil {
+		t.Errorf("pool.Verify(): unexpected error: %v", err)
+		return
+	}
+	if len(problems) != 1 || problems[0].Pos != int64(len(b)) {
+		t.Errorf("pool.Verify() = %v, expected trailing bytes at 0x%x", problems, len(b))
+	}
+}
+
+func TestPoolUndoLog(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		file := newReadWriteSeeker(nil).(*readWriteSeeker)
+		var buf, log io.ReadWriteSeeker = file, newReadWriteSeeker(nil)
+		if truncate {
+			buf = truncatingReadWriteSeeker{file}
+		} else {
+			log = truncatingReadWriteSeeker{log.(*readWriteSeeker)}
+		}
+
+		pool, err := container.NewPool(buf, container.WithUndoLog(log))
+		if err != nil {
+			t.Errorf("NewPool(nil, WithUndoLog(...)): unexpected error: %v", err)
+			return
+		}
+		payloads := map[container.ChunkPtr]string{}
+		var ptrs []container.ChunkPtr
+		for i := 0; i < 100; i++ {
+			payload := fmt.Sprintf("chunk %d%s", i, strings.Repeat(".", i))
+			chunk, err := pool.AllocAndWrite([]byte(payload))
+			if err != nil {
+				t.Errorf("pool.AllocAndWrite(%q): unexpected error: %v", payload, err)
+				return
+			}
+			payloads[chunk.Ptr()] = payload
+			ptrs = append(ptrs, chunk.Ptr())
+		}
+		size := len(file.b)
+
+		update := func(pool *container.Pool) error {
+			err := pool.Begin()
+			if err != nil {
+				return err
+			}
+			for i, ptr := range ptrs {
+				chunk, err := pool.Get(ptr)
+				if err != nil {
+					return err
+				}
+				if i%2 == 0 {
+					err = chunk.Free()
+				} else {
+					_, err = chunk.WriteAt([]byte("updated"), 0)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			_, err = pool.AllocAndWrite(bytes.Repeat([]byte("new"), 5000))
+
+			return err
+		}
+		check := func(pool *container.Pool) {
+			for ptr, payload := range payloads {
+				chunk, err := pool.Get(ptr)
+				if err != nil {
+					t.Errorf("truncate=%v: pool.Get(0x%x): unexpected error: %v", truncate, ptr, err)
+					return
+				}
+				b, err := chunk.ReadAll()
+				if err != nil {
+					t.Errorf("truncate=%v: chunk.ReadAll(): unexpected error: %v", truncate, err)
+					return
+				}
+				if string(b) != payload {
+					t.Errorf("truncate=%v: chunk 0x%x = %q, expected %q", truncate, ptr, b, payload)
+					return
+				}
+			}
+			problems, err := pool.Verify()
+			if err != nil || len(problems) != 0 {
+				t.Errorf("truncate=%v: pool.Verify() = %v, %v, expected no problems", truncate, problems, err)
+			}
+			chunks, err := pool.Allocated()
+			if err != nil || len(chunks) != len(payloads) {
+				t.Errorf("truncate=%v: pool.Allocated() = %d chunks, %v, expected %d", truncate, len(chunks), err, len(payloads))
+			}
+		}
+
+		err = update(pool)
+		if err != nil {
+			t.Errorf("truncate=%v: update: unexpected error: %v", truncate, err)
+			return
+		}
+		err = pool.Rollback()
+		if err != nil {
+			t.Errorf("truncate=%v: pool.Rollback(): unexpected error: %v", truncate, err)
+			return
+		}
+		check(pool)
+
+		// the update is interrupted, the next NewPool rolls it back
+		err = update(pool)
+		if err != nil {
+			t.Errorf("truncate=%v: update: unexpected error: %v", truncate, err)
+			return
+		}
+		pool, err = container.NewPool(buf, container.WithUndoLog(log))
+		if err != nil {
+			t.Errorf("truncate=%v: NewPool(...): unexpected error: %v", truncate, err)
+			return
+		}
+		check(pool)
+		if truncate && len(file.b) != size {
+			t.Errorf("truncate=%v: file size = %d, expected %d", truncate, len(file.b), size)
+		}
+
+		err = update(pool)
+		if err != nil {
+			t.Errorf("truncate=%v: update: unexpected error: %v", truncate, err)
+			return
+		}
+		err = pool.Commit()
+		if err != nil {
+			t.Errorf("truncate=%v: pool.Commit(): unexpected error: %v", truncate, err)
+			return
+		}
+		pool, err = container.NewPool(buf, container.WithUndoLog(log))
+		if err != nil {
+			t.Errorf("truncate=%v: NewPool(...): unexpected error: %v", truncate, err)
+			return
+		}
+		chunk, err := pool.Get(ptrs[1])
+		if err != nil {
+			t.Errorf("truncate=%v: pool.Get(0x%x): unexpected error: %v", truncate, ptrs[1], err)
+			return
+		}
+		b, err := chunk.ReadAll()
+		if err != nil || !strings.HasPrefix(string(b), "updated") {
+			t.Errorf("truncate=%v: committed chunk = %q, %v, expected it to be updated", truncate, b, err)
+		}
+	}
+
+	pool, err := container.NewPool(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	err = pool.Rollback()
+	if !errors.Is(err, container.ErrNoUndoLog) {
+		t.Errorf("pool.Rollback() = %v without an undo log, expected %v", err, container.ErrNoUndoLog)
+	}
+}
+
+func TestPoolRetain(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	before, err := pool.AllocAndWrite([]byte("before"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	full, err := pool.AllocAndWrite([]byte("full"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	err = full.Retain()
+	if !errors.Is(err, container.ErrChunkFull) {
+		t.Errorf("chunk.Retain() = %v on a full chunk, expected %v", err, container.ErrChunkFull)
+	}
+	shared, err := pool.Alloc(16)
+	if err != nil {
+		t.Errorf("pool.Alloc(16): unexpected error: %v", err)
+		return
+	}
+	_, err = shared.Write([]byte("shared"))
+	if err != nil {
+		t.Errorf("chunk.Write(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		err = shared.Retain()
+		if err != nil {
+			t.Errorf("chunk.Retain(): unexpected error: %v", err)
+			return
+		}
+	}
+	_, err = shared.Write([]byte("overwritten"))
+	if !errors.Is(err, container.ErrSharedChunk) {
+		t.Errorf("chunk.Write(...) = %v on a shared chunk, expected %v", err, container.ErrSharedChunk)
+	}
+	_, err = shared.Realloc(64)
+	if !errors.Is(err, container.ErrSharedChunk) {
+		t.Errorf("chunk.Realloc(64) = %v on a shared chunk, expected %v", err, container.ErrSharedChunk)
+	}
+
+	// the count is kept when the chunk moves
+	err = before.Free()
+	if err != nil {
+		t.Errorf("chunk.Free(): unexpected error: %v", err)
+		return
+	}
+	ptr := shared.Ptr()
+	err = pool.Compact(func(old, new container.ChunkPtr) error {
+		if old == ptr {
+			ptr = new
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("pool.Compact(...): unexpected error: %v", err)
+		return
+	}
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+
+	for _, expected := range []uint32{3, 2, 1} {
+		shared, err = pool.Get(ptr)
+		if err != nil {
+			t.Errorf("pool.Get(0x%x): unexpected error: %v", ptr, err)
+			return
+		}
+		refs, err := shared.Refs()
+		if err != nil || refs != expected {
+			t.Errorf("chunk.Refs() = %d, %v, expected %d", refs, err, expected)
+			return
+		}
+		b, err := shared.ReadAll()
+		if err != nil || string(b) != "shared" {
+			t.Errorf("chunk.ReadAll() = %q, %v, expected %q", b, err, "shared")
+			return
+		}
+		problems, err := pool.Verify()
+		if err != nil || len(problems) != 0 {
+			t.Errorf("pool.Verify() = %v, %v, expected no problems", problems, err)
+		}
+		err = shared.Free()
+		if err != nil {
+			t.Errorf("chunk.Free(): unexpected error: %v", err)
+			return
+		}
+	}
+
+	chunks, err := pool.Allocated()
+	if err != nil || len(chunks) != 1 || chunks[0].Ptr() != full.Ptr() {
+		t.Errorf("pool.Allocated() = %d chunks, %v, expected only the full chunk", len(chunks), err)
+	}
+}
+
+func TestPoolVacuum(t *testing.T) {
+	file := newReadWriteSeeker(nil).(*readWriteSeeker)
+	buf := truncatingReadWriteSeeker{file}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	var chunks []*container.Chunk
+	for i := 0; i < 10; i++ {
+		chunk, err := pool.AllocAndWrite([]byte(fmt.Sprintf("chunk %d", i)))
+		if err != nil {
+			t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+			return
+		}
+		chunks = append(chunks, chunk)
+	}
+	for _, i := range []int{2, 7, 9, 8} {
+		err = chunks[i].Free()
+		if err != nil {
+			t.Errorf("chunk.Free(): unexpected error: %v", err)
+			return
+		}
+	}
+	err = pool.Checkpoint()
+	if err != nil {
+		t.Errorf("pool.Checkpoint(): unexpected error: %v", err)
+		return
+	}
+
+	size, end := int64(len(file.b)), int64(chunks[7].Ptr())
+	n, err := pool.Vacuum()
+	if err != nil {
+		t.Errorf("pool.Vacuum(): unexpected error: %v", err)
+		return
+	}
+	if n != size-end || int64(len(file.b)) != end {
+		t.Errorf("pool.Vacuum() = %d, file of %d bytes, expected %d, %d bytes", n, len(file.b), size-end, end)
+	}
+	n, err = pool.Vacuum()
+	if err != nil || n != 0 {
+		t.Errorf("pool.Vacuum() = %d, %v a second time, expected 0", n, err)
+	}
+	problems, err := pool.Verify()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("pool.Verify() = %v, %v, expected no problems", problems, err)
+	}
+	stats, err := pool.Stats()
+	if err != nil || stats.Chunks != 7 || stats.FreeChunks != 1 {
+		t.Errorf("pool.Stats() = %+v, %v, expected 7 chunks, 1 free", stats, err)
+	}
+
+	pool, err = container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	if pool.Size() != 7 {
+		t.Errorf("pool.Size() = %d after reopening, expected 7", pool.Size())
+	}
+
+	unbuf := newReadWriteSeeker(nil)
+	pool, err = container.NewPool(unbuf)
+	if err != nil {
+		t.Errorf("NewPool(nil): unexpected error: %v", err)
+		return
+	}
+	chunk, err := pool.AllocAndWrite([]byte("chunk"))
+	if err != nil {
+		t.Errorf("pool.AllocAndWrite(...): unexpected error: %v", err)
+		return
+	}
+	err = chunk.Free()
+	if err != nil {
+		t.Errorf("chunk.Free(): unexpected error: %v", err)
+		return
+	}
+	n, err = pool.Vacuum()
+	if err != nil || n != 0 {
+		t.Errorf("pool.Vacuum() = %d, %v without Truncate, expected 0", n, err)
+	}
+}
+
+type readCounter struct {
+	io.ReadWriteSeeker
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+
+	return r.ReadWriteSeeker.Read(p)
+}
+
 func jsonMustMarshal(v interface{}) []byte {
 	b, err := json.Marshal(v)
 	if err != nil {
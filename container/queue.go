@@ -0,0 +1,309 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Queue is a FIFO queue of byte slices, each item being stored in a chunk
+// linked to the next one.
+//
+// Push and Pop record the item they are working on in the header before
+// touching the list, so that an interrupted call is either completed or
+// rolled back by the next NewQueue: a popped item is never returned twice and
+// a pushed one is either fully queued or not at all. A Push interrupted
+// before it recorded its item leaks that chunk until Scavenge is called.
+type Queue struct {
+	m *sync.Mutex
+
+	pool      *Pool
+	headChunk *Chunk
+	head      ChunkPtr
+	tail      ChunkPtr
+	pending   ChunkPtr
+	count     int64
+}
+
+// The head chunk holds the queue header:
+//
+//	head     int64, the next item to pop
+//	tail     int64, the last pushed item
+//	pending  int64, the item being pushed or popped
+//	count    int64
+//	magic    [4]byte
+//
+// Items hold the next item followed by the payload:
+//
+//	next     int64
+//	payload  []byte
+var sizeQueueHeader = 3*sizePtr + sizeCount + len(queueMagic)
+
+var queueMagic = [4]byte{'k', 'v', 'q', 'u'}
+
+func NewQueue(f io.ReadWriteSeeker) (*Queue, error) {
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		m: &sync.Mutex{},
+
+		pool: pool,
+	}
+
+	if pool.Size() == 0 {
+		q.headChunk, err = pool.Alloc(uint32(sizeQueueHeader))
+		if err != nil {
+			return nil, err
+		}
+
+		return q, q.writeHead()
+	}
+
+	q.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := q.headChunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sizeQueueHeader || !bytes.Equal(b[sizeQueueHeader-len(queueMagic):], queueMagic[:]) {
+		return nil, fmt.Errorf("invalid queue header: %d bytes", len(b))
+	}
+	q.head = ChunkPtr(binary.LittleEndian.Uint64(b))
+	q.tail = ChunkPtr(binary.LittleEndian.Uint64(b[sizePtr:]))
+	q.pending = ChunkPtr(binary.LittleEndian.Uint64(b[2*sizePtr:]))
+	q.count = int64(binary.LittleEndian.Uint64(b[3*sizePtr:]))
+
+	if q.pending == 0 {
+		return q, nil
+	}
+
+	return q, q.recover()
+}
+
+func (q *Queue) writeHead() error {
+	b := make([]byte, sizeQueueHeader)
+	binary.LittleEndian.PutUint64(b, uint64(q.head))
+	binary.LittleEndian.PutUint64(b[sizePtr:], uint64(q.tail))
+	binary.LittleEndian.PutUint64(b[2*sizePtr:], uint64(q.pending))
+	binary.LittleEndian.PutUint64(b[3*sizePtr:], uint64(q.count))
+	copy(b[3*sizePtr+sizeCount:], queueMagic[:])
+
+	_, err := q.headChunk.Write(b)
+
+	return err
+}
+
+// recover completes a push interrupted after the item was linked to the
+// tail, and frees the item of any other interrupted call. The pending item
+// may have been freed and merged with its neighbors already, so the pool is
+// scanned to find it.
+func (q *Queue) recover() error {
+	chunks, err := q.pool.Allocated()
+	if err != nil {
+		return err
+	}
+	var pending *Chunk
+	for _, chunk := range chunks {
+		if chunk.Ptr() == q.pending {
+			pending = chunk
+		}
+	}
+	q.pending = 0
+
+	if pending == nil {
+		return q.writeHead()
+	}
+	if q.tail != 0 {
+		next, err := q.next(q.tail)
+		if err != nil {
+			return err
+		}
+		if next == pending.Ptr() {
+			q.tail = next
+			q.count++
+			return q.writeHead()
+		}
+	}
+
+	err = q.writeHead()
+	if err != nil {
+		return err
+	}
+
+	return pending.Free()
+}
+
+func (q *Queue) next(ptr ChunkPtr) (ChunkPtr, error) {
+	chunk, err := q.pool.Get(ptr)
+	if err != nil {
+		return 0, err
+	}
+	b := make([]byte, sizePtr)
+	_, err = chunk.ReadAt(b, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return ChunkPtr(binary.LittleEndian.Uint64(b)), nil
+}
+
+// Len returns the number of items in the queue.
+func (q *Queue) Len() int64 {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return q.count
+}
+
+// Push adds b at the end of the queue.
+func (q *Queue) Push(b []byte) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	item, err := q.pool.AllocAndWrite(append(make([]byte, sizePtr), b...))
+	if err != nil {
+		return err
+	}
+	q.pending = item.Ptr()
+	err = q.writeHead()
+	if err != nil {
+		return err
+	}
+
+	if q.tail != 0 {
+		tail, err := q.pool.Get(q.tail)
+		if err != nil {
+			return err
+		}
+		next := make([]byte, sizePtr)
+		binary.LittleEndian.PutUint64(next, uint64(item.Ptr()))
+		_, err = tail.WriteAt(next, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if q.head == 0 {
+		q.head = item.Ptr()
+	}
+	q.tail = item.Ptr()
+	q.pending = 0
+	q.count++
+
+	return q.writeHead()
+}
+
+// Peek returns the item at the front of the queue without removing it, false
+// if the queue is empty.
+func (q *Queue) Peek() ([]byte, bool, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	_, b, err := q.front()
+	if err != nil || q.head == 0 {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+func (q *Queue) front() (next ChunkPtr, payload []byte, err error) {
+	if q.head == 0 {
+		return 0, nil, nil
+	}
+
+	chunk, err := q.pool.Get(q.head)
+	if err != nil {
+		return 0, nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < sizePtr {
+		return 0, nil, fmt.Errorf("item 0x%x: expected at least %d bytes, read %d", q.head, sizePtr, len(b))
+	}
+
+	return ChunkPtr(binary.LittleEndian.Uint64(b)), b[sizePtr:], nil
+}
+
+// Pop removes the item at the front of the queue and returns it, false if the
+// queue is empty.
+func (q *Queue) Pop() ([]byte, bool, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	next, b, err := q.front()
+	if err != nil || q.head == 0 {
+		return nil, false, err
+	}
+
+	item := q.head
+	q.head = next
+	if next == 0 {
+		q.tail = 0
+	}
+	q.pending = item
+	q.count--
+	err = q.writeHead()
+	if err != nil {
+		return nil, false, err
+	}
+
+	chunk, err := q.pool.Get(item)
+	if err != nil {
+		return nil, false, err
+	}
+	err = chunk.Free()
+	if err != nil {
+		return nil, false, err
+	}
+	q.pending = 0
+
+	return b, true, q.writeHead()
+}
+
+// Scavenge frees the chunks of the pool that aren't items of the queue, like
+// the ones leaked by an interrupted Push. It returns the number of chunks
+// freed.
+func (q *Queue) Scavenge() (int, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	reachable := map[ChunkPtr]struct{}{
+		q.headChunk.Ptr(): {},
+	}
+	for ptr := q.head; ptr != 0; {
+		reachable[ptr] = struct{}{}
+		var err error
+		ptr, err = q.next(ptr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	chunks, err := q.pool.Allocated()
+	if err != nil {
+		return 0, err
+	}
+	var freed int
+	for _, chunk := range chunks {
+		if _, ok := reachable[chunk.Ptr()]; ok {
+			continue
+		}
+		err = chunk.Free()
+		if err != nil {
+			return freed, err
+		}
+		freed++
+	}
+
+	return freed, nil
+}
@@ -0,0 +1,191 @@
+package container_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestQueue(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	q, err := container.NewQueue(buf)
+	if err != nil {
+		t.Errorf("NewQueue(nil): unexpected error: %v", err)
+		return
+	}
+	_, ok, err := q.Pop()
+	if err != nil || ok {
+		t.Errorf("q.Pop() = %v, %v on an empty queue, expected false, nil", ok, err)
+	}
+	for _, item := range []string{"foo", "bar", "baz"} {
+		err = q.Push([]byte(item))
+		if err != nil {
+			t.Errorf("q.Push(%q): unexpected error: %v", item, err)
+			return
+		}
+	}
+	if n := q.Len(); n != 3 {
+		t.Errorf("q.Len() = %d, expected 3", n)
+	}
+	b, ok, err := q.Peek()
+	if err != nil || !ok || string(b) != "foo" {
+		t.Errorf("q.Peek() = %q, %v, %v, expected %q, true, nil", b, ok, err, "foo")
+	}
+	b, ok, err = q.Pop()
+	if err != nil || !ok || string(b) != "foo" {
+		t.Errorf("q.Pop() = %q, %v, %v, expected %q, true, nil", b, ok, err, "foo")
+	}
+
+	q, err = container.NewQueue(buf)
+	if err != nil {
+		t.Errorf("NewQueue(...): unexpected error: %v", err)
+		return
+	}
+	err = q.Push([]byte("qux"))
+	if err != nil {
+		t.Errorf("q.Push(%q): unexpected error: %v", "qux", err)
+		return
+	}
+	got, err := queueItems(q)
+	if err != nil {
+		t.Errorf("popping: unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != "[bar baz qux]" {
+		t.Errorf("popped %v, expected [bar baz qux]", got)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("q.Len() = %d, expected 0", n)
+	}
+}
+
+func TestQueueInterrupted(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		op       func(q *container.Queue) error
+		before   string
+		after    string
+		leaks    int
+		complete bool
+	}{
+		{
+			name: "push",
+			op: func(q *container.Queue) error {
+				return q.Push([]byte("baz"))
+			},
+			before: "[foo bar]",
+			after:  "[foo bar baz]",
+			leaks:  1,
+		},
+		{
+			name: "pop",
+			op: func(q *container.Queue) error {
+				_, _, err := q.Pop()
+				return err
+			},
+			before: "[foo bar]",
+			after:  "[bar]",
+		},
+	} {
+		for writes := 0; !tc.complete; writes++ {
+			buf := newReadWriteSeeker(nil)
+			q, err := container.NewQueue(buf)
+			if err != nil {
+				t.Errorf("NewQueue(nil): unexpected error: %v", err)
+				return
+			}
+			for _, item := range []string{"foo", "bar"} {
+				err = q.Push([]byte(item))
+				if err != nil {
+					t.Errorf("q.Push(%q): unexpected error: %v", item, err)
+					return
+				}
+			}
+
+			q, err = container.NewQueue(&failingWriter{ReadWriteSeeker: buf, writes: writes})
+			if err != nil {
+				t.Errorf("NewQueue(...): unexpected error: %v", err)
+				return
+			}
+			err = tc.op(q)
+			tc.complete = err == nil
+			if err != nil && !errors.Is(err, errWriteFailed) {
+				t.Errorf("%s after %d writes: unexpected error: %v", tc.name, writes, err)
+				return
+			}
+
+			q, err = container.NewQueue(buf)
+			if err != nil {
+				t.Errorf("NewQueue(...) after an interrupted %s: unexpected error: %v", tc.name, err)
+				return
+			}
+			n := q.Len()
+			got, err := queueItems(q)
+			if err != nil {
+				t.Errorf("popping after an interrupted %s: unexpected error: %v", tc.name, err)
+				return
+			}
+			if fmt.Sprint(got) != tc.before && fmt.Sprint(got) != tc.after {
+				t.Errorf("%s interrupted after %d writes left %v, expected %s or %s", tc.name, writes, got, tc.before, tc.after)
+			}
+			if n != int64(len(got)) {
+				t.Errorf("%s interrupted after %d writes: q.Len() = %d, expected %d", tc.name, writes, n, len(got))
+			}
+
+			freed, err := q.Scavenge()
+			if err != nil {
+				t.Errorf("q.Scavenge(): unexpected error: %v", err)
+				return
+			}
+			if freed > tc.leaks {
+				t.Errorf("%s interrupted after %d writes leaked %d chunks", tc.name, writes, freed)
+			}
+
+			pool, err := container.NewPool(buf)
+			if err != nil {
+				t.Errorf("NewPool(...): unexpected error: %v", err)
+				return
+			}
+			chunks, err := pool.Allocated()
+			if err != nil {
+				t.Errorf("pool.Allocated(): unexpected error: %v", err)
+				return
+			}
+			if len(chunks) != 1 {
+				t.Errorf("pool.Allocated() = %d chunks after scavenging, expected the header only", len(chunks))
+			}
+		}
+	}
+}
+
+func queueItems(q *container.Queue) ([]string, error) {
+	var items []string
+	for {
+		b, ok, err := q.Pop()
+		if err != nil || !ok {
+			return items, err
+		}
+		items = append(items, string(b))
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter fails every write after the first ones.
+type failingWriter struct {
+	io.ReadWriteSeeker
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		return 0, errWriteFailed
+	}
+	w.writes--
+
+	return w.ReadWriteSeeker.Write(p)
+}
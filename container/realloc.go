@@ -0,0 +1,145 @@
+package container
+
+import "io"
+
+// Realloc changes the cap of the chunk to at least newCap, keeping its
+// payload. The chunk grows in place when it is the last of the pool or is
+// followed by a large enough free chunk, otherwise the payload is copied to a
+// new chunk and c is freed. Chunks are never shrunk. The returned chunk
+// replaces c, which must not be used anymore if they differ.
+func (c *Chunk) Realloc(newCap uint32) (*Chunk, error) {
+	return c.Realloc64(uint64(newCap))
+}
+
+// Realloc64 is Realloc for chunks of any size. Chunks growing past
+// MaxChunkSize are moved to a chunk with a wide header.
+func (c *Chunk) Realloc64(newCap uint64) (*Chunk, error) {
+	p := c.pool
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	err := p.resident(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.shared {
+		return nil, ErrSharedChunk
+	}
+	if newCap <= c.cap {
+		return c, nil
+	}
+	err = p.invalidateCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := p.growInPlace(c, newCap)
+	if err != nil || ok {
+		return c, err
+	}
+
+	b := make([]byte, c.size)
+	_, err = c.read(b)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := p.alloc(newCap)
+	if err != nil {
+		return nil, err
+	}
+	chunk.size = c.size
+	p.wasted -= int64(c.size)
+	err = chunk.writeHeader()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.f.Write(b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.freeChunk()
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// growInPlace extends c over the free chunk following it, or past the end of
+// the file when c is the last chunk. It returns false when neither is
+// possible, or when c would need a wide header.
+func (p *Pool) growInPlace(c *Chunk, newCap uint64) (bool, error) {
+	if newCap > MaxChunkSize && !c.wide {
+		return false, nil
+	}
+	fileEnd, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if c.end() == fileEnd {
+		err = writeZeros(p.f, newCap-c.cap)
+		if err != nil {
+			return false, err
+		}
+
+		return true, p.setCap(c, newCap)
+	}
+
+	next, ok := p.freeChunks[c.end()]
+	if !ok {
+		return false, nil
+	}
+	headerSize := uint64(c.headerSize())
+	total := uint64(next.end() - c.pos - int64(headerSize))
+	if total < newCap || total > MaxChunkSize && !c.wide {
+		return false, nil
+	}
+
+	// the remainder is split off when its header fits in the payload of
+	// next, so that next still covers it until c is extended
+	restCap := total - newCap
+	if newCap-c.cap < uint64(next.headerSize()) || restCap < uint64(p.headerSize())+minSplitCap {
+		err = p.setCap(c, total)
+		if err != nil {
+			return false, err
+		}
+		p.removeFree(next)
+		delete(p.chunks, next.pos)
+		p.count--
+
+		return true, nil
+	}
+
+	rest, err := p.spanChunk(c.pos+int64(headerSize)+int64(newCap), next.end())
+	if err != nil {
+		return false, err
+	}
+	err = rest.writeHeader()
+	if err != nil {
+		return false, err
+	}
+	err = p.setCap(c, newCap)
+	if err != nil {
+		return false, err
+	}
+	p.removeFree(next)
+	delete(p.chunks, next.pos)
+	p.chunks[rest.pos] = rest
+	p.addFree(rest)
+
+	return true, nil
+}
+
+func (p *Pool) setCap(c *Chunk, newCap uint64) error {
+	oldCap := c.cap
+	c.cap = newCap
+	err := c.writeHeader()
+	if err != nil {
+		c.cap = oldCap
+		return err
+	}
+	p.wasted += int64(newCap) - int64(oldCap)
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package container
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrSharedChunk is returned when writing to or reallocating a chunk shared
+// with Retain.
+var ErrSharedChunk = errors.New("chunk is shared")
+
+// ErrChunkFull is returned by Retain when the chunk has no room for its
+// reference count after the payload.
+var ErrChunkFull = errors.New("no room for the reference count")
+
+var sizeRefs = binarySizePanic(uint32(0))
+
+// Retain adds a reference to the chunk, so that it is only freed once Free was
+// called for each of them. The reference count of a shared chunk is stored
+// after its payload, which can't be written to anymore until a single
+// reference is left. It fails with ErrChunkFull unless the cap of the chunk
+// leaves 4 bytes after the payload.
+func (c *Chunk) Retain() error {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	err := c.pool.resident(c)
+	if err != nil {
+		return err
+	}
+	if c.free {
+		return errors.New("chunk is free")
+	}
+	if !c.shared {
+		if c.cap-c.size < uint64(sizeRefs) {
+			return ErrChunkFull
+		}
+		c.shared = true
+		err = c.writeRefs(2)
+		if err != nil {
+			c.shared = false
+			return err
+		}
+		err = c.writeHeader()
+		if err != nil {
+			c.shared = false
+		}
+
+		return err
+	}
+
+	refs, err := c.readRefs()
+	if err != nil {
+		return err
+	}
+	if refs == ^uint32(0) {
+		return errors.New("too many references")
+	}
+
+	return c.writeRefs(refs + 1)
+}
+
+// Refs returns the number of references to the chunk, 1 unless it was shared
+// with Retain.
+func (c *Chunk) Refs() (uint32, error) {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	err := c.pool.resident(c)
+	if err != nil {
+		return 0, err
+	}
+	if !c.shared {
+		return 1, nil
+	}
+
+	return c.readRefs()
+}
+
+// release drops a reference to c, freeing it when it was the last one. A
+// chunk left with one reference stops being shared.
+func (c *Chunk) release() error {
+	if !c.shared {
+		return c.freeChunk()
+	}
+
+	refs, err := c.readRefs()
+	if err != nil {
+		return err
+	}
+	if refs > 2 {
+		return c.writeRefs(refs - 1)
+	}
+
+	c.shared = false
+	err = c.writeHeader()
+	if err != nil {
+		c.shared = true
+		return err
+	}
+	c.refs = 0
+
+	return nil
+}
+
+// freeAll frees c whatever its references.
+func (c *Chunk) freeAll() error {
+	c.pool.m.Lock()
+	defer c.pool.m.Unlock()
+
+	err := c.pool.resident(c)
+	if err != nil {
+		return err
+	}
+
+	return c.freeChunk()
+}
+
+// used returns the bytes of c in use after the header: the payload, followed
+// by the reference count of a shared chunk.
+func (c Chunk) used() uint64 {
+	if c.shared {
+		return c.size + uint64(sizeRefs)
+	}
+
+	return c.size
+}
+
+func (c *Chunk) readRefs() (uint32, error) {
+	if c.refs != 0 {
+		return c.refs, nil
+	}
+
+	_, err := c.pool.f.Seek(c.pos+int64(c.headerSize())+int64(c.size), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	b := make([]byte, sizeRefs)
+	_, err = io.ReadFull(c.pool.f, b)
+	if err != nil {
+		return 0, err
+	}
+	refs := binary.LittleEndian.Uint32(b)
+	if refs < 2 {
+		return 0, fmt.Errorf("shared chunk at 0x%x: %d references: %w", c.pos, refs, ErrCorruptChunk)
+	}
+	c.refs = refs
+
+	return refs, nil
+}
+
+func (c *Chunk) writeRefs(refs uint32) error {
+	_, err := c.pool.f.Seek(c.pos+int64(c.headerSize())+int64(c.size), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, sizeRefs)
+	binary.LittleEndian.PutUint32(b, refs)
+	_, err = c.pool.f.Write(b)
+	if err != nil {
+		c.refs = 0
+		return err
+	}
+	c.refs = refs
+
+	return nil
+}
+
+// Link stores the value of from for key too, both keys sharing the value
+// chunk until one of them is stored again or deleted. It fails when from
+// doesn't exist. A value allocated without room for its reference count is
+// copied to a chunk that has some first.
+func (m *HashMap) Link(key, from []byte) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.update(func() error {
+		node, err := m.findNode(from)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return fmt.Errorf("key %q not found", from)
+		}
+		value, err := node.Value()
+		if err != nil {
+			return err
+		}
+
+		err = value.Retain()
+		if errors.Is(err, ErrChunkFull) {
+			value, err = m.shareable(node, value)
+			if err != nil {
+				return err
+			}
+			err = value.Retain()
+		}
+		if err != nil {
+			return err
+		}
+
+		return m.store(m.headBuckets, key, value, 0)
+	})
+}
+
+// shareable moves the value of node to a chunk with room for a reference
+// count, returning it.
+func (m *HashMap) shareable(node *KVNode, value *Chunk) (*Chunk, error) {
+	b, err := value.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := m.pool.Alloc64(uint64(len(b)) + uint64(sizeRefs))
+	if err != nil {
+		return nil, err
+	}
+	_, err = chunk.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	old, err := node.SetValue(chunk.Ptr())
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk, m.freeChunks(old)
+}
@@ -0,0 +1,146 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// readHeadTable loads the grown head table referenced from b, keeping the
+// buckets of the head chunk when the table never grew.
+func (m *HashMap) readHeadTable(b []byte) error {
+	ptr := ChunkPtr(binary.LittleEndian.Uint64(b))
+	if ptr == 0 {
+		return nil
+	}
+	fanOut := int(binary.LittleEndian.Uint32(b[sizePtr:]))
+	if fanOut < 2 {
+		return fmt.Errorf("invalid head table fan-out %d", fanOut)
+	}
+
+	chunk, err := m.pool.Get(ptr)
+	if err != nil {
+		return err
+	}
+	bb := newHeadBuckets(m.pool, m.cfg, chunk, fanOut)
+	err = bb.ReadFrom(chunk)
+	if err != nil {
+		return err
+	}
+	m.headBuckets = bb
+
+	return nil
+}
+
+func (m *HashMap) writeHeadTable() error {
+	b := make([]byte, sizeHeadTable)
+	binary.LittleEndian.PutUint64(b, uint64(m.headBuckets[0].chunk.Ptr()))
+	binary.LittleEndian.PutUint32(b[sizePtr:], uint32(len(m.headBuckets)))
+	_, err := m.headBucketsChunk.WriteAt(b, int64(m.cfg.headTableOffset()))
+
+	return err
+}
+
+// growIfLoaded doubles the head table of a resizable map once it holds more
+// than half the list threshold of entries per bucket.
+func (m *HashMap) growIfLoaded() error {
+	if !m.cfg.resize || 2*m.count <= int64(len(m.headBuckets))*int64(m.cfg.maxList) {
+		return nil
+	}
+	fanOut := 2 * len(m.headBuckets)
+	if int64(fanOut)*int64(sizeHashBucket) > MaxChunkSize {
+		return nil
+	}
+
+	return m.grow(fanOut)
+}
+
+// grow rehashes every entry into a new head table of fanOut buckets. Keys and
+// values are moved to new nodes, and the old nodes and tables are freed once
+// the header points to the new table, so that an interrupted grow only leaks
+// chunks that Scavenge can reclaim.
+func (m *HashMap) grow(fanOut int) error {
+	chunk, err := m.pool.Alloc(uint32(fanOut * sizeHashBucket))
+	if err != nil {
+		return err
+	}
+	table := newHeadBuckets(m.pool, m.cfg, chunk, fanOut)
+	err = table.WriteTo(chunk)
+	if err != nil {
+		return err
+	}
+
+	var (
+		heads  []*KVNode
+		tables []ChunkPtr
+		itErr  error
+	)
+	err = m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
+		if b.Type == bucketTypeBuckets {
+			tables = append(tables, b.Head)
+			return true
+		}
+		if b.Head == 0 {
+			return true
+		}
+
+		node, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		if err == nil {
+			heads = append(heads, node)
+		}
+		for err == nil && node != nil {
+			var key []byte
+			key, err = node.KeyBytes()
+			if err != nil {
+				break
+			}
+			err = table.insert(key, node.key, node.value, node.expiry)
+			if err != nil {
+				break
+			}
+			node, err = node.Next()
+		}
+		if err != nil {
+			itErr = err
+			return false
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if itErr != nil {
+		return itErr
+	}
+
+	old := m.headBuckets
+	m.headBuckets = table
+	err = m.writeHeadTable()
+	if err != nil {
+		m.headBuckets = old
+		return err
+	}
+
+	for _, node := range heads {
+		err = node.DeleteAll()
+		if err != nil {
+			return err
+		}
+	}
+	for _, ptr := range tables {
+		chunk, err := m.pool.Get(ptr)
+		if err != nil {
+			return err
+		}
+		err = chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+	if old[0].chunk != m.headBucketsChunk {
+		return old[0].chunk.Free()
+	}
+	_, err = m.headBucketsChunk.WriteAt(newHashBuckets(m.pool, m.cfg, m.headBucketsChunk).encode(), 0)
+
+	return err
+}
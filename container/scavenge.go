@@ -0,0 +1,128 @@
+package container
+
+// Scavenge frees the chunks of the pool that aren't reachable from the map,
+// like the keys and values leaked by Delete in earlier versions, and drops the
+// references to shared values that no key holds. It returns the number of
+// chunks freed.
+func (m *HashMap) Scavenge() (int, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	var n int
+	err := m.update(func() error {
+		var err error
+		n, err = m.scavenge()
+		return err
+	})
+
+	return n, err
+}
+
+func (m *HashMap) scavenge() (int, error) {
+	reachable, err := m.reachable()
+	if err != nil {
+		return 0, err
+	}
+	reachable[m.headBucketsChunk.Ptr()]++
+	reachable[m.headBuckets[0].chunk.Ptr()]++
+
+	chunks, err := m.pool.Allocated()
+	if err != nil {
+		return 0, err
+	}
+	var freed int
+	for _, chunk := range chunks {
+		n, ok := reachable[chunk.Ptr()]
+		if ok {
+			err = m.dropExtraRefs(chunk, n)
+			if err != nil {
+				return freed, err
+			}
+			continue
+		}
+		err = chunk.freeAll()
+		if err != nil {
+			return freed, err
+		}
+		freed++
+	}
+
+	return freed, nil
+}
+
+// dropExtraRefs releases the references to chunk above the n the map holds,
+// left by an interrupted Link.
+func (m *HashMap) dropExtraRefs(chunk *Chunk, n int) error {
+	if n == 0 {
+		return nil
+	}
+	refs, err := chunk.Refs()
+	for err == nil && int64(refs) > int64(n) {
+		err = chunk.Free()
+		refs--
+	}
+
+	return err
+}
+
+// reachable returns the chunks referenced from the head buckets: nested
+// bucket tables, nodes, keys and values, as well as the ordered index, the
+// insertion order list, the bloom filter and the chunks pinned by snapshots.
+// Chunks are mapped to the number of references the map holds, 0 for those
+// only pinned.
+func (m *HashMap) reachable() (map[ChunkPtr]int, error) {
+	reachable := map[ChunkPtr]int{}
+	m.pinM.Lock()
+	for ptr := range m.pinned {
+		reachable[ptr] = 0
+	}
+	m.pinM.Unlock()
+	if m.bloom != nil {
+		reachable[m.bloom.chunk.Ptr()]++
+	}
+	var itErr error
+	err := m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
+		if b.Head == 0 {
+			return true
+		}
+		if b.Type == bucketTypeBuckets {
+			reachable[b.Head]++
+			return true
+		}
+
+		node, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		for err == nil && node != nil {
+			reachable[node.Ptr()]++
+			reachable[node.key]++
+			reachable[node.value]++
+
+			node, err = node.Next()
+		}
+		if err != nil {
+			itErr = err
+			return false
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if itErr != nil {
+		return nil, itErr
+	}
+
+	for _, head := range []ChunkPtr{m.indexHead, m.orderHead} {
+		err = m.iterateList(head, func(node *KVNode) (bool, error) {
+			reachable[node.Ptr()]++
+			reachable[node.key]++
+
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reachable, nil
+}
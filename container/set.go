@@ -0,0 +1,406 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Initial number of buckets of a Set, and average number of members per
+// bucket above which the bucket table is doubled.
+const (
+	SetBuckets = 16
+	SetLoad    = 4
+)
+
+// Set is a set of byte slices. Members are hashed into buckets, each bucket
+// being a single chunk holding its members back to back, so a member costs
+// no chunk of its own.
+type Set struct {
+	m *sync.RWMutex
+
+	pool      *Pool
+	headChunk *Chunk
+	table     *Chunk
+	buckets   []ChunkPtr
+	count     int64
+}
+
+// The head chunk holds the bucket table and the member count:
+//
+//	table  int64
+//	count  int64
+//	magic  [4]byte
+//
+// The table holds a power of two number of bucket pointers, 0 for empty
+// buckets, and buckets hold uvarint-prefixed members.
+var sizeSetHead = sizePtr + sizeCount + len(setMagic)
+
+var setMagic = [4]byte{'k', 'v', 's', 't'}
+
+func NewSet(f io.ReadWriteSeeker) (*Set, error) {
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Set{
+		m: &sync.RWMutex{},
+
+		pool: pool,
+	}
+
+	if pool.Size() == 0 {
+		s.headChunk, err = pool.Alloc(uint32(sizeSetHead))
+		if err != nil {
+			return nil, err
+		}
+		s.buckets = make([]ChunkPtr, SetBuckets)
+		s.table, err = pool.AllocAndWrite(encodePtrs(s.buckets))
+		if err != nil {
+			return nil, err
+		}
+
+		return s, s.writeHead()
+	}
+
+	s.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.headChunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sizeSetHead || !bytes.Equal(b[sizeSetHead-len(setMagic):], setMagic[:]) {
+		return nil, fmt.Errorf("invalid set header: %d bytes", len(b))
+	}
+	s.count = int64(binary.LittleEndian.Uint64(b[sizePtr:]))
+
+	s.table, err = pool.Get(ChunkPtr(binary.LittleEndian.Uint64(b)))
+	if err != nil {
+		return nil, err
+	}
+	b, err = s.table.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	n := len(b) / sizePtr
+	if n == 0 || n&(n-1) != 0 || len(b)%sizePtr != 0 {
+		return nil, fmt.Errorf("invalid set table: %d bytes", len(b))
+	}
+	s.buckets = make([]ChunkPtr, n)
+	for i := range s.buckets {
+		s.buckets[i] = ChunkPtr(binary.LittleEndian.Uint64(b[i*sizePtr:]))
+	}
+
+	return s, nil
+}
+
+func encodePtrs(ptrs []ChunkPtr) []byte {
+	b := make([]byte, len(ptrs)*sizePtr)
+	for i, ptr := range ptrs {
+		binary.LittleEndian.PutUint64(b[i*sizePtr:], uint64(ptr))
+	}
+
+	return b
+}
+
+func (s *Set) writeHead() error {
+	b := make([]byte, sizeSetHead)
+	binary.LittleEndian.PutUint64(b, uint64(s.table.Ptr()))
+	binary.LittleEndian.PutUint64(b[sizePtr:], uint64(s.count))
+	copy(b[sizePtr+sizeCount:], setMagic[:])
+
+	_, err := s.headChunk.Write(b)
+
+	return err
+}
+
+func (s *Set) setBucket(i int, ptr ChunkPtr) error {
+	s.buckets[i] = ptr
+
+	b := make([]byte, sizePtr)
+	binary.LittleEndian.PutUint64(b, uint64(ptr))
+	_, err := s.table.WriteAt(b, int64(i*sizePtr))
+
+	return err
+}
+
+func (s *Set) bucketIndex(member []byte) int {
+	return int(fnv32a(member) & uint32(len(s.buckets)-1))
+}
+
+// readBucket returns the members of bucket i, and the chunk holding them,
+// nil if the bucket is empty.
+func (s *Set) readBucket(i int) (*Chunk, [][]byte, error) {
+	if s.buckets[i] == 0 {
+		return nil, nil, nil
+	}
+	chunk, err := s.pool.Get(s.buckets[i])
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var members [][]byte
+	for len(b) > 0 {
+		n, l := binary.Uvarint(b)
+		if l <= 0 || uint64(len(b)-l) < n {
+			return nil, nil, fmt.Errorf("bucket 0x%x: invalid member", chunk.Ptr())
+		}
+		members = append(members, b[l:l+int(n)])
+		b = b[l+int(n):]
+	}
+
+	return chunk, members, nil
+}
+
+func encodeMembers(members [][]byte) []byte {
+	var b []byte
+	l := make([]byte, binary.MaxVarintLen64)
+	for _, member := range members {
+		n := binary.PutUvarint(l, uint64(len(member)))
+		b = append(b, l[:n]...)
+		b = append(b, member...)
+	}
+
+	return b
+}
+
+// writeBucket replaces the members of bucket i, whose chunk is chunk, nil if
+// it is empty.
+func (s *Set) writeBucket(i int, chunk *Chunk, members [][]byte) error {
+	if len(members) == 0 {
+		if chunk == nil {
+			return nil
+		}
+		err := s.setBucket(i, 0)
+		if err != nil {
+			return err
+		}
+
+		return chunk.Free()
+	}
+
+	b := encodeMembers(members)
+	if chunk == nil {
+		chunk, err := s.pool.AllocAndWrite(b)
+		if err != nil {
+			return err
+		}
+
+		return s.setBucket(i, chunk.Ptr())
+	}
+
+	if len(b) > int(chunk.Cap()) {
+		grown, err := chunk.Realloc(uint32(2 * len(b)))
+		if err != nil {
+			return err
+		}
+		if grown != chunk {
+			err = s.setBucket(i, grown.Ptr())
+			if err != nil {
+				return err
+			}
+		}
+		chunk = grown
+	}
+	_, err := chunk.Write(b)
+
+	return err
+}
+
+func indexMember(members [][]byte, member []byte) int {
+	for i, m := range members {
+		if bytes.Equal(m, member) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Len returns the number of members in the set.
+func (s *Set) Len() int64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.count
+}
+
+// Has reports whether member is in the set.
+func (s *Set) Has(member []byte) (bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	_, members, err := s.readBucket(s.bucketIndex(member))
+	if err != nil {
+		return false, err
+	}
+
+	return indexMember(members, member) >= 0, nil
+}
+
+// Add adds member to the set, returning false if it already was in it.
+func (s *Set) Add(member []byte) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.add(member)
+}
+
+func (s *Set) add(member []byte) (bool, error) {
+	i := s.bucketIndex(member)
+	chunk, members, err := s.readBucket(i)
+	if err != nil {
+		return false, err
+	}
+	if indexMember(members, member) >= 0 {
+		return false, nil
+	}
+
+	err = s.writeBucket(i, chunk, append(members, member))
+	if err != nil {
+		return false, err
+	}
+	s.count++
+	err = s.writeHead()
+	if err != nil {
+		return true, err
+	}
+	if s.count <= int64(SetLoad*len(s.buckets)) {
+		return true, nil
+	}
+
+	return true, s.grow()
+}
+
+// grow doubles the bucket table. The new buckets are written before the head
+// points to them, the old ones being freed afterwards.
+func (s *Set) grow() error {
+	buckets := make([][][]byte, 2*len(s.buckets))
+	var old []*Chunk
+	for i := range s.buckets {
+		chunk, members, err := s.readBucket(i)
+		if err != nil {
+			return err
+		}
+		if chunk != nil {
+			old = append(old, chunk)
+		}
+		for _, member := range members {
+			j := int(fnv32a(member) & uint32(len(buckets)-1))
+			buckets[j] = append(buckets[j], member)
+		}
+	}
+
+	ptrs := make([]ChunkPtr, len(buckets))
+	for i, members := range buckets {
+		if len(members) == 0 {
+			continue
+		}
+		chunk, err := s.pool.AllocAndWrite(encodeMembers(members))
+		if err != nil {
+			return err
+		}
+		ptrs[i] = chunk.Ptr()
+	}
+	table, err := s.pool.AllocAndWrite(encodePtrs(ptrs))
+	if err != nil {
+		return err
+	}
+
+	old = append(old, s.table)
+	s.table, s.buckets = table, ptrs
+	err = s.writeHead()
+	if err != nil {
+		return err
+	}
+	for _, chunk := range old {
+		err = chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove removes member from the set, returning false if it wasn't in it.
+func (s *Set) Remove(member []byte) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	i := s.bucketIndex(member)
+	chunk, members, err := s.readBucket(i)
+	if err != nil {
+		return false, err
+	}
+	j := indexMember(members, member)
+	if j < 0 {
+		return false, nil
+	}
+
+	err = s.writeBucket(i, chunk, append(members[:j], members[j+1:]...))
+	if err != nil {
+		return false, err
+	}
+	s.count--
+
+	return true, s.writeHead()
+}
+
+// Union adds the members of other to the set.
+func (s *Set) Union(other *Set) error {
+	if other == s {
+		return nil
+	}
+
+	var members [][]byte
+	err := other.Iterate(func(member []byte) bool {
+		members = append(members, member)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, member := range members {
+		_, err = s.add(member)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Iterate calls f on every member of the set, in no particular order, until
+// it returns false.
+func (s *Set) Iterate(f func(member []byte) bool) error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	for i := range s.buckets {
+		_, members, err := s.readBucket(i)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if !f(member) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package container_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestSet(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	s, err := container.NewSet(buf)
+	if err != nil {
+		t.Errorf("NewSet(nil): unexpected error: %v", err)
+		return
+	}
+
+	expected := map[string]bool{}
+	for i := 0; i < 500; i++ {
+		member := fmt.Sprintf("member-%d", i)
+		added, err := s.Add([]byte(member))
+		if err != nil {
+			t.Errorf("s.Add(%q): unexpected error: %v", member, err)
+			return
+		}
+		if !added {
+			t.Errorf("s.Add(%q) = false, expected true", member)
+		}
+		expected[member] = true
+	}
+	added, err := s.Add([]byte("member-42"))
+	if err != nil || added {
+		t.Errorf("s.Add(%q) = %v, %v on an existing member, expected false, nil", "member-42", added, err)
+	}
+	for i := 0; i < 500; i += 2 {
+		member := fmt.Sprintf("member-%d", i)
+		removed, err := s.Remove([]byte(member))
+		if err != nil || !removed {
+			t.Errorf("s.Remove(%q) = %v, %v, expected true, nil", member, removed, err)
+			return
+		}
+		delete(expected, member)
+	}
+	removed, err := s.Remove([]byte("missing"))
+	if err != nil || removed {
+		t.Errorf("s.Remove(%q) = %v, %v, expected false, nil", "missing", removed, err)
+	}
+
+	s, err = container.NewSet(buf)
+	if err != nil {
+		t.Errorf("NewSet(...): unexpected error: %v", err)
+		return
+	}
+	if n := s.Len(); n != int64(len(expected)) {
+		t.Errorf("s.Len() = %d, expected %d", n, len(expected))
+	}
+	for _, member := range []string{"member-0", "member-1", "member-42", "member-499", "missing"} {
+		ok, err := s.Has([]byte(member))
+		if err != nil {
+			t.Errorf("s.Has(%q): unexpected error: %v", member, err)
+			return
+		}
+		if ok != expected[member] {
+			t.Errorf("s.Has(%q) = %v, expected %v", member, ok, expected[member])
+		}
+	}
+
+	other, err := container.NewSet(newReadWriteSeeker(nil))
+	if err != nil {
+		t.Errorf("NewSet(nil): unexpected error: %v", err)
+		return
+	}
+	for _, member := range []string{"member-1", "member-2", "other"} {
+		_, err = other.Add([]byte(member))
+		if err != nil {
+			t.Errorf("other.Add(%q): unexpected error: %v", member, err)
+			return
+		}
+		expected[member] = true
+	}
+	err = s.Union(other)
+	if err != nil {
+		t.Errorf("s.Union(...): unexpected error: %v", err)
+		return
+	}
+
+	var want []string
+	for member := range expected {
+		want = append(want, member)
+	}
+	sort.Strings(want)
+	var got []string
+	err = s.Iterate(func(member []byte) bool {
+		got = append(got, string(member))
+		return true
+	})
+	if err != nil {
+		t.Errorf("s.Iterate(...): unexpected error: %v", err)
+		return
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("s.Iterate(...) = %v, expected %v", got, want)
+	}
+	if n := s.Len(); n != int64(len(want)) {
+		t.Errorf("s.Len() = %d, expected %d", n, len(want))
+	}
+
+	for _, member := range want {
+		_, err = s.Remove([]byte(member))
+		if err != nil {
+			t.Errorf("s.Remove(%q): unexpected error: %v", member, err)
+			return
+		}
+	}
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunks, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(chunks) != 2 {
+		t.Errorf("pool.Allocated() = %d chunks after removing everything, expected the head and table", len(chunks))
+	}
+}
@@ -0,0 +1,91 @@
+package container
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+)
+
+// ShardedHashMap partitions keys across independent HashMaps, each stored in
+// its own file and locked on its own, so that operations on keys of different
+// shards don't contend. Keys are assigned to shards by hash, so the same
+// files have to be given in the same order every time the map is opened.
+type ShardedHashMap struct {
+	shards []*HashMap
+}
+
+func NewShardedHashMap(files []io.ReadWriteSeeker, opts ...HashMapOption) (*ShardedHashMap, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no shards")
+	}
+
+	s := &ShardedHashMap{
+		shards: make([]*HashMap, len(files)),
+	}
+	for i, f := range files {
+		var err error
+		s.shards[i], err = NewHashMap(f, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Shards returns the maps of the shards, in the order of their files.
+func (s *ShardedHashMap) Shards() []*HashMap {
+	return s.shards
+}
+
+// shard returns the map holding key, picked with a hash independent from the
+// one distributing keys among buckets.
+func (s *ShardedHashMap) shard(key []byte) *HashMap {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+
+	return s.shards[h.Sum64()%uint64(len(s.shards))]
+}
+
+func (s *ShardedHashMap) Load(key []byte) ([]byte, bool, error) {
+	return s.shard(key).Load(key)
+}
+
+func (s *ShardedHashMap) Store(key, value []byte) error {
+	return s.shard(key).Store(key, value)
+}
+
+func (s *ShardedHashMap) Delete(key []byte) error {
+	return s.shard(key).Delete(key)
+}
+
+// Len returns the number of entries in all the shards.
+func (s *ShardedHashMap) Len() (int64, error) {
+	var total int64
+	for _, m := range s.shards {
+		n, err := m.Len()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// Range calls f on the entries of every shard in turn, until it returns false.
+// Each shard is only locked while it is being ranged over.
+func (s *ShardedHashMap) Range(f func(key, value []byte) bool) error {
+	for _, m := range s.shards {
+		ok := true
+		err := m.Range(func(key, value []byte) bool {
+			ok = f(key, value)
+			return ok
+		})
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package container_test
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestShardedHashMap(t *testing.T) {
+	files := make([]io.ReadWriteSeeker, 4)
+	for i := range files {
+		files[i] = newReadWriteSeeker(nil)
+	}
+
+	m, err := container.NewShardedHashMap(files)
+	if err != nil {
+		t.Errorf("NewShardedHashMap(...): unexpected error: %v", err)
+		return
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 4)
+	)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%d-%d", w, i)
+				err := m.Store([]byte(key), []byte(strconv.Itoa(i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, _, err = m.Load([]byte(key))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent m.Store(...): unexpected error: %v", err)
+		return
+	}
+
+	err = m.Delete([]byte("key-0-0"))
+	if err != nil {
+		t.Errorf("m.Delete(%q): unexpected error: %v", "key-0-0", err)
+		return
+	}
+	n, err := m.Len()
+	if err != nil || n != 399 {
+		t.Errorf("m.Len() = %d, %v, expected 399, nil", n, err)
+	}
+	for i, shard := range m.Shards() {
+		n, err := shard.Len()
+		if err != nil || n == 0 || n == 399 {
+			t.Errorf("m.Shards()[%d].Len() = %d, %v, expected the keys to be spread across shards", i, n, err)
+		}
+	}
+
+	m, err = container.NewShardedHashMap(files)
+	if err != nil {
+		t.Errorf("NewShardedHashMap(...): unexpected error: %v", err)
+		return
+	}
+	v, ok, err := m.Load([]byte("key-3-42"))
+	if err != nil || !ok || string(v) != "42" {
+		t.Errorf("m.Load(%q) = %q, %v, %v, expected %q, true, nil", "key-3-42", v, ok, err, "42")
+	}
+	_, ok, err = m.Load([]byte("key-0-0"))
+	if err != nil || ok {
+		t.Errorf("m.Load(%q) = %v, %v, expected false, nil", "key-0-0", ok, err)
+	}
+	var ranged int
+	err = m.Range(func(_, _ []byte) bool {
+		ranged++
+		return ranged < 10
+	})
+	if err != nil || ranged != 10 {
+		t.Errorf("m.Range(...) = %v after %d entries, expected to stop after 10", err, ranged)
+	}
+
+	_, err = container.NewShardedHashMap(nil)
+	if err == nil {
+		t.Errorf("NewShardedHashMap(nil): expected error, got nil")
+	}
+}
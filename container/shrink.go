@@ -0,0 +1,116 @@
+package container
+
+// Shrink collapses the nested bucket tables holding at most half the list
+// threshold of entries back into lists, freeing their chunks. Tables are never collapsed
+// on Delete, so that a map hovering around the overflow threshold doesn't
+// keep splitting and collapsing the same bucket.
+func (m *HashMap) Shrink() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.update(func() error {
+		_, _, err := m.shrink(m.headBuckets)
+		return err
+	})
+}
+
+// shrink collapses the underfull tables nested in bb, returning the number of
+// entries in bb and whether nested tables remain.
+func (m *HashMap) shrink(bb hashBuckets) (entries int64, nested bool, err error) {
+	for _, b := range bb {
+		switch {
+		case b.Type == bucketTypeBuckets:
+			chunk, err := m.pool.Get(b.Head)
+			if err != nil {
+				return 0, false, err
+			}
+			child := newHashBuckets(m.pool, m.cfg, chunk)
+			err = child.ReadFrom(chunk)
+			if err != nil {
+				return 0, false, err
+			}
+
+			n, childNested, err := m.shrink(child)
+			if err != nil {
+				return 0, false, err
+			}
+			entries += n
+			if childNested || n > int64(m.cfg.maxList/2) {
+				nested = true
+				continue
+			}
+
+			err = m.collapse(b, child, chunk)
+			if err != nil {
+				return 0, false, err
+			}
+		case b.Head != 0:
+			head, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+			if err != nil {
+				return 0, false, err
+			}
+			n, err := head.ListSize()
+			if err != nil {
+				return 0, false, err
+			}
+			entries += n
+		}
+	}
+
+	return entries, nested, nil
+}
+
+// collapse replaces the table child, referenced by b and only holding lists,
+// by a single list. Keys and values are moved to the new nodes, the old nodes
+// and the table chunk are freed once b points to the new list.
+func (m *HashMap) collapse(b *hashBucket, child hashBuckets, chunk *Chunk) error {
+	var (
+		head  *KVNode
+		heads []*KVNode
+	)
+	for _, childBucket := range child {
+		if childBucket.Head == 0 {
+			continue
+		}
+		node, err := NewKVNodeFromChunkPtr(m.pool, childBucket.Head)
+		if err != nil {
+			return err
+		}
+		heads = append(heads, node)
+
+		for node != nil {
+			if head == nil {
+				head, err = newKVNode(m.pool, node.key, node.value, node.expiry)
+			} else {
+				_, err = head.append(node.key, node.value, node.expiry)
+			}
+			if err != nil {
+				return err
+			}
+
+			node, err = node.Next()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	b.Type = bucketTypeList
+	b.Head = 0
+	if head != nil {
+		b.Head = head.Ptr()
+	}
+	err := b.Write()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range heads {
+		err = node.DeleteAll()
+		if err != nil {
+			return err
+		}
+	}
+
+	return chunk.Free()
+}
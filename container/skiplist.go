@@ -0,0 +1,474 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+)
+
+// SkipListMaxLevel is the number of levels of a SkipList.
+const SkipListMaxLevel = 16
+
+// SkipList maps keys to values in key order. It is simpler than BTree, nodes
+// being only written when inserted and when their neighbors change, at the
+// cost of more chunk reads per lookup.
+type SkipList struct {
+	m *sync.RWMutex
+
+	pool      *Pool
+	headChunk *Chunk
+	head      []ChunkPtr
+	count     int64
+}
+
+// The head chunk holds the entry count and the first node of each level:
+//
+//	count  int64
+//	head   SkipListMaxLevel * int64
+//	magic  [4]byte
+//
+// Nodes hold their key, value, and the next node of each of their levels:
+//
+//	key    int64
+//	value  int64
+//	level  uint8
+//	next   level * int64
+var (
+	sizeSkipListHead = sizeCount + SkipListMaxLevel*sizePtr + len(skipListMagic)
+	offsetSkipNext   = 2*sizePtr + 1
+)
+
+var skipListMagic = [4]byte{'k', 'v', 's', 'l'}
+
+type skipNode struct {
+	chunk *Chunk // nil for the head
+	key   ChunkPtr
+	value ChunkPtr
+	next  []ChunkPtr
+
+	keyBytes []byte
+}
+
+func NewSkipList(f io.ReadWriteSeeker) (*SkipList, error) {
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &SkipList{
+		m: &sync.RWMutex{},
+
+		pool: pool,
+		head: make([]ChunkPtr, SkipListMaxLevel),
+	}
+
+	if pool.Size() == 0 {
+		l.headChunk, err = pool.Alloc(uint32(sizeSkipListHead))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, sizeSkipListHead)
+		copy(b[sizeSkipListHead-len(skipListMagic):], skipListMagic[:])
+		_, err = l.headChunk.Write(b)
+		if err != nil {
+			return nil, err
+		}
+
+		return l, nil
+	}
+
+	l.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := l.headChunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sizeSkipListHead || !bytes.Equal(b[sizeSkipListHead-len(skipListMagic):], skipListMagic[:]) {
+		return nil, fmt.Errorf("invalid skip list header: %d bytes", len(b))
+	}
+	l.count = int64(binary.LittleEndian.Uint64(b))
+	for i := range l.head {
+		l.head[i] = ChunkPtr(binary.LittleEndian.Uint64(b[sizeCount+i*sizePtr:]))
+	}
+
+	return l, nil
+}
+
+// Len returns the number of entries in the list.
+func (l *SkipList) Len() int64 {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	return l.count
+}
+
+func (l *SkipList) writeCount() error {
+	b := make([]byte, sizeCount)
+	binary.LittleEndian.PutUint64(b, uint64(l.count))
+	_, err := l.headChunk.WriteAt(b, 0)
+
+	return err
+}
+
+func (l *SkipList) readNode(ptr ChunkPtr) (*skipNode, error) {
+	chunk, err := l.pool.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < offsetSkipNext || len(b) != offsetSkipNext+int(b[2*sizePtr])*sizePtr {
+		return nil, fmt.Errorf("node 0x%x: invalid size %d", ptr, len(b))
+	}
+
+	n := &skipNode{
+		chunk: chunk,
+		key:   ChunkPtr(binary.LittleEndian.Uint64(b)),
+		value: ChunkPtr(binary.LittleEndian.Uint64(b[sizePtr:])),
+		next:  make([]ChunkPtr, b[2*sizePtr]),
+	}
+	for i := range n.next {
+		n.next[i] = ChunkPtr(binary.LittleEndian.Uint64(b[offsetSkipNext+i*sizePtr:]))
+	}
+
+	return n, nil
+}
+
+func (l *SkipList) newNode(key, value ChunkPtr, next []ChunkPtr) (*skipNode, error) {
+	b := make([]byte, offsetSkipNext+len(next)*sizePtr)
+	binary.LittleEndian.PutUint64(b, uint64(key))
+	binary.LittleEndian.PutUint64(b[sizePtr:], uint64(value))
+	b[2*sizePtr] = uint8(len(next))
+	for i, ptr := range next {
+		binary.LittleEndian.PutUint64(b[offsetSkipNext+i*sizePtr:], uint64(ptr))
+	}
+
+	chunk, err := l.pool.AllocAndWrite(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &skipNode{
+		chunk: chunk,
+		key:   key,
+		value: value,
+		next:  next,
+	}, nil
+}
+
+// setNext points level i of n, the head if it has no chunk, to ptr.
+func (l *SkipList) setNext(n *skipNode, i int, ptr ChunkPtr) error {
+	n.next[i] = ptr
+
+	b := make([]byte, sizePtr)
+	binary.LittleEndian.PutUint64(b, uint64(ptr))
+	if n.chunk == nil {
+		_, err := l.headChunk.WriteAt(b, int64(sizeCount+i*sizePtr))
+		return err
+	}
+	_, err := n.chunk.WriteAt(b, int64(offsetSkipNext+i*sizePtr))
+
+	return err
+}
+
+func (l *SkipList) nodeKey(n *skipNode) ([]byte, error) {
+	if n.keyBytes != nil {
+		return n.keyBytes, nil
+	}
+
+	chunk, err := l.pool.Get(n.key)
+	if err != nil {
+		return nil, err
+	}
+	n.keyBytes, err = chunk.ReadAll()
+
+	return n.keyBytes, err
+}
+
+// find returns the last node before key on every level, and the first node
+// greater or equal to key, nil if there are none.
+func (l *SkipList) find(key []byte) ([]*skipNode, *skipNode, error) {
+	nodes := map[ChunkPtr]*skipNode{}
+	update := make([]*skipNode, SkipListMaxLevel)
+
+	var next *skipNode
+	x := &skipNode{next: l.head}
+	for i := SkipListMaxLevel - 1; i >= 0; i-- {
+		next = nil
+		for x.next[i] != 0 {
+			var err error
+			next = nodes[x.next[i]]
+			if next == nil {
+				next, err = l.readNode(x.next[i])
+				if err != nil {
+					return nil, nil, err
+				}
+				nodes[x.next[i]] = next
+			}
+			b, err := l.nodeKey(next)
+			if err != nil {
+				return nil, nil, err
+			}
+			if bytes.Compare(b, key) >= 0 {
+				break
+			}
+			x, next = next, nil
+		}
+		update[i] = x
+	}
+
+	return update, next, nil
+}
+
+func randomSkipLevel() int {
+	level := 1
+	for level < SkipListMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+
+	return level
+}
+
+func (l *SkipList) Load(key []byte) ([]byte, bool, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	_, n, err := l.find(key)
+	if err != nil || n == nil {
+		return nil, false, err
+	}
+	b, err := l.nodeKey(n)
+	if err != nil || !bytes.Equal(b, key) {
+		return nil, false, err
+	}
+
+	chunk, err := l.pool.Get(n.value)
+	if err != nil {
+		return nil, true, err
+	}
+	value, err := chunk.ReadAll()
+	if err != nil {
+		return nil, true, err
+	}
+
+	return value, true, nil
+}
+
+func (l *SkipList) Store(key, value []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	update, n, err := l.find(key)
+	if err != nil {
+		return err
+	}
+	valueChunk, err := l.pool.AllocAndWrite(value)
+	if err != nil {
+		return err
+	}
+
+	if n != nil {
+		b, err := l.nodeKey(n)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(b, key) {
+			return l.setValue(n, valueChunk.Ptr())
+		}
+	}
+
+	keyChunk, err := l.pool.AllocAndWrite(key)
+	if err != nil {
+		return err
+	}
+	next := make([]ChunkPtr, randomSkipLevel())
+	for i := range next {
+		next[i] = update[i].next[i]
+	}
+	n, err = l.newNode(keyChunk.Ptr(), valueChunk.Ptr(), next)
+	if err != nil {
+		return err
+	}
+	for i := range next {
+		err = l.setNext(update[i], i, n.chunk.Ptr())
+		if err != nil {
+			return err
+		}
+	}
+	l.count++
+
+	return l.writeCount()
+}
+
+func (l *SkipList) setValue(n *skipNode, value ChunkPtr) error {
+	b := make([]byte, sizePtr)
+	binary.LittleEndian.PutUint64(b, uint64(value))
+	_, err := n.chunk.WriteAt(b, int64(sizePtr))
+	if err != nil {
+		return err
+	}
+
+	old, err := l.pool.Get(n.value)
+	if err != nil {
+		return err
+	}
+	n.value = value
+
+	return old.Free()
+}
+
+func (l *SkipList) Delete(key []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	update, n, err := l.find(key)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		b, err := l.nodeKey(n)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, key) {
+			n = nil
+		}
+	}
+	if n == nil {
+		return fmt.Errorf("key %q not found", key)
+	}
+
+	err = l.unlink(update, n)
+	if err != nil {
+		return err
+	}
+	l.count--
+
+	return l.writeCount()
+}
+
+// DeleteRange deletes the entries with keys from start, included, to end,
+// excluded, returning how many were deleted. A nil end deletes up to the end
+// of the list.
+func (l *SkipList) DeleteRange(start, end []byte) (int64, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	update, n, err := l.find(start)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for n != nil {
+		b, err := l.nodeKey(n)
+		if err != nil {
+			return deleted, err
+		}
+		if end != nil && bytes.Compare(b, end) >= 0 {
+			break
+		}
+
+		err = l.unlink(update, n)
+		if err != nil {
+			return deleted, err
+		}
+		l.count--
+		deleted++
+
+		n = nil
+		if next := update[0].next[0]; next != 0 {
+			n, err = l.readNode(next)
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	return deleted, l.writeCount()
+}
+
+// unlink removes n, whose predecessors are update, from every level and frees
+// it and its key and value.
+func (l *SkipList) unlink(update []*skipNode, n *skipNode) error {
+	for i, next := range n.next {
+		if update[i].next[i] != n.chunk.Ptr() {
+			continue
+		}
+		err := l.setNext(update[i], i, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ptr := range []ChunkPtr{n.key, n.value} {
+		chunk, err := l.pool.Get(ptr)
+		if err != nil {
+			return err
+		}
+		err = chunk.Free()
+		if err != nil {
+			return err
+		}
+	}
+
+	return n.chunk.Free()
+}
+
+// Range calls f on every entry in key order until it returns false.
+func (l *SkipList) Range(f func(key, value []byte) bool) error {
+	return l.Scan(nil, nil, f)
+}
+
+// Scan calls f on the entries with keys from start, included, to end,
+// excluded, in key order until it returns false. A nil end ranges up to the
+// end of the list.
+func (l *SkipList) Scan(start, end []byte, f func(key, value []byte) bool) error {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	_, n, err := l.find(start)
+	if err != nil {
+		return err
+	}
+	for n != nil {
+		key, err := l.nodeKey(n)
+		if err != nil {
+			return err
+		}
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return nil
+		}
+		chunk, err := l.pool.Get(n.value)
+		if err != nil {
+			return err
+		}
+		value, err := chunk.ReadAll()
+		if err != nil {
+			return err
+		}
+		if !f(key, value) {
+			return nil
+		}
+
+		if n.next[0] == 0 {
+			return nil
+		}
+		n, err = l.readNode(n.next[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
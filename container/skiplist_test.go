@@ -0,0 +1,140 @@
+package container_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestSkipList(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	l, err := container.NewSkipList(buf)
+	if err != nil {
+		t.Errorf("NewSkipList(nil): unexpected error: %v", err)
+		return
+	}
+
+	expected := map[string]string{}
+	for _, i := range rand.Perm(300) {
+		key, value := fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)
+		err = l.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("l.Store(%q, %q): unexpected error: %v", key, value, err)
+			return
+		}
+		expected[key] = value
+	}
+	err = l.Store([]byte("key-042"), []byte("updated"))
+	if err != nil {
+		t.Errorf("l.Store(%q, ...): unexpected error: %v", "key-042", err)
+		return
+	}
+	expected["key-042"] = "updated"
+	for _, key := range []string{"key-000", "key-150", "key-299"} {
+		err = l.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("l.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+		delete(expected, key)
+	}
+	err = l.Delete([]byte("key-150"))
+	if err == nil {
+		t.Errorf("l.Delete(%q) twice: expected error, got nil", "key-150")
+	}
+
+	deleted, err := l.DeleteRange([]byte("key-100"), []byte("key-200"))
+	if err != nil {
+		t.Errorf("l.DeleteRange(...): unexpected error: %v", err)
+		return
+	}
+	if deleted != 99 {
+		t.Errorf("l.DeleteRange(%q, %q) = %d, expected 99", "key-100", "key-200", deleted)
+	}
+	for key := range expected {
+		if key >= "key-100" && key < "key-200" {
+			delete(expected, key)
+		}
+	}
+
+	l, err = container.NewSkipList(buf)
+	if err != nil {
+		t.Errorf("NewSkipList(...): unexpected error: %v", err)
+		return
+	}
+	if n := l.Len(); n != int64(len(expected)) {
+		t.Errorf("l.Len() = %d, expected %d", n, len(expected))
+	}
+	for _, key := range []string{"key-000", "key-042", "key-150", "key-250"} {
+		value, ok, err := l.Load([]byte(key))
+		if err != nil {
+			t.Errorf("l.Load(%q): unexpected error: %v", key, err)
+			return
+		}
+		expectedValue, expectedOK := expected[key]
+		if ok != expectedOK || string(value) != expectedValue {
+			t.Errorf("l.Load(%q) = %q, %v, expected %q, %v", key, value, ok, expectedValue, expectedOK)
+		}
+	}
+
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var got []string
+	err = l.Range(func(key, value []byte) bool {
+		if string(value) != expected[string(key)] {
+			t.Errorf("l.Range(...): value for %q = %q, expected %q", key, value, expected[string(key)])
+		}
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("l.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Errorf("l.Range(...) = %v, expected %v", got, keys)
+	}
+
+	got = nil
+	err = l.Scan([]byte("key-095"), []byte("key-205"), func(key, _ []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("l.Scan(...): unexpected error: %v", err)
+		return
+	}
+	if expectedKeys := "[key-095 key-096 key-097 key-098 key-099 key-200 key-201 key-202 key-203 key-204]"; fmt.Sprint(got) != expectedKeys {
+		t.Errorf("l.Scan(%q, %q, ...) = %v, expected %v", "key-095", "key-205", got, expectedKeys)
+	}
+
+	deleted, err = l.DeleteRange(nil, nil)
+	if err != nil {
+		t.Errorf("l.DeleteRange(nil, nil): unexpected error: %v", err)
+		return
+	}
+	if deleted != int64(len(keys)) || l.Len() != 0 {
+		t.Errorf("l.DeleteRange(nil, nil) = %d, leaving %d entries, expected %d and 0", deleted, l.Len(), len(keys))
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunks, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(chunks) != 1 {
+		t.Errorf("pool.Allocated() = %d chunks after deleting everything, expected the head only", len(chunks))
+	}
+}
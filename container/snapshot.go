@@ -0,0 +1,169 @@
+package container
+
+import (
+	"errors"
+	"time"
+)
+
+// Snapshot is an immutable view of a HashMap at the time Snapshot was called.
+// The keys and values it references are kept allocated until it is released,
+// so that it can be read while the map is being modified.
+type Snapshot struct {
+	m       *HashMap
+	entries []snapshotEntry
+}
+
+type snapshotEntry struct {
+	key, value ChunkPtr
+}
+
+var errSnapshotReleased = errors.New("snapshot released")
+
+// Snapshot copies the entries of the map, holding the read lock only while
+// walking the buckets. Release has to be called once done with it.
+func (m *HashMap) Snapshot() (*Snapshot, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	s := &Snapshot{
+		m:       m,
+		entries: make([]snapshotEntry, 0, m.count),
+	}
+	now := time.Now().UnixNano()
+	var itErr error
+	err := m.iterateBuckets(func(_ int, _ hashBuckets, b *hashBucket) bool {
+		if b.Type != bucketTypeList || b.Head == 0 {
+			return true
+		}
+
+		node, err := NewKVNodeFromChunkPtr(m.pool, b.Head)
+		for err == nil && node != nil {
+			if !node.expired(now) {
+				s.entries = append(s.entries, snapshotEntry{key: node.key, value: node.value})
+			}
+
+			node, err = node.Next()
+		}
+		if err != nil {
+			itErr = err
+			return false
+		}
+
+		return true
+	})
+	if err == nil {
+		err = itErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.pin(s.ptrs()...)
+
+	return s, nil
+}
+
+// Len returns the number of entries in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+// Range calls f on every entry of the snapshot until it returns false. It
+// doesn't lock the map.
+func (s *Snapshot) Range(f func(key, value []byte) bool) error {
+	if s.m == nil {
+		return errSnapshotReleased
+	}
+
+	for _, e := range s.entries {
+		key, err := s.read(e.key)
+		if err != nil {
+			return err
+		}
+		value, err := s.read(e.value)
+		if err != nil {
+			return err
+		}
+
+		if !f(key, value) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *Snapshot) read(ptr ChunkPtr) ([]byte, error) {
+	chunk, err := s.m.pool.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk.ReadAll()
+}
+
+// Release unpins the chunks of the snapshot, freeing those the map released
+// in the meantime. The snapshot can't be used afterwards.
+func (s *Snapshot) Release() error {
+	if s.m == nil {
+		return nil
+	}
+	m := s.m
+	s.m = nil
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.unpin(s.ptrs()...)
+}
+
+func (s *Snapshot) ptrs() []ChunkPtr {
+	ptrs := make([]ChunkPtr, 0, 2*len(s.entries))
+	for _, e := range s.entries {
+		ptrs = append(ptrs, e.key, e.value)
+	}
+
+	return ptrs
+}
+
+func (m *HashMap) pin(ptrs ...ChunkPtr) {
+	m.pinM.Lock()
+	defer m.pinM.Unlock()
+
+	for _, ptr := range ptrs {
+		m.pinned[ptr]++
+	}
+}
+
+// unpin releases the chunks at ptrs, freeing those the map released while
+// they were pinned. The map must be locked for writing.
+func (m *HashMap) unpin(ptrs ...ChunkPtr) error {
+	m.pinM.Lock()
+	defer m.pinM.Unlock()
+
+	for _, ptr := range ptrs {
+		m.pinned[ptr]--
+		if m.pinned[ptr] > 0 {
+			continue
+		}
+		delete(m.pinned, ptr)
+		n, ok := m.deferred[ptr]
+		if !ok {
+			continue
+		}
+		delete(m.deferred, ptr)
+
+		chunk, err := m.pool.Get(ptr)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			err = chunk.Free()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
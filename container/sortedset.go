@@ -0,0 +1,227 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// SortedSet maps members to float64 scores, and ranges over them in score
+// order, members with equal scores being ordered by their bytes. It is stored
+// as a BTree holding both the score of every member and an entry for every
+// score and member pair, so that both lookups and score ranges are a single
+// tree operation.
+type SortedSet struct {
+	m *sync.RWMutex
+
+	tree *BTree
+}
+
+// Keys of the tree start with the kind of entry:
+//
+//	'm' member       -> score, big endian float64 bits
+//	's' score member -> empty, the score being encoded to sort like floats
+var (
+	sortedSetMemberPrefix = []byte{'m'}
+	sortedSetScorePrefix  = []byte{'s'}
+)
+
+var errNaNScore = errors.New("NaN score")
+
+func NewSortedSet(f io.ReadWriteSeeker, opts ...BTreeOption) (*SortedSet, error) {
+	tree, err := NewBTree(f, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SortedSet{
+		m: &sync.RWMutex{},
+
+		tree: tree,
+	}, nil
+}
+
+// encodeScore returns the big endian bits of score, with the sign bit flipped
+// for positive scores and every bit flipped for negative ones so that the
+// encoded scores sort like the floats.
+func encodeScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+
+	return b
+}
+
+func decodeScore(b []byte) float64 {
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return math.Float64frombits(bits)
+}
+
+func memberKey(member []byte) []byte {
+	return append(append([]byte{}, sortedSetMemberPrefix...), member...)
+}
+
+func scoreKey(score float64, member []byte) []byte {
+	key := append(append([]byte{}, sortedSetScorePrefix...), encodeScore(score)...)
+
+	return append(key, member...)
+}
+
+// Len returns the number of members in the set.
+func (s *SortedSet) Len() int64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.tree.Len() / 2
+}
+
+// Score returns the score of member, false if it isn't in the set.
+func (s *SortedSet) Score(member []byte) (float64, bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.score(member)
+}
+
+func (s *SortedSet) score(member []byte) (float64, bool, error) {
+	b, ok, err := s.tree.Load(memberKey(member))
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if len(b) != 8 {
+		return 0, false, fmt.Errorf("member %q: invalid score of %d bytes", member, len(b))
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), true, nil
+}
+
+// Add sets the score of member, returning false if it already was in the set.
+func (s *SortedSet) Add(member []byte, score float64) (bool, error) {
+	if math.IsNaN(score) {
+		return false, errNaNScore
+	}
+	if score == 0 {
+		score = 0 // -0 would sort before 0
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	old, ok, err := s.score(member)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		if old == score {
+			return false, nil
+		}
+		err = s.tree.Delete(scoreKey(old, member))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(score))
+	err = s.tree.Store(memberKey(member), b)
+	if err != nil {
+		return false, err
+	}
+
+	return !ok, s.tree.Store(scoreKey(score, member), nil)
+}
+
+// Remove removes member from the set, returning false if it wasn't in it.
+func (s *SortedSet) Remove(member []byte) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	score, ok, err := s.score(member)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = s.tree.Delete(scoreKey(score, member))
+	if err != nil {
+		return false, err
+	}
+
+	return true, s.tree.Delete(memberKey(member))
+}
+
+// Rank returns the number of members ordered before member, false if it isn't
+// in the set. It scans the lower ranked members, so it is linear in the rank.
+func (s *SortedSet) Rank(member []byte) (int64, bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	score, ok, err := s.score(member)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	var rank int64
+	err = s.tree.Scan(sortedSetScorePrefix, scoreKey(score, member), func(_, _ []byte) bool {
+		rank++
+		return true
+	})
+
+	return rank, true, err
+}
+
+// RangeByScore calls f on the members with scores from min to max, both
+// included, in order until it returns false.
+func (s *SortedSet) RangeByScore(min, max float64, f func(member []byte, score float64) bool) error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	end := encodeScore(max)
+
+	return s.tree.Scan(scoreKey(min, nil), nil, func(key, _ []byte) bool {
+		if !bytes.HasPrefix(key, sortedSetScorePrefix) {
+			return false
+		}
+		encoded := key[len(sortedSetScorePrefix) : len(sortedSetScorePrefix)+8]
+		if bytes.Compare(encoded, end) > 0 {
+			return false
+		}
+
+		return f(key[len(sortedSetScorePrefix)+8:], decodeScore(encoded))
+	})
+}
+
+// RangeByRank calls f on the members ranked from start, included, to stop,
+// excluded, in order until it returns false. A negative stop ranges up to the
+// last member.
+func (s *SortedSet) RangeByRank(start, stop int64, f func(member []byte, score float64) bool) error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	var rank int64
+	return s.tree.RangePrefix(sortedSetScorePrefix, func(key, _ []byte) bool {
+		rank++
+		if rank <= start {
+			return true
+		}
+		if stop >= 0 && rank > stop {
+			return false
+		}
+		encoded := key[len(sortedSetScorePrefix) : len(sortedSetScorePrefix)+8]
+
+		return f(key[len(sortedSetScorePrefix)+8:], decodeScore(encoded))
+	})
+}
@@ -0,0 +1,126 @@
+package container_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestSortedSet(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	s, err := container.NewSortedSet(buf, container.WithMaxKeys(4))
+	if err != nil {
+		t.Errorf("NewSortedSet(nil): unexpected error: %v", err)
+		return
+	}
+
+	for _, tc := range []struct {
+		member string
+		score  float64
+		added  bool
+	}{
+		{member: "alice", score: 10, added: true},
+		{member: "bob", score: -2.5, added: true},
+		{member: "carol", score: 10, added: true},
+		{member: "dave", score: 0, added: true},
+		{member: "eve", score: math.Inf(1), added: true},
+		{member: "frank", score: 3, added: true},
+		{member: "bob", score: 7},
+		{member: "frank", score: 3},
+	} {
+		added, err := s.Add([]byte(tc.member), tc.score)
+		if err != nil {
+			t.Errorf("s.Add(%q, %v): unexpected error: %v", tc.member, tc.score, err)
+			return
+		}
+		if added != tc.added {
+			t.Errorf("s.Add(%q, %v) = %v, expected %v", tc.member, tc.score, added, tc.added)
+		}
+	}
+	_, err = s.Add([]byte("nan"), math.NaN())
+	if err == nil {
+		t.Errorf("s.Add(%q, NaN): expected error, got nil", "nan")
+	}
+	removed, err := s.Remove([]byte("frank"))
+	if err != nil || !removed {
+		t.Errorf("s.Remove(%q) = %v, %v, expected true, nil", "frank", removed, err)
+	}
+	removed, err = s.Remove([]byte("missing"))
+	if err != nil || removed {
+		t.Errorf("s.Remove(%q) = %v, %v, expected false, nil", "missing", removed, err)
+	}
+
+	s, err = container.NewSortedSet(buf)
+	if err != nil {
+		t.Errorf("NewSortedSet(...): unexpected error: %v", err)
+		return
+	}
+	if n := s.Len(); n != 5 {
+		t.Errorf("s.Len() = %d, expected 5", n)
+	}
+	score, ok, err := s.Score([]byte("bob"))
+	if err != nil || !ok || score != 7 {
+		t.Errorf("s.Score(%q) = %v, %v, %v, expected 7, true, nil", "bob", score, ok, err)
+	}
+	_, ok, err = s.Score([]byte("frank"))
+	if err != nil || ok {
+		t.Errorf("s.Score(%q) = _, %v, %v, expected false, nil", "frank", ok, err)
+	}
+
+	for member, expected := range map[string]int64{"dave": 0, "bob": 1, "alice": 2, "carol": 3, "eve": 4} {
+		rank, ok, err := s.Rank([]byte(member))
+		if err != nil || !ok || rank != expected {
+			t.Errorf("s.Rank(%q) = %d, %v, %v, expected %d, true, nil", member, rank, ok, err, expected)
+		}
+	}
+	_, ok, err = s.Rank([]byte("missing"))
+	if err != nil || ok {
+		t.Errorf("s.Rank(%q) = _, %v, %v, expected false, nil", "missing", ok, err)
+	}
+
+	collect := func(got *[]string) func(member []byte, score float64) bool {
+		return func(member []byte, score float64) bool {
+			*got = append(*got, fmt.Sprintf("%s:%v", member, score))
+			return true
+		}
+	}
+	for _, tc := range []struct {
+		min, max float64
+		expected string
+	}{
+		{min: 0, max: 10, expected: "[dave:0 bob:7 alice:10 carol:10]"},
+		{min: 7.5, max: math.Inf(1), expected: "[alice:10 carol:10 eve:+Inf]"},
+		{min: math.Inf(-1), max: -1, expected: "[]"},
+	} {
+		var got []string
+		err = s.RangeByScore(tc.min, tc.max, collect(&got))
+		if err != nil {
+			t.Errorf("s.RangeByScore(%v, %v, ...): unexpected error: %v", tc.min, tc.max, err)
+			return
+		}
+		if fmt.Sprint(got) != tc.expected {
+			t.Errorf("s.RangeByScore(%v, %v, ...) = %v, expected %s", tc.min, tc.max, got, tc.expected)
+		}
+	}
+	for _, tc := range []struct {
+		start, stop int64
+		expected    string
+	}{
+		{start: 0, stop: 2, expected: "[dave:0 bob:7]"},
+		{start: 3, stop: -1, expected: "[carol:10 eve:+Inf]"},
+		{start: 5, stop: 10, expected: "[]"},
+	} {
+		var got []string
+		err = s.RangeByRank(tc.start, tc.stop, collect(&got))
+		if err != nil {
+			t.Errorf("s.RangeByRank(%d, %d, ...): unexpected error: %v", tc.start, tc.stop, err)
+			return
+		}
+		if fmt.Sprint(got) != tc.expected {
+			t.Errorf("s.RangeByRank(%d, %d, ...) = %v, expected %s", tc.start, tc.stop, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errReaderClosed = errors.New("reader closed")
+
+// Values of unknown size are read in a chunk of streamInitialCap bytes,
+// reallocated to twice its cap whenever it is full.
+const (
+	streamBufferSize = 32 << 10
+	streamInitialCap = 4096
+)
+
+// valueReader reads a value chunk pinned by LoadReader, so that it stays
+// allocated while the map is modified.
+type valueReader struct {
+	m     *HashMap
+	chunk *Chunk
+	size  int64
+	off   int64
+}
+
+// LoadReader returns a reader over the value of key and its size, without
+// reading the value in memory. The value is the one stored when LoadReader was
+// called, even if the key is stored or deleted before the reader is closed.
+// Close has to be called once done with it.
+func (m *HashMap) LoadReader(key []byte) (io.ReadCloser, int64, bool, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	node, err := m.findNode(key)
+	if err != nil || node == nil {
+		return nil, 0, false, err
+	}
+	chunk, err := node.Value()
+	if err != nil {
+		return nil, 0, true, err
+	}
+	m.pin(chunk.Ptr())
+
+	return &valueReader{
+		m:     m,
+		chunk: chunk,
+		size:  int64(chunk.Size64()),
+	}, int64(chunk.Size64()), true, nil
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.m == nil {
+		return 0, errReaderClosed
+	}
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+
+	n, err := r.chunk.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Close unpins the value, freeing it if the map released it in the meantime.
+func (r *valueReader) Close() error {
+	if r.m == nil {
+		return nil
+	}
+	m := r.m
+	r.m = nil
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.unpin(r.chunk.Ptr())
+}
+
+// StoreFromReader stores the value read from r for key, writing it to its
+// chunk as it is read. When size is negative, r is read until io.EOF, into a
+// chunk that grows as needed. Otherwise exactly size bytes are read from r.
+// The map is only locked once the value was written.
+func (m *HashMap) StoreFromReader(key []byte, r io.Reader, size int64) error {
+	chunk, err := m.writeValue(r, size)
+	if err != nil {
+		return err
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.update(func() error {
+		return m.store(m.headBuckets, key, chunk, 0)
+	})
+}
+
+func (m *HashMap) writeValue(r io.Reader, size int64) (*Chunk, error) {
+	initialCap := uint64(size)
+	if size < 0 {
+		initialCap = streamInitialCap
+	}
+	chunk, err := m.pool.Alloc64(initialCap)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk, err = copyToChunk(chunk, r, size)
+	if err != nil {
+		_ = chunk.Free()
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// copyToChunk writes r to chunk, returning the chunk it was written to once
+// reallocated.
+func copyToChunk(chunk *Chunk, r io.Reader, size int64) (*Chunk, error) {
+	buf := make([]byte, streamBufferSize)
+	var off int64
+	for size < 0 || off < size {
+		want := int64(len(buf))
+		if size >= 0 && size-off < want {
+			want = size - off
+		}
+		n, readErr := io.ReadFull(r, buf[:want])
+
+		end := off + int64(n)
+		if uint64(end) > chunk.Cap64() {
+			newCap := 2 * int64(chunk.Cap64())
+			if newCap < end {
+				newCap = end
+			}
+			if newCap > MaxChunkSize && end <= MaxChunkSize {
+				// the chunk only gets a wide header when needed
+				newCap = MaxChunkSize
+			}
+			grown, err := chunk.Realloc64(uint64(newCap))
+			if err != nil {
+				return chunk, err
+			}
+			chunk = grown
+		}
+		_, err := chunk.WriteAt(buf[:n], off)
+		if err != nil {
+			return chunk, err
+		}
+		off = end
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			if size >= 0 {
+				return chunk, fmt.Errorf("value ended after %d of %d bytes: %w", off, size, io.ErrUnexpectedEOF)
+			}
+			break
+		}
+		if readErr != nil {
+			return chunk, readErr
+		}
+	}
+
+	return chunk, nil
+}
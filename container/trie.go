@@ -0,0 +1,553 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Trie is a radix tree mapping keys to values, supporting longest prefix
+// matches and ranging over the keys sharing a prefix. Nodes hold the part of
+// the key leading to them from their parent, and are merged with their only
+// child when they have no value.
+type Trie struct {
+	m *sync.RWMutex
+
+	pool      *Pool
+	headChunk *Chunk
+	root      ChunkPtr
+	count     int64
+}
+
+// The head chunk holds the root node and the entry count:
+//
+//	root      int64
+//	count     int64
+//	magic     [4]byte
+//
+// Nodes hold their value, 0 if they have none, their children sorted by the
+// first byte of their label, and their label:
+//
+//	value     int64
+//	children  uint16
+//	child     children * (first uint8, node int64)
+//	label     []byte
+var (
+	sizeTrieHead       = sizePtr + sizeCount + len(trieMagic)
+	sizeTrieChild      = 1 + sizePtr
+	offsetTrieChildren = sizePtr + 2
+)
+
+var trieMagic = [4]byte{'k', 'v', 't', 'r'}
+
+type trieNode struct {
+	chunk    *Chunk
+	label    []byte
+	value    ChunkPtr
+	children []trieChild
+}
+
+type trieChild struct {
+	first byte
+	ptr   ChunkPtr
+}
+
+func NewTrie(f io.ReadWriteSeeker) (*Trie, error) {
+	pool, err := NewPool(f)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Trie{
+		m: &sync.RWMutex{},
+
+		pool: pool,
+	}
+
+	if pool.Size() == 0 {
+		t.headChunk, err = pool.Alloc(uint32(sizeTrieHead))
+		if err != nil {
+			return nil, err
+		}
+		root := &trieNode{}
+		err = t.writeNode(root)
+		if err != nil {
+			return nil, err
+		}
+		t.root = root.chunk.Ptr()
+
+		return t, t.writeHead()
+	}
+
+	t.headChunk, err = pool.Get(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := t.headChunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sizeTrieHead || !bytes.Equal(b[sizeTrieHead-len(trieMagic):], trieMagic[:]) {
+		return nil, fmt.Errorf("invalid trie header: %d bytes", len(b))
+	}
+	t.root = ChunkPtr(binary.LittleEndian.Uint64(b))
+	t.count = int64(binary.LittleEndian.Uint64(b[sizePtr:]))
+
+	return t, nil
+}
+
+func (t *Trie) writeHead() error {
+	b := make([]byte, sizeTrieHead)
+	binary.LittleEndian.PutUint64(b, uint64(t.root))
+	binary.LittleEndian.PutUint64(b[sizePtr:], uint64(t.count))
+	copy(b[sizePtr+sizeCount:], trieMagic[:])
+
+	_, err := t.headChunk.Write(b)
+
+	return err
+}
+
+// Len returns the number of entries in the trie.
+func (t *Trie) Len() int64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.count
+}
+
+func (t *Trie) readNode(ptr ChunkPtr) (*trieNode, error) {
+	chunk, err := t.pool.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := chunk.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < offsetTrieChildren {
+		return nil, fmt.Errorf("node 0x%x: invalid size %d", ptr, len(b))
+	}
+	n := int(binary.LittleEndian.Uint16(b[sizePtr:]))
+	if len(b) < offsetTrieChildren+n*sizeTrieChild {
+		return nil, fmt.Errorf("node 0x%x: invalid size %d for %d children", ptr, len(b), n)
+	}
+
+	node := &trieNode{
+		chunk:    chunk,
+		value:    ChunkPtr(binary.LittleEndian.Uint64(b)),
+		children: make([]trieChild, n),
+		label:    b[offsetTrieChildren+n*sizeTrieChild:],
+	}
+	for i := range node.children {
+		off := offsetTrieChildren + i*sizeTrieChild
+		node.children[i] = trieChild{
+			first: b[off],
+			ptr:   ChunkPtr(binary.LittleEndian.Uint64(b[off+1:])),
+		}
+	}
+
+	return node, nil
+}
+
+// writeNode writes n, allocating its chunk if it has none or growing it when
+// it is too small. The chunk is replaced when it can't grow in place, in which
+// case the parent has to be updated.
+func (t *Trie) writeNode(n *trieNode) error {
+	b := make([]byte, offsetTrieChildren+len(n.children)*sizeTrieChild, offsetTrieChildren+len(n.children)*sizeTrieChild+len(n.label))
+	binary.LittleEndian.PutUint64(b, uint64(n.value))
+	binary.LittleEndian.PutUint16(b[sizePtr:], uint16(len(n.children)))
+	for i, c := range n.children {
+		off := offsetTrieChildren + i*sizeTrieChild
+		b[off] = c.first
+		binary.LittleEndian.PutUint64(b[off+1:], uint64(c.ptr))
+	}
+	b = append(b, n.label...)
+
+	if n.chunk == nil {
+		var err error
+		n.chunk, err = t.pool.AllocAndWrite(b)
+		return err
+	}
+	if len(b) > int(n.chunk.Cap()) {
+		chunk, err := n.chunk.Realloc(uint32(len(b) + sizeTrieChild))
+		if err != nil {
+			return err
+		}
+		n.chunk = chunk
+	}
+	_, err := n.chunk.Write(b)
+
+	return err
+}
+
+// relink writes n, updating the child pointer of parent, or the root when
+// parent is nil, if n moved.
+func (t *Trie) relink(parent *trieNode, n *trieNode) error {
+	ptr := ChunkPtr(0)
+	if n.chunk != nil {
+		ptr = n.chunk.Ptr()
+	}
+	err := t.writeNode(n)
+	if err != nil || n.chunk.Ptr() == ptr {
+		return err
+	}
+
+	if parent == nil {
+		t.root = n.chunk.Ptr()
+		return t.writeHead()
+	}
+	i, ok := parent.child(n.label[0])
+	if !ok {
+		return fmt.Errorf("node 0x%x: missing child %q", parent.chunk.Ptr(), n.label[0])
+	}
+	parent.children[i].ptr = n.chunk.Ptr()
+
+	return t.writeNode(parent)
+}
+
+// child returns the index of the child starting with first, or where it would
+// be inserted and false.
+func (n *trieNode) child(first byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].first >= first
+	})
+
+	return i, i < len(n.children) && n.children[i].first == first
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// find returns the nodes from the root to the one holding key, nil if there
+// is none.
+func (t *Trie) find(key []byte) ([]*trieNode, error) {
+	n, err := t.readNode(t.root)
+	if err != nil {
+		return nil, err
+	}
+	path := []*trieNode{n}
+	for len(key) > 0 {
+		i, ok := n.child(key[0])
+		if !ok {
+			return nil, nil
+		}
+		n, err = t.readNode(n.children[i].ptr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(key, n.label) {
+			return nil, nil
+		}
+		key = key[len(n.label):]
+		path = append(path, n)
+	}
+
+	return path, nil
+}
+
+func (t *Trie) readValue(ptr ChunkPtr) ([]byte, error) {
+	chunk, err := t.pool.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk.ReadAll()
+}
+
+func (t *Trie) Load(key []byte) ([]byte, bool, error) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	path, err := t.find(key)
+	if err != nil || path == nil || path[len(path)-1].value == 0 {
+		return nil, false, err
+	}
+	value, err := t.readValue(path[len(path)-1].value)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return value, true, nil
+}
+
+func (t *Trie) Store(key, value []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	valueChunk, err := t.pool.AllocAndWrite(value)
+	if err != nil {
+		return err
+	}
+
+	var parent *trieNode
+	n, err := t.readNode(t.root)
+	if err != nil {
+		return err
+	}
+	rest := key
+	for len(rest) > 0 {
+		i, ok := n.child(rest[0])
+		if !ok {
+			leaf := &trieNode{label: rest, value: valueChunk.Ptr()}
+			err = t.writeNode(leaf)
+			if err != nil {
+				return err
+			}
+			n.children = append(n.children, trieChild{})
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = trieChild{first: rest[0], ptr: leaf.chunk.Ptr()}
+			err = t.relink(parent, n)
+			if err != nil {
+				return err
+			}
+			t.count++
+
+			return t.writeHead()
+		}
+
+		child, err := t.readNode(n.children[i].ptr)
+		if err != nil {
+			return err
+		}
+		common := commonPrefix(child.label, rest)
+		if common < len(child.label) {
+			child, err = t.split(n, i, child, common)
+			if err != nil {
+				return err
+			}
+		}
+		parent, n, rest = n, child, rest[common:]
+	}
+
+	old := n.value
+	n.value = valueChunk.Ptr()
+	err = t.writeNode(n)
+	if err != nil {
+		return err
+	}
+	if old != 0 {
+		chunk, err := t.pool.Get(old)
+		if err != nil {
+			return err
+		}
+		return chunk.Free()
+	}
+	t.count++
+
+	return t.writeHead()
+}
+
+// split cuts the label of child i of n after common bytes, returning the new
+// node holding the first part.
+func (t *Trie) split(n *trieNode, i int, child *trieNode, common int) (*trieNode, error) {
+	head := &trieNode{
+		label: append([]byte{}, child.label[:common]...),
+		children: []trieChild{
+			{first: child.label[common], ptr: child.chunk.Ptr()},
+		},
+	}
+	err := t.writeNode(head)
+	if err != nil {
+		return nil, err
+	}
+	n.children[i].ptr = head.chunk.Ptr()
+	err = t.writeNode(n)
+	if err != nil {
+		return nil, err
+	}
+
+	child.label = child.label[common:]
+	err = t.writeNode(child)
+	if err != nil {
+		return nil, err
+	}
+
+	return head, nil
+}
+
+func (t *Trie) Delete(key []byte) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	path, err := t.find(key)
+	if err != nil {
+		return err
+	}
+	if path == nil || path[len(path)-1].value == 0 {
+		return fmt.Errorf("key %q not found", key)
+	}
+
+	n := path[len(path)-1]
+	chunk, err := t.pool.Get(n.value)
+	if err != nil {
+		return err
+	}
+	n.value = 0
+	err = t.collapse(path)
+	if err != nil {
+		return err
+	}
+	err = chunk.Free()
+	if err != nil {
+		return err
+	}
+	t.count--
+
+	return t.writeHead()
+}
+
+// collapse writes the last node of path, removing it when it has neither a
+// value nor children and merging it with its child when it has only one. The
+// root is never removed.
+func (t *Trie) collapse(path []*trieNode) error {
+	n := path[len(path)-1]
+	if len(path) == 1 || n.value != 0 || len(n.children) > 1 {
+		return t.writeNode(n)
+	}
+	parent := path[len(path)-2]
+
+	if len(n.children) == 1 {
+		child, err := t.readNode(n.children[0].ptr)
+		if err != nil {
+			return err
+		}
+		n.label = append(append([]byte{}, n.label...), child.label...)
+		n.value, n.children = child.value, child.children
+		err = t.relink(parent, n)
+		if err != nil {
+			return err
+		}
+
+		return child.chunk.Free()
+	}
+
+	i, _ := parent.child(n.label[0])
+	parent.children = append(parent.children[:i], parent.children[i+1:]...)
+	err := t.writeNode(parent)
+	if err != nil {
+		return err
+	}
+	err = n.chunk.Free()
+	if err != nil {
+		return err
+	}
+	if len(parent.children) != 1 {
+		return nil
+	}
+
+	return t.collapse(path[:len(path)-1])
+}
+
+// LongestPrefix returns the longest key of the trie that is a prefix of key,
+// and its value, false if there is none.
+func (t *Trie) LongestPrefix(key []byte) (prefix, value []byte, ok bool, err error) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	n, err := t.readNode(t.root)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var (
+		depth int
+		match ChunkPtr
+	)
+	for consumed := 0; ; {
+		if n.value != 0 {
+			depth, match = consumed, n.value
+		}
+		if consumed == len(key) {
+			break
+		}
+		i, ok := n.child(key[consumed])
+		if !ok {
+			break
+		}
+		n, err = t.readNode(n.children[i].ptr)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !bytes.HasPrefix(key[consumed:], n.label) {
+			break
+		}
+		consumed += len(n.label)
+	}
+	if match == 0 {
+		return nil, nil, false, nil
+	}
+
+	value, err = t.readValue(match)
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	return key[:depth], value, true, nil
+}
+
+// RangePrefix calls f on the entries whose key starts with prefix, in key
+// order, until it returns false.
+func (t *Trie) RangePrefix(prefix []byte, f func(key, value []byte) bool) error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	n, err := t.readNode(t.root)
+	if err != nil {
+		return err
+	}
+	key := []byte{}
+	for len(key) < len(prefix) {
+		i, ok := n.child(prefix[len(key)])
+		if !ok {
+			return nil
+		}
+		n, err = t.readNode(n.children[i].ptr)
+		if err != nil {
+			return err
+		}
+		rest := prefix[len(key):]
+		if !bytes.HasPrefix(n.label, rest) && !bytes.HasPrefix(rest, n.label) {
+			return nil
+		}
+		key = append(key, n.label...)
+	}
+
+	_, err = t.walk(n, key, f)
+
+	return err
+}
+
+// walk calls f on the entries of the subtree of n, whose key is key, in key
+// order. It returns false once f did.
+func (t *Trie) walk(n *trieNode, key []byte, f func(key, value []byte) bool) (bool, error) {
+	if n.value != 0 {
+		value, err := t.readValue(n.value)
+		if err != nil {
+			return false, err
+		}
+		if !f(key, value) {
+			return false, nil
+		}
+	}
+
+	for _, c := range n.children {
+		child, err := t.readNode(c.ptr)
+		if err != nil {
+			return false, err
+		}
+		ok, err := t.walk(child, append(key[:len(key):len(key)], child.label...), f)
+		if err != nil || !ok {
+			return ok, err
+		}
+	}
+
+	return true, nil
+}
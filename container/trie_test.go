@@ -0,0 +1,138 @@
+package container_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestTrie(t *testing.T) {
+	buf := newReadWriteSeeker(nil)
+
+	trie, err := container.NewTrie(buf)
+	if err != nil {
+		t.Errorf("NewTrie(nil): unexpected error: %v", err)
+		return
+	}
+
+	expected := map[string]string{}
+	words := []string{"", "a", "ab", "abc", "abd", "b", "ba", "bar", "baz", "foo", "foobar", "foobaz", "fo"}
+	for i := 0; i < 300; i++ {
+		word := words[rand.Intn(len(words))] + words[rand.Intn(len(words))]
+		key, value := word, fmt.Sprintf("value-%d", i)
+		if rand.Intn(3) == 0 {
+			_, ok := expected[key]
+			err = trie.Delete([]byte(key))
+			if ok != (err == nil) {
+				t.Errorf("trie.Delete(%q) = %v, expected the key to exist: %v", key, err, ok)
+				return
+			}
+			delete(expected, key)
+			continue
+		}
+		err = trie.Store([]byte(key), []byte(value))
+		if err != nil {
+			t.Errorf("trie.Store(%q, %q): unexpected error: %v", key, value, err)
+			return
+		}
+		expected[key] = value
+	}
+
+	trie, err = container.NewTrie(buf)
+	if err != nil {
+		t.Errorf("NewTrie(...): unexpected error: %v", err)
+		return
+	}
+	if n := trie.Len(); n != int64(len(expected)) {
+		t.Errorf("trie.Len() = %d, expected %d", n, len(expected))
+	}
+	var keys []string
+	for _, a := range words {
+		for _, b := range words {
+			key := a + b
+			value, ok, err := trie.Load([]byte(key))
+			if err != nil {
+				t.Errorf("trie.Load(%q): unexpected error: %v", key, err)
+				return
+			}
+			expectedValue, expectedOK := expected[key]
+			if ok != expectedOK || string(value) != expectedValue {
+				t.Errorf("trie.Load(%q) = %q, %v, expected %q, %v", key, value, ok, expectedValue, expectedOK)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range append(keys, "abcdef", "fooba", "zzz") {
+		var expectedPrefix string
+		expectedOK := false
+		for k := range expected {
+			if strings.HasPrefix(key, k) && (!expectedOK || len(k) > len(expectedPrefix)) {
+				expectedPrefix, expectedOK = k, true
+			}
+		}
+		prefix, value, ok, err := trie.LongestPrefix([]byte(key))
+		if err != nil {
+			t.Errorf("trie.LongestPrefix(%q): unexpected error: %v", key, err)
+			return
+		}
+		if ok != expectedOK || string(prefix) != expectedPrefix || string(value) != expected[expectedPrefix] {
+			t.Errorf("trie.LongestPrefix(%q) = %q, %q, %v, expected %q, %q, %v", key, prefix, value, ok, expectedPrefix, expected[expectedPrefix], expectedOK)
+		}
+	}
+
+	for _, prefix := range []string{"", "a", "ab", "ba", "foob", "fooba", "foobarx", "z"} {
+		var expectedKeys []string
+		for key := range expected {
+			if strings.HasPrefix(key, prefix) {
+				expectedKeys = append(expectedKeys, key)
+			}
+		}
+		sort.Strings(expectedKeys)
+
+		var got []string
+		err = trie.RangePrefix([]byte(prefix), func(key, value []byte) bool {
+			if string(value) != expected[string(key)] {
+				t.Errorf("trie.RangePrefix(%q, ...): value for %q = %q, expected %q", prefix, key, value, expected[string(key)])
+			}
+			got = append(got, string(key))
+			return true
+		})
+		if err != nil {
+			t.Errorf("trie.RangePrefix(%q, ...): unexpected error: %v", prefix, err)
+			return
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expectedKeys) {
+			t.Errorf("trie.RangePrefix(%q, ...) = %v, expected %v", prefix, got, expectedKeys)
+		}
+	}
+
+	for key := range expected {
+		err = trie.Delete([]byte(key))
+		if err != nil {
+			t.Errorf("trie.Delete(%q): unexpected error: %v", key, err)
+			return
+		}
+	}
+	if n := trie.Len(); n != 0 {
+		t.Errorf("trie.Len() = %d, expected 0", n)
+	}
+
+	pool, err := container.NewPool(buf)
+	if err != nil {
+		t.Errorf("NewPool(...): unexpected error: %v", err)
+		return
+	}
+	chunks, err := pool.Allocated()
+	if err != nil {
+		t.Errorf("pool.Allocated(): unexpected error: %v", err)
+		return
+	}
+	if len(chunks) != 2 {
+		t.Errorf("pool.Allocated() = %d chunks after deleting everything, expected the head and root", len(chunks))
+	}
+}
@@ -0,0 +1,145 @@
+package container
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts values of type T to and from the bytes stored in a map.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// StringCodec stores strings as their bytes.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// Uint64Codec stores integers as 8 big endian bytes, so that the encoded keys
+// sort like the integers.
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(v uint64) ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+
+	return b, nil
+}
+
+func (Uint64Codec) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("invalid uint64 of %d bytes", len(b))
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// JSONCodec stores values as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+
+	return v, err
+}
+
+// TypedMap is a HashMap of keys of type K and values of type V, encoded with
+// the codecs it was created with. Keys have to be encoded the same way every
+// time for lookups to find them.
+type TypedMap[K comparable, V any] struct {
+	m      *HashMap
+	keys   Codec[K]
+	values Codec[V]
+}
+
+func NewTypedMap[K comparable, V any](m *HashMap, keys Codec[K], values Codec[V]) *TypedMap[K, V] {
+	return &TypedMap[K, V]{
+		m:      m,
+		keys:   keys,
+		values: values,
+	}
+}
+
+// HashMap returns the map the entries are stored in.
+func (t *TypedMap[K, V]) HashMap() *HashMap {
+	return t.m
+}
+
+func (t *TypedMap[K, V]) Load(key K) (V, bool, error) {
+	var v V
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return v, false, err
+	}
+	b, ok, err := t.m.Load(k)
+	if err != nil || !ok {
+		return v, ok, err
+	}
+	v, err = t.values.Decode(b)
+
+	return v, true, err
+}
+
+func (t *TypedMap[K, V]) Store(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	b, err := t.values.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return t.m.Store(k, b)
+}
+
+func (t *TypedMap[K, V]) Delete(key K) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+
+	return t.m.Delete(k)
+}
+
+func (t *TypedMap[K, V]) Len() (int64, error) {
+	return t.m.Len()
+}
+
+// Range calls f on every entry until it returns false, stopping with an error
+// when an entry can't be decoded.
+func (t *TypedMap[K, V]) Range(f func(key K, value V) bool) error {
+	var decodeErr error
+	err := t.m.Range(func(k, b []byte) bool {
+		key, err := t.keys.Decode(k)
+		if err != nil {
+			decodeErr = fmt.Errorf("key %q: %w", k, err)
+			return false
+		}
+		value, err := t.values.Decode(b)
+		if err != nil {
+			decodeErr = fmt.Errorf("value of key %q: %w", k, err)
+			return false
+		}
+
+		return f(key, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeErr
+}
@@ -0,0 +1,101 @@
+package container_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+func TestTypedMap(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+
+	buf := newReadWriteSeeker(nil)
+	m, err := container.NewHashMap(buf)
+	if err != nil {
+		t.Errorf("NewHashMap(nil): unexpected error: %v", err)
+		return
+	}
+	users := container.NewTypedMap[string, user](m, container.StringCodec{}, container.JSONCodec[user]{})
+
+	expected := map[string]user{
+		"alice": {Name: "Alice", Age: 31},
+		"bob":   {Name: "Bob", Age: 42},
+		"carol": {Name: "Carol", Age: 27},
+	}
+	for key, u := range expected {
+		err = users.Store(key, u)
+		if err != nil {
+			t.Errorf("users.Store(%q, ...): unexpected error: %v", key, err)
+			return
+		}
+	}
+	err = users.Delete("carol")
+	if err != nil {
+		t.Errorf("users.Delete(%q): unexpected error: %v", "carol", err)
+		return
+	}
+	delete(expected, "carol")
+
+	u, ok, err := users.Load("alice")
+	if err != nil {
+		t.Errorf("users.Load(%q): unexpected error: %v", "alice", err)
+		return
+	}
+	if !ok || u != expected["alice"] {
+		t.Errorf("users.Load(%q) = %+v, %v, expected %+v, true", "alice", u, ok, expected["alice"])
+	}
+	_, ok, err = users.Load("carol")
+	if err != nil || ok {
+		t.Errorf("users.Load(%q) = %v, %v, expected false, nil", "carol", ok, err)
+	}
+	n, err := users.Len()
+	if err != nil || n != 2 {
+		t.Errorf("users.Len() = %d, %v, expected 2", n, err)
+	}
+
+	got := map[string]user{}
+	err = users.Range(func(key string, u user) bool {
+		got[key] = u
+		return true
+	})
+	if err != nil {
+		t.Errorf("users.Range(...): unexpected error: %v", err)
+		return
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("users.Range(...) = %v, expected %v", got, expected)
+	}
+
+	err = users.HashMap().Store([]byte("dave"), []byte("not json"))
+	if err != nil {
+		t.Errorf("m.Store(%q, ...): unexpected error: %v", "dave", err)
+		return
+	}
+	_, _, err = users.Load("dave")
+	if err == nil {
+		t.Errorf("users.Load(%q): expected error decoding the value, got nil", "dave")
+	}
+	err = users.Range(func(string, user) bool { return true })
+	if err == nil {
+		t.Errorf("users.Range(...): expected error decoding the values, got nil")
+	}
+
+	ids := container.NewTypedMap[uint64, string](m, container.Uint64Codec{}, container.StringCodec{})
+	err = ids.Store(42, "answer")
+	if err != nil {
+		t.Errorf("ids.Store(42, ...): unexpected error: %v", err)
+		return
+	}
+	name, ok, err := ids.Load(42)
+	if err != nil || !ok || name != "answer" {
+		t.Errorf("ids.Load(42) = %q, %v, %v, expected %q, true, nil", name, ok, err, "answer")
+	}
+	b, ok, err := m.Load([]byte{0, 0, 0, 0, 0, 0, 0, 42})
+	if err != nil || !ok || string(b) != "answer" {
+		t.Errorf("m.Load(...) = %q, %v, %v, expected the key to be stored big endian", b, ok, err)
+	}
+}
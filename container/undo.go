@@ -0,0 +1,421 @@
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrNoUndoLog is returned by Rollback for pools opened without WithUndoLog.
+var ErrNoUndoLog = errors.New("pool has no undo log")
+
+// An undo log makes the updates of a pool, from Begin to Commit, atomic.
+// Before a page of the pool file is first overwritten in an update, its
+// former content is appended to the log, which is cleared on Commit. NewPool
+// rolls back the update the log was left with, writing the pages back and
+// truncating what the update appended to the file. The log is laid out as:
+//
+//	magic    [8]byte
+//	fileSize int64, size of the pool file when the update began
+//	crc      uint32, IEEE CRC of the magic and fileSize
+//
+// followed by the pages:
+//
+//	page     int64
+//	size     uint32, less than undoLogPage for the last page of the file
+//	crc      uint32, IEEE CRC of page, size and data
+//	data     [size]byte
+//
+// A torn page at the end of the log is ignored, its page having not been
+// overwritten yet. The log has to reach the file before the pool does, which
+// holds for files written in order, like an os.File that isn't synced.
+var undoLogMagic = [8]byte{'k', 'v', 'p', 'o', 'o', 'l', 'u', 'n'}
+
+const (
+	undoLogPage       = 4096
+	sizeUndoLogHeader = 8 + 8 + 4
+	sizeUndoLogRecord = 8 + 4 + 4
+)
+
+// undoLog stands for the pool file, saving the pages it overwrites during
+// updates to log.
+type undoLog struct {
+	f   io.ReadWriteSeeker
+	log io.ReadWriteSeeker
+	pos int64
+
+	depth    int
+	started  bool // the header was written, on the first write of the update
+	fileSize int64
+	end      int64 // end of the log
+	saved    map[int64]struct{}
+
+	tail int64 // end of the file when appended bytes couldn't be truncated
+}
+
+func newUndoLog(f, log io.ReadWriteSeeker) *undoLog {
+	return &undoLog{
+		f:     f,
+		log:   log,
+		saved: map[int64]struct{}{},
+	}
+}
+
+func (u *undoLog) Seek(offset int64, whence int) (int64, error) {
+	pos, err := u.f.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	u.pos = pos
+
+	return pos, nil
+}
+
+func (u *undoLog) Read(p []byte) (int, error) {
+	n, err := u.f.Read(p)
+	u.pos += int64(n)
+
+	return n, err
+}
+
+func (u *undoLog) Write(p []byte) (int, error) {
+	if u.depth > 0 {
+		err := u.save(u.pos, int64(len(p)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := u.f.Write(p)
+	u.pos += int64(n)
+
+	return n, err
+}
+
+// Truncate saves the pages past size before truncating the file, which must
+// implement Truncater.
+func (u *undoLog) Truncate(size int64) error {
+	if u.depth > 0 {
+		end, err := u.f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		err = u.save(size, end-size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.f.(Truncater).Truncate(size)
+}
+
+// save appends the pages holding the n bytes at pos to the log, unless they
+// were saved already or were appended by the update. The position of the file
+// is restored.
+func (u *undoLog) save(pos, n int64) error {
+	if !u.started {
+		size, err := u.f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		u.fileSize = size
+		err = u.writeAt(newUndoLogHeader(size), 0)
+		if err != nil {
+			return err
+		}
+		u.started, u.end = true, sizeUndoLogHeader
+	}
+
+	var saved bool
+	for page := pos / undoLogPage; page*undoLogPage < pos+n && page*undoLogPage < u.fileSize; page++ {
+		if _, ok := u.saved[page]; ok {
+			continue
+		}
+		size := int64(undoLogPage)
+		if rest := u.fileSize - page*undoLogPage; rest < size {
+			size = rest
+		}
+		record := make([]byte, sizeUndoLogRecord+size)
+		_, err := u.f.Seek(page*undoLogPage, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(u.f, record[sizeUndoLogRecord:])
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(record, uint64(page))
+		binary.LittleEndian.PutUint32(record[8:], uint32(size))
+		binary.LittleEndian.PutUint32(record[12:], undoLogRecordCRC(record))
+
+		err = u.writeAt(record, u.end)
+		if err != nil {
+			return err
+		}
+		u.end += int64(len(record))
+		u.saved[page] = struct{}{}
+		saved = true
+	}
+	if !saved {
+		return nil
+	}
+	_, err := u.f.Seek(u.pos, io.SeekStart)
+
+	return err
+}
+
+func (u *undoLog) writeAt(b []byte, off int64) error {
+	_, err := u.log.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = u.log.Write(b)
+
+	return err
+}
+
+func newUndoLogHeader(fileSize int64) []byte {
+	b := make([]byte, sizeUndoLogHeader)
+	copy(b, undoLogMagic[:])
+	binary.LittleEndian.PutUint64(b[8:], uint64(fileSize))
+	binary.LittleEndian.PutUint32(b[16:], crc32.ChecksumIEEE(b[:16]))
+
+	return b
+}
+
+func undoLogRecordCRC(record []byte) uint32 {
+	h := crc32.NewIEEE()
+	_, _ = h.Write(record[:12])
+	_, _ = h.Write(record[sizeUndoLogRecord:])
+
+	return h.Sum32()
+}
+
+// restore writes back the pages saved in the log, if it holds an update, and
+// truncates the file to its size before the update. When the file can't be
+// truncated, the end of the file is left in u.tail.
+func (u *undoLog) restore() error {
+	header := make([]byte, sizeUndoLogHeader)
+	_, err := u.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(u.log, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:8], undoLogMagic[:]) || binary.LittleEndian.Uint32(header[16:]) != crc32.ChecksumIEEE(header[:16]) {
+		return nil
+	}
+	fileSize := int64(binary.LittleEndian.Uint64(header[8:]))
+
+	var records [][]byte
+	for {
+		record := make([]byte, sizeUndoLogRecord, sizeUndoLogRecord+undoLogPage)
+		_, err = io.ReadFull(u.log, record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(record[8:])
+		if size > undoLogPage {
+			break
+		}
+		record = record[:sizeUndoLogRecord+int(size)]
+		_, err = io.ReadFull(u.log, record[sizeUndoLogRecord:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(record[12:]) != undoLogRecordCRC(record) {
+			break
+		}
+		records = append(records, record)
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		page := int64(binary.LittleEndian.Uint64(records[i]))
+		_, err = u.f.Seek(page*undoLogPage, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = u.f.Write(records[i][sizeUndoLogRecord:])
+		if err != nil {
+			return err
+		}
+	}
+
+	end, err := u.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end <= fileSize {
+		return nil
+	}
+	if canTruncate(u.f) {
+		return u.f.(Truncater).Truncate(fileSize)
+	}
+	u.fileSize, u.tail = fileSize, end
+
+	return nil
+}
+
+// clear empties the log once the update it holds is committed or rolled
+// back.
+func (u *undoLog) clear() error {
+	u.depth, u.started, u.end = 0, false, 0
+	u.saved = map[int64]struct{}{}
+	if canTruncate(u.log) {
+		return u.log.(Truncater).Truncate(0)
+	}
+
+	return u.writeAt(make([]byte, len(undoLogMagic)), 0)
+}
+
+// recover rolls back the update the undo log of the pool was left with, once
+// the format of the pool is known. The bytes an update appended to a file
+// that can't be truncated become a free chunk.
+func (p *Pool) recover() error {
+	u := p.undo
+	if u.tail > u.fileSize {
+		size := u.tail - u.fileSize
+		if size < int64(p.headerSize()) {
+			_, err := u.f.Seek(u.tail, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			_, err = u.f.Write(make([]byte, int64(p.headerSize())-size))
+			if err != nil {
+				return err
+			}
+			size = int64(p.headerSize())
+		}
+		rest, err := p.spanChunk(u.fileSize, u.fileSize+size)
+		if err != nil {
+			return fmt.Errorf("rolled back update: %w", err)
+		}
+		err = rest.writeHeader()
+		if err != nil {
+			return err
+		}
+		u.tail = 0
+	}
+	if p.buffer != nil {
+		err := p.buffer.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.clear()
+}
+
+// Begin starts an update of a pool opened with WithUndoLog, the changes made
+// to the pool until Commit being rolled back by Rollback or by the next
+// NewPool. Updates can nest, the outermost Commit ending the update. It is a
+// no-op for other pools.
+func (p *Pool) Begin() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.undo == nil {
+		return nil
+	}
+	if p.undo.depth == 0 && p.buffer != nil {
+		err := p.buffer.flush()
+		if err != nil {
+			return err
+		}
+	}
+	p.undo.depth++
+
+	return nil
+}
+
+// Commit ends the update started by Begin. The outermost Commit flushes the
+// writes staged by WithWriteBuffer, then clears the undo log.
+func (p *Pool) Commit() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.undo == nil || p.undo.depth == 0 {
+		return nil
+	}
+	p.undo.depth--
+	if p.undo.depth > 0 || !p.undo.started {
+		return nil
+	}
+	if p.buffer != nil {
+		err := p.buffer.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.undo.clear()
+}
+
+// Rollback undoes the changes made to the pool since the outermost Begin,
+// ending the update, and reloads the pool. Chunks obtained since must not be
+// used anymore.
+func (p *Pool) Rollback() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.undo == nil {
+		return ErrNoUndoLog
+	}
+	p.undo.depth = 0
+
+	for e := p.cache.Front(); e != nil; e = e.Next() {
+		e.Value.(*Chunk).elem = nil
+	}
+	p.cache.Init()
+	p.chunks = map[int64]*Chunk{}
+	p.freeChunks = map[int64]*Chunk{}
+	p.freeEnds = map[int64]*Chunk{}
+	p.freeSizes = nil
+	p.payloads = newPayloadCache(p.payloads.max)
+	p.count, p.wasted, p.wasteKnown = 0, 0, false
+	p.checkpoint = nil
+
+	return p.open()
+}
+
+// open loads the state of the pool from its file, after rolling back the
+// update left in its undo log.
+func (p *Pool) open() error {
+	if p.undo != nil {
+		err := p.undo.restore()
+		if err != nil {
+			return err
+		}
+	}
+	err := p.detectFormat()
+	if err != nil {
+		return err
+	}
+	if p.undo != nil {
+		err = p.recover()
+		if err != nil {
+			return err
+		}
+	}
+
+	ok, err := p.loadCheckpoint()
+	if err != nil || ok {
+		return err
+	}
+
+	return p.scan()
+}
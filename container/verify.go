@@ -0,0 +1,275 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// PoolProblem is an inconsistency found by Verify, at the position of the
+// chunk or bytes it concerns.
+type PoolProblem struct {
+	Pos int64
+	Err error
+}
+
+func (p PoolProblem) Error() string {
+	return fmt.Sprintf("0x%x: %v", p.Pos, p.Err)
+}
+
+func (p PoolProblem) Unwrap() error {
+	return p.Err
+}
+
+// Verify reads every chunk header back from the file, checking checksums and
+// that sizes fit caps and chunks fit the file, then cross-checks the free
+// list and the resident chunks against the headers. A chunk the pool knows of
+// that doesn't start on a header overlaps another one. After an unreadable
+// header, the scan resumes at the next chunk the pool knows of, the bytes in
+// between being reported as a gap. The returned error is only set when the
+// file can't be read.
+func (p *Pool) Verify() ([]PoolProblem, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	fileEnd, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		problems []PoolProblem
+		onDisk   = map[int64]*Chunk{}
+	)
+	report := func(pos int64, format string, args ...interface{}) {
+		problems = append(problems, PoolProblem{Pos: pos, Err: fmt.Errorf(format, args...)})
+	}
+
+	for pos := int64(0); pos < fileEnd; {
+		if fileEnd-pos < int64(p.headerSize()) {
+			report(pos, "%d trailing bytes, too short for a chunk header", fileEnd-pos)
+			break
+		}
+		_, err = p.f.Seek(pos, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		chunk := &Chunk{pool: p, pos: pos}
+		err = chunk.readHeaderFrom(p.f)
+		if errors.Is(err, ErrCorruptChunk) {
+			problems = append(problems, PoolProblem{Pos: pos, Err: err})
+			next := p.nextKnownChunk(pos)
+			if next < 0 {
+				break
+			}
+			report(pos, "0x%x bytes up to the next known chunk at 0x%x can't be walked", next-pos, next)
+			pos = next
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunk.end() > fileEnd {
+			report(pos, "chunk of cap %d ends past the end of the file at 0x%x", chunk.cap, fileEnd)
+			break
+		}
+		if chunk.shared && (chunk.free || chunk.cap-chunk.size < uint64(sizeRefs)) {
+			report(pos, "shared chunk of cap %d and size %d has no room for its reference count or is free", chunk.cap, chunk.size)
+		}
+		onDisk[pos] = chunk
+		pos = chunk.end()
+	}
+
+	for pos, c := range p.chunks {
+		disk, ok := onDisk[pos]
+		switch {
+		case !ok:
+			report(pos, "known chunk doesn't start on a chunk header, it overlaps another chunk")
+		case disk.free != c.free:
+			report(pos, "chunk is free %v on disk, %v in memory", disk.free, c.free)
+		case disk.cap != c.cap:
+			report(pos, "chunk has a cap of %d on disk, %d in memory", disk.cap, c.cap)
+		case !c.free && disk.size != c.size:
+			report(pos, "chunk has a size of %d on disk, %d in memory", disk.size, c.size)
+		case disk.shared != c.shared:
+			report(pos, "chunk is shared %v on disk, %v in memory", disk.shared, c.shared)
+		}
+	}
+	for pos, c := range p.freeChunks {
+		if p.chunks[pos] != c {
+			report(pos, "free list entry isn't a resident chunk")
+		}
+		if p.freeEnds[c.end()] != c {
+			report(pos, "free chunk is missing from the free list by end position")
+		}
+	}
+	for end, c := range p.freeEnds {
+		if p.freeChunks[c.pos] != c {
+			report(c.pos, "free list entry by end position 0x%x isn't in the free list", end)
+		}
+	}
+	for i, c := range p.freeSizes {
+		if p.freeChunks[c.pos] != c {
+			report(c.pos, "free list entry by size isn't in the free list")
+		}
+		if i == 0 {
+			continue
+		}
+		prev := p.freeSizes[i-1]
+		if prev.cap > c.cap || prev.cap == c.cap && prev.pos >= c.pos {
+			report(c.pos, "free list by size is out of order")
+		}
+	}
+	if len(p.freeSizes) != len(p.freeChunks) {
+		report(0, "free list by size has %d chunks, the free list %d", len(p.freeSizes), len(p.freeChunks))
+	}
+	for pos, disk := range onDisk {
+		if !disk.free || p.freeChunks[pos] != nil || p.checkpoint != nil && p.checkpoint.pos == pos {
+			continue
+		}
+		report(pos, "free chunk of cap %d is missing from the free list", disk.cap)
+	}
+	if len(problems) == 0 && len(onDisk) != p.count {
+		report(0, "pool counts %d chunks, the file has %d", p.count, len(onDisk))
+	}
+	if len(problems) == 0 && p.wasteKnown {
+		var wasted int64
+		for _, disk := range onDisk {
+			if !disk.free {
+				wasted += int64(disk.cap) - int64(disk.size)
+			}
+		}
+		if wasted != p.wasted {
+			report(0, "pool counts %d wasted bytes, the chunks waste %d", p.wasted, wasted)
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Pos < problems[j].Pos
+	})
+
+	return problems, nil
+}
+
+// nextKnownChunk returns the position of the first resident chunk after pos,
+// -1 if there is none.
+func (p *Pool) nextKnownChunk(pos int64) int64 {
+	next := int64(-1)
+	for chunkPos := range p.chunks {
+		if chunkPos > pos && (next < 0 || chunkPos < next) {
+			next = chunkPos
+		}
+	}
+
+	return next
+}
+
+// Verify runs Pool.Verify on the pool of the map and, when the pool is sound,
+// cross-checks the map against its chunks: the entry count, the reference
+// counts of shared values, and that every allocated chunk is reachable from
+// the map and every chunk the map references is allocated. Chunks and
+// references reported as unreachable are the ones Scavenge drops.
+func (m *HashMap) Verify() ([]PoolProblem, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	problems, err := m.pool.Verify()
+	if err != nil || len(problems) != 0 {
+		return problems, err
+	}
+
+	report := func(pos int64, format string, args ...interface{}) {
+		problems = append(problems, PoolProblem{Pos: pos, Err: fmt.Errorf(format, args...)})
+	}
+
+	count, err := m.countEntries()
+	if err != nil {
+		report(0, "map can't be walked: %v", err)
+		return problems, nil
+	}
+	if count != m.count {
+		report(0, "map counts %d entries, its buckets hold %d", m.count, count)
+	}
+
+	reachable, err := m.reachable()
+	if err != nil {
+		report(0, "map can't be walked: %v", err)
+		return problems, nil
+	}
+	reachable[m.headBucketsChunk.Ptr()]++
+	if head := m.headBuckets[0].chunk; head != m.headBucketsChunk {
+		reachable[head.Ptr()]++
+	}
+
+	chunks, err := m.pool.Allocated()
+	if err != nil {
+		return nil, err
+	}
+	allocated := make(map[ChunkPtr]struct{}, len(chunks))
+	for _, chunk := range chunks {
+		allocated[chunk.Ptr()] = struct{}{}
+		n, ok := reachable[chunk.Ptr()]
+		if !ok {
+			report(int64(chunk.Ptr()), "allocated chunk of size %d isn't reachable from the map", chunk.Size64())
+			continue
+		}
+		if !chunk.shared || n == 0 {
+			continue
+		}
+		refs, err := chunk.Refs()
+		if err != nil {
+			return nil, err
+		}
+		if int64(refs) != int64(n) {
+			report(int64(chunk.Ptr()), "shared chunk counts %d references, the map holds %d", refs, n)
+		}
+	}
+	for ptr := range reachable {
+		if _, ok := allocated[ptr]; !ok {
+			report(int64(ptr), "chunk referenced by the map isn't allocated")
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Pos < problems[j].Pos
+	})
+
+	return problems, nil
+}
+
+// Repair fixes the problems of the map Verify reports when its pool is sound:
+// the entry count is recomputed and the unreachable chunks and references are
+// dropped, as with Scavenge. It returns the number of chunks freed, and an
+// error when the pool has problems.
+func (m *HashMap) Repair() (int, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	problems, err := m.pool.Verify()
+	if err != nil {
+		return 0, err
+	}
+	if len(problems) != 0 {
+		return 0, fmt.Errorf("pool with %d problems can't be repaired: %w", len(problems), problems[0])
+	}
+
+	var n int
+	err = m.update(func() error {
+		count, err := m.countEntries()
+		if err != nil {
+			return err
+		}
+		if count != m.count {
+			m.count = count
+			err = m.writeCount()
+			if err != nil {
+				return err
+			}
+		}
+		n, err = m.scavenge()
+		return err
+	})
+
+	return n, err
+}
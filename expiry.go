@@ -0,0 +1,124 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Expiry returns the expiry of the key, the zero time if it doesn't expire.
+func (rtx *readTx) Expiry(bucket, key string) (time.Time, error) {
+	m, ok := rtx.store.buckets[bucket]
+	if !ok {
+		return time.Time{}, ErrKeyNotFound
+	}
+	expiry, ok, err := m.Expiry([]byte(key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok || !expiry.IsZero() && !expiry.After(time.Now()) {
+		return time.Time{}, ErrKeyNotFound
+	}
+
+	return expiry, nil
+}
+
+// Expiry returns the expiry of the key, including the one set in the
+// transaction, the zero time if it doesn't expire.
+func (wtx *writeTx) Expiry(bucket, key string) (time.Time, error) {
+	var value json.RawMessage
+	err := wtx.Get(bucket, key, &value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if value == nil {
+		return time.Time{}, ErrKeyNotFound
+	}
+
+	wtx.m.RLock()
+	expiry, staged := wtx.expiryCache[bucket][key]
+	_, written := wtx.writeCache[bucket][key]
+	m, ok := wtx.bucket(bucket)
+	wtx.m.RUnlock()
+	if staged || written || !ok {
+		return expiry, nil
+	}
+	expiry, _, err = m.Expiry([]byte(key))
+
+	return expiry, err
+}
+
+// SetExpiry makes the key expire at expiry, or never for the zero time, on
+// Commit. Setting the key again clears its expiry.
+func (wtx *writeTx) SetExpiry(bucket, key string, expiry time.Time) error {
+	var value json.RawMessage
+	err := wtx.Get(bucket, key, &value)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrKeyNotFound
+	}
+
+	wtx.m.Lock()
+	e, ok := wtx.expiryCache[bucket]
+	if !ok {
+		e = map[string]time.Time{}
+		wtx.expiryCache[bucket] = e
+	}
+	e[key] = expiry
+	wtx.m.Unlock()
+
+	return nil
+}
+
+// writeExpiries stores the values given an expiry in the transaction again,
+// with their expiry, once the writes are done.
+func (wtx *writeTx) writeExpiries() error {
+	for name, bucket := range wtx.expiryCache {
+		m, ok := wtx.store.buckets[name]
+		if !ok {
+			continue
+		}
+		for k, expiry := range bucket {
+			value, ok, err := m.Load([]byte(k))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			err = m.StoreWithExpiry([]byte(k), value, expiry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PurgeExpired deletes the expired keys of every bucket, returning how many
+// were deleted.
+func (st *store) PurgeExpired() (int, error) {
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	if st.readOnly {
+		return 0, ErrReadOnly
+	}
+	unlock, err := st.lockFile()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	var purged int
+	for _, m := range st.buckets {
+		n, err := m.PurgeExpired()
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
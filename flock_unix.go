@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flock takes an advisory lock on f, shared or exclusive, waiting for the
+// locks of other processes to be released, and returns the function releasing
+// it.
+func flock(f *os.File, shared bool) (unlock func(), err error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	fd := int(f.Fd())
+	for {
+		err = syscall.Flock(fd, how)
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+
+	return func() {
+		_ = syscall.Flock(fd, syscall.LOCK_UN)
+	}, nil
+}
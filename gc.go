@@ -0,0 +1,74 @@
+package kvstore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+// GCReport is the space reclaimed by GC.
+type GCReport struct {
+	Chunks     int   // freed in the pools of the buckets
+	ChunkBytes int64 // returned to the free lists of the pools
+	Blocks     int   // returned to the free list of the blocks
+	BlockBytes int64
+}
+
+// GC frees the chunks of the buckets and of the list of buckets that aren't
+// reachable from their map, like the keys and values leaked by Delete in
+// earlier versions, then the blocks that no object holds.
+func (st *store) GC() (GCReport, error) {
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	var report GCReport
+	if st.readOnly {
+		return report, ErrReadOnly
+	}
+	unlock, err := st.lockFile()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	names := make([]string, 0, len(st.buckets))
+	for name := range st.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scavenge := func(m *container.HashMap) error {
+		before, err := m.Stats()
+		if err != nil {
+			return err
+		}
+		n, err := m.Scavenge()
+		report.Chunks += n
+		if err != nil {
+			return err
+		}
+		after, err := m.Stats()
+		if err != nil {
+			return err
+		}
+		report.ChunkBytes += after.PoolFree - before.PoolFree
+
+		return nil
+	}
+	err = scavenge(st.bucketsMap)
+	if err != nil {
+		return report, fmt.Errorf("list of buckets: %w", err)
+	}
+	for _, name := range names {
+		err = scavenge(st.buckets[name])
+		if err != nil {
+			return report, fmt.Errorf("bucket %q: %w", name, err)
+		}
+	}
+
+	report.Blocks, err = st.db.Reclaim()
+	report.BlockBytes = int64(report.Blocks) * int64(st.db.Meta().BlockSize)
+
+	return report, err
+}
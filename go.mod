@@ -1,3 +1,3 @@
 module github.com/yazgazan/kvstore
 
-go 1.16
+go 1.18
@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/yazgazan/kvstore/container"
+)
+
+// KeyFilter selects a page of the sorted keys of a bucket, for Keys.
+type KeyFilter struct {
+	Prefix string
+	After  string                // only keys sorted after this one, for the next page
+	Limit  int                   // no limit when <= 0
+	Match  func(key string) bool // optional
+}
+
+func (f KeyFilter) match(key string) bool {
+	if !strings.HasPrefix(key, f.Prefix) || f.After != "" && key <= f.After {
+		return false
+	}
+
+	return f.Match == nil || f.Match(key)
+}
+
+// page collects the smallest keys matching f, holding at most f.Limit of them
+// in a max-heap so that the bucket is walked without keeping all its keys.
+type page struct {
+	f    KeyFilter
+	keys []string
+}
+
+func (p *page) add(key string) {
+	if !p.f.match(key) {
+		return
+	}
+	if p.f.Limit <= 0 || len(p.keys) < p.f.Limit {
+		heap.Push(p, key)
+		return
+	}
+	if key < p.keys[0] {
+		p.keys[0] = key
+		heap.Fix(p, 0)
+	}
+}
+
+func (p *page) sorted() []string {
+	keys := p.keys
+	if keys == nil {
+		keys = []string{}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (p *page) Len() int           { return len(p.keys) }
+func (p *page) Less(i, j int) bool { return p.keys[i] > p.keys[j] }
+func (p *page) Swap(i, j int)      { p.keys[i], p.keys[j] = p.keys[j], p.keys[i] }
+
+func (p *page) Push(x interface{}) {
+	p.keys = append(p.keys, x.(string))
+}
+
+func (p *page) Pop() interface{} {
+	key := p.keys[len(p.keys)-1]
+	p.keys = p.keys[:len(p.keys)-1]
+
+	return key
+}
+
+// rangePage returns the page of the keys of m selected by f. Maps with an
+// ordered index are walked in key order from the first key after f.After,
+// stopping once the page is full, others are walked whole.
+func rangePage(m *container.HashMap, f KeyFilter) ([]string, error) {
+	var after []byte
+	if f.After != "" {
+		after = []byte(f.After)
+	}
+	keys := []string{}
+	err := m.RangeKeys([]byte(f.Prefix), after, func(key []byte) bool {
+		if k := string(key); f.Match == nil || f.Match(k) {
+			keys = append(keys, k)
+		}
+
+		return f.Limit <= 0 || len(keys) < f.Limit
+	})
+	if err == nil {
+		return keys, nil
+	}
+	if !errors.Is(err, container.ErrNoOrderedIndex) {
+		return nil, err
+	}
+
+	p := &page{f: f}
+	err = m.Range(func(key, _ []byte) bool {
+		p.add(string(key))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.sorted(), nil
+}
+
+// Keys returns the sorted keys of the bucket selected by f.
+func (rtx *readTx) Keys(bucket string, f KeyFilter) ([]string, error) {
+	m, ok := rtx.store.buckets[bucket]
+	if !ok {
+		return nil, nil
+	}
+
+	return rangePage(m, f)
+}
+
+// Keys returns the sorted keys of the bucket selected by f, including the
+// changes of the transaction.
+func (wtx *writeTx) Keys(bucket string, f KeyFilter) ([]string, error) {
+	keys, err := wtx.List(bucket)
+	if err != nil || keys == nil {
+		return keys, err
+	}
+
+	p := &page{f: f}
+	for _, key := range keys {
+		p.add(key)
+	}
+
+	return p.sorted(), nil
+}
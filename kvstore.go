@@ -3,16 +3,24 @@ package kvstore
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/yazgazan/kvstore/block"
 	"github.com/yazgazan/kvstore/container"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrKeyExists      = errors.New("key already exists")
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrReadOnly       = errors.New("store is read-only")
+)
 
 type Store interface {
 	io.Closer
@@ -21,6 +29,10 @@ type Store interface {
 	Reader() ReadTx
 	Writer() WriteTx
 	Get(bucket, key string, dst interface{}) error
+	Verify(repair bool) (VerifyReport, error)
+	Backup(w io.Writer) error
+	PurgeExpired() (int, error)
+	GC() (GCReport, error)
 }
 
 type Tx interface {
@@ -33,6 +45,8 @@ type ReadTx interface {
 
 	Get(bucket, key string, dst interface{}) error
 	List(bucket string) ([]string, error)
+	Keys(bucket string, f KeyFilter) ([]string, error)
+	Expiry(bucket, key string) (time.Time, error)
 }
 
 type WriteTx interface {
@@ -40,20 +54,31 @@ type WriteTx interface {
 
 	Get(bucket, key string, dst interface{}) error
 	List(bucket string) ([]string, error)
+	Keys(bucket string, f KeyFilter) ([]string, error)
+	Expiry(bucket, key string) (time.Time, error)
 	Set(bucket, key string, value interface{}) error
 	Delete(bucket, key string) error
+	SetExpiry(bucket, key string, expiry time.Time) error
+	DeleteBucket(bucket string) error
+	RenameKey(bucket, oldKey, newKey string) error
+	RenameBucket(oldBucket, newBucket string) error
 }
 
 type store struct {
 	db     *block.BlockDB
 	closer io.Closer
+	file   *os.File // set by NewFromFile, locked while writing to it
 
 	m          *sync.RWMutex
 	buckets    map[string]*container.HashMap // map[bucketName]hashmap
 	bucketsMap *container.HashMap
+	readOnly   bool
 }
 
-func New(f io.ReadWriteSeeker) (Store, error) {
+// New opens the store in f, creating it when f is empty. The options are
+// given to block.Create or block.Open, like block.WithCipher for encrypted
+// stores.
+func New(f io.ReadWriteSeeker, opts ...block.Option) (Store, error) {
 	var db *block.BlockDB
 
 	n, err := f.Seek(0, io.SeekEnd)
@@ -61,14 +86,44 @@ func New(f io.ReadWriteSeeker) (Store, error) {
 		return nil, err
 	}
 	if n == 0 {
-		db, err = block.Create(f)
+		db, err = block.Create(f, opts...)
 	} else {
-		db, err = block.Open(f)
+		db, err = block.Open(f, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := newStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// NewReadOnly opens a read-only store over r, using block.OpenShared so that
+// nothing is written to it. Write transactions fail to commit with
+// ErrReadOnly. Stores that weren't closed cleanly must be opened with New
+// first, to be recovered.
+func NewReadOnly(r io.ReaderAt, opts ...block.Option) (Store, error) {
+	db, err := block.OpenShared(r, opts...)
+	if err != nil {
+		return nil, err
 	}
+
+	st, err := newStore(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	st.readOnly = true
 
+	return st, nil
+}
+
+func newStore(db *block.BlockDB) (*store, error) {
 	obj, err := db.Open("objects")
 	if errors.Is(err, os.ErrNotExist) {
 		obj, err = db.Create("objects")
@@ -119,13 +174,38 @@ func New(f io.ReadWriteSeeker) (Store, error) {
 	return st, nil
 }
 
-func NewFromFile(fpath string) (Store, error) {
+func NewFromFile(fpath string, opts ...block.Option) (Store, error) {
 	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
+	unlock, err := flock(f, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
-	st, err := New(f)
+	st, err := New(f, opts...)
+	unlock()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st.(*store).closer = f
+	st.(*store).file = f
+
+	return st, nil
+}
+
+// OpenReadOnly opens the store at fpath with NewReadOnly, the file being
+// opened read-only.
+func OpenReadOnly(fpath string, opts ...block.Option) (Store, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := NewReadOnly(f, opts...)
 	if err != nil {
 		f.Close()
 		return nil, err
@@ -136,6 +216,16 @@ func NewFromFile(fpath string) (Store, error) {
 }
 
 func (st *store) Close() error {
+	if !st.readOnly {
+		err := st.checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+	err := st.db.Close()
+	if err != nil {
+		return err
+	}
 	if st.closer == nil {
 		return nil
 	}
@@ -143,6 +233,40 @@ func (st *store) Close() error {
 	return st.closer.Close()
 }
 
+func (st *store) checkpoint() error {
+	st.m.Lock()
+	defer st.m.Unlock()
+	unlock, err := st.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = st.bucketsMap.Checkpoint()
+	if err != nil {
+		return err
+	}
+	for _, m := range st.buckets {
+		err = m.Checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockFile takes an exclusive advisory lock on the file of the stores opened
+// by NewFromFile, for the writes to the store not to overlap with a backup
+// taken by BackupFile in another process.
+func (st *store) lockFile() (unlock func(), err error) {
+	if st.file == nil {
+		return func() {}, nil
+	}
+
+	return flock(st.file, false)
+}
+
 func (st *store) Buckets() ([]string, error) {
 	st.m.Lock()
 	defer st.m.Unlock()
@@ -242,6 +366,8 @@ func (st *store) Writer() WriteTx {
 		m:           &sync.RWMutex{},
 		writeCache:  map[string]map[string]json.RawMessage{},
 		deleteCache: map[string]map[string]bool{},
+		bucketNames: map[string]string{},
+		expiryCache: map[string]map[string]time.Time{},
 	}
 }
 
@@ -251,6 +377,8 @@ type writeTx struct {
 	store       *store
 	writeCache  map[string]map[string]json.RawMessage
 	deleteCache map[string]map[string]bool
+	bucketNames map[string]string // buckets deleted ("") or renamed in the transaction, to the bucket of the store they name
+	expiryCache map[string]map[string]time.Time
 }
 
 func (wtx *writeTx) Commit() error {
@@ -262,17 +390,35 @@ func (wtx *writeTx) Commit() error {
 	defer wtx.m.Unlock()
 	defer wtx.store.m.Unlock()
 
+	if wtx.store.readOnly {
+		wtx.store = nil
+		return ErrReadOnly
+	}
+	unlock, err := wtx.store.lockFile()
+	if err != nil {
+		wtx.store = nil
+		return err
+	}
+	defer unlock()
+	err = wtx.rebindBuckets()
+	if err != nil {
+		wtx.store = nil
+		return err
+	}
+
 	for name, bucket := range wtx.writeCache {
 		deletedCache := wtx.deleteCache[name]
+		items := make([]container.KV, 0, len(bucket))
 		for k, v := range bucket {
 			if deletedCache != nil && deletedCache[k] {
 				continue
 			}
-			err := wtx.write(name, k, v)
-			if err != nil {
-				wtx.store = nil
-				return err
-			}
+			items = append(items, container.KV{Key: []byte(k), Value: v})
+		}
+		err := wtx.write(name, items)
+		if err != nil {
+			wtx.store = nil
+			return err
 		}
 	}
 
@@ -286,6 +432,18 @@ func (wtx *writeTx) Commit() error {
 			if !ok {
 				continue
 			}
+			if _, set := wtx.writeCache[name][k]; set {
+				// set then deleted in the transaction, the key may only have
+				// been in its cache
+				_, ok, err := m.Load([]byte(k))
+				if err != nil {
+					wtx.store = nil
+					return err
+				}
+				if !ok {
+					continue
+				}
+			}
 			err := m.Delete([]byte(k))
 			if err != nil {
 				wtx.store = nil
@@ -294,15 +452,85 @@ func (wtx *writeTx) Commit() error {
 		}
 	}
 
+	err = wtx.writeExpiries()
+	if err != nil {
+		wtx.store = nil
+		return err
+	}
+
 	wtx.store = nil
 
 	return nil
 }
 
-func (wtx *writeTx) write(bucket, key string, payload json.RawMessage) error {
+// rebindBuckets applies the deletes and renames of buckets. The buckets no
+// name is left to are removed from the list of buckets before their object is
+// deleted, so that an interrupted commit leaves unused objects rather than
+// buckets without one. Renamed buckets keep their object.
+func (wtx *writeTx) rebindBuckets() error {
+	st := wtx.store
+	bound := map[string]bool{}
+	for _, src := range wtx.bucketNames {
+		if src != "" {
+			bound[src] = true
+		}
+	}
+
+	type binding struct {
+		m    *container.HashMap
+		path []byte
+	}
+	moved := map[string]binding{}
+	for name := range wtx.bucketNames {
+		m, ok := st.buckets[name]
+		if !ok {
+			continue
+		}
+		p, _, err := st.bucketsMap.Load([]byte(name))
+		if err != nil {
+			return err
+		}
+		err = st.bucketsMap.Delete([]byte(name))
+		if err != nil {
+			return err
+		}
+		delete(st.buckets, name)
+		if bound[name] {
+			moved[name] = binding{m: m, path: p}
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		err = st.db.Delete(string(p))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	for name, src := range wtx.bucketNames {
+		b, ok := moved[src]
+		if src == "" || !ok {
+			continue
+		}
+		err := st.bucketsMap.Store([]byte(name), b.path)
+		if err != nil {
+			return err
+		}
+		st.buckets[name] = b.m
+	}
+
+	return nil
+}
+
+func (wtx *writeTx) write(bucket string, items []container.KV) error {
+	if len(items) == 0 {
+		return nil
+	}
+
 	m, ok := wtx.store.buckets[bucket]
 	if !ok {
-		p := bucketPath(bucket)
+		p := wtx.store.newBucketPath(bucket)
 		obj, err := wtx.store.db.Create(p)
 		if err != nil {
 			return err
@@ -318,7 +546,7 @@ func (wtx *writeTx) write(bucket, key string, payload json.RawMessage) error {
 
 		wtx.store.buckets[bucket] = m
 	}
-	return m.Store([]byte(key), payload)
+	return m.StoreBatch(items)
 }
 
 func (wtx *writeTx) Rollback() error {
@@ -348,10 +576,8 @@ func (wtx *writeTx) Get(bucket, key string, dst interface{}) error {
 			return json.Unmarshal(cached, dst)
 		}
 	}
+	m, ok := wtx.bucket(bucket)
 	wtx.m.RUnlock()
-
-	p := bucketPath(bucket)
-	m, ok := wtx.store.buckets[p]
 	if !ok {
 		return nil
 	}
@@ -367,8 +593,9 @@ func (wtx *writeTx) Get(bucket, key string, dst interface{}) error {
 }
 
 func (wtx *writeTx) List(bucket string) ([]string, error) {
-	p := bucketPath(bucket)
-	m, ok := wtx.store.buckets[p]
+	wtx.m.RLock()
+	m, ok := wtx.bucket(bucket)
+	wtx.m.RUnlock()
 	if !ok {
 		return nil, nil
 	}
@@ -431,6 +658,7 @@ func (wtx *writeTx) Set(bucket, key string, value interface{}) error {
 	if ok {
 		d[key] = false
 	}
+	delete(wtx.expiryCache[bucket], key)
 	wtx.m.Unlock()
 
 	return nil
@@ -445,11 +673,107 @@ func (wtx *writeTx) Delete(bucket, key string) error {
 		wtx.deleteCache[bucket] = d
 	}
 	d[key] = true
+	delete(wtx.expiryCache[bucket], key)
+	wtx.m.Unlock()
+
+	return nil
+}
+
+// DeleteBucket deletes the bucket and its keys on Commit, before the keys set
+// in the transaction are written.
+func (wtx *writeTx) DeleteBucket(bucket string) error {
+	wtx.m.Lock()
+	wtx.bucketNames[bucket] = ""
+	delete(wtx.writeCache, bucket)
+	delete(wtx.deleteCache, bucket)
+	delete(wtx.expiryCache, bucket)
 	wtx.m.Unlock()
 
 	return nil
 }
 
+// RenameKey moves the value of oldKey to newKey, which must not exist.
+func (wtx *writeTx) RenameKey(bucket, oldKey, newKey string) error {
+	var value json.RawMessage
+	err := wtx.Get(bucket, oldKey, &value)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrKeyNotFound
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	var existing json.RawMessage
+	err = wtx.Get(bucket, newKey, &existing)
+	if err == nil && existing != nil {
+		return ErrKeyExists
+	}
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	err = wtx.Set(bucket, newKey, value)
+	if err != nil {
+		return err
+	}
+
+	return wtx.Delete(bucket, oldKey)
+}
+
+// RenameBucket gives the keys of oldBucket, including the ones written in the
+// transaction, to newBucket, which must not exist.
+func (wtx *writeTx) RenameBucket(oldBucket, newBucket string) error {
+	wtx.m.Lock()
+	defer wtx.m.Unlock()
+
+	src, ok := wtx.bucketNames[oldBucket]
+	if !ok {
+		src = oldBucket
+	}
+	if _, stored := wtx.store.buckets[src]; src == "" || !stored {
+		return ErrBucketNotFound
+	}
+	if oldBucket == newBucket {
+		return nil
+	}
+	if _, ok := wtx.bucket(newBucket); ok || len(wtx.writeCache[newBucket]) != 0 {
+		return ErrBucketExists
+	}
+
+	wtx.bucketNames[newBucket] = src
+	wtx.bucketNames[oldBucket] = ""
+	if b, ok := wtx.writeCache[oldBucket]; ok {
+		wtx.writeCache[newBucket] = b
+		delete(wtx.writeCache, oldBucket)
+	}
+	delete(wtx.deleteCache, newBucket)
+	if d, ok := wtx.deleteCache[oldBucket]; ok {
+		wtx.deleteCache[newBucket] = d
+		delete(wtx.deleteCache, oldBucket)
+	}
+	delete(wtx.expiryCache, newBucket)
+	if e, ok := wtx.expiryCache[oldBucket]; ok {
+		wtx.expiryCache[newBucket] = e
+		delete(wtx.expiryCache, oldBucket)
+	}
+
+	return nil
+}
+
+// bucket returns the map of the store the bucket names in the transaction.
+// wtx.m has to be held.
+func (wtx *writeTx) bucket(name string) (*container.HashMap, bool) {
+	src, ok := wtx.bucketNames[name]
+	if !ok {
+		src = name
+	}
+	m, ok := wtx.store.buckets[src]
+
+	return m, ok && src != ""
+}
+
 func contains(ss []string, needle string) bool {
 	for _, s := range ss {
 		if s == needle {
@@ -463,3 +787,15 @@ func contains(ss []string, needle string) bool {
 func bucketPath(name string) string {
 	return path.Join("bucket", name)
 }
+
+// newBucketPath returns a path for a new bucket that isn't used by a bucket
+// renamed from name.
+func (st *store) newBucketPath(name string) string {
+	p := bucketPath(name)
+	used := st.db.List(p)
+	for i := 1; contains(used, p); i++ {
+		p = fmt.Sprintf("%s~%d", bucketPath(name), i)
+	}
+
+	return p
+}
@@ -1,6 +1,654 @@
 package kvstore_test
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yazgazan/kvstore"
+	"github.com/yazgazan/kvstore/block"
+)
 
 func TestKVStore(t *testing.T) {
 }
+
+func TestStoreDeleteBucket(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "store.db")
+	st, err := kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+
+	tx := st.Writer()
+	for _, bucket := range []string{"a", "b"} {
+		err = tx.Set(bucket, "key", bucket+" value")
+		if err != nil {
+			t.Errorf("tx.Set(%q, ...): unexpected error: %v", bucket, err)
+			tx.Rollback()
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	tx = st.Writer()
+	err = tx.DeleteBucket("a")
+	if err != nil {
+		t.Errorf("tx.DeleteBucket(%q): unexpected error: %v", "a", err)
+		tx.Rollback()
+		return
+	}
+	keys, err := tx.List("a")
+	if err != nil || len(keys) != 0 {
+		t.Errorf("tx.List(%q) = %v, %v, expected no keys", "a", keys, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+	err = st.Close()
+	if err != nil {
+		t.Errorf("st.Close(): unexpected error: %v", err)
+		return
+	}
+
+	st, err = kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer st.Close()
+	buckets, err := st.Buckets()
+	if err != nil || len(buckets) != 1 || buckets[0] != "b" {
+		t.Errorf("st.Buckets() = %v, %v, expected [b]", buckets, err)
+	}
+
+	tx = st.Writer()
+	_ = tx.DeleteBucket("b")
+	err = tx.Set("b", "other", "recreated")
+	if err != nil {
+		t.Errorf("tx.Set(%q, ...): unexpected error: %v", "b", err)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+	var value string
+	err = st.Get("b", "key", &value)
+	if err != kvstore.ErrKeyNotFound {
+		t.Errorf("st.Get(%q, %q) = %v, expected ErrKeyNotFound", "b", "key", err)
+	}
+	err = st.Get("b", "other", &value)
+	if err != nil || value != "recreated" {
+		t.Errorf("st.Get(%q, %q) = %q, %v, expected %q", "b", "other", value, err, "recreated")
+	}
+}
+
+func TestStoreRename(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "store.db")
+	st, err := kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+
+	tx := st.Writer()
+	_ = tx.Set("a", "k1", "v1")
+	_ = tx.Set("a", "k2", "v2")
+	_ = tx.Set("c", "k", "v")
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	tx = st.Writer()
+	err = tx.RenameKey("a", "k1", "k2")
+	if err != kvstore.ErrKeyExists {
+		t.Errorf("tx.RenameKey(%q, %q, %q) = %v, expected ErrKeyExists", "a", "k1", "k2", err)
+	}
+	err = tx.RenameKey("a", "missing", "k3")
+	if err != kvstore.ErrKeyNotFound {
+		t.Errorf("tx.RenameKey(%q, %q, %q) = %v, expected ErrKeyNotFound", "a", "missing", "k3", err)
+	}
+	err = tx.RenameKey("a", "k1", "k3")
+	if err != nil {
+		t.Errorf("tx.RenameKey(%q, %q, %q): unexpected error: %v", "a", "k1", "k3", err)
+	}
+	err = tx.RenameBucket("a", "c")
+	if err != kvstore.ErrBucketExists {
+		t.Errorf("tx.RenameBucket(%q, %q) = %v, expected ErrBucketExists", "a", "c", err)
+	}
+	err = tx.RenameBucket("missing", "d")
+	if err != kvstore.ErrBucketNotFound {
+		t.Errorf("tx.RenameBucket(%q, %q) = %v, expected ErrBucketNotFound", "missing", "d", err)
+	}
+	err = tx.RenameBucket("a", "b")
+	if err != nil {
+		t.Errorf("tx.RenameBucket(%q, %q): unexpected error: %v", "a", "b", err)
+	}
+	var value string
+	err = tx.Get("b", "k3", &value)
+	if err != nil || value != "v1" {
+		t.Errorf("tx.Get(%q, %q) = %q, %v, expected %q", "b", "k3", value, err, "v1")
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	tx = st.Writer()
+	_ = tx.Set("a", "new", "recreated")
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+	err = st.Close()
+	if err != nil {
+		t.Errorf("st.Close(): unexpected error: %v", err)
+		return
+	}
+
+	st, err = kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer st.Close()
+	buckets, err := st.Buckets()
+	sort.Strings(buckets)
+	if err != nil || strings.Join(buckets, ",") != "a,b,c" {
+		t.Errorf("st.Buckets() = %v, %v, expected [a b c]", buckets, err)
+	}
+	for _, kv := range [][3]string{
+		{"a", "new", "recreated"},
+		{"b", "k2", "v2"},
+		{"b", "k3", "v1"},
+		{"c", "k", "v"},
+	} {
+		err = st.Get(kv[0], kv[1], &value)
+		if err != nil || value != kv[2] {
+			t.Errorf("st.Get(%q, %q) = %q, %v, expected %q", kv[0], kv[1], value, err, kv[2])
+		}
+	}
+	err = st.Get("b", "k1", &value)
+	if err != kvstore.ErrKeyNotFound {
+		t.Errorf("st.Get(%q, %q) = %v, expected ErrKeyNotFound", "b", "k1", err)
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	st, err := kvstore.NewFromFile(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer st.Close()
+
+	tx := st.Writer()
+	for i := 20; i > 0; i-- {
+		_ = tx.Set("bucket", fmt.Sprintf("a%02d", i), i)
+		_ = tx.Set("bucket", fmt.Sprintf("b%02d", i), i)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		f        kvstore.KeyFilter
+		expected string
+	}{
+		{kvstore.KeyFilter{Prefix: "a", After: "a03", Limit: 5}, "a04,a05,a06,a07,a08"},
+		{kvstore.KeyFilter{After: "a19", Limit: 3}, "a20,b01,b02"},
+		{kvstore.KeyFilter{Prefix: "b", Match: func(key string) bool { return strings.HasSuffix(key, "5") }}, "b05,b15"},
+		{kvstore.KeyFilter{Prefix: "c"}, ""},
+	} {
+		rtx := st.Reader()
+		keys, err := rtx.Keys("bucket", test.f)
+		_ = rtx.Rollback()
+		if err != nil || strings.Join(keys, ",") != test.expected {
+			t.Errorf("rtx.Keys(%q, %+v) = %v, %v, expected %s", "bucket", test.f, keys, err, test.expected)
+		}
+	}
+
+	tx = st.Writer()
+	defer tx.Rollback()
+	_ = tx.Set("bucket", "a00", 0)
+	_ = tx.Delete("bucket", "a01")
+	keys, err := tx.Keys("bucket", kvstore.KeyFilter{Prefix: "a", Limit: 2})
+	if err != nil || strings.Join(keys, ",") != "a00,a02" {
+		t.Errorf("tx.Keys(...) = %v, %v, expected [a00 a02]", keys, err)
+	}
+}
+
+func TestStoreBackup(t *testing.T) {
+	st, err := kvstore.NewFromFile(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer st.Close()
+
+	tx := st.Writer()
+	for i := 0; i < 100; i++ {
+		_ = tx.Set(fmt.Sprintf("bucket-%d", i%3), fmt.Sprintf("key-%d", i), i)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	var backup bytes.Buffer
+	err = st.Backup(&backup)
+	if err != nil {
+		t.Errorf("st.Backup(...): unexpected error: %v", err)
+		return
+	}
+
+	fpath := filepath.Join(t.TempDir(), "restored.db")
+	f, err := os.Create(fpath)
+	if err != nil {
+		t.Errorf("os.Create(...): unexpected error: %v", err)
+		return
+	}
+	err = kvstore.Restore(f, &backup)
+	f.Close()
+	if err != nil {
+		t.Errorf("Restore(...): unexpected error: %v", err)
+		return
+	}
+
+	restored, err := kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer restored.Close()
+	buckets, err := restored.Buckets()
+	if err != nil || len(buckets) != 3 {
+		t.Errorf("restored.Buckets() = %v, %v, expected 3 buckets", buckets, err)
+	}
+	for i := 0; i < 100; i++ {
+		var v int
+		err = restored.Get(fmt.Sprintf("bucket-%d", i%3), fmt.Sprintf("key-%d", i), &v)
+		if err != nil || v != i {
+			t.Errorf("restored.Get(..., %q) = %d, %v, expected %d", fmt.Sprintf("key-%d", i), v, err, i)
+			return
+		}
+	}
+}
+
+func TestStoreBackupEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	fpath := filepath.Join(t.TempDir(), "store.db")
+	st, err := kvstore.NewFromFile(fpath, block.WithCipher(key), block.WithCompression())
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	tx := st.Writer()
+	for i := 0; i < 100; i++ {
+		_ = tx.Set("bucket", fmt.Sprintf("key-%d", i), fmt.Sprintf("secret value %d", i))
+	}
+	err = tx.Commit()
+	if err == nil {
+		err = st.Close()
+	}
+	if err != nil {
+		t.Errorf("unexpected error writing the store: %v", err)
+		return
+	}
+	before, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Errorf("os.ReadFile(...): unexpected error: %v", err)
+		return
+	}
+
+	var backup bytes.Buffer
+	err = kvstore.BackupFile(fpath, &backup, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("BackupFile(...): unexpected error: %v", err)
+		return
+	}
+	if after, err := os.ReadFile(fpath); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("BackupFile(...) changed the store (%v)", err)
+	}
+	if bytes.Contains(backup.Bytes(), []byte("secret value")) {
+		t.Errorf("the backup of an encrypted store holds plaintext values")
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     []block.Option
+		expected error
+	}{
+		{"without a key", nil, block.ErrKeyRequired},
+		{"with another key", []block.Option{block.WithCipher(bytes.Repeat([]byte{0x24}, 16))}, block.ErrInvalidKey},
+	} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "restored.db"))
+		if err != nil {
+			t.Errorf("os.Create(...): unexpected error: %v", err)
+			return
+		}
+		err = kvstore.Restore(f, bytes.NewReader(backup.Bytes()), test.opts...)
+		f.Close()
+		if !errors.Is(err, test.expected) {
+			t.Errorf("Restore(...) %s: got error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	restoredPath := filepath.Join(t.TempDir(), "restored.db")
+	f, err := os.Create(restoredPath)
+	if err != nil {
+		t.Errorf("os.Create(...): unexpected error: %v", err)
+		return
+	}
+	err = kvstore.Restore(f, &backup, block.WithCipher(key))
+	f.Close()
+	if err != nil {
+		t.Errorf("Restore(...): unexpected error: %v", err)
+		return
+	}
+
+	_, err = kvstore.OpenReadOnly(restoredPath)
+	if !errors.Is(err, block.ErrKeyRequired) {
+		t.Errorf("OpenReadOnly(...) without a key: got error %v, expected %v", err, block.ErrKeyRequired)
+	}
+	restored, err := kvstore.OpenReadOnly(restoredPath, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("OpenReadOnly(...): unexpected error: %v", err)
+		return
+	}
+	defer restored.Close()
+	for i := 0; i < 100; i++ {
+		var v string
+		err = restored.Get("bucket", fmt.Sprintf("key-%d", i), &v)
+		if expected := fmt.Sprintf("secret value %d", i); err != nil || v != expected {
+			t.Errorf("restored.Get(..., %q) = %q, %v, expected %q", fmt.Sprintf("key-%d", i), v, err, expected)
+			return
+		}
+	}
+	if raw, err := os.ReadFile(restoredPath); err != nil || bytes.Contains(raw, []byte("secret value")) {
+		t.Errorf("the restored store holds plaintext values (%v)", err)
+	}
+	f, err = os.Open(restoredPath)
+	if err != nil {
+		t.Errorf("os.Open(...): unexpected error: %v", err)
+		return
+	}
+	defer f.Close()
+	db, err := block.OpenShared(f, block.WithCipher(key))
+	if err != nil {
+		t.Errorf("block.OpenShared(...): unexpected error: %v", err)
+		return
+	}
+	defer db.Close()
+	if flags := db.Meta().Flags; flags&block.FlagCompressed == 0 {
+		t.Errorf("the restored store isn't compressed (flags %b)", flags)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	st, err := kvstore.NewFromFile(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer st.Close()
+
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	tx := st.Writer()
+	for _, key := range []string{"later", "expired", "reset", "cleared"} {
+		_ = tx.Set("bucket", key, key)
+	}
+	err = tx.SetExpiry("bucket", "missing", later)
+	if err != kvstore.ErrKeyNotFound {
+		t.Errorf("tx.SetExpiry(%q, %q, ...) = %v, expected ErrKeyNotFound", "bucket", "missing", err)
+	}
+	for key, expiry := range map[string]time.Time{
+		"later":   later,
+		"expired": time.Now().Add(-time.Second),
+		"reset":   later,
+		"cleared": later,
+	} {
+		err = tx.SetExpiry("bucket", key, expiry)
+		if err != nil {
+			t.Errorf("tx.SetExpiry(%q, %q, ...): unexpected error: %v", "bucket", key, err)
+		}
+	}
+	expiry, err := tx.Expiry("bucket", "later")
+	if err != nil || !expiry.Equal(later) {
+		t.Errorf("tx.Expiry(%q, %q) = %v, %v, expected %v", "bucket", "later", expiry, err, later)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	tx = st.Writer()
+	_ = tx.Set("bucket", "reset", "again")
+	_ = tx.SetExpiry("bucket", "cleared", time.Time{})
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+
+	rtx := st.Reader()
+	for key, expected := range map[string]time.Time{
+		"later":   later,
+		"reset":   {},
+		"cleared": {},
+	} {
+		expiry, err := rtx.Expiry("bucket", key)
+		if err != nil || !expiry.Equal(expected) {
+			t.Errorf("rtx.Expiry(%q, %q) = %v, %v, expected %v", "bucket", key, expiry, err, expected)
+		}
+	}
+	_, err = rtx.Expiry("bucket", "expired")
+	if err != kvstore.ErrKeyNotFound {
+		t.Errorf("rtx.Expiry(%q, %q) = %v, expected ErrKeyNotFound", "bucket", "expired", err)
+	}
+	_ = rtx.Rollback()
+
+	n, err := st.PurgeExpired()
+	if err != nil || n != 1 {
+		t.Errorf("st.PurgeExpired() = %d, %v, expected 1", n, err)
+	}
+}
+
+func TestStoreReadOnly(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "store.db")
+	st, err := kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	tx := st.Writer()
+	for i := 0; i < 100; i++ {
+		_ = tx.Set(fmt.Sprintf("bucket-%d", i%3), fmt.Sprintf("key-%d", i), i)
+	}
+	err = tx.Commit()
+	if err == nil {
+		err = st.Close()
+	}
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	before, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Errorf("os.ReadFile(...): unexpected error: %v", err)
+		return
+	}
+
+	ro, err := kvstore.OpenReadOnly(fpath)
+	if err != nil {
+		t.Errorf("OpenReadOnly(...): unexpected error: %v", err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		var v int
+		err = ro.Get(fmt.Sprintf("bucket-%d", i%3), fmt.Sprintf("key-%d", i), &v)
+		if err != nil || v != i {
+			t.Errorf("ro.Get(..., %q) = %d, %v, expected %d", fmt.Sprintf("key-%d", i), v, err, i)
+			return
+		}
+	}
+	_, err = ro.Verify(false)
+	if err != nil {
+		t.Errorf("ro.Verify(false): unexpected error: %v", err)
+	}
+
+	wtx := ro.Writer()
+	_ = wtx.Set("bucket-0", "key-0", -1)
+	err = wtx.Commit()
+	if !errors.Is(err, kvstore.ErrReadOnly) {
+		t.Errorf("wtx.Commit() = %v on a read-only store, expected %v", err, kvstore.ErrReadOnly)
+	}
+	_, err = ro.PurgeExpired()
+	if !errors.Is(err, kvstore.ErrReadOnly) {
+		t.Errorf("ro.PurgeExpired() = %v on a read-only store, expected %v", err, kvstore.ErrReadOnly)
+	}
+	_, err = ro.GC()
+	if !errors.Is(err, kvstore.ErrReadOnly) {
+		t.Errorf("ro.GC() = %v on a read-only store, expected %v", err, kvstore.ErrReadOnly)
+	}
+	var v int
+	err = ro.Get("bucket-0", "key-0", &v)
+	if err != nil || v != 0 {
+		t.Errorf("ro.Get(...) = %d, %v after a failed commit, expected 0", v, err)
+	}
+	err = ro.Close()
+	if err != nil {
+		t.Errorf("ro.Close(): unexpected error: %v", err)
+	}
+
+	after, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Errorf("os.ReadFile(...): unexpected error: %v", err)
+		return
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("the store was modified by a read-only open")
+	}
+}
+
+func TestStoreGC(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "store.db")
+	st, err := kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	tx := st.Writer()
+	for i := 0; i < 100; i++ {
+		_ = tx.Set(fmt.Sprintf("bucket-%d", i%2), fmt.Sprintf("key-%d", i), strings.Repeat("v", 1000))
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+	tx = st.Writer()
+	_ = tx.DeleteBucket("bucket-1")
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("tx.Commit(): unexpected error: %v", err)
+		return
+	}
+	report, err := st.GC()
+	if err != nil || report != (kvstore.GCReport{}) {
+		t.Errorf("st.GC() = %+v, %v on a store without leaks, expected nothing reclaimed", report, err)
+	}
+	err = st.Close()
+	if err != nil {
+		t.Errorf("st.Close(): unexpected error: %v", err)
+		return
+	}
+
+	// Leak the free list of the blocks
+	f, err := os.OpenFile(fpath, os.O_RDWR, 0)
+	if err != nil {
+		t.Errorf("os.OpenFile(...): unexpected error: %v", err)
+		return
+	}
+	db, err := block.Open(f)
+	if err != nil {
+		f.Close()
+		t.Errorf("block.Open(...): unexpected error: %v", err)
+		return
+	}
+	stats, err := db.Stats()
+	if err == nil {
+		err = db.Close()
+	}
+	meta := stats.DBMeta
+	meta.FirstFreeBlock = 0
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = meta.WriteTo(f)
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Errorf("unexpected error leaking blocks: %v", err)
+		return
+	}
+	if stats.FreeBlocks == 0 {
+		t.Errorf("no free blocks after deleting a bucket")
+		return
+	}
+
+	st, err = kvstore.NewFromFile(fpath)
+	if err != nil {
+		t.Errorf("NewFromFile(...): unexpected error: %v", err)
+		return
+	}
+	defer st.Close()
+	report, err = st.GC()
+	if err != nil {
+		t.Errorf("st.GC(): unexpected error: %v", err)
+		return
+	}
+	if report.Blocks != int(stats.FreeBlocks) || report.BlockBytes != int64(stats.FreeBlocks)*int64(meta.BlockSize) {
+		t.Errorf("st.GC() reclaimed %d blocks of %d bytes, expected %d", report.Blocks, report.BlockBytes, stats.FreeBlocks)
+	}
+	for i := 0; i < 100; i += 2 {
+		var v string
+		err = st.Get("bucket-0", fmt.Sprintf("key-%d", i), &v)
+		if err != nil || len(v) != 1000 {
+			t.Errorf("st.Get(..., %q) = %d bytes, %v after GC, expected 1000", fmt.Sprintf("key-%d", i), len(v), err)
+			return
+		}
+	}
+	verify, err := st.Verify(false)
+	if err != nil || len(verify.Problems) != 0 {
+		t.Errorf("st.Verify(false) = %v, %v after GC, expected no problems", verify.Problems, err)
+	}
+}
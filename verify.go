@@ -0,0 +1,124 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/yazgazan/kvstore/block"
+	"github.com/yazgazan/kvstore/container"
+)
+
+// Problem is an inconsistency found by Verify.
+type Problem struct {
+	Bucket string // empty for the blocks and the list of buckets
+	Err    error
+}
+
+func (p Problem) Error() string {
+	if p.Bucket == "" {
+		return p.Err.Error()
+	}
+
+	return fmt.Sprintf("bucket %q: %v", p.Bucket, p.Err)
+}
+
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+type VerifyReport struct {
+	Recovery  block.RecoveryStats // done by Open, after an interrupted update
+	Problems  []Problem           // found before repairing
+	Repaired  []string            // buckets repaired
+	Freed     int                 // chunks freed by the repairs
+	Remaining []Problem           // left after repairing
+}
+
+// Verify scrubs the blocks of the store, then verifies the list of buckets
+// and every bucket. With repair, the buckets with problems are repaired when
+// their pool is sound and verified again. Problems with the blocks can't be
+// repaired, the recovery of an interrupted update being done by Open.
+func (st *store) Verify(repair bool) (VerifyReport, error) {
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	var report VerifyReport
+	if repair && st.readOnly {
+		return report, ErrReadOnly
+	}
+	if repair {
+		unlock, err := st.lockFile()
+		if err != nil {
+			return report, err
+		}
+		defer unlock()
+	}
+	stats, err := st.db.Stats()
+	if err != nil {
+		return report, err
+	}
+	report.Recovery = stats.Recovery
+
+	err = st.db.Scrub(context.Background(), 0, func(p block.ScrubProblem) {
+		report.Problems = append(report.Problems, Problem{Err: p})
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Remaining = append(report.Remaining, report.Problems...)
+
+	names := make([]string, 0, len(st.buckets))
+	for name := range st.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	verify := func(name string, m *container.HashMap) ([]Problem, error) {
+		problems, err := m.Verify()
+		if err != nil {
+			return nil, err
+		}
+		pp := make([]Problem, 0, len(problems))
+		for _, p := range problems {
+			if name == "" {
+				pp = append(pp, Problem{Err: fmt.Errorf("list of buckets: %w", p)})
+				continue
+			}
+			pp = append(pp, Problem{Bucket: name, Err: p})
+		}
+
+		return pp, nil
+	}
+	for i := -1; i < len(names); i++ {
+		name, m := "", st.bucketsMap
+		if i >= 0 {
+			name, m = names[i], st.buckets[names[i]]
+		}
+
+		problems, err := verify(name, m)
+		if err != nil {
+			return report, err
+		}
+		report.Problems = append(report.Problems, problems...)
+		if !repair || len(problems) == 0 {
+			report.Remaining = append(report.Remaining, problems...)
+			continue
+		}
+
+		freed, err := m.Repair()
+		if err != nil {
+			report.Remaining = append(report.Remaining, problems...)
+			continue
+		}
+		report.Repaired = append(report.Repaired, name)
+		report.Freed += freed
+		problems, err = verify(name, m)
+		if err != nil {
+			return report, err
+		}
+		report.Remaining = append(report.Remaining, problems...)
+	}
+
+	return report, nil
+}